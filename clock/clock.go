@@ -0,0 +1,115 @@
+package clock
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+/*
+==========================================================
+ clock：时钟和随机数的来源
+==========================================================
+
+rpc.Client、router.Acker、dht、pubsub、mailbox 里用到的“现在几点”、
+定时器和随机数都从这里取，平时就是系统时钟和 crypto/rand；
+sim 换成虚拟时钟和由种子派生的随机数，同一个种子跑出同样的结果：
+
+  type X struct {
+      Clock clock.Clock // nil 用系统时钟
+      Rand  io.Reader   // nil 用 crypto/rand
+  }
+
+  now := clock.Or(x.Clock).Now()
+  t := clock.Or(x.Clock).AfterFunc(d, fn)   // 和 time.AfterFunc 一样，fn 在自己的 goroutine 里跑
+  n := clock.Intn(x.Rand, 10)
+==========================================================
+*/
+
+// Clock 是时间来源
+type Clock interface {
+	Now() time.Time
+	// AfterFunc 在 d 之后调用 f（f 跑在自己的 goroutine 里）
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer 是 AfterFunc 返回的定时器
+type Timer interface {
+	// Stop 取消定时器；f 还没开始执行时返回 true
+	Stop() bool
+}
+
+// Real 是系统时钟
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+// Or 返回 c，c 为 nil 时返回 Real
+func Or(c Clock) Clock {
+	if c == nil {
+		return Real
+	}
+	return c
+}
+
+// After 返回一个在 d 之后关闭的 channel，以及停掉它的函数（相当于 time.NewTimer）
+func After(c Clock, d time.Duration) (<-chan struct{}, func()) {
+	ch := make(chan struct{})
+	t := Or(c).AfterFunc(d, func() { close(ch) })
+	return ch, func() { t.Stop() }
+}
+
+// Sleep 按 c 的时间睡 d
+func Sleep(c Clock, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	ch, _ := After(c, d)
+	<-ch
+}
+
+/*
+==========================================================
+ 随机数：r 为 nil 时用 crypto/rand
+==========================================================
+*/
+
+// Read 从 r 读满 b
+func Read(r io.Reader, b []byte) error {
+	if r == nil {
+		r = rand.Reader
+	}
+	_, err := io.ReadFull(r, b)
+	return err
+}
+
+// Uint64 从 r 取一个随机数；读失败时退回用当前时间
+func Uint64(r io.Reader) uint64 {
+	var b [8]byte
+	if err := Read(r, b[:]); err != nil {
+		return uint64(time.Now().UnixNano())
+	}
+	return binary.BigEndian.Uint64(b[:])
+}
+
+// Intn 返回 [0, n) 里的随机数（n 必须大于 0）
+func Intn(r io.Reader, n int) int {
+	return int(Uint64(r) % uint64(n))
+}
+
+// Float64 返回 [0, 1) 里的随机数
+func Float64(r io.Reader) float64 {
+	return float64(Uint64(r)>>11) / (1 << 53)
+}
+
+// Shuffle 和 rand.Shuffle 一样打乱 n 个元素
+func Shuffle(r io.Reader, n int, swap func(i, j int)) {
+	for i := n - 1; i > 0; i-- {
+		swap(i, Intn(r, i+1))
+	}
+}
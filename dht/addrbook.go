@@ -0,0 +1,141 @@
+package dht
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"envelop/peer"
+	"envelop/rpc"
+)
+
+/*
+==========================================================
+ 地址簿：把“PeerID → 地址”发布到 DHT
+==========================================================
+
+RelayRegistry 只是本进程里的一张 map，跨机器没法共享。
+这里让每个节点把自己的地址签名后发布到 DHT：
+
+  Key   = AddrKey(id)                 （每个 PeerID 一个固定的 Key）
+  Value = {"a": ["1.2.3.4:9000", ...]}
+  Publisher 必须就是 id 本人            （别人发布的同 Key 记录一律忽略）
+  Seq   地址变了就加一；Expires 默认 DefaultAddrTTL，之后随 Republish 自动续期
+
+查地址（ResolveAddrs，挂在 RelayRegistry.Fallback 上）的顺序：
+  1. 地址记录缓存（签过名、Seq 检查过、没过期的）
+  2. 拨号提示：节点本人在签名请求里报的地址，或者进行中的查找里别人转述的地址
+  3. DHT FIND_VALUE(AddrKey(id))         → 拿到签名地址记录，放进缓存
+  4. 拨号提示：之前查找里别人转述、对方回应过的地址
+
+只有 1、3 是确认过的“id 的地址”。2、4 只是“可以去这里试试”：
+拨通之后连接要等到 id 签名的 REGISTER 才算数（netquic.Node.ConfirmTimeout），
+接通的不是 id 就断开。
+==========================================================
+*/
+
+// DefaultAddrTTL 是地址记录的默认有效期（大于续期周期，续期之间不会断档）
+const DefaultAddrTTL = 3 * DefaultRepublishInterval
+
+// AddrKey 返回存放 id 地址记录的 Key
+func AddrKey(id peer.PeerID) peer.PeerID {
+	return KeyOf("addrs:" + peer.PeerIDToDomain(id))
+}
+
+// addrValue 是地址记录的 Value
+type addrValue struct {
+	Addrs []string `json:"a"`
+}
+
+// addrEntry 是一条缓存的地址记录
+type addrEntry struct {
+	seq     uint64
+	addrs   []string
+	expires time.Time
+}
+
+// addrCache 缓存从 DHT 拿到的、验过签的地址记录
+type addrCache struct {
+	mu      sync.Mutex
+	entries map[peer.PeerID]addrEntry
+}
+
+func (c *addrCache) get(id peer.PeerID, now time.Time) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+	if now.After(e.expires) {
+		delete(c.entries, id)
+		return nil, false
+	}
+	return append([]string(nil), e.addrs...), true
+}
+
+// put 只接受更新的记录（Seq 更大，或 Seq 相同但更晚过期）
+func (c *addrCache) put(id peer.PeerID, e addrEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[peer.PeerID]addrEntry)
+	}
+	if old, ok := c.entries[id]; ok {
+		if e.seq < old.seq || (e.seq == old.seq && !e.expires.After(old.expires)) {
+			return
+		}
+	}
+	c.entries[id] = e
+}
+
+// PublishAddrs 以 kp 的身份把自己的地址发布到 DHT（之后自动续期）。
+// 地址变化时再调一次即可，Seq 会自动加一。
+func (d *DHT) PublishAddrs(kp *peer.KeyPair, addrs []string) error {
+	v, err := json.Marshal(addrValue{Addrs: addrs})
+	if err != nil {
+		return err
+	}
+	r, err := d.Put(kp, AddrKey(kp.PeerID), v, DefaultAddrTTL)
+	if r != nil {
+		d.cacheAddrRecord(kp.PeerID, r)
+	}
+	return err
+}
+
+// FindAddrs 在 DHT 里查 id 本人发布的地址记录
+func (d *DHT) FindAddrs(id peer.PeerID) ([]string, error) {
+	recs, err := d.GetValue(AddrKey(id))
+	if err != nil {
+		return nil, err
+	}
+
+	var best *Record
+	for _, r := range recs {
+		if r.PublisherID() != id {
+			continue // 只认本人签的
+		}
+		if best == nil || r.Supersedes(best) {
+			best = r
+		}
+	}
+	if best == nil {
+		return nil, rpc.Errorf(rpc.CodeNotFound, "dht: no address record for %s", peer.PeerIDToDomain(id))
+	}
+
+	addrs, ok := d.cacheAddrRecord(id, best)
+	if !ok {
+		return nil, rpc.Errorf(rpc.CodeInvalidArgument, "dht: bad address record for %s", peer.PeerIDToDomain(id))
+	}
+	return addrs, nil
+}
+
+// cacheAddrRecord 解析一条地址记录并放进缓存
+func (d *DHT) cacheAddrRecord(id peer.PeerID, r *Record) ([]string, bool) {
+	var v addrValue
+	if err := json.Unmarshal(r.Value, &v); err != nil || len(v.Addrs) == 0 {
+		return nil, false
+	}
+	d.addrRecords.put(id, addrEntry{seq: r.Seq, addrs: v.Addrs, expires: r.ExpiresAt()})
+	return v.Addrs, true
+}
@@ -0,0 +1,491 @@
+// Package dht 在 router.KademliaTable 之上实现真正的 Kademlia 网络协议。
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"envelop/clock"
+	"envelop/peer"
+	"envelop/router"
+	"envelop/rpc"
+)
+
+/*
+==========================================================
+ Kademlia DHT（网络协议部分）
+==========================================================
+
+router.KademliaTable 只是一张“本地表”：
+  - 不会主动联系任何节点
+  - 只有别人调用 Update 时才会长大
+
+本包把它变成一个真正的 Kademlia 节点：
+
+  1. PING        确认对方在线（dht.Ping）
+  2. FIND_NODE   问对方“你知道的、离 target 最近的 K 个节点”（dht.FindNode）
+  3. 迭代查找    每轮并发问 Alpha 个最近的、还没问过的节点，
+                 直到最近的 K 个都问过了（lookup.go）
+  4. Bootstrap   把种子节点放进表里，然后对“自己的 ID”做一次查找，
+                 顺便把自己宣告给离自己最近的那批节点
+  5. 桶刷新      定时对“很久没查找过的桶”随机取一个 ID 做查找
+  6. STORE / FIND_VALUE
+                 存取发布者签名的 Key/Value 记录，k 副本 + 定时续期（value.go）
+  7. 地址簿      节点把自己的地址签名发布到 DHT，取代进程内共享的 Registry（addrbook.go）
+
+协议消息走 RPC（rpc.Endpoint，FlagRPC 信封），每个请求都带上发送方的 Contact：
+    - 签名验证通过、且签名者就是 Contact.ID 时，接收方才把它学进路由表
+      （防止有人冒充别人的 PeerID 把垃圾地址塞进表里）
+
+学到的地址通过 OnContact 回调交给上层（一般是 RelayRegistry.AddAddrs），
+这样 PeerManager 之后就能直接拨号这些节点。
+只有验过签的调用方自己报的地址、以及种子节点才走 OnContact；
+迭代查找里别人转述的地址只当拨号提示（lookup.go）。
+==========================================================
+*/
+
+// 协议方法名
+const (
+	MethodPing     = "dht.Ping"
+	MethodFindNode = "dht.FindNode"
+)
+
+// 默认参数
+const (
+	DefaultAlpha           = 3
+	DefaultRefreshInterval = 15 * time.Minute
+	defaultRPCTimeout      = 5 * time.Second
+)
+
+// Contact 是 DHT 里的一个节点：PeerID + 可拨号的地址
+type Contact struct {
+	ID    peer.PeerID
+	Addrs []string
+}
+
+// wireContact 是 Contact 在线上的格式（PeerID 用域名形式，方便调试）
+type wireContact struct {
+	ID    string   `json:"id"`
+	Addrs []string `json:"a,omitempty"`
+}
+
+func (c Contact) toWire() wireContact {
+	return wireContact{ID: peer.PeerIDToDomain(c.ID), Addrs: c.Addrs}
+}
+
+func (w wireContact) toContact() (Contact, error) {
+	id, err := peer.DomainToPeerID(w.ID)
+	if err != nil {
+		return Contact{}, err
+	}
+	return Contact{ID: id, Addrs: w.Addrs}, nil
+}
+
+// findNodeRequest / findNodeResponse 是 FIND_NODE 的参数和返回值
+type findNodeRequest struct {
+	From   wireContact `json:"from"`
+	Target string      `json:"target"`
+}
+
+type findNodeResponse struct {
+	Closest []wireContact `json:"closest"`
+}
+
+// pingRequest 是 PING 的参数（返回值为空）
+type pingRequest struct {
+	From wireContact `json:"from"`
+}
+
+// DHT 是一个 Kademlia 节点
+type DHT struct {
+	self  peer.PeerID
+	table *router.KademliaTable
+	call  rpc.PeerCallFunc
+
+	// Alpha：迭代查找的并发度
+	Alpha int
+	// K：每次查找返回 / 维护的最近节点数
+	K int
+	// RPCTimeout：单次 PING / FIND_NODE 的超时
+	RPCTimeout time.Duration
+
+	// SelfAddrs：返回本节点当前可被拨号的地址（放进 Contact 告诉别人）
+	SelfAddrs func() []string
+
+	// OnContact：学到一个节点的地址时调用（一般接 RelayRegistry.AddAddrs）。
+	// 只有节点本人（验过签）报的地址、种子节点会走这里，转述来的不会
+	OnContact func(c Contact)
+
+	// Store：本地记录存储（默认 MemoryStore）
+	Store RecordStore
+	// 存储限制（<=0 表示不限制），见 value.go
+	MaxValueSize           int
+	MaxRecordTTL           time.Duration
+	MaxRecordsPerPublisher int
+	// RepublishInterval：续期 / 副本维护的周期
+	RepublishInterval time.Duration
+
+	// Clock（可选）：记录过期、地址缓存用的时钟，nil = 系统时钟；
+	// sim 里换成虚拟时钟（路由表的 KademliaTable.Clock 要一起换）
+	Clock clock.Clock
+
+	mu        sync.Mutex
+	addrs     map[peer.PeerID][]string // 已知节点的地址（节点本人报的 / 种子）
+	hints     map[peer.PeerID][]string // 查找里转述来、对方回应过的地址：只当拨号提示
+	lookups   map[*lookupState]bool    // 进行中的迭代查找（它们的候选地址也是拨号提示）
+	resolving map[peer.PeerID]bool     // 正在 ResolveAddrs 的目标，防止递归查找
+	published map[pubKey]*publication  // 本节点发布、需要续期的记录
+
+	addrRecords addrCache // 验过签的地址记录缓存
+
+	storeMu sync.Mutex // 串行化 storeLocal 的“检查 + 写入”
+}
+
+// New 创建一个 DHT 节点
+//   - self： 本节点 PeerID
+//   - table：路由表（一般是 RouteTable.Kademlia()，和 Router 共用）
+//   - call： 远程调用函数（一般是 rpc.Endpoint.Call）
+//
+// 如果 table 还没有 Pinger，会把 DHT.Ping 装上去（桶满时 ping-before-evict）。
+func New(self peer.PeerID, table *router.KademliaTable, call rpc.PeerCallFunc) *DHT {
+	d := &DHT{
+		self:       self,
+		table:      table,
+		call:       call,
+		Alpha:      DefaultAlpha,
+		K:          router.K,
+		RPCTimeout: defaultRPCTimeout,
+
+		Store:                  NewMemoryStore(),
+		MaxValueSize:           DefaultMaxValueSize,
+		MaxRecordTTL:           DefaultMaxRecordTTL,
+		MaxRecordsPerPublisher: DefaultMaxRecordsPerPublisher,
+		RepublishInterval:      DefaultRepublishInterval,
+
+		addrs:     make(map[peer.PeerID][]string),
+		hints:     make(map[peer.PeerID][]string),
+		lookups:   make(map[*lookupState]bool),
+		resolving: make(map[peer.PeerID]bool),
+		published: make(map[pubKey]*publication),
+	}
+	if table.Pinger == nil {
+		table.Pinger = func(id peer.PeerID) bool { return d.Ping(id) == nil }
+	}
+	return d
+}
+
+func (d *DHT) now() time.Time { return clock.Or(d.Clock).Now() }
+
+// Table 返回底层的 Kademlia 表
+func (d *DHT) Table() *router.KademliaTable { return d.table }
+
+// selfContact 返回本节点的 Contact
+func (d *DHT) selfContact() Contact {
+	c := Contact{ID: d.self}
+	if d.SelfAddrs != nil {
+		c.Addrs = d.SelfAddrs()
+	}
+	return c
+}
+
+// Mount 把 DHT 协议方法挂到 RPC Server 上
+func (d *DHT) Mount(s *rpc.Server) {
+	s.RegisterWithCaller(rpc.MethodInfo{
+		Name:        MethodPing,
+		Version:     "1",
+		Description: "kademlia PING",
+	}, d.handlePing)
+
+	s.RegisterWithCaller(rpc.MethodInfo{
+		Name:        MethodFindNode,
+		Version:     "1",
+		Description: "kademlia FIND_NODE: return the K closest known contacts to target",
+	}, d.handleFindNode)
+
+	s.RegisterWithCaller(rpc.MethodInfo{
+		Name:        MethodStore,
+		Version:     "1",
+		Description: "kademlia STORE: keep a signed record",
+	}, d.handleStore)
+
+	s.RegisterWithCaller(rpc.MethodInfo{
+		Name:        MethodFindValue,
+		Version:     "1",
+		Description: "kademlia FIND_VALUE: return records for key plus the K closest known contacts",
+	}, d.handleFindValue)
+}
+
+/*
+==========================================================
+ 服务端：处理 PING / FIND_NODE
+==========================================================
+*/
+
+func (d *DHT) handlePing(caller rpc.CallerInfo, data []byte) ([]byte, error) {
+	var req pingRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, rpc.Errorf(rpc.CodeInvalidArgument, "bad ping: %v", err)
+	}
+	d.learnFromCaller(caller, req.From)
+	return nil, nil
+}
+
+func (d *DHT) handleFindNode(caller rpc.CallerInfo, data []byte) ([]byte, error) {
+	var req findNodeRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, rpc.Errorf(rpc.CodeInvalidArgument, "bad find_node: %v", err)
+	}
+	target, err := peer.DomainToPeerID(req.Target)
+	if err != nil {
+		return nil, rpc.Errorf(rpc.CodeInvalidArgument, "bad target: %v", err)
+	}
+	d.learnFromCaller(caller, req.From)
+
+	var resp findNodeResponse
+	for _, id := range d.table.FindClosest(target, d.K) {
+		resp.Closest = append(resp.Closest, d.contactOf(id).toWire())
+	}
+	return json.Marshal(resp)
+}
+
+// learnFromCaller：只有签名者就是 Contact.ID 时才学进路由表
+func (d *DHT) learnFromCaller(caller rpc.CallerInfo, from wireContact) {
+	c, err := from.toContact()
+	if err != nil || !caller.Verified || caller.ID != c.ID {
+		return
+	}
+	d.learn(c)
+}
+
+// learn 记住一个节点的地址，并放进路由表
+func (d *DHT) learn(c Contact) {
+	if c.ID.IsZero() || c.ID == d.self {
+		return
+	}
+	d.rememberAddrs(c)
+	d.table.Update(c.ID)
+}
+
+// rememberAddrs 只记地址、通知上层，不动路由表
+func (d *DHT) rememberAddrs(c Contact) {
+	if c.ID.IsZero() || c.ID == d.self || len(c.Addrs) == 0 {
+		return
+	}
+	d.mu.Lock()
+	d.addrs[c.ID] = append([]string(nil), c.Addrs...)
+	d.mu.Unlock()
+
+	if d.OnContact != nil {
+		d.OnContact(c)
+	}
+}
+
+// hint 把查找里转述来的地址记成 id 的拨号提示：已经有地址（本人报的或更早的提示）时不覆盖
+func (d *DHT) hint(id peer.PeerID, addrs []string) {
+	if len(addrs) == 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.addrs[id]) == 0 && len(d.hints[id]) == 0 {
+		d.hints[id] = addrs
+	}
+}
+
+// ownAddrs 返回 id 本人报的地址，没有就看进行中的查找里有没有人转述（调用方持有 d.mu）
+func (d *DHT) ownAddrs(id peer.PeerID) []string {
+	if addrs := d.addrs[id]; len(addrs) > 0 {
+		return append([]string(nil), addrs...)
+	}
+	for st := range d.lookups {
+		if addrs := st.addrsOf(id); len(addrs) > 0 {
+			return addrs
+		}
+	}
+	return nil
+}
+
+// contactOf 用缓存的地址拼出一个 Contact（本人报的优先，没有就用提示）
+func (d *DHT) contactOf(id peer.PeerID) Contact {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if addrs := d.hints[id]; len(d.addrs[id]) == 0 && len(addrs) > 0 {
+		return Contact{ID: id, Addrs: append([]string(nil), addrs...)}
+	}
+	return Contact{ID: id, Addrs: d.ownAddrs(id)}
+}
+
+/*
+==========================================================
+ 客户端：PING / FIND_NODE 单次调用
+==========================================================
+*/
+
+// Ping 确认 id 在线；成功会刷新它在路由表里的位置，失败计一次失败
+func (d *DHT) Ping(id peer.PeerID) error {
+	req, _ := json.Marshal(pingRequest{From: d.selfContact().toWire()})
+	if _, err := d.call(id, MethodPing, req, d.RPCTimeout); err != nil {
+		d.callFailed(id, err)
+		return err
+	}
+	d.table.Update(id)
+	return nil
+}
+
+// callFailed 把一次 RPC 失败记到路由表上。
+// 只记超时：发送失败（Unavailable）已经由 PeerManager.OnSendResult 记过一次了。
+func (d *DHT) callFailed(id peer.PeerID, err error) {
+	if rpc.CodeOf(err) == rpc.CodeDeadlineExceeded {
+		d.table.RecordFailure(id)
+	}
+}
+
+// findNode 对单个节点发 FIND_NODE
+func (d *DHT) findNode(to, target peer.PeerID) ([]Contact, error) {
+	req, _ := json.Marshal(findNodeRequest{
+		From:   d.selfContact().toWire(),
+		Target: peer.PeerIDToDomain(target),
+	})
+	resp, err := d.call(to, MethodFindNode, req, d.RPCTimeout)
+	if err != nil {
+		d.callFailed(to, err)
+		return nil, err
+	}
+
+	var out findNodeResponse
+	if err := json.Unmarshal(resp.Data, &out); err != nil {
+		return nil, rpc.Errorf(rpc.CodeInternal, "bad find_node response: %v", err)
+	}
+
+	contacts := make([]Contact, 0, len(out.Closest))
+	for _, w := range out.Closest {
+		c, err := w.toContact()
+		if err != nil {
+			continue
+		}
+		contacts = append(contacts, c)
+	}
+	return contacts, nil
+}
+
+/*
+==========================================================
+ Bootstrap + 桶刷新
+==========================================================
+*/
+
+// Bootstrap 用种子节点加入网络：
+//  1. 种子节点的地址交给上层、放进路由表
+//  2. 对自己的 ID 做一次迭代查找（找到“邻居”，也让邻居认识自己）
+//
+// 一个种子都联系不上时返回错误。
+func (d *DHT) Bootstrap(seeds []Contact) error {
+	for _, s := range seeds {
+		d.learn(s)
+	}
+
+	if _, err := d.FindNode(d.self); err != nil {
+		return err
+	}
+	if d.table.Size() == 0 {
+		return rpc.Errorf(rpc.CodeUnavailable, "dht bootstrap: no seed reachable")
+	}
+	return nil
+}
+
+// Refresh 对所有“超过 maxAge 没查找过”的桶做一次随机查找
+func (d *DHT) Refresh(maxAge time.Duration) {
+	for _, idx := range d.table.StaleBuckets(maxAge) {
+		target := d.table.RandomIDInBucket(idx)
+		if _, err := d.FindNode(target); err != nil {
+			log.Printf("[DHT] refresh bucket %d: %v", idx, err)
+		}
+	}
+}
+
+// Start 启动后台定时器（桶刷新 + 记录续期），ctx 取消时停止
+// interval 是桶刷新周期，<=0 时使用 DefaultRefreshInterval；
+// 续期周期取 RepublishInterval。
+func (d *DHT) Start(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultRefreshInterval
+	}
+	republish := d.RepublishInterval
+	if republish <= 0 {
+		republish = DefaultRepublishInterval
+	}
+	go func() {
+		refreshTicker := time.NewTicker(interval)
+		defer refreshTicker.Stop()
+		republishTicker := time.NewTicker(republish)
+		defer republishTicker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-refreshTicker.C:
+				d.Refresh(interval)
+			case <-republishTicker.C:
+				d.Republish()
+			}
+		}
+	}()
+}
+
+/*
+==========================================================
+ 给 Router / RelayRegistry 用的 Fallback
+==========================================================
+*/
+
+// ResolveAddrs 查一个未知 PeerID 的地址：先看签名记录缓存和拨号提示，没有再去 DHT 里找
+// （顺序见 addrbook.go）。可以直接赋给 RelayRegistry.Fallback。
+//
+// 只有签名的地址记录算确认过；其余的是拨号提示，拨通后要靠 REGISTER 确认接的是 id。
+func (d *DHT) ResolveAddrs(id peer.PeerID) []string {
+	if addrs, ok := d.addrRecords.get(id, d.now()); ok {
+		return addrs
+	}
+
+	d.mu.Lock()
+	// 本人报的 / 正在查找里转述的：查找要靠它拨下一个节点，不能再为它发起查找
+	if addrs := d.ownAddrs(id); len(addrs) > 0 {
+		d.mu.Unlock()
+		return addrs
+	}
+	// 查找过程中要给别的节点发 RPC，发 RPC 又会来解析地址：
+	// 同一个目标正在查的时候直接返回 nil，避免无限递归
+	if d.resolving[id] {
+		d.mu.Unlock()
+		return nil
+	}
+	d.resolving[id] = true
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		delete(d.resolving, id)
+		d.mu.Unlock()
+	}()
+
+	if addrs, err := d.FindAddrs(id); err == nil {
+		return addrs
+	}
+
+	// 没有签名记录：之前查找里转述过、对方回应过的地址，也只当拨号提示
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.hints[id]...)
+}
+
+// NextHop 在 DHT 里找 dest：找到了就把它当作可直连的下一跳。
+// 可以直接赋给 Router.Fallback。
+func (d *DHT) NextHop(dest peer.PeerID) (peer.PeerID, bool) {
+	if len(d.ResolveAddrs(dest)) == 0 {
+		return peer.PeerID{}, false
+	}
+	return dest, true
+}
@@ -0,0 +1,250 @@
+package dht
+
+import (
+	"sort"
+	"sync"
+
+	"envelop/peer"
+	"envelop/rpc"
+)
+
+/*
+==========================================================
+ 迭代查找（Iterative FIND_NODE / FIND_VALUE）
+==========================================================
+
+  shortlist = 本地表里离 target 最近的 K 个
+  loop:
+     从 shortlist 里挑 Alpha 个“最近、还没问过”的节点，并发 FIND_NODE
+       - 回应了：标记为 responded，放进路由表；把它给的节点合并进 shortlist
+         （它转述的地址只记在本次查找里，见下）
+       - 失败了：从 shortlist 里划掉
+     shortlist 里最近的 K 个都问过了 → 结束
+
+  返回：回应过的节点里离 target 最近的 K 个
+
+Alpha 并发可以让一个慢节点不拖慢整个查找；
+每一轮都只挑“当前最近的”，所以大约 O(log N) 轮就能收敛。
+
+别人转述的 Contact 谁都能编（把别人的 PeerID 配上自己的地址），所以：
+  - 转述的地址只进 lookupState.addrs（先到先得，不覆盖），
+    查找进行中 ResolveAddrs 把它当拨号提示用——拨通之后 REGISTER 握手会确认对面是谁
+  - 回应过的节点，它的候选地址记进 DHT.hints（同样不覆盖），之后还能当拨号提示 / 转述给别人
+  - 都不进 d.addrs、不走 OnContact：Registry 的正向表和反向表都不会被转述的地址改写
+==========================================================
+*/
+
+// lookupState 是一次迭代查找的状态
+type lookupState struct {
+	target peer.PeerID
+
+	mu        sync.Mutex
+	seen      map[peer.PeerID]bool // 出现过（不管问没问过）
+	queried   map[peer.PeerID]bool // 已经发出过请求
+	responded map[peer.PeerID]bool // 成功回应
+	failed    map[peer.PeerID]bool // 请求失败
+	shortlist []peer.PeerID        // 按距离排序的候选
+
+	addrs map[peer.PeerID][]string // 转述来的地址（只在本次查找里用）
+}
+
+// candidate 记下别人转述的 c（调用方持有锁）：第一次听到的地址为准，后来的不覆盖
+func (s *lookupState) candidate(c Contact) {
+	if len(c.Addrs) > 0 && len(s.addrs[c.ID]) == 0 {
+		s.addrs[c.ID] = append([]string(nil), c.Addrs...)
+	}
+	s.add(c.ID)
+}
+
+// addrsOf 返回本次查找里 id 的候选地址
+func (s *lookupState) addrsOf(id peer.PeerID) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.addrs[id]...)
+}
+
+func (s *lookupState) add(id peer.PeerID) {
+	if s.seen[id] {
+		return
+	}
+	s.seen[id] = true
+	s.shortlist = append(s.shortlist, id)
+}
+
+// sortShortlist 按到 target 的 XOR 距离排序（调用方持有锁）
+func (s *lookupState) sortShortlist() {
+	sort.Slice(s.shortlist, func(i, j int) bool {
+		return closer(s.shortlist[i], s.shortlist[j], s.target)
+	})
+}
+
+// nextBatch 挑出最近 k 个里还没问过的，最多 alpha 个
+func (s *lookupState) nextBatch(k, alpha int) []peer.PeerID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sortShortlist()
+	var batch []peer.PeerID
+	considered := 0
+	for _, id := range s.shortlist {
+		if s.failed[id] {
+			continue
+		}
+		if considered >= k {
+			break
+		}
+		considered++
+		if s.queried[id] {
+			continue
+		}
+		batch = append(batch, id)
+		if len(batch) >= alpha {
+			break
+		}
+	}
+	for _, id := range batch {
+		s.queried[id] = true
+	}
+	return batch
+}
+
+// result 返回回应过的节点里最近的 k 个
+func (s *lookupState) result(k int) []peer.PeerID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sortShortlist()
+	var out []peer.PeerID
+	for _, id := range s.shortlist {
+		if !s.responded[id] {
+			continue
+		}
+		out = append(out, id)
+		if len(out) >= k {
+			break
+		}
+	}
+	return out
+}
+
+// closer 判断 a 是否比 b 离 target 更近
+func closer(a, b, target peer.PeerID) bool {
+	for i := 0; i < peer.PeerIDLength; i++ {
+		da, db := a[i]^target[i], b[i]^target[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+// queryFunc 向单个节点发一次查询，返回它给出的（更近的）节点
+type queryFunc func(id peer.PeerID) ([]Contact, error)
+
+// FindNode 对 target 做一次迭代查找，返回网络里离 target 最近的（最多 K 个）在线节点。
+// 本地表为空时返回 CodeUnavailable。
+func (d *DHT) FindNode(target peer.PeerID) ([]Contact, error) {
+	return d.iterate(target, func(id peer.PeerID) ([]Contact, error) {
+		return d.findNode(id, target)
+	})
+}
+
+// iterate 是 FIND_NODE / FIND_VALUE 共用的迭代过程，query 决定每一步问什么
+func (d *DHT) iterate(target peer.PeerID, query queryFunc) ([]Contact, error) {
+	d.table.MarkLookup(target)
+
+	st := &lookupState{
+		target:    target,
+		seen:      make(map[peer.PeerID]bool),
+		queried:   make(map[peer.PeerID]bool),
+		responded: make(map[peer.PeerID]bool),
+		failed:    make(map[peer.PeerID]bool),
+		addrs:     make(map[peer.PeerID][]string),
+	}
+	st.seen[d.self] = true // 永远不问自己
+
+	// 查找进行中，ResolveAddrs 能看到本次的候选地址（拨号提示）
+	d.mu.Lock()
+	d.lookups[st] = true
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.lookups, st)
+		d.mu.Unlock()
+	}()
+
+	for _, id := range d.table.FindClosest(target, d.K) {
+		st.add(id)
+	}
+	if len(st.shortlist) == 0 {
+		return nil, rpc.Errorf(rpc.CodeUnavailable, "dht: routing table is empty")
+	}
+
+	alpha := d.Alpha
+	if alpha <= 0 {
+		alpha = DefaultAlpha
+	}
+
+	for {
+		batch := st.nextBatch(d.K, alpha)
+		if len(batch) == 0 {
+			break
+		}
+
+		var wg sync.WaitGroup
+		for _, id := range batch {
+			wg.Add(1)
+			go func(id peer.PeerID) {
+				defer wg.Done()
+
+				contacts, err := query(id)
+
+				st.mu.Lock()
+				defer st.mu.Unlock()
+				if err != nil {
+					st.failed[id] = true
+					return
+				}
+				st.responded[id] = true
+				for _, c := range contacts {
+					if c.ID == d.self || c.ID.IsZero() {
+						continue
+					}
+					// 别人转述的节点：地址只记在本次查找里，回应之后才进路由表
+					st.candidate(c)
+				}
+			}(id)
+		}
+		wg.Wait()
+
+		// 回应过的进路由表，候选地址记成提示
+		for _, id := range batch {
+			if st.responded[id] {
+				d.hint(id, st.addrsOf(id))
+				d.table.Update(id)
+			}
+		}
+	}
+
+	ids := st.result(d.K)
+	out := make([]Contact, 0, len(ids))
+	for _, id := range ids {
+		out = append(out, d.contactOf(id))
+	}
+	return out, nil
+}
+
+// Lookup 在网络里找一个具体的 PeerID：
+// 迭代查找结束后，如果最近的节点里就有它（它本人回应过），返回它的 Contact。
+func (d *DHT) Lookup(id peer.PeerID) (Contact, bool) {
+	contacts, err := d.FindNode(id)
+	if err != nil {
+		return Contact{}, false
+	}
+	for _, c := range contacts {
+		if c.ID == id && len(c.Addrs) > 0 {
+			return c, true
+		}
+	}
+	return Contact{}, false
+}
@@ -0,0 +1,164 @@
+package dht
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+
+	"envelop/peer"
+	"envelop/rpc"
+)
+
+/*
+==========================================================
+ 签名记录（Record）
+==========================================================
+
+DHT 里存的不是“裸”的 Key/Value，而是发布者签过名的记录：
+
+  Record{
+      Key        32 字节，和 PeerID 在同一个 XOR 空间（用 KeyOf(name) 得到）
+      Value      任意字节（地址 / 服务描述 / 名字 ...）
+      Publisher  发布者 Ed25519 公钥（PublisherID = SHA256(Publisher)）
+      Seq        序号：同一个发布者、同一个 Key，序号大的覆盖小的
+      Expires    过期时间（Unix 秒）
+      Sig        Publisher 对以上字段的签名
+  }
+
+规则：
+  - 一个 Key 下可以同时有多个发布者的记录（比如多个节点提供同一个服务），
+    每个 (Key, 发布者) 只保留一条
+  - 同一个 (Key, 发布者)：
+      Seq 更大                → 覆盖
+      Seq 相同但 Expires 更晚 → 覆盖（发布者续期 / 重新发布）
+      其它                    → 拒绝（旧数据）
+  - 存储节点只认签名，不认“是谁 STORE 过来的”：
+    任何人都可以把别人的记录转存到别处，但没法伪造或篡改
+==========================================================
+*/
+
+// recordDomain 用于区分“DHT 记录签名”和其它用途的签名
+const recordDomain = "envelop-dht-record-v1"
+
+// Record 是 DHT 里存储的一条签名记录
+type Record struct {
+	Key       peer.PeerID
+	Value     []byte
+	Publisher ed25519.PublicKey
+	Seq       uint64
+	Expires   int64 // Unix 秒
+	Sig       []byte
+}
+
+// wireRecord 是 Record 在线上 / 磁盘上的格式
+type wireRecord struct {
+	Key       string `json:"k"`
+	Value     []byte `json:"v,omitempty"`
+	Publisher []byte `json:"p"`
+	Seq       uint64 `json:"s"`
+	Expires   int64  `json:"e"`
+	Sig       []byte `json:"g"`
+}
+
+func (r *Record) toWire() wireRecord {
+	return wireRecord{
+		Key:       peer.PeerIDToDomain(r.Key),
+		Value:     r.Value,
+		Publisher: r.Publisher,
+		Seq:       r.Seq,
+		Expires:   r.Expires,
+		Sig:       r.Sig,
+	}
+}
+
+func (w wireRecord) toRecord() (*Record, error) {
+	key, err := peer.DomainToPeerID(w.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &Record{
+		Key:       key,
+		Value:     w.Value,
+		Publisher: ed25519.PublicKey(w.Publisher),
+		Seq:       w.Seq,
+		Expires:   w.Expires,
+		Sig:       w.Sig,
+	}, nil
+}
+
+// KeyOf 把一个名字映射到 DHT 的 Key 空间
+func KeyOf(name string) peer.PeerID {
+	return peer.PeerID(sha256.Sum256([]byte("envelop-dht:" + name)))
+}
+
+// NewRecord 创建并签名一条记录，ttl 之后过期
+func NewRecord(kp *peer.KeyPair, key peer.PeerID, value []byte, seq uint64, ttl time.Duration) *Record {
+	return newRecordAt(kp, key, value, seq, time.Now().Add(ttl))
+}
+
+// newRecordAt 创建并签名一条在 expires 过期的记录（DHT 按自己的 Clock 算过期时间）
+func newRecordAt(kp *peer.KeyPair, key peer.PeerID, value []byte, seq uint64, expires time.Time) *Record {
+	r := &Record{
+		Key:       key,
+		Value:     append([]byte(nil), value...),
+		Publisher: append(ed25519.PublicKey(nil), kp.PublicKey...),
+		Seq:       seq,
+		Expires:   expires.Unix(),
+	}
+	r.Sig = ed25519.Sign(kp.PrivateKey, r.digest())
+	return r
+}
+
+// digest 计算记录的规范化摘要（不含 Sig 本身）
+func (r *Record) digest() []byte {
+	var buf [8]byte
+	h := sha256.New()
+	h.Write([]byte(recordDomain))
+	h.Write(r.Key[:])
+
+	binary.BigEndian.PutUint64(buf[:], uint64(len(r.Value)))
+	h.Write(buf[:])
+	h.Write(r.Value)
+
+	h.Write(r.Publisher)
+	binary.BigEndian.PutUint64(buf[:], r.Seq)
+	h.Write(buf[:])
+	binary.BigEndian.PutUint64(buf[:], uint64(r.Expires))
+	h.Write(buf[:])
+	return h.Sum(nil)
+}
+
+// Verify 检查签名
+func (r *Record) Verify() error {
+	if len(r.Publisher) != ed25519.PublicKeySize || len(r.Sig) != ed25519.SignatureSize {
+		return rpc.Errorf(rpc.CodeInvalidArgument, "malformed record signature")
+	}
+	if !ed25519.Verify(r.Publisher, r.digest(), r.Sig) {
+		return rpc.Errorf(rpc.CodeInvalidArgument, "invalid record signature")
+	}
+	return nil
+}
+
+// PublisherID 返回发布者的 PeerID
+func (r *Record) PublisherID() peer.PeerID {
+	return peer.NewPeerIDFromPubKey(r.Publisher)
+}
+
+// Expired 判断记录在 now 时刻是否已经过期
+func (r *Record) Expired(now time.Time) bool {
+	return now.Unix() >= r.Expires
+}
+
+// ExpiresAt 返回过期时间
+func (r *Record) ExpiresAt() time.Time {
+	return time.Unix(r.Expires, 0)
+}
+
+// Supersedes 判断 r 能否覆盖同一个 (Key, 发布者) 下已有的 old
+func (r *Record) Supersedes(old *Record) bool {
+	if r.Seq != old.Seq {
+		return r.Seq > old.Seq
+	}
+	return r.Expires > old.Expires
+}
@@ -0,0 +1,305 @@
+package dht
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"envelop/peer"
+)
+
+/*
+==========================================================
+ RecordStore：记录的本地存储
+==========================================================
+
+DHT 只通过这个接口读写本地记录，不关心存在哪：
+
+  - MemoryStore：进程内 map，重启就没了（默认）
+  - FileStore：  一个目录，每条记录一个 JSON 文件，重启后还在
+
+  目录结构：
+     <dir>/<hex(Key)>/<hex(PublisherID)>.json
+
+存储层只负责“存 / 取 / 删”，不做任何判断：
+签名校验、Seq 比较、过期、每个发布者的配额都在 DHT 那一层（value.go）。
+==========================================================
+*/
+
+// RecordStore 是 DHT 记录的本地存储
+type RecordStore interface {
+	// Get 返回 key 下所有发布者的记录（可能包含已过期的）
+	Get(key peer.PeerID) ([]*Record, error)
+	// Lookup 返回 (key, publisher) 对应的那一条记录
+	Lookup(key, publisher peer.PeerID) (*Record, bool, error)
+	// Put 写入一条记录，覆盖同一个 (Key, PublisherID) 的旧记录
+	Put(r *Record) error
+	// Delete 删除 (key, publisher) 对应的记录，不存在时不报错
+	Delete(key, publisher peer.PeerID) error
+	// CountByPublisher 统计某个发布者一共存了多少条
+	CountByPublisher(publisher peer.PeerID) (int, error)
+	// Range 遍历所有记录，fn 返回 false 时停止
+	Range(fn func(r *Record) bool) error
+}
+
+/*
+==========================================================
+ MemoryStore
+==========================================================
+*/
+
+// MemoryStore 是进程内的 RecordStore
+type MemoryStore struct {
+	mu      sync.RWMutex
+	records map[peer.PeerID]map[peer.PeerID]*Record // key → publisher → record
+}
+
+// NewMemoryStore 创建一个空的 MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: make(map[peer.PeerID]map[peer.PeerID]*Record)}
+}
+
+func (s *MemoryStore) Get(key peer.PeerID) ([]*Record, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []*Record
+	for _, r := range s.records[key] {
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+func (s *MemoryStore) Lookup(key, publisher peer.PeerID) (*Record, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r, ok := s.records[key][publisher]
+	return r, ok, nil
+}
+
+func (s *MemoryStore) Put(r *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.records[r.Key]
+	if m == nil {
+		m = make(map[peer.PeerID]*Record)
+		s.records[r.Key] = m
+	}
+	m[r.PublisherID()] = r
+	return nil
+}
+
+func (s *MemoryStore) Delete(key, publisher peer.PeerID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.records[key]
+	delete(m, publisher)
+	if len(m) == 0 {
+		delete(s.records, key)
+	}
+	return nil
+}
+
+func (s *MemoryStore) CountByPublisher(publisher peer.PeerID) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := 0
+	for _, m := range s.records {
+		if _, ok := m[publisher]; ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *MemoryStore) Range(fn func(r *Record) bool) error {
+	// 先拷一份，fn 里可以放心调用 Put / Delete
+	s.mu.RLock()
+	var all []*Record
+	for _, m := range s.records {
+		for _, r := range m {
+			all = append(all, r)
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, r := range all {
+		if !fn(r) {
+			break
+		}
+	}
+	return nil
+}
+
+/*
+==========================================================
+ FileStore
+==========================================================
+*/
+
+// FileStore 是基于目录的 RecordStore
+type FileStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewFileStore 打开（必要时创建）一个记录目录
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) keyDir(key peer.PeerID) string {
+	return filepath.Join(s.dir, hex.EncodeToString(key[:]))
+}
+
+func (s *FileStore) path(key, publisher peer.PeerID) string {
+	return filepath.Join(s.keyDir(key), hex.EncodeToString(publisher[:])+".json")
+}
+
+// readRecordFile 读一条记录；文件不存在返回 (nil, nil)
+func readRecordFile(path string) (*Record, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var w wireRecord
+	if err := json.Unmarshal(b, &w); err != nil {
+		return nil, err
+	}
+	return w.toRecord()
+}
+
+func (s *FileStore) Get(key peer.PeerID) ([]*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := os.ReadDir(s.keyDir(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var out []*Record
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		r, err := readRecordFile(filepath.Join(s.keyDir(key), e.Name()))
+		if err != nil || r == nil {
+			continue // 坏文件跳过，不影响其它记录
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+func (s *FileStore) Lookup(key, publisher peer.PeerID) (*Record, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, err := readRecordFile(s.path(key, publisher))
+	if err != nil || r == nil {
+		return nil, false, err
+	}
+	return r, true, nil
+}
+
+func (s *FileStore) Put(r *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := json.Marshal(r.toWire())
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.keyDir(r.Key), 0o700); err != nil {
+		return err
+	}
+	// 先写临时文件再 rename，避免写一半崩溃留下坏文件
+	path := s.path(r.Key, r.PublisherID())
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *FileStore) Delete(key, publisher peer.PeerID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := os.Remove(s.path(key, publisher))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	_ = os.Remove(s.keyDir(key)) // 目录空了顺手删掉（不空会失败，忽略）
+	return nil
+}
+
+func (s *FileStore) CountByPublisher(publisher peer.PeerID) (int, error) {
+	name := hex.EncodeToString(publisher[:]) + ".json"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, k := range keys {
+		if !k.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(s.dir, k.Name(), name)); err == nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *FileStore) Range(fn func(r *Record) bool) error {
+	// 先把记录都读出来再回调，fn 里可以放心调用 Put / Delete
+	s.mu.Lock()
+	var all []*Record
+	keys, err := os.ReadDir(s.dir)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	for _, k := range keys {
+		if !k.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(s.dir, k.Name()))
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			if !strings.HasSuffix(f.Name(), ".json") {
+				continue
+			}
+			r, err := readRecordFile(filepath.Join(s.dir, k.Name(), f.Name()))
+			if err != nil || r == nil {
+				continue
+			}
+			all = append(all, r)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, r := range all {
+		if !fn(r) {
+			break
+		}
+	}
+	return nil
+}
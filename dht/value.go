@@ -0,0 +1,460 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"envelop/peer"
+	"envelop/rpc"
+)
+
+/*
+==========================================================
+ STORE / FIND_VALUE：Key/Value 存储
+==========================================================
+
+  STORE       把一条签名记录存到对方那里
+  FIND_VALUE  问对方“key 下有哪些记录”，对方同时返回它知道的最近 K 个节点
+
+发布（Put）：
+  1. 用发布者的 KeyPair 签一条 Record
+  2. 本地先存一份
+  3. FindNode(key) 找到离 key 最近的 K 个节点，并发 STORE（k 副本）
+  4. 记进 published：之后每 RepublishInterval 续期重签、重新 STORE 一遍
+
+查找（GetValue）：
+  和 FindNode 一样迭代，但每一步发 FIND_VALUE：
+    - 收到的记录逐条验签，同一个发布者只留最新的（Seq / Expires 最大）
+    - 查找一直走到收敛，这样多个发布者的记录都能收集到
+
+存储节点的限制（防止被塞爆）：
+  - Value 不能超过 MaxValueSize
+  - Expires 不能超过 now + MaxRecordTTL
+  - 每个发布者最多 MaxRecordsPerPublisher 条
+  - 过期记录定时清理
+
+节点除了续期自己发布的记录，还会把自己存着的别人的记录
+每个周期重新推给当前离 key 最近的 K 个节点（新节点加入后也能拿到）。
+==========================================================
+*/
+
+// 协议方法名
+const (
+	MethodStore     = "dht.Store"
+	MethodFindValue = "dht.FindValue"
+)
+
+// 存储相关默认参数
+const (
+	DefaultRecordTTL              = 24 * time.Hour
+	DefaultMaxRecordTTL           = 48 * time.Hour
+	DefaultRepublishInterval      = time.Hour
+	DefaultMaxValueSize           = 8 * 1024
+	DefaultMaxRecordsPerPublisher = 128
+)
+
+// storeRequest 是 STORE 的参数（返回值为空）
+type storeRequest struct {
+	From   wireContact `json:"from"`
+	Record wireRecord  `json:"rec"`
+}
+
+// findValueRequest / findValueResponse 是 FIND_VALUE 的参数和返回值
+type findValueRequest struct {
+	From wireContact `json:"from"`
+	Key  string      `json:"key"`
+}
+
+type findValueResponse struct {
+	Records []wireRecord  `json:"recs,omitempty"`
+	Closest []wireContact `json:"closest"`
+}
+
+// publication 是本节点自己发布、需要定时续期的一条记录
+type publication struct {
+	kp  *peer.KeyPair
+	rec *Record
+	ttl time.Duration
+}
+
+// pubKey 标识一条发布：(Key, 发布者)
+type pubKey struct {
+	key       peer.PeerID
+	publisher peer.PeerID
+}
+
+/*
+==========================================================
+ 本地存储：校验 + 配额
+==========================================================
+*/
+
+// storeLocal 校验一条记录并存进本地 Store
+func (d *DHT) storeLocal(r *Record) error {
+	if err := r.Verify(); err != nil {
+		return err
+	}
+	now := d.now()
+	if r.Expired(now) {
+		return rpc.Errorf(rpc.CodeInvalidArgument, "record expired")
+	}
+	if d.MaxValueSize > 0 && len(r.Value) > d.MaxValueSize {
+		return rpc.Errorf(rpc.CodeInvalidArgument, "value too large: %d > %d", len(r.Value), d.MaxValueSize)
+	}
+	if d.MaxRecordTTL > 0 && r.ExpiresAt().After(now.Add(d.MaxRecordTTL)) {
+		return rpc.Errorf(rpc.CodeInvalidArgument, "record ttl exceeds %s", d.MaxRecordTTL)
+	}
+
+	publisher := r.PublisherID()
+
+	// 查旧记录 + 数配额 + 写入 要作为一个整体
+	d.storeMu.Lock()
+	defer d.storeMu.Unlock()
+
+	old, ok, err := d.Store.Lookup(r.Key, publisher)
+	if err != nil {
+		return rpc.FromError(err)
+	}
+	if ok {
+		if !r.Supersedes(old) {
+			if r.Seq == old.Seq && r.Expires == old.Expires {
+				return nil // 同一条记录重复 STORE：幂等
+			}
+			return rpc.Errorf(rpc.CodeAlreadyExists, "stale record: seq %d <= %d", r.Seq, old.Seq)
+		}
+	} else if d.MaxRecordsPerPublisher > 0 {
+		n, err := d.Store.CountByPublisher(publisher)
+		if err != nil {
+			return rpc.FromError(err)
+		}
+		if n >= d.MaxRecordsPerPublisher {
+			return rpc.Errorf(rpc.CodeResourceExhausted,
+				"publisher %s has too many records (%d)", peer.PeerIDToDomain(publisher), n)
+		}
+	}
+
+	if err := d.Store.Put(r); err != nil {
+		return rpc.FromError(err)
+	}
+	return nil
+}
+
+// localRecords 返回本地 key 下没过期的记录
+func (d *DHT) localRecords(key peer.PeerID) []*Record {
+	recs, err := d.Store.Get(key)
+	if err != nil {
+		log.Printf("[DHT] store get: %v", err)
+		return nil
+	}
+	now := d.now()
+	out := recs[:0]
+	for _, r := range recs {
+		if !r.Expired(now) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// ExpireRecords 删掉本地所有过期记录，返回删了多少条
+func (d *DHT) ExpireRecords() int {
+	now := d.now()
+	n := 0
+	err := d.Store.Range(func(r *Record) bool {
+		if r.Expired(now) {
+			if err := d.Store.Delete(r.Key, r.PublisherID()); err == nil {
+				n++
+			}
+		}
+		return true
+	})
+	if err != nil {
+		log.Printf("[DHT] expire records: %v", err)
+	}
+	return n
+}
+
+/*
+==========================================================
+ 服务端：处理 STORE / FIND_VALUE
+==========================================================
+*/
+
+func (d *DHT) handleStore(caller rpc.CallerInfo, data []byte) ([]byte, error) {
+	var req storeRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, rpc.Errorf(rpc.CodeInvalidArgument, "bad store: %v", err)
+	}
+	d.learnFromCaller(caller, req.From)
+
+	r, err := req.Record.toRecord()
+	if err != nil {
+		return nil, rpc.Errorf(rpc.CodeInvalidArgument, "bad record key: %v", err)
+	}
+	return nil, d.storeLocal(r)
+}
+
+func (d *DHT) handleFindValue(caller rpc.CallerInfo, data []byte) ([]byte, error) {
+	var req findValueRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, rpc.Errorf(rpc.CodeInvalidArgument, "bad find_value: %v", err)
+	}
+	key, err := peer.DomainToPeerID(req.Key)
+	if err != nil {
+		return nil, rpc.Errorf(rpc.CodeInvalidArgument, "bad key: %v", err)
+	}
+	d.learnFromCaller(caller, req.From)
+
+	var resp findValueResponse
+	for _, r := range d.localRecords(key) {
+		resp.Records = append(resp.Records, r.toWire())
+	}
+	for _, id := range d.table.FindClosest(key, d.K) {
+		resp.Closest = append(resp.Closest, d.contactOf(id).toWire())
+	}
+	return json.Marshal(resp)
+}
+
+/*
+==========================================================
+ 客户端：单次 STORE / FIND_VALUE
+==========================================================
+*/
+
+// storeAt 把一条记录 STORE 到 to
+func (d *DHT) storeAt(to peer.PeerID, r *Record) error {
+	req, _ := json.Marshal(storeRequest{
+		From:   d.selfContact().toWire(),
+		Record: r.toWire(),
+	})
+	_, err := d.call(to, MethodStore, req, d.RPCTimeout)
+	return err
+}
+
+// findValue 对单个节点发 FIND_VALUE
+func (d *DHT) findValue(to, key peer.PeerID) ([]*Record, []Contact, error) {
+	req, _ := json.Marshal(findValueRequest{
+		From: d.selfContact().toWire(),
+		Key:  peer.PeerIDToDomain(key),
+	})
+	resp, err := d.call(to, MethodFindValue, req, d.RPCTimeout)
+	if err != nil {
+		d.callFailed(to, err)
+		return nil, nil, err
+	}
+
+	var out findValueResponse
+	if err := json.Unmarshal(resp.Data, &out); err != nil {
+		return nil, nil, rpc.Errorf(rpc.CodeInternal, "bad find_value response: %v", err)
+	}
+
+	var recs []*Record
+	for _, w := range out.Records {
+		r, err := w.toRecord()
+		if err != nil {
+			continue
+		}
+		recs = append(recs, r)
+	}
+	contacts := make([]Contact, 0, len(out.Closest))
+	for _, w := range out.Closest {
+		c, err := w.toContact()
+		if err != nil {
+			continue
+		}
+		contacts = append(contacts, c)
+	}
+	return recs, contacts, nil
+}
+
+/*
+==========================================================
+ Put / GetValue
+==========================================================
+*/
+
+// replicate 把 r 推给离 r.Key 最近的 K 个节点，返回成功的副本数
+func (d *DHT) replicate(r *Record) (int, error) {
+	closest, err := d.FindNode(r.Key)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+		ok int
+	)
+	for _, c := range closest {
+		wg.Add(1)
+		go func(id peer.PeerID) {
+			defer wg.Done()
+			if err := d.storeAt(id, r); err != nil {
+				log.Printf("[DHT] store at %s: %v", peer.PeerIDToDomain(id), err)
+				return
+			}
+			mu.Lock()
+			ok++
+			mu.Unlock()
+		}(c.ID)
+	}
+	wg.Wait()
+
+	if ok == 0 {
+		return 0, rpc.Errorf(rpc.CodeUnavailable, "dht: no replica accepted the record")
+	}
+	return ok, nil
+}
+
+// nextSeq 返回 (key, publisher) 下一条记录该用的 Seq
+func (d *DHT) nextSeq(key, publisher peer.PeerID) uint64 {
+	var seq uint64
+	d.mu.Lock()
+	if p, ok := d.published[pubKey{key, publisher}]; ok {
+		seq = p.rec.Seq
+	}
+	d.mu.Unlock()
+
+	if old, ok, _ := d.Store.Lookup(key, publisher); ok && old.Seq > seq {
+		seq = old.Seq
+	}
+	return seq + 1
+}
+
+// Put 以 kp 的身份发布 key → value：
+//   - ttl<=0 时用 DefaultRecordTTL
+//   - Seq 在本节点已知的最大 Seq 上加一
+//   - 本地存一份，再复制到离 key 最近的 K 个节点
+//   - 之后每 RepublishInterval 自动续期，直到 Unpublish
+//
+// 本地存储成功但一个副本都没推出去时，返回记录和 CodeUnavailable 错误
+// （记录仍会在下一轮续期时重试）。
+func (d *DHT) Put(kp *peer.KeyPair, key peer.PeerID, value []byte, ttl time.Duration) (*Record, error) {
+	if ttl <= 0 {
+		ttl = DefaultRecordTTL
+	}
+	r := newRecordAt(kp, key, value, d.nextSeq(key, kp.PeerID), d.now().Add(ttl))
+	if err := d.storeLocal(r); err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	d.published[pubKey{key, kp.PeerID}] = &publication{kp: kp, rec: r, ttl: ttl}
+	d.mu.Unlock()
+
+	if _, err := d.replicate(r); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+// Unpublish 停止续期 (key, publisher) 的记录（已经发出去的会自然过期）
+func (d *DHT) Unpublish(key, publisher peer.PeerID) {
+	d.mu.Lock()
+	delete(d.published, pubKey{key, publisher})
+	d.mu.Unlock()
+}
+
+// GetValue 在网络里查 key 下的所有记录（每个发布者只保留最新的一条）。
+// 本地和网络上都没找到时返回 CodeNotFound。
+func (d *DHT) GetValue(key peer.PeerID) ([]*Record, error) {
+	var mu sync.Mutex
+	best := make(map[peer.PeerID]*Record)
+	now := d.now()
+
+	merge := func(r *Record) {
+		if r.Key != key || r.Expired(now) || r.Verify() != nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		pub := r.PublisherID()
+		if old, ok := best[pub]; !ok || r.Supersedes(old) {
+			best[pub] = r
+		}
+	}
+
+	for _, r := range d.localRecords(key) {
+		merge(r)
+	}
+
+	_, err := d.iterate(key, func(id peer.PeerID) ([]Contact, error) {
+		recs, contacts, err := d.findValue(id, key)
+		for _, r := range recs {
+			merge(r)
+		}
+		return contacts, err
+	})
+
+	if len(best) == 0 {
+		if err != nil && rpc.CodeOf(err) != rpc.CodeUnavailable {
+			return nil, err
+		}
+		return nil, rpc.Errorf(rpc.CodeNotFound, "dht: no record for key %s", peer.PeerIDToDomain(key))
+	}
+
+	out := make([]*Record, 0, len(best))
+	for _, r := range best {
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return bytes.Compare(out[i].Publisher, out[j].Publisher) < 0
+	})
+	return out, nil
+}
+
+/*
+==========================================================
+ 续期 + 副本维护
+==========================================================
+*/
+
+// Republish 做一轮维护：
+//  1. 清理本地过期记录
+//  2. 自己发布的记录：重签（Seq 不变、Expires 往后推）并重新复制
+//  3. 别人发布、存在本地的记录：原样推给当前离 key 最近的 K 个节点
+func (d *DHT) Republish() {
+	d.ExpireRecords()
+
+	d.mu.Lock()
+	pubs := make([]*publication, 0, len(d.published))
+	for _, p := range d.published {
+		pubs = append(pubs, p)
+	}
+	d.mu.Unlock()
+
+	own := make(map[pubKey]bool)
+	for _, p := range pubs {
+		r := newRecordAt(p.kp, p.rec.Key, p.rec.Value, p.rec.Seq, d.now().Add(p.ttl))
+		own[pubKey{r.Key, p.kp.PeerID}] = true
+
+		if err := d.storeLocal(r); err != nil {
+			log.Printf("[DHT] republish %s: %v", peer.PeerIDToDomain(r.Key), err)
+			continue
+		}
+		d.mu.Lock()
+		p.rec = r
+		d.mu.Unlock()
+
+		if _, err := d.replicate(r); err != nil {
+			log.Printf("[DHT] republish %s: %v", peer.PeerIDToDomain(r.Key), err)
+		}
+	}
+
+	var others []*Record
+	_ = d.Store.Range(func(r *Record) bool {
+		if !own[pubKey{r.Key, r.PublisherID()}] {
+			others = append(others, r)
+		}
+		return true
+	})
+	for _, r := range others {
+		if _, err := d.replicate(r); err != nil {
+			log.Printf("[DHT] replicate %s: %v", peer.PeerIDToDomain(r.Key), err)
+		}
+	}
+}
@@ -40,6 +40,24 @@ func (b *Builder) Payload(p []byte) *Builder {
 	return b
 }
 
+// Datagram 标记 FlagDatagram：小信封走 datagram，丢了不重传
+func (b *Builder) Datagram() *Builder {
+	b.e.Flags |= FlagDatagram
+	return b
+}
+
+// Ext 添加一个扩展（见 ext.go）
+func (b *Builder) Ext(typ uint8, value []byte) *Builder {
+	b.e.SetExt(typ, value)
+	return b
+}
+
+// RecordPath 打开路径记录：之后每个中继都会把自己追加进去
+func (b *Builder) RecordPath() *Builder {
+	b.e.EnablePathRecord()
+	return b
+}
+
 func (b *Builder) Build() (*Envelope, error) {
 	return &b.e, nil
 }
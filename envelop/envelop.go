@@ -31,6 +31,11 @@ const (
 
 	FlagRegister uint8 = 1 << 7 // 1000_0000：控制包类型：REGISTER
 	FlagRPC      uint8 = 1 << 2 // 0000 0100  ← 新增，给 RPC 用
+	FlagExt      uint8 = 1 << 3 // 0000 1000：header 后面跟着扩展区（见 ext.go）
+
+	// FlagDatagram：尽力而为，每一跳能放进一个 datagram 的就不开流（可能丢、可能乱序），
+	// 放不下或者连接不支持时照常走流（见 PeerManager.SendToPeer）
+	FlagDatagram uint8 = 1 << 4 // 0001 0000
 )
 
 // Envelope 是一层信封，可以递归嵌套。
@@ -45,6 +50,9 @@ type Envelope struct {
 	InnerLen uint16
 	Reserved [3]byte
 
+	// Exts：可选扩展（TLV），非空时 Marshal 自动置 FlagExt，见 ext.go
+	Exts []Ext
+
 	InnerPayload []byte
 }
 
@@ -65,12 +73,24 @@ func (e *Envelope) Marshal() []byte {
 }
 
 // Marshal Envelope → []byte（无 padding）
+//
+// 有扩展时的布局：Header(72) | ExtBlock | InnerPayload
 func Marshal(e *Envelope) ([]byte, error) {
-	total := EnvHeaderSize + len(e.InnerPayload)
+	var ext []byte
+	flags := e.Flags &^ FlagExt
+	if len(e.Exts) > 0 {
+		var err error
+		if ext, err = marshalExts(e.Exts); err != nil {
+			return nil, err
+		}
+		flags |= FlagExt
+	}
+
+	total := EnvHeaderSize + len(ext) + len(e.InnerPayload)
 	buf := make([]byte, total)
 
 	buf[0] = e.Version
-	buf[1] = e.Flags
+	buf[1] = flags
 	buf[2] = e.TTL
 
 	copy(buf[3:35], e.DestPeerID[:])
@@ -79,7 +99,8 @@ func Marshal(e *Envelope) ([]byte, error) {
 	binary.BigEndian.PutUint16(buf[67:69], e.InnerLen)
 	copy(buf[69:72], e.Reserved[:])
 
-	copy(buf[72:], e.InnerPayload)
+	copy(buf[72:], ext)
+	copy(buf[72+len(ext):], e.InnerPayload)
 
 	return buf, nil
 }
@@ -101,12 +122,22 @@ func Unmarshal(data []byte) (*Envelope, error) {
 	e.InnerLen = binary.BigEndian.Uint16(data[67:69])
 	copy(e.Reserved[:], data[69:72])
 
-	if len(data) < EnvHeaderSize+int(e.InnerLen) {
+	body := data[EnvHeaderSize:]
+	if e.Flags&FlagExt != 0 {
+		exts, n, err := unmarshalExts(body)
+		if err != nil {
+			return nil, err
+		}
+		e.Exts = exts
+		body = body[n:]
+	}
+
+	if len(body) < int(e.InnerLen) {
 		return nil, fmt.Errorf("inner payload truncated")
 	}
 
 	e.InnerPayload = make([]byte, e.InnerLen)
-	copy(e.InnerPayload, data[72:72+e.InnerLen])
+	copy(e.InnerPayload, body[:e.InnerLen])
 	return e, nil
 }
 
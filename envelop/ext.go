@@ -0,0 +1,183 @@
+package envelop
+
+import (
+	"encoding/binary"
+
+	"envelop/peer"
+)
+
+/*
+===============================================================
+ Envelope 扩展区（FlagExt）
+ --------------------------------------------------------------
+ 固定 72 字节的 header 放不下“可选信息”，所以加一个可选扩展区：
+
+   Header(72, Flags 带 FlagExt) | ExtBlock | InnerPayload(InnerLen)
+
+   ExtBlock = ExtLen(2) + 若干个 TLV
+   TLV      = Type(1) + Len(2) + Value(Len)
+
+ 规则：
+   - 没有 FlagExt 的信封和以前完全一样（旧节点不受影响）
+   - 不认识的扩展类型原样保留、原样转发
+   - 扩展只属于“这一层”信封；Onion 内层信封有自己的扩展区
+     （例外：ExtReceiptReq 在拆 Onion 时由 Router 带进内层，回执由最终收件人发）
+===============================================================
+*/
+
+// 扩展类型
+const (
+	ExtPath       uint8 = 1 // 路径记录：中继依次追加自己的 PeerID（N × 32 字节）
+	ExtProbe      uint8 = 2 // traceroute 探测：ProbeID(8)
+	ExtTraceReply uint8 = 3 // traceroute 回应：ProbeID(8) + Hop PeerID(32) + Reached(1)
+	ExtReceiptReq uint8 = 4 // 请求端到端回执：MsgID(8)
+	ExtReceipt    uint8 = 5 // 端到端回执：MsgID(8) + Status(1) + Reporter PeerID(32) [+ Pub(32) + Sig(64)]
+	ExtHopReq     uint8 = 6 // 请求逐跳确认：Seq(8) + 上一跳 PeerID(32)，每一跳转发时替换
+	ExtHopAck     uint8 = 7 // 逐跳确认：Seq(8)
+)
+
+// MaxPathLen 是路径记录最多记多少跳（再多就不追加了，避免信封无限变大）
+const MaxPathLen = 32
+
+// Ext 是一个 TLV 扩展
+type Ext struct {
+	Type  uint8
+	Value []byte
+}
+
+// marshalExts 把扩展编码成 ExtBlock
+func marshalExts(exts []Ext) ([]byte, error) {
+	size := 2
+	for _, x := range exts {
+		if len(x.Value) > 0xFFFF {
+			return nil, ErrBadExtension
+		}
+		size += 3 + len(x.Value)
+	}
+	if size-2 > 0xFFFF {
+		return nil, ErrBadExtension
+	}
+
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint16(buf[0:2], uint16(size-2))
+	off := 2
+	for _, x := range exts {
+		buf[off] = x.Type
+		binary.BigEndian.PutUint16(buf[off+1:off+3], uint16(len(x.Value)))
+		copy(buf[off+3:], x.Value)
+		off += 3 + len(x.Value)
+	}
+	return buf, nil
+}
+
+// unmarshalExts 解析 ExtBlock，返回扩展和 ExtBlock 占用的字节数
+func unmarshalExts(data []byte) ([]Ext, int, error) {
+	if len(data) < 2 {
+		return nil, 0, ErrBadExtension
+	}
+	n := int(binary.BigEndian.Uint16(data[0:2]))
+	if len(data) < 2+n {
+		return nil, 0, ErrBadExtension
+	}
+
+	var exts []Ext
+	block := data[2 : 2+n]
+	for len(block) > 0 {
+		if len(block) < 3 {
+			return nil, 0, ErrBadExtension
+		}
+		l := int(binary.BigEndian.Uint16(block[1:3]))
+		if len(block) < 3+l {
+			return nil, 0, ErrBadExtension
+		}
+		exts = append(exts, Ext{
+			Type:  block[0],
+			Value: append([]byte(nil), block[3:3+l]...),
+		})
+		block = block[3+l:]
+	}
+	return exts, 2 + n, nil
+}
+
+// Ext 返回第一个类型为 typ 的扩展
+func (e *Envelope) Ext(typ uint8) ([]byte, bool) {
+	for _, x := range e.Exts {
+		if x.Type == typ {
+			return x.Value, true
+		}
+	}
+	return nil, false
+}
+
+// SetExt 设置类型为 typ 的扩展（已存在就替换）
+func (e *Envelope) SetExt(typ uint8, value []byte) {
+	for i, x := range e.Exts {
+		if x.Type == typ {
+			e.Exts[i].Value = value
+			return
+		}
+	}
+	e.Exts = append(e.Exts, Ext{Type: typ, Value: value})
+}
+
+// DelExt 删除类型为 typ 的扩展
+func (e *Envelope) DelExt(typ uint8) {
+	out := e.Exts[:0]
+	for _, x := range e.Exts {
+		if x.Type != typ {
+			out = append(out, x)
+		}
+	}
+	e.Exts = out
+}
+
+/*
+===============================================================
+ 路径记录（ExtPath）
+===============================================================
+*/
+
+// EnablePathRecord 给信封加一个空的路径记录，之后每个中继转发时都会追加自己
+func (e *Envelope) EnablePathRecord() {
+	if _, ok := e.Ext(ExtPath); !ok {
+		e.SetExt(ExtPath, []byte{})
+	}
+}
+
+// Path 返回路径记录（没有路径记录时 ok=false）
+func (e *Envelope) Path() (path []peer.PeerID, ok bool) {
+	v, ok := e.Ext(ExtPath)
+	if !ok {
+		return nil, false
+	}
+	for len(v) >= peer.PeerIDLength {
+		var id peer.PeerID
+		copy(id[:], v[:peer.PeerIDLength])
+		path = append(path, id)
+		v = v[peer.PeerIDLength:]
+	}
+	return path, true
+}
+
+// AppendPath 把 id 追加到路径记录末尾（没有路径记录或已满时什么都不做）
+func (e *Envelope) AppendPath(id peer.PeerID) {
+	v, ok := e.Ext(ExtPath)
+	if !ok || len(v) >= MaxPathLen*peer.PeerIDLength {
+		return
+	}
+	nv := make([]byte, 0, len(v)+peer.PeerIDLength)
+	nv = append(nv, v...)
+	nv = append(nv, id[:]...)
+	e.SetExt(ExtPath, nv)
+}
+
+// PathContains 判断路径记录里是否已经有 id（用于环路检测）
+func (e *Envelope) PathContains(id peer.PeerID) bool {
+	path, _ := e.Path()
+	for _, p := range path {
+		if p.Equals(id) {
+			return true
+		}
+	}
+	return false
+}
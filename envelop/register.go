@@ -0,0 +1,101 @@
+package envelop
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"envelop/peer"
+)
+
+/*
+===============================================================
+ REGISTER 信封：带签名的“我就在这条连接上”
+ --------------------------------------------------------------
+ Flags=1，TTL=1，ReturnPeerID = 发送方，DestPeerID = 接收方。
+
+ ReturnPeerID 谁都能填，所以 InnerPayload 带着发送方的身份证明：
+
+   Pub(32) | Timestamp(8, UnixNano) | Sig(64)
+
+   Sig = Ed25519(priv, "envelop-register-v1" | DestPeerID | ReturnPeerID | Timestamp)
+
+ 接收方（VerifyRegister）检查：
+   1. SHA256(Pub) == ReturnPeerID      （公钥就是它声称的那个节点的）
+   2. DestPeerID == 自己                （发给别人的 REGISTER 拿过来重放没用）
+   3. Timestamp 和本地时间相差不超过 RegisterMaxSkew
+   4. Sig 验证通过
+===============================================================
+*/
+
+// registerDomain 用于区分“REGISTER 签名”和其它用途的签名
+const registerDomain = "envelop-register-v1"
+
+// registerProofSize：Pub + Timestamp + Sig
+const registerProofSize = ed25519.PublicKeySize + 8 + ed25519.SignatureSize
+
+// RegisterMaxSkew 是 REGISTER 时间戳和本地时间允许的最大偏差
+const RegisterMaxSkew = 2 * time.Minute
+
+// ErrBadRegister：REGISTER 没有身份证明，或者证明验不过
+var ErrBadRegister = errors.New("envelop: bad register proof")
+
+// NewRegister 以 kp 的身份构造一个发给 dest 的 REGISTER 信封
+func NewRegister(kp *peer.KeyPair, dest peer.PeerID) (*Envelope, error) {
+	ts := time.Now().UnixNano()
+
+	proof := make([]byte, 0, registerProofSize)
+	proof = append(proof, kp.PublicKey...)
+	proof = binary.BigEndian.AppendUint64(proof, uint64(ts))
+	proof = append(proof, ed25519.Sign(kp.PrivateKey, registerDigest(dest, kp.PeerID, ts))...)
+
+	return NewBuilder().
+		Version(1).
+		Flags(1). // Router / Node 按 Flags==1 识别 REGISTER
+		TTL(1).
+		Dest(dest).
+		Return(kp.PeerID).
+		Payload(proof).
+		Build()
+}
+
+// VerifyRegister 检查 REGISTER 的身份证明：env.ReturnPeerID 本人签的、发给 self 的、不过期的。
+// 通过时返回 nil，否则返回包着 ErrBadRegister 的错误。
+func VerifyRegister(env *Envelope, self peer.PeerID, now time.Time) error {
+	p := env.InnerPayload
+	if len(p) != registerProofSize {
+		return fmt.Errorf("%w: missing proof", ErrBadRegister)
+	}
+	pub := ed25519.PublicKey(p[:ed25519.PublicKeySize])
+	ts := int64(binary.BigEndian.Uint64(p[ed25519.PublicKeySize:]))
+	sig := p[ed25519.PublicKeySize+8:]
+
+	if peer.NewPeerIDFromPubKey(pub) != env.ReturnPeerID {
+		return fmt.Errorf("%w: key does not match sender", ErrBadRegister)
+	}
+	if env.DestPeerID != self {
+		return fmt.Errorf("%w: addressed to another peer", ErrBadRegister)
+	}
+	skew := now.Sub(time.Unix(0, ts))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > RegisterMaxSkew {
+		return fmt.Errorf("%w: timestamp off by %v", ErrBadRegister, skew.Round(time.Second))
+	}
+	if !ed25519.Verify(pub, registerDigest(env.DestPeerID, env.ReturnPeerID, ts), sig) {
+		return fmt.Errorf("%w: invalid signature", ErrBadRegister)
+	}
+	return nil
+}
+
+// registerDigest 是 REGISTER 签名覆盖的内容
+func registerDigest(dest, sender peer.PeerID, ts int64) []byte {
+	buf := make([]byte, 0, len(registerDomain)+2*peer.PeerIDLength+8)
+	buf = append(buf, registerDomain...)
+	buf = append(buf, dest[:]...)
+	buf = append(buf, sender[:]...)
+	return binary.BigEndian.AppendUint64(buf, uint64(ts))
+}
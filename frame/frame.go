@@ -94,6 +94,7 @@ package frame
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 )
 
 /*
@@ -132,6 +133,9 @@ import (
  *   - 接收端 io.ReadAll 一次获得完整消息
  ******************************************************/
 
+// ErrIncomplete：数据还不够一整帧（从流上读的时候，再读一些就好）
+var ErrIncomplete = errors.New("frame: incomplete")
+
 const (
 	FrameHeaderSize = 3 // 1 byte Type + 2 byte Length
 
@@ -178,19 +182,20 @@ func (f *Frame) Build(t uint8, payload []byte, _ int) error {
 //
 //	t：帧类型
 //	payload：Envelope 字节
-//	err：错误
+//	err：错误（数据还不够一整帧时 errors.Is(err, ErrIncomplete)）
 //
+// data 后面多出来的字节不管（流上背靠背的帧，见 Reader）。
 // ------------------------------------------------------------
 func Decode(data []byte) (uint8, []byte, error) {
 	if len(data) < FrameHeaderSize {
-		return 0, nil, errors.New("frame too short")
+		return 0, nil, fmt.Errorf("frame too short: %w", ErrIncomplete)
 	}
 
 	t := data[0]
 	length := binary.BigEndian.Uint16(data[1:3])
 
 	if len(data) < int(FrameHeaderSize+length) {
-		return 0, nil, errors.New("frame length mismatch")
+		return 0, nil, fmt.Errorf("frame length mismatch: %w", ErrIncomplete)
 	}
 
 	payload := data[3 : 3+length]
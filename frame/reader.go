@@ -0,0 +1,63 @@
+package frame
+
+import (
+	"errors"
+	"io"
+)
+
+/*
+===============================================================
+ Reader：从一条长期复用的流里逐帧读
+ --------------------------------------------------------------
+ 一帧一个流时，接收端 io.ReadAll 就是一整帧。
+ 多帧背靠背写在同一条流上时，帧自带的 Length 就是分隔：
+
+   [Type][Length][Payload][Type][Length][Payload]...
+
+ Reader 把读到的字节攒起来，每次用 Decode 试着切出一帧，
+ 不够一整帧（ErrIncomplete）就接着读。
+===============================================================
+*/
+
+// readChunk：每次从流上最多读多少字节
+const readChunk = 4096
+
+// Reader 从 io.Reader 里逐帧读出背靠背写进去的帧
+type Reader struct {
+	r   io.Reader
+	buf []byte
+}
+
+// NewReader 创建一个从 r 读帧的 Reader
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// Next 返回下一整帧的原始字节（Type + Length + Payload，可以直接交给 Decode）。
+// 流正好在帧边界结束时返回 io.EOF，结束在帧中间时返回 io.ErrUnexpectedEOF。
+func (fr *Reader) Next() ([]byte, error) {
+	for {
+		if _, payload, err := Decode(fr.buf); err == nil {
+			n := FrameHeaderSize + len(payload)
+			raw := append([]byte(nil), fr.buf[:n]...)
+			fr.buf = fr.buf[:copy(fr.buf, fr.buf[n:])]
+			return raw, nil
+		} else if !errors.Is(err, ErrIncomplete) {
+			return nil, err
+		}
+
+		if cap(fr.buf)-len(fr.buf) < readChunk {
+			grown := make([]byte, len(fr.buf), 2*cap(fr.buf)+readChunk)
+			copy(grown, fr.buf)
+			fr.buf = grown
+		}
+		n, err := fr.r.Read(fr.buf[len(fr.buf):cap(fr.buf)])
+		fr.buf = fr.buf[:len(fr.buf)+n]
+		if err != nil && n == 0 {
+			if err == io.EOF && len(fr.buf) > 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+}
@@ -2,8 +2,9 @@ module envelop
 
 go 1.25
 
+require github.com/quic-go/quic-go v0.57.1
+
 require (
-	github.com/quic-go/quic-go v0.57.1 // indirect
 	golang.org/x/crypto v0.41.0 // indirect
 	golang.org/x/net v0.43.0 // indirect
 	golang.org/x/sys v0.35.0 // indirect
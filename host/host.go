@@ -13,22 +13,36 @@
 //
 //   h.Send(destID, payload)
 //   h.Recv() <-chan socket.IncomingMessage
-//   h.Start() // ListenAndServe
+//   h.Start(ctx) // 后台监听，ctx 取消或 h.Close() 时优雅关闭
 //
 // 这样，真正使用你框架的人，只需要配置 Host，而不用自己手动拼一堆 Node / Router / PeerManager。
 
 package host
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"sync"
+	"time"
 
+	"envelop/clock"
+	"envelop/dht"
 	"envelop/envelop"
+	"envelop/identify"
+	"envelop/mailbox"
 	"envelop/netquic"
 	"envelop/peer"
+	"envelop/pubsub"
+	"envelop/punch"
+	"envelop/relay"
 	"envelop/router"
+	"envelop/rpc"
 	"envelop/socket"
 	"envelop/strategy"
+	"envelop/transport"
 )
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -44,12 +58,20 @@ import (
 //   - Node：         处理 QUIC 联机、Frame/Envelope 收发
 //   - Strategy：     构造/解释信封策略
 //   - Socket：       给 App 层用的 Send/Recv 接口
+//   - RPC：          RPC Endpoint（FlagRPC 信封在交给 Socket 之前被它拦下）
+//   - DHT：          Kademlia 节点（PING / FIND_NODE / STORE / FIND_VALUE，和 Router 共用一张 Kademlia 表）
+//   - Acker：        逐跳确认重发 + 端到端回执（SendWithReceipt 用）
+//   - Mailbox：      可选，替离线节点暂存信封，对方重新 REGISTER 时投递
+//   - PubSub：       基于 gossip 的发布 / 订阅（走 RPC 通知，邻居取自路由表）
+//   - Punch：        relay 协调的 UDP 打洞（Connect），打不通时改走 relay 转发
+//   - Identify：     和连上的节点交换观察地址，推断并公布自己的公网地址
+//   - Relay：        circuit relay：在别的 relay 上预约（Reserve / DialRelay）；Builder.Relay 开启时也替别人中继
 //
 // 对外暴露：
 //   - ID()    → 返回本节点 PeerID
 //   - Send()  → 发送业务数据（自动封装 Envelope + 路由）
 //   - Recv()  → 收到业务数据（从 Socket 里拿）
-//   - Start() → 开始监听（ListenAndServe）
+//   - Start() → 后台开始监听；Close() → 优雅关闭
 type Host struct {
 	id   peer.PeerID
 	name string
@@ -61,6 +83,21 @@ type Host struct {
 	Node     *netquic.Node
 	Strategy strategy.EnvelopeStrategy
 	Socket   *socket.Socket
+	RPC      *rpc.Endpoint
+	DHT      *dht.DHT
+	Tracer   *router.Tracer
+	Acker    *router.Acker
+	Mailbox  *mailbox.Mailbox // 没有开启邮箱时为 nil
+	Punch    *punch.Service
+	Identify *identify.Service
+	Relay    *relay.Service
+
+	pubsub *pubsub.PubSub
+	clock  clock.Clock // Builder.Clock 给的时钟（nil = 系统时钟），Host 自己的等待也按它走
+
+	mu     sync.Mutex
+	cancel context.CancelFunc // Start 时创建，Close 时取消后台任务
+	closed bool
 }
 
 func (h *Host) ID() peer.PeerID { return h.id }
@@ -68,10 +105,204 @@ func (h *Host) ID() peer.PeerID { return h.id }
 // Addr 返回监听地址（仅用于调试）
 func (h *Host) Addr() string { return h.addr }
 
-// Start 启动底层 Node 的监听循环。
-// 一般会在外面用 go h.Start()。
-func (h *Host) Start() error {
-	return h.Node.ListenAndServe(h.addr)
+// Start 开始监听（还没 Listen 的话），并在后台运行 Node 的接收循环
+// 以及连接池清理、观察地址过期、中继预约续约、DHT 桶刷新、PubSub 心跳、邮箱过期这些定时任务。不阻塞：
+// 返回 nil 时已经在监听了，别的节点马上就能连进来。
+// ctx 取消时等同于调用 Close。
+//
+// 加入已有网络：h.Bootstrap([]dht.Contact{{ID: seedID, Addrs: []string{"1.2.3.4:9000"}}})
+func (h *Host) Start(ctx context.Context) error {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return netquic.ErrNodeClosed
+	}
+	if h.cancel != nil {
+		h.mu.Unlock()
+		return fmt.Errorf("host already started")
+	}
+	bg, cancel := context.WithCancel(ctx)
+	h.cancel = cancel
+	h.mu.Unlock()
+
+	if h.Node.ListenAddr() == "" {
+		if err := h.Listen(); err != nil {
+			cancel()
+			return err
+		}
+	}
+	if err := h.Node.Start(bg); err != nil {
+		cancel()
+		return err
+	}
+
+	h.PeerMgr.Start(bg, 0)
+	h.Identify.Start(bg, 0)
+	h.Relay.Start(bg, 0)
+	h.DHT.Start(bg, 0)
+	h.pubsub.Start(bg, 0)
+	if h.Mailbox != nil {
+		h.Mailbox.Start(bg, 0)
+	}
+
+	go func() {
+		<-bg.Done()
+		_ = h.Close()
+	}()
+	return nil
+}
+
+// Listen 只开始监听、不接受连接（Start 会自动调用）。
+func (h *Host) Listen() error {
+	return h.Node.Listen(h.addr)
+}
+
+// Close 优雅关闭 Host：
+//  1. 停掉后台定时任务（连接池清理 / 观察地址 / 中继预约 / DHT / PubSub / 邮箱）
+//  2. Node.Close：停止接收，等正在处理的帧（最多 Node.DrainTimeout），关掉所有连接
+//  3. 关闭 Socket（Recv 的通道随之关闭）
+//
+// 可以重复调用。
+func (h *Host) Close() error {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return nil
+	}
+	h.closed = true
+	cancel := h.cancel
+	h.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+	err := h.Node.Close()
+	_ = h.Socket.Close()
+	return err
+}
+
+// Bootstrap 通过种子节点加入 DHT，然后把自己的地址签名发布出去，
+// 其它机器上的节点之后就能通过 DHT 查到本节点的地址（不再依赖共享的 Registry）。
+func (h *Host) Bootstrap(seeds []dht.Contact) error {
+	if err := h.DHT.Bootstrap(seeds); err != nil {
+		return err
+	}
+	return h.DHT.PublishAddrs(h.Node.Key, h.Addrs())
+}
+
+// Addrs 返回本节点对外公布的地址：确认过的观察地址 + 展开后的监听地址（见 identify.Service.Addrs），
+// 最后是中继地址（每个有效的预约一个，见 Reserve）
+func (h *Host) Addrs() []string {
+	return append(h.Identify.Addrs(), h.Relay.Addrs()...)
+}
+
+// identify 告诉 id 我在哪（REGISTER），再和它交换地址（见 identify.Service.Identify）。
+// 每个帧走各自的 stream，REGISTER 不一定先到，对方说没看到地址就稍等再问。
+func (h *Host) identify(id peer.PeerID) {
+	if err := h.sendRegister(id); err != nil {
+		return
+	}
+	for attempt := 1; attempt <= identifyAttempts; attempt++ {
+		observed, err := h.Identify.Identify(id)
+		if err != nil {
+			log.Printf("[Host %s] identify %s: %v", h.name, peer.PeerIDToDomain(id), err)
+			return
+		}
+		if observed != "" {
+			return
+		}
+		clock.Sleep(h.clock, time.Duration(attempt)*50*time.Millisecond)
+	}
+}
+
+// identifyAttempts：对方还没认出连接时，Identify 最多问几次
+const identifyAttempts = 3
+
+// PubSub 返回本节点的发布 / 订阅子系统：
+//
+//	t, _ := h.PubSub().Join("jobs")
+//	t.Publish([]byte("job-42"))
+//	for m := range t.Messages() { ... }
+func (h *Host) PubSub() *pubsub.PubSub {
+	return h.pubsub
+}
+
+// Register 给 relay 发一个 REGISTER 信封，告诉它“我现在在这个地址上”。
+// 对方开启了邮箱的话，会把替我暂存的信封发过来。
+// 之后也接受这个 relay 协调的打洞（见 Connect）。
+func (h *Host) Register(relay peer.PeerID) error {
+	if err := h.sendRegister(relay); err != nil {
+		return err
+	}
+	h.Punch.TrustRelay(relay)
+	return nil
+}
+
+// sendRegister 发签名的 REGISTER（见 envelop.NewRegister）：
+// 对方因此认出我拨过去的这条连接，以后从它回发
+func (h *Host) sendRegister(to peer.PeerID) error {
+	env, err := envelop.NewRegister(h.Node.Key, to)
+	if err != nil {
+		return err
+	}
+	return h.PeerMgr.SendToPeer(to, env)
+}
+
+// ObservedAddrs 问 relay 它看到的我的地址（NAT 后面就是映射出来的公网地址）。
+// 需要先 Register 到这个 relay。
+func (h *Host) ObservedAddrs(relay peer.PeerID) ([]string, error) {
+	return h.Punch.Observe(relay)
+}
+
+// Connect 通过 relay 和 target 打洞（两边都要 Register 到这个 relay）：
+//   - 打通了：返回 direct=true，之后发给 target 的信封直接走打通的连接
+//   - 没打通（例如对称型 NAT）：改走 relay 转发（见 DialRelay），返回 direct=false
+//
+// 只有 relay / target 联系不上、或者 relay 不肯开 circuit 时才返回 error。
+func (h *Host) Connect(ctx context.Context, relay, target peer.PeerID) (bool, error) {
+	addr, err := h.Punch.Connect(ctx, relay, target)
+	if err == nil {
+		// 拨号时两边已经在这条连接上交换过 REGISTER（见 Node.Connect），对方也认得它
+		log.Printf("[Host %s] 和 %s 打洞成功：%s", h.name, peer.PeerIDToDomain(target), addr)
+		return true, nil
+	}
+	if !errors.Is(err, punch.ErrPunchFailed) {
+		return false, err
+	}
+	log.Printf("[Host %s] 和 %s 打洞失败，改走 relay：%v", h.name, peer.PeerIDToDomain(target), err)
+	return false, h.DialRelay(relay, target)
+}
+
+// Reserve 在 relayID 上预约中继（先 Register 过去，relay 才能把信封转给我）。
+// 预约成功后中继地址出现在 Addrs() 里、随地址一起发布；Start 之后后台自动续约。
+func (h *Host) Reserve(relayID peer.PeerID) (relay.Reservation, error) {
+	if err := h.Register(relayID); err != nil {
+		return relay.Reservation{}, err
+	}
+	return h.Relay.Reserve(relayID)
+}
+
+// DialRelay 经 relayID 联系 target（target 要在 relayID 上预约过）：请 relay 开一条 circuit，
+// 路由表记下“target 经 relayID 可达”并排在其它中继候选前面。relay 没开 relay 服务（什么都转发）时直接记路由。
+// circuit 到期后 relay 不再转发，需要再调用一次（流量用完的要等它到期，提前再调拿到的还是同一条）。
+func (h *Host) DialRelay(relayID, target peer.PeerID) error {
+	c, err := h.Relay.Connect(relayID, target)
+	switch {
+	case err == nil:
+		log.Printf("[Host %s] 经 %s 到 %s 的 circuit 已打开，%s 到期", h.name,
+			peer.PeerIDToDomain(relayID), peer.PeerIDToDomain(target), c.Expires.Format(time.TimeOnly))
+	case rpc.CodeOf(err) == rpc.CodeNotFound:
+		// 对方没有 relay.Connect 方法：老的转发行为，不需要 circuit
+	default:
+		return err
+	}
+	h.Router.RouteTable.PreferVia(target, relayID)
+	return nil
+}
+
+// Traceroute 探测到 dest 的路径，返回每一跳的 PeerID 和 RTT（见 router.Tracer）。
+func (h *Host) Traceroute(dest peer.PeerID, maxHops int, timeout time.Duration) ([]router.Hop, error) {
+	return h.Tracer.Trace(dest, maxHops, timeout)
 }
 
 // Send 直接走 Socket 的 Send。
@@ -79,6 +310,22 @@ func (h *Host) Send(dest peer.PeerID, payload []byte) error {
 	return h.Socket.Send(dest, payload)
 }
 
+// SendDatagram 尽力而为地发送：小消息走 datagram，可能丢（见 Socket.SendDatagram）。
+// 想让所有消息都这样发，可以用 Strategy(&strategy.SimpleStrategy{Datagram: true})。
+func (h *Host) SendDatagram(dest peer.PeerID, payload []byte) error {
+	return h.Socket.SendDatagram(dest, payload)
+}
+
+// SendWithReceipt 可靠发送：逐跳确认 + 重发，等收件人的回执（见 Socket.SendWithReceipt）。
+// 超时时间由 ctx 控制，例如：
+//
+//	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+//	defer cancel()
+//	if _, err := h.SendWithReceipt(ctx, bobID, job); err != nil { ... }
+func (h *Host) SendWithReceipt(ctx context.Context, dest peer.PeerID, payload []byte) (router.Receipt, error) {
+	return h.Socket.SendWithReceipt(ctx, dest, payload)
+}
+
 // Recv 返回 Socket 的消息通道。
 func (h *Host) Recv() <-chan socket.IncomingMessage {
 	return h.Socket.Recv()
@@ -105,6 +352,15 @@ type Builder struct {
 	registry   *netquic.RelayRegistry
 	routeTable *router.RouteTable
 	strategy   strategy.EnvelopeStrategy
+	records    dht.RecordStore
+	policy     *router.SelectPolicy
+	mailbox    mailbox.Store
+	transport  transport.Transport
+	relay      *relay.Limits
+	noRelay    bool
+	ordered    bool
+	clock      clock.Clock
+	rand       io.Reader
 }
 
 // NewBuilder 创建一个空的 Builder。
@@ -140,7 +396,8 @@ func (b *Builder) Registry(rr *netquic.RelayRegistry) *Builder {
 }
 
 // RouteTable 手工指定路由表（可选）。
-// 如果不指定，可以后续再给 Router.RouteTable 赋值。
+// 如果不指定，Build() 会内部创建一张新的 RouteTable。
+// 不管哪种情况，Build() 都会 BindSelf，DHT 用的就是这张表里的 Kademlia 表。
 func (b *Builder) RouteTable(rt *router.RouteTable) *Builder {
 	b.routeTable = rt
 	return b
@@ -153,16 +410,99 @@ func (b *Builder) Strategy(strat strategy.EnvelopeStrategy) *Builder {
 	return b
 }
 
+// RoutePolicy 设置多条候选路由之间的选择策略（可选）。
+// 如果不指定，保持 RouteTable 自己的设置（默认 router.PolicyFailover）。
+func (b *Builder) RoutePolicy(p router.SelectPolicy) *Builder {
+	b.policy = &p
+	return b
+}
+
+// RecordStore 手工指定 DHT 的记录存储（可选）。
+// 如果不指定，DHT 使用进程内的 MemoryStore；需要重启后保留记录时可以传 dht.NewFileStore(dir)。
+func (b *Builder) RecordStore(s dht.RecordStore) *Builder {
+	b.records = s
+	return b
+}
+
+// Mailbox 开启邮箱（可选）：发给已注册但暂时连不上的节点的信封先存进 s，
+// 对方重新 REGISTER 时再投递。s 为 nil 时用 mailbox.NewMemoryStore()，
+// 需要重启后保留时可以传 mailbox.NewFileStore(dir)。
+// 配额 / 有效期可以在 Build 之后通过 h.Mailbox 调整。
+func (b *Builder) Mailbox(s mailbox.Store) *Builder {
+	if s == nil {
+		s = mailbox.NewMemoryStore()
+	}
+	b.mailbox = s
+	return b
+}
+
+// Transport 指定监听 / 拨号用的传输层（可选），Node 和 PeerManager 共用这一个实例。
+// 如果不指定，Build() 会创建一个 netquic.QUICTransport。
+// 测试时可以传 transport.MemNetwork 的 Transport，多个 Host 在一个进程里跑，不占端口：
+//
+//	mn := transport.NewMemNetwork(1)
+//	a, _ := host.NewBuilder().Name("A").Listen("a").Transport(mn.Transport()).Build()
+func (b *Builder) Transport(t transport.Transport) *Builder {
+	b.transport = t
+	return b
+}
+
+// OrderedStreams 让发给同一个节点的消息按顺序到达（可选）：
+// 帧写进每条连接上长期复用的流（控制信封一条、业务信封一条，见 netquic.PeerManager.Streams），
+// 收到的业务信封按到达顺序处理（netquic.Node.Ordered）。两端都要打开。
+// 不打开时一帧一个单向流，消息之间不保证顺序。
+func (b *Builder) OrderedStreams() *Builder {
+	b.ordered = true
+	return b
+}
+
+// Clock 指定时钟和随机数来源（可选）：RPC、可靠发送、DHT、PubSub、邮箱里的超时 / 过期时间
+// 和随机 ID，路由表的断路冷却和加权随机选路都从这里取。不指定时用系统时钟和 crypto/rand；
+// sim 传虚拟时钟和由种子派生的随机数（r 要能并发读），同一个种子跑出同样的结果。
+func (b *Builder) Clock(c clock.Clock, r io.Reader) *Builder {
+	b.clock = c
+	b.rand = r
+	return b
+}
+
+// Relay 开启 circuit relay 服务（可选）：接受别人的预约，只替有 circuit 的节点转发，
+// 每条 circuit 受 l 的时长 / 流量 / 速率限制，每个节点的 circuit 数也有上限（字段为 0 用默认值）。
+//
+// Relay 和 NoRelay 都不调用时保持原来的行为：不接受预约，什么信封都转发。
+func (b *Builder) Relay(l relay.Limits) *Builder {
+	b.relay = &l
+	b.noRelay = false
+	return b
+}
+
+// NoRelay 不替别人转发任何信封（只收发自己的），也不接受预约。
+func (b *Builder) NoRelay() *Builder {
+	b.relay = nil
+	b.noRelay = true
+	return b
+}
+
 // Build 根据当前 Builder 配置，构建一个 Host 实例。
 //
 // 会自动做的事情：
 //   - 如果 Key 没指定：生成一把新的 KeyPair
 //   - 如果 Registry 没指定：创建新的 RelayRegistry，并注册自己的静态地址
-//   - 创建 PeerManager（使用 Registry.Resolver）
-//   - 创建 Router，并设置：SelfID / RouteTable / NextHop / Send
-//   - 创建 Node，并设置：Name / Key / Router / PeerMgr / Registry / OnRegisterPeer / OnEnvelope
+//   - 如果 Transport 没指定：创建 QUICTransport
+//   - 创建 PeerManager（使用 Registry.Resolver 和上面的 Transport）；
+//     OrderedStreams 时打开 PeerManager.Streams / Node.Ordered
+//   - 如果 RouteTable 没指定：创建一张新的；并 BindSelf(selfID)
+//   - 创建 Router，并设置：SelfID / RouteTable / Send / Fallback
+//     （不设 NextHop：Router 默认查 RouteTable，直连 → via → Kademlia 最近邻）
+//   - 创建 Node，并设置：Name / Key / Router / PeerMgr / Registry / Transport / OnRegisterPeer / OnEnvelope
 //   - 如果 Strategy 没指定：用 SimpleStrategy{Key:nil, DefaultTTL:5}
 //   - 创建 Socket，并接管 Router.OnPayload
+//   - 开启了 Mailbox 时：发给离线节点的信封存进邮箱，对方 REGISTER 时投递
+//   - 创建 Tracer / Acker（traceroute、可靠发送）
+//   - 创建 RPC Endpoint + DHT：FlagRPC 信封先交给 RPC，其余交给 Socket；
+//     Registry / Router 查不到的 PeerID 再去 DHT 里找
+//   - 创建 PubSub，挂在同一个 RPC Endpoint 上
+//   - 创建 Relay：开启了 Relay 时挂上 relay 服务并接管 Router.Admit；NoRelay 时什么都不转发
+//   - 指定了 Clock 时：RPC / Acker / DHT（连同 Kademlia 表）/ PubSub / 邮箱都用它的时钟和随机数
 func (b *Builder) Build() (*Host, error) {
 	// 1）校验必要参数
 	if b.listenAddr == "" {
@@ -187,53 +527,108 @@ func (b *Builder) Build() (*Host, error) {
 	if reg == nil {
 		reg = netquic.NewRelayRegistry()
 	}
-	// 确保自己的地址在 Registry 里有一条静态映射
-	reg.RegisterStatic(selfID, b.listenAddr)
+	// 确保自己的地址在 Registry 里有静态映射（"0.0.0.0:port" 展开成网卡地址）
+	for _, addr := range identify.ExpandAddrs(b.listenAddr) {
+		reg.RegisterStatic(selfID, addr)
+	}
 
-	// 4）创建 PeerManager，使用 Registry.Resolver 作为寻址函数
-	pm := netquic.NewPeerManager(reg.Resolver)
+	// 4）创建 PeerManager，使用 Registry.Resolver 作为寻址函数；
+	//    传输层没指定就用 QUIC，Node 监听也用同一个
+	tr := b.transport
+	if tr == nil {
+		tr = netquic.NewQUICTransport()
+	}
+	pm := netquic.NewPeerManagerWithTransport(reg.Resolver, tr)
+	pm.Streams = b.ordered
+
+	// 5）准备 RouteTable，并创建 Router
+	rt := b.routeTable
+	if rt == nil {
+		rt = router.NewRouteTable()
+	}
+	rt.BindSelf(selfID)
+	rt.Clock, rt.Rand = b.clock, b.rand
+	if b.policy != nil {
+		rt.Policy = *b.policy
+	}
 
-	// 5）创建 Router，并注入 SelfID 和 RouteTable
 	r := &router.Router{
 		SelfID:     selfID,
-		RouteTable: b.routeTable, // 可以为 nil
+		Key:        kp,
+		RouteTable: rt,
+		Clock:      b.clock,
 	}
 
-	// NextHop：默认简化为“直连路由”（后续可结合 RouteTable 做 Kademlia）
-	r.NextHop = func(dest peer.PeerID) (peer.PeerID, bool) {
-		// 最简单：每个目标都视为“可直连”
-		return dest, true
+	var mb *mailbox.Mailbox
+	if b.mailbox != nil {
+		mb = mailbox.New(b.mailbox)
+		mb.Clock, mb.Rand = b.clock, b.rand
 	}
 
 	// Send：交给 PeerManager.SendToPeer
+	// 开启了邮箱时：下一跳就是最终目标、而且是认识的节点，却发不过去 → 先存起来
 	r.Send = func(nextHop peer.PeerID, env *envelop.Envelope) {
-		if err := pm.SendToPeer(nextHop, env); err != nil {
-			log.Printf("[Router] SendToPeer error: %v", err)
+		err := pm.SendToPeer(nextHop, env)
+		if err == nil {
+			return
+		}
+		if mb != nil && nextHop.Equals(env.DestPeerID) && !router.IsControl(env) && reg.Registered(nextHop) {
+			herr := mb.Hold(env)
+			if herr == nil {
+				log.Printf("[Router] %s 不在线，信封已存入邮箱", peer.PeerIDToDomain(nextHop))
+				if r.Acker != nil {
+					r.Acker.Settle(env) // 已经替它收下了，这一跳不用再重发
+				}
+				return
+			}
+			log.Printf("[Router] Mailbox.Hold error: %v", herr)
 		}
+		log.Printf("[Router] SendToPeer error: %v", err)
 	}
 
 	// OnRegister：当收到 REGISTER Envelope 时，透传给 Registry 做动态注册
 	r.OnRegister = func(id peer.PeerID) {
 		// 注意：真正的 addr 信息由 Node.OnRegisterPeer 负责调用 RegisterPeer，
-		// 这里只是保留扩展点；当前实现中 Node.handleStream 已经提供了 OnRegisterPeer 回调。
+		// 这里只是保留扩展点；当前实现中 Node.handleEnvelope 已经提供了 OnRegisterPeer 回调。
 		log.Printf("[Router] OnRegister from %s", peer.PeerIDToDomain(id))
 	}
 
 	// 6）创建 Node：绑定 Router / PeerManager / Registry
 	node := &netquic.Node{
-		Name:     b.name,
-		Key:      kp,
-		Router:   r,
-		PeerMgr:  pm,
-		Registry: reg,
+		Name:      b.name,
+		Key:       kp,
+		Router:    r,
+		PeerMgr:   pm,
+		Registry:  reg,
+		Transport: tr,
+		Ordered:   b.ordered,
+		// 拨出去的连接由 identify 先发 REGISTER，对方回的 REGISTER 确认接通的是谁；
+		// 地址可能是 DHT 里别人转述的，等不到确认就断开
+		ConfirmTimeout: netquic.DefaultConfirmTimeout,
 	}
 
-	// Node.OnRegisterPeer：当远端发来 REGISTER 信封时，把 (PeerID, addr) 注册到 Registry
-	node.OnRegisterPeer = func(id peer.PeerID, addr string) {
-		reg.RegisterPeer(id, addr)
+	// Node.OnRegisterPeer：当远端发来 REGISTER 信封（签名验过）时，把 (PeerID, addr) 注册到 Registry
+	// 开启了邮箱的，顺便把替它暂存的信封发过去：只从它证明了身份的这条连接发，
+	// 不交给 SendToPeer（池子里 id 的连接可能是拨到某个没验证过的地址上的）
+	node.OnRegisterPeer = func(id peer.PeerID, conn transport.Conn) {
+		reg.RegisterPeer(id, conn.RemoteAddr())
+		if mb == nil {
+			return
+		}
+		go func() {
+			n, err := mb.Flush(id, func(env *envelop.Envelope) error {
+				return pm.SendOnConn(conn, env)
+			})
+			if n > 0 || err != nil {
+				log.Printf("[Mailbox] 投递给 %s：%d 封，err=%v", peer.PeerIDToDomain(id), n, err)
+			}
+		}()
 	}
 
-	// Node.OnEnvelope：可选调试回调，这里简单打印一行日志
+	// Node.OnEnvelope：路由学习
+	//   from = 直接把信封交给我的那个节点（Registry 反查得到，查不到为零值）
+	//   - from 本身可以直连
+	//   - 想回到 env.ReturnPeerID，先交给 from（ReturnPeerID == from 时就是直连）
 	node.OnEnvelope = func(from peer.PeerID, env *envelop.Envelope) {
 		log.Printf("[Node %s] OnEnvelope from %s → Dest=%s TTL=%d",
 			b.name,
@@ -241,6 +636,13 @@ func (b *Builder) Build() (*Host, error) {
 			peer.PeerIDToDomain(env.DestPeerID),
 			env.TTL,
 		)
+		if from.IsZero() {
+			return
+		}
+		rt.LearnDirect(from)
+		if !env.ReturnPeerID.IsZero() && !env.ReturnPeerID.Equals(selfID) {
+			rt.LearnVia(env.ReturnPeerID, from)
+		}
 	}
 
 	// 7）准备 Strategy：如果用户没传，就用默认 SimpleStrategy
@@ -256,8 +658,175 @@ func (b *Builder) Build() (*Host, error) {
 	sender := &socket.RouterEnvelopeSender{R: r}
 	sock := socket.NewSocket(selfID, strat, sender, r)
 
-	// 9）把所有东西装进 Host
-	h := &Host{
+	// 9）RPC + DHT：
+	//    - RPC 信封走和 Socket 一样的 Router 发送路径
+	//    - Router.OnPayload 先给 RPC，不是 RPC 的再交给 Socket
+	ep := rpc.NewEndpoint(kp, sender.SendEnvelope)
+	ep.SetClock(b.clock, b.rand)
+	// DHT PING 丢了只是超时，走 datagram
+	ep.Datagram = func(method string) bool {
+		return method == dht.MethodPing
+	}
+
+	sockOnPayload := r.OnPayload
+	r.OnPayload = func(env *envelop.Envelope) {
+		if ep.HandleEnvelope(env) {
+			return
+		}
+		sockOnPayload(env)
+	}
+
+	// Identify：和连上的节点交换地址，别人看到的我的地址被足够多节点确认后对外公布
+	//   - 本地地址 = 实际监听地址展开成网卡地址（"0.0.0.0:9000" 对别人没用）
+	//   - 别人看到的我的地址 = 它那条连接的对端地址
+	//   - 对方报来的地址写进 Registry；自己的地址变了就更新 Registry，加入 DHT 之后重新发布
+	listenAddr := b.listenAddr
+	idn := identify.New(selfID, ep.Call)
+	idn.ListenAddrs = func() []string {
+		addr := node.ListenAddr()
+		if addr == "" {
+			addr = listenAddr
+		}
+		return identify.ExpandAddrs(addr)
+	}
+	idn.Observed = pm.ConnAddr
+
+	// Relay：对外公布的地址 = Identify 的地址 + 中继地址。
+	// 别人公布的中继地址拨不了，学到时记成“经 relay 可达”，只把其余的地址交给 Registry
+	rl := relay.New(selfID, ep.Call)
+	advertised := func() []string {
+		return append(idn.Addrs(), rl.Addrs()...)
+	}
+	dialable := func(id peer.PeerID, addrs []string) []string {
+		var out []string
+		for _, addr := range addrs {
+			via, ok := relay.ParseAddr(addr)
+			if !ok {
+				out = append(out, addr)
+				continue
+			}
+			if via != selfID && via != id {
+				rt.LearnVia(id, via)
+			}
+		}
+		return out
+	}
+	switch {
+	case b.relay != nil:
+		rl.Limits = *b.relay
+		rl.Mount(ep.Server)
+		r.Admit = rl.Admit
+	case b.noRelay:
+		r.Admit = relay.Deny
+	}
+
+	// 对方自己报的地址只进正向表：反向表（地址 → 谁）只认签名 REGISTER 来的那条连接
+	idn.OnPeerAddrs = func(id peer.PeerID, addrs []string) {
+		reg.AddAddrs(id, dialable(id, addrs))
+	}
+
+	kt := rt.Kademlia()
+	kt.Clock, kt.Rand = b.clock, b.rand
+	d := dht.New(selfID, kt, ep.Call)
+	d.Clock = b.clock
+	d.SelfAddrs = advertised
+	// DHT 学到的地址（节点本人报的 / 种子）只进正向表，不改反向表
+	d.OnContact = func(c dht.Contact) {
+		reg.AddAddrs(c.ID, dialable(c.ID, c.Addrs))
+	}
+	if b.records != nil {
+		d.Store = b.records
+	}
+	d.Mount(ep.Server)
+
+	// PubSub：邻居 = 路由表（Kademlia 表）里的所有节点
+	ps := pubsub.New(kp, ep.Notify, func() []peer.PeerID {
+		return kt.FindClosest(selfID, kt.Size())
+	})
+	ps.Clock, ps.Rand = b.clock, b.rand
+	ps.Mount(ep.Server)
+
+	// 自己的地址变了（观察地址确认 / 中继预约成功或过期）：加入 DHT 之后重新发布
+	publish := func() {
+		if kt.Size() == 0 {
+			return // 还没加入 DHT，Bootstrap 时会发布
+		}
+		addrs := advertised()
+		go func() {
+			if err := d.PublishAddrs(kp, addrs); err != nil {
+				log.Printf("[Host] PublishAddrs error: %v", err)
+			}
+		}()
+	}
+	idn.OnAddrsChanged = func(addrs []string) {
+		for _, addr := range addrs {
+			reg.RegisterPeer(selfID, addr)
+		}
+		publish()
+	}
+	idn.Mount(ep.Server)
+	rl.OnAddrsChanged = func([]string) { publish() }
+
+	// 拨出去的连接也交给 Node 收帧：对端（比如 relay）从同一条连接回发，
+	// 我们在 NAT 后面时这是唯一能收到回包的路。
+	// 然后和对方 Identify 一次（先 REGISTER，让它认出这条连接，它才说得出看到的我是什么地址）
+	var h *Host
+	pm.OnDial = func(id peer.PeerID, conn transport.Conn) {
+		node.ServeConn(id, conn)
+		go h.identify(id)
+	}
+
+	// 打洞：
+	//   - 候选地址 = relay 看到的公网地址 + 对外公布的地址（Identify）
+	//   - relay 看到的 id 的地址 = id 那条连接的对端地址（REGISTER 之后就是它拨进来的那条）
+	//   - 拨号走 Node.Connect：从监听 socket 拨出去，确认接通的就是对方之后连接留在池子里
+	pu := punch.New(selfID, ep.Call)
+	pu.ListenAddrs = idn.Addrs
+	pu.Observed = func(id peer.PeerID) []string {
+		if a, ok := pm.ConnAddr(id); ok {
+			return []string{a}
+		}
+		return nil
+	}
+	pu.Dial = node.Connect
+	pu.OnDirect = func(id peer.PeerID, addr string) {
+		reg.RegisterPeer(id, addr)
+		rt.LearnDirect(id)
+	}
+	pu.Mount(ep.Server)
+
+	// PeerManager 的发送结果反馈给：
+	//   - RouteTable：链路 RTT / 丢包统计，影响多路径选路
+	//   - Kademlia 表：连续失败的节点会被移出、由候补顶上
+	pm.OnSendResult = func(id peer.PeerID, res netquic.SendResult) {
+		rt.ReportSend(id, res.RTT, res.Err)
+		if res.Err != nil {
+			kt.RecordFailure(id)
+			return
+		}
+		kt.RecordSuccess(id)
+	}
+
+	// 本地查不到的 PeerID：去 DHT 找（中继地址顺手记成路由）
+	reg.Fallback = func(id peer.PeerID) []string {
+		return dialable(id, d.ResolveAddrs(id))
+	}
+
+	// RouteTable 里没有路由时：Registry（含 DHT 地址簿）能查到地址的，就当作直连；
+	// 只查到中继地址的，Fallback 已经把“经 relay 可达”记进路由表了。
+	// Router 只在本节点自己发信封时调用它（转发别人的不查 DHT），查不到的目标一段时间内不再查。
+	r.Fallback = func(dest peer.PeerID) (peer.PeerID, bool) {
+		if len(reg.Resolver(dest)) > 0 {
+			return dest, true
+		}
+		return rt.LookupLearned(dest)
+	}
+
+	acker := router.NewAcker(r)
+	acker.Clock, acker.Rand = b.clock, b.rand
+
+	// 10）把所有东西装进 Host
+	h = &Host{
 		id:       selfID,
 		name:     b.name,
 		addr:     b.listenAddr,
@@ -267,6 +836,16 @@ func (b *Builder) Build() (*Host, error) {
 		Node:     node,
 		Strategy: strat,
 		Socket:   sock,
+		RPC:      ep,
+		DHT:      d,
+		Tracer:   router.NewTracer(r),
+		Acker:    acker,
+		Mailbox:  mb,
+		Punch:    pu,
+		Identify: idn,
+		Relay:    rl,
+		pubsub:   ps,
+		clock:    b.clock,
 	}
 
 	return h, nil
@@ -0,0 +1,430 @@
+// Package identify 让节点互相告诉对方“我看到的你的地址”，据此推断自己的公网地址。
+package identify
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"envelop/peer"
+	"envelop/rpc"
+)
+
+/*
+==========================================================
+ Identify：观察地址交换（类似 STUN）
+==========================================================
+
+节点自己只知道监听地址，往往是 "0.0.0.0:9000" 这种对别人没用的地址；
+在 NAT 后面时，别人看到的更是 NAT 映射出来的另一个地址。
+
+  Identify   A → B：“这是我的地址”
+             B 回复：“我看到你是 X，这是我的地址”
+             双方都把对方报来的地址交给 OnPeerAddrs（一般写进 Registry）
+
+观察地址的可信度：
+  - 一个地址被多少个不同网段的观察者看到（ObservationTTL 之内），就是它的可信度。
+    观察者按“我们看到的它的网络地址”分组：IPv4 同一个 /24、IPv6 同一个 /48 算一个，
+    不按 PeerID 算——PeerID 随便生成，一台机器开一堆身份不能凑出可信度
+  - 可信度 >= MinConfidence 的才算“确认”，放进 Addrs() 对外公布
+    （一个节点说的不算数：它可能撒谎，也可能只是和我们在同一个内网里）
+  - Addrs() 变化时调用 OnAddrsChanged（一般是更新 Registry、重新发布到 DHT）
+  - 最多跟踪 maxObservations 个地址（地址是对方随便报的），满了丢掉可信度最低的
+
+Addrs() = 确认的观察地址（可信度从高到低） + 本地监听地址（ExpandAddrs 展开之后）
+==========================================================
+*/
+
+// 协议方法名
+const MethodIdentify = "identify.Identify"
+
+// 默认参数
+const (
+	DefaultMinConfidence  = 2
+	DefaultObservationTTL = 30 * time.Minute
+	DefaultExpireInterval = 5 * time.Minute
+	defaultRPCTimeout     = 5 * time.Second
+
+	maxObservations = 64 // 最多跟踪多少个观察地址
+)
+
+// identifyRequest / identifyResponse 是 Identify 的参数和返回值
+type identifyRequest struct {
+	Addrs []string `json:"a,omitempty"`
+}
+
+type identifyResponse struct {
+	Observed string   `json:"o,omitempty"`
+	Addrs    []string `json:"a,omitempty"`
+}
+
+// Observation 是一个观察到的地址和它的可信度
+type Observation struct {
+	Addr       string
+	Confidence int // 观察到它的不同网段数
+}
+
+// Service 负责 Identify 协议的两端，以及观察地址的打分
+type Service struct {
+	self peer.PeerID
+	call rpc.PeerCallFunc
+
+	// MinConfidence：观察地址至少被几个节点看到才对外公布（0 → DefaultMinConfidence）
+	MinConfidence int
+	// ObservationTTL：一次观察多久之后不再算数（0 → DefaultObservationTTL）
+	ObservationTTL time.Duration
+	// RPCTimeout：单次 Identify 调用的超时（0 → 5s）
+	RPCTimeout time.Duration
+
+	// ListenAddrs：本地监听地址（一般已经 ExpandAddrs 过）
+	ListenAddrs func() []string
+
+	// Observed：我看到的 id 的地址（一般是 id 那条连接的对端地址，PeerManager.ConnAddr）
+	Observed func(id peer.PeerID) (string, bool)
+
+	// OnPeerAddrs（可选）：对方（签名验证过）报来了它的地址
+	OnPeerAddrs func(id peer.PeerID, addrs []string)
+
+	// OnAddrsChanged（可选）：Addrs() 变了，参数是新的地址列表。在锁外调用。
+	OnAddrsChanged func(addrs []string)
+
+	mu           sync.Mutex
+	observations map[string]map[string]time.Time // 地址 → 观察者网段 → 最近一次观察时间
+	confirmed    []string                        // 上次算出来的确认地址
+}
+
+// New 创建一个 Identify 服务
+//   - self：本节点 PeerID
+//   - call：远程调用函数（一般是 rpc.Endpoint.Call）
+func New(self peer.PeerID, call rpc.PeerCallFunc) *Service {
+	return &Service{
+		self:           self,
+		call:           call,
+		MinConfidence:  DefaultMinConfidence,
+		ObservationTTL: DefaultObservationTTL,
+		RPCTimeout:     defaultRPCTimeout,
+		observations:   make(map[string]map[string]time.Time),
+	}
+}
+
+func (s *Service) minConfidence() int {
+	if s.MinConfidence > 0 {
+		return s.MinConfidence
+	}
+	return DefaultMinConfidence
+}
+
+func (s *Service) observationTTL() time.Duration {
+	if s.ObservationTTL > 0 {
+		return s.ObservationTTL
+	}
+	return DefaultObservationTTL
+}
+
+func (s *Service) rpcTimeout() time.Duration {
+	if s.RPCTimeout > 0 {
+		return s.RPCTimeout
+	}
+	return defaultRPCTimeout
+}
+
+// Mount 把 Identify 挂到 RPC Server 上
+func (s *Service) Mount(srv *rpc.Server) {
+	srv.RegisterWithCaller(rpc.MethodInfo{
+		Name:        MethodIdentify,
+		Version:     "1",
+		Description: "identify: exchange addresses and report the caller's observed address",
+	}, s.handleIdentify)
+}
+
+// Identify 和 id 交换地址：记下它看到的我的地址（返回值），把它报来的地址交给 OnPeerAddrs。
+// 对方还没认出我们的连接时看不到地址，返回 ""。
+// 观察算在“我们看到的 id 的地址”（Observed）所在的网段上，看不到 id 的地址时不计入可信度。
+func (s *Service) Identify(id peer.PeerID) (string, error) {
+	req, _ := json.Marshal(identifyRequest{Addrs: s.Addrs()})
+	resp, err := s.call(id, MethodIdentify, req, s.rpcTimeout())
+	if err != nil {
+		return "", err
+	}
+	var out identifyResponse
+	if err := json.Unmarshal(resp.Data, &out); err != nil {
+		return "", rpc.Errorf(rpc.CodeInternal, "bad identify response: %v", err)
+	}
+	if len(out.Addrs) > 0 && s.OnPeerAddrs != nil {
+		s.OnPeerAddrs(id, out.Addrs)
+	}
+	if out.Observed != "" && s.Observed != nil {
+		if from, ok := s.Observed(id); ok {
+			s.Record(out.Observed, from)
+		}
+	}
+	return out.Observed, nil
+}
+
+func (s *Service) handleIdentify(caller rpc.CallerInfo, data []byte) ([]byte, error) {
+	if !caller.Verified {
+		return nil, rpc.Errorf(rpc.CodeUnauthenticated, "identify requires a signed request")
+	}
+	var req identifyRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, rpc.Errorf(rpc.CodeInvalidArgument, "bad identify: %v", err)
+	}
+	if len(req.Addrs) > 0 && s.OnPeerAddrs != nil {
+		s.OnPeerAddrs(caller.ID, req.Addrs)
+	}
+
+	resp := identifyResponse{Addrs: s.Addrs()}
+	if s.Observed != nil {
+		resp.Observed, _ = s.Observed(caller.ID)
+	}
+	return json.Marshal(resp)
+}
+
+/*
+==========================================================
+ 观察地址打分
+==========================================================
+*/
+
+// Record 记下网络地址为 observer 的观察者看到的我的地址 addr
+func (s *Service) Record(addr, observer string) {
+	if addr == "" || observer == "" {
+		return
+	}
+	s.mu.Lock()
+	byNet := s.observations[addr]
+	if byNet == nil {
+		if len(s.observations) >= maxObservations {
+			s.dropWeakestLocked()
+		}
+		byNet = make(map[string]time.Time)
+		s.observations[addr] = byNet
+	}
+	byNet[observerNet(observer)] = time.Now()
+	changed, addrs := s.recomputeLocked()
+	s.mu.Unlock()
+
+	if changed {
+		log.Printf("[Identify] 观察地址确认：%v", addrs)
+		s.notify()
+	}
+}
+
+// dropWeakestLocked 丢掉可信度最低的观察地址（一样低的丢最久没被看到的）
+func (s *Service) dropWeakestLocked() {
+	cutoff := time.Now().Add(-s.observationTTL())
+	var weakest string
+	var weakestN int
+	var weakestAt time.Time
+	found := false
+	for addr, byNet := range s.observations {
+		n := 0
+		var latest time.Time
+		for _, at := range byNet {
+			if !at.Before(cutoff) {
+				n++
+			}
+			if at.After(latest) {
+				latest = at
+			}
+		}
+		if !found || n < weakestN || (n == weakestN && latest.Before(weakestAt)) {
+			weakest, weakestN, weakestAt, found = addr, n, latest, true
+		}
+	}
+	if found {
+		delete(s.observations, weakest)
+	}
+}
+
+// Expire 丢掉超过 ObservationTTL 的观察
+func (s *Service) Expire() {
+	cutoff := time.Now().Add(-s.observationTTL())
+	s.mu.Lock()
+	for addr, byNet := range s.observations {
+		for prefix, at := range byNet {
+			if at.Before(cutoff) {
+				delete(byNet, prefix)
+			}
+		}
+		if len(byNet) == 0 {
+			delete(s.observations, addr)
+		}
+	}
+	changed, _ := s.recomputeLocked()
+	s.mu.Unlock()
+
+	if changed {
+		s.notify()
+	}
+}
+
+// Start 在后台每 interval 跑一次 Expire（interval <= 0 → DefaultExpireInterval），ctx 结束时退出
+func (s *Service) Start(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultExpireInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.Expire()
+			}
+		}
+	}()
+}
+
+// Observations 返回所有还有效的观察地址和可信度（可信度从高到低）
+func (s *Service) Observations() []Observation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.observationsLocked()
+}
+
+func (s *Service) observationsLocked() []Observation {
+	cutoff := time.Now().Add(-s.observationTTL())
+	var out []Observation
+	for addr, byNet := range s.observations {
+		n := 0
+		for _, at := range byNet {
+			if !at.Before(cutoff) {
+				n++
+			}
+		}
+		if n > 0 {
+			out = append(out, Observation{Addr: addr, Confidence: n})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Confidence != out[j].Confidence {
+			return out[i].Confidence > out[j].Confidence
+		}
+		return out[i].Addr < out[j].Addr
+	})
+	return out
+}
+
+// observerNet 把观察者的网络地址归到网段：IPv4 取 /24，IPv6 取 /48；
+// 不是 IP 的地址（比如模拟网络里的节点名）原样返回
+func observerNet(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
+
+// recomputeLocked 重新算确认地址，返回是否有变化
+func (s *Service) recomputeLocked() (bool, []string) {
+	var confirmed []string
+	for _, o := range s.observationsLocked() {
+		if o.Confidence >= s.minConfidence() {
+			confirmed = append(confirmed, o.Addr)
+		}
+	}
+	changed := len(confirmed) != len(s.confirmed)
+	for i := 0; !changed && i < len(confirmed); i++ {
+		changed = confirmed[i] != s.confirmed[i]
+	}
+	s.confirmed = confirmed
+	return changed, confirmed
+}
+
+func (s *Service) notify() {
+	if s.OnAddrsChanged != nil {
+		s.OnAddrsChanged(s.Addrs())
+	}
+}
+
+// Addrs 返回本节点对外公布的地址：确认的观察地址在前，本地监听地址在后
+func (s *Service) Addrs() []string {
+	s.mu.Lock()
+	out := append([]string(nil), s.confirmed...)
+	s.mu.Unlock()
+
+	if s.ListenAddrs != nil {
+		for _, a := range s.ListenAddrs() {
+			dup := false
+			for _, o := range out {
+				if o == a {
+					dup = true
+					break
+				}
+			}
+			if !dup {
+				out = append(out, a)
+			}
+		}
+	}
+	return out
+}
+
+/*
+==========================================================
+ 展开监听地址
+==========================================================
+*/
+
+// ExpandAddrs 把未指定主机的监听地址展开成本机各网卡的地址：
+//
+//	"0.0.0.0:9000" → ["192.168.1.5:9000", "127.0.0.1:9000"]
+//	"[::]:9000"    → IPv4 + IPv6 网卡地址（双栈）
+//
+// 链路本地地址不要（别人拨不通），回环地址放最后。
+// 主机已经指定、或者根本不是 IP 地址的（例如内存网络的 "alice:1"）原样返回。
+func ExpandAddrs(addr string) []string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return []string{addr}
+	}
+	ip := net.ParseIP(host)
+	if host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return []string{addr}
+	}
+	v4only := ip != nil && ip.To4() != nil
+
+	ifAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return []string{addr}
+	}
+	var out, loopback []string
+	for _, a := range ifAddrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipnet.IP
+		if ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+			continue
+		}
+		if v4only && ip.To4() == nil {
+			continue
+		}
+		hp := net.JoinHostPort(ip.String(), port)
+		if ip.IsLoopback() {
+			loopback = append(loopback, hp)
+		} else {
+			out = append(out, hp)
+		}
+	}
+	out = append(out, loopback...)
+	if len(out) == 0 {
+		return []string{addr}
+	}
+	return out
+}
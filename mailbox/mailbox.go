@@ -0,0 +1,258 @@
+package mailbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"envelop/clock"
+	"envelop/envelop"
+	"envelop/peer"
+)
+
+/*
+==========================================================
+ Mailbox：给离线节点暂存信封（store-and-forward）
+==========================================================
+
+目标节点离线时，PeerManager.SendToPeer 会失败，信封就丢了。
+开启邮箱的中继会把“发给已注册但暂时连不上的节点”的信封先存起来：
+
+  转发失败，且下一跳就是最终目标   → Hold(env)
+      - 每个目标最多 MaxPerPeer 封、MaxBytesPerPeer 字节，超出直接拒绝（ErrMailboxFull）
+      - 每封信 TTL 之后过期，过期的不再投递
+  目标重新发来 REGISTER             → Flush(dest, send)
+      - 只认签名验过的 REGISTER（envelop.VerifyRegister），冒充 dest 的拿不到它的信
+      - send 只从 dest 证明了身份的那条连接发（见 host 里的 Node.OnRegisterPeer）
+      - 按存入顺序（Message.Seq）逐封发送，发成功一封删一封
+      - 中途发送失败就停下，剩下的留着等下一次 REGISTER
+
+逐跳确认（ExtHopReq）只对“这一跳”有效，存进邮箱前去掉；
+端到端回执请求（ExtReceiptReq）原样保留，目标收到后照常给发送方回执。
+==========================================================
+*/
+
+const (
+	DefaultMaxPerPeer      = 256
+	DefaultMaxBytesPerPeer = 4 << 20
+	DefaultTTL             = 24 * time.Hour
+	DefaultExpireInterval  = 10 * time.Minute
+)
+
+// ErrMailboxFull：目标的邮箱已经满了（封数或字节数超出配额）
+var ErrMailboxFull = errors.New("mailbox: quota exceeded")
+
+// Mailbox 按配额和有效期管理一个 Store
+type Mailbox struct {
+	Store Store
+
+	MaxPerPeer      int           // 为 0 时用 DefaultMaxPerPeer
+	MaxBytesPerPeer int           // 为 0 时用 DefaultMaxBytesPerPeer
+	TTL             time.Duration // 为 0 时用 DefaultTTL
+
+	// Clock / Rand（可选）：过期时间和信件 ID 的来源，nil = 系统时钟 / crypto/rand；
+	// sim 里换成虚拟的
+	Clock clock.Clock
+	Rand  io.Reader
+
+	mu       sync.Mutex // 串行化同一个邮箱的“查配额 + 写入”
+	flushing map[peer.PeerID]bool
+	seq      uint64 // 最近一封信的存入序号
+}
+
+// New 创建一个 Mailbox；store 为 nil 时使用 MemoryStore
+func New(store Store) *Mailbox {
+	if store == nil {
+		store = NewMemoryStore()
+	}
+	return &Mailbox{
+		Store:    store,
+		flushing: make(map[peer.PeerID]bool),
+	}
+}
+
+func (m *Mailbox) maxPerPeer() int {
+	if m.MaxPerPeer > 0 {
+		return m.MaxPerPeer
+	}
+	return DefaultMaxPerPeer
+}
+
+func (m *Mailbox) maxBytesPerPeer() int {
+	if m.MaxBytesPerPeer > 0 {
+		return m.MaxBytesPerPeer
+	}
+	return DefaultMaxBytesPerPeer
+}
+
+func (m *Mailbox) ttl() time.Duration {
+	if m.TTL > 0 {
+		return m.TTL
+	}
+	return DefaultTTL
+}
+
+// Hold 把 env 存进 env.DestPeerID 的邮箱
+func (m *Mailbox) Hold(env *envelop.Envelope) error {
+	held := *env
+	held.Exts = append([]envelop.Ext(nil), env.Exts...)
+	held.DelExt(envelop.ExtHopReq)
+
+	b, err := envelop.Marshal(&held)
+	if err != nil {
+		return err
+	}
+	if len(b) > m.maxBytesPerPeer() {
+		return fmt.Errorf("%w: envelope of %d bytes", ErrMailboxFull, len(b))
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := clock.Or(m.Clock).Now()
+	msgs, err := m.live(held.DestPeerID, now)
+	if err != nil {
+		return err
+	}
+	size := len(b)
+	for _, msg := range msgs {
+		size += len(msg.Env)
+	}
+	if len(msgs) >= m.maxPerPeer() || size > m.maxBytesPerPeer() {
+		return fmt.Errorf("%w: %s has %d pending", ErrMailboxFull, peer.PeerIDToDomain(held.DestPeerID), len(msgs))
+	}
+
+	// 序号接着 Store 里已有的信往下排：换了 Mailbox（例如重启后重新打开 FileStore）也不会排到旧信前面
+	if n := len(msgs); n > 0 && msgs[n-1].Seq > m.seq {
+		m.seq = msgs[n-1].Seq
+	}
+	m.seq++
+
+	return m.Store.Put(&Message{
+		ID:      m.newID(),
+		Seq:     m.seq,
+		Dest:    held.DestPeerID,
+		Env:     b,
+		Stored:  now,
+		Expires: now.Add(m.ttl()),
+	})
+}
+
+// live 返回 dest 没过期的信，顺手删掉过期的（调用方持有 m.mu）
+func (m *Mailbox) live(dest peer.PeerID, now time.Time) ([]*Message, error) {
+	msgs, err := m.Store.List(dest)
+	if err != nil {
+		return nil, err
+	}
+	out := msgs[:0]
+	for _, msg := range msgs {
+		if msg.Expired(now) {
+			_ = m.Store.Delete(dest, msg.ID)
+			continue
+		}
+		out = append(out, msg)
+	}
+	return out, nil
+}
+
+// Pending 返回 dest 还有几封没投递的信
+func (m *Mailbox) Pending(dest peer.PeerID) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	msgs, _ := m.live(dest, clock.Or(m.Clock).Now())
+	return len(msgs)
+}
+
+// Flush 按存入顺序把 dest 的信逐封交给 send，成功一封删一封；
+// send 失败时停下并返回已投递的数量和错误。同一个 dest 同时只会有一个 Flush 在跑。
+func (m *Mailbox) Flush(dest peer.PeerID, send func(env *envelop.Envelope) error) (int, error) {
+	m.mu.Lock()
+	if m.flushing[dest] {
+		m.mu.Unlock()
+		return 0, nil
+	}
+	m.flushing[dest] = true
+	msgs, err := m.live(dest, clock.Or(m.Clock).Now())
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		delete(m.flushing, dest)
+		m.mu.Unlock()
+	}()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, msg := range msgs {
+		env, err := envelop.Unmarshal(msg.Env)
+		if err != nil {
+			_ = m.Store.Delete(dest, msg.ID) // 坏数据，留着也发不出去
+			continue
+		}
+		if err := send(env); err != nil {
+			return n, err
+		}
+		if err := m.Store.Delete(dest, msg.ID); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Expire 删掉所有过期的信，返回删了多少
+func (m *Mailbox) Expire() (int, error) {
+	dests, err := m.Store.Dests()
+	if err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := clock.Or(m.Clock).Now()
+	n := 0
+	for _, dest := range dests {
+		msgs, err := m.Store.List(dest)
+		if err != nil {
+			continue
+		}
+		for _, msg := range msgs {
+			if msg.Expired(now) {
+				if m.Store.Delete(dest, msg.ID) == nil {
+					n++
+				}
+			}
+		}
+	}
+	return n, nil
+}
+
+// Start 启动后台过期清理，ctx 取消时停止；interval<=0 时使用 DefaultExpireInterval
+func (m *Mailbox) Start(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultExpireInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				_, _ = m.Expire()
+			}
+		}
+	}()
+}
+
+// newID 生成一个随机的信件 ID
+func (m *Mailbox) newID() uint64 {
+	return clock.Uint64(m.Rand)
+}
@@ -0,0 +1,283 @@
+package mailbox
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"envelop/peer"
+)
+
+/*
+==========================================================
+ Store：邮箱的本地存储
+==========================================================
+
+Mailbox 只通过这个接口读写暂存的信封，不关心存在哪：
+
+  - MemoryStore：进程内 map，重启就没了（默认）
+  - FileStore：  一个目录，每封信一个 JSON 文件，重启后还在
+
+  目录结构：
+     <dir>/<hex(Dest)>/<存入序号(定长)>-<hex(ID)>.json
+
+存储层只负责“存 / 取 / 删”，不做任何判断：
+配额、过期、投递顺序都在 Mailbox 那一层（mailbox.go）。
+==========================================================
+*/
+
+// Message 是一封暂存的信封
+type Message struct {
+	ID      uint64
+	Seq     uint64 // 存入序号：同一个 Mailbox 里单调递增，决定投递顺序
+	Dest    peer.PeerID
+	Env     []byte // envelop.Marshal 之后的字节
+	Stored  time.Time
+	Expires time.Time
+}
+
+// Expired 判断这封信在 now 时是否已过期
+func (m *Message) Expired(now time.Time) bool {
+	return !now.Before(m.Expires)
+}
+
+// Store 是邮箱的本地存储
+type Store interface {
+	// Put 存一封信
+	Put(m *Message) error
+	// List 返回 dest 的所有信，按存入顺序（Seq）从旧到新（可能包含已过期的）
+	List(dest peer.PeerID) ([]*Message, error)
+	// Delete 删除 dest 的一封信，不存在时不报错
+	Delete(dest peer.PeerID, id uint64) error
+	// Dests 返回当前有信的所有 PeerID
+	Dests() ([]peer.PeerID, error)
+}
+
+// sortMessages 按存入序号排序（时间可能相同，ID 是随机的，都不能决定先后）；
+// 没有序号的旧信再按存入时间、ID
+func sortMessages(ms []*Message) {
+	sort.Slice(ms, func(i, j int) bool {
+		if ms[i].Seq != ms[j].Seq {
+			return ms[i].Seq < ms[j].Seq
+		}
+		if !ms[i].Stored.Equal(ms[j].Stored) {
+			return ms[i].Stored.Before(ms[j].Stored)
+		}
+		return ms[i].ID < ms[j].ID
+	})
+}
+
+/*
+==========================================================
+ MemoryStore
+==========================================================
+*/
+
+// MemoryStore 是进程内的 Store
+type MemoryStore struct {
+	mu   sync.RWMutex
+	msgs map[peer.PeerID]map[uint64]*Message // dest → id → message
+}
+
+// NewMemoryStore 创建一个空的 MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{msgs: make(map[peer.PeerID]map[uint64]*Message)}
+}
+
+func (s *MemoryStore) Put(m *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	box := s.msgs[m.Dest]
+	if box == nil {
+		box = make(map[uint64]*Message)
+		s.msgs[m.Dest] = box
+	}
+	box[m.ID] = m
+	return nil
+}
+
+func (s *MemoryStore) List(dest peer.PeerID) ([]*Message, error) {
+	s.mu.RLock()
+	var out []*Message
+	for _, m := range s.msgs[dest] {
+		out = append(out, m)
+	}
+	s.mu.RUnlock()
+	sortMessages(out)
+	return out, nil
+}
+
+func (s *MemoryStore) Delete(dest peer.PeerID, id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	box := s.msgs[dest]
+	delete(box, id)
+	if len(box) == 0 {
+		delete(s.msgs, dest)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Dests() ([]peer.PeerID, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]peer.PeerID, 0, len(s.msgs))
+	for id := range s.msgs {
+		out = append(out, id)
+	}
+	return out, nil
+}
+
+/*
+==========================================================
+ FileStore
+==========================================================
+*/
+
+// wireMessage 是 Message 在文件里的样子
+type wireMessage struct {
+	ID      uint64 `json:"i"`
+	Seq     uint64 `json:"q,omitempty"`
+	Env     []byte `json:"e"`
+	Stored  int64  `json:"s"` // unix 纳秒
+	Expires int64  `json:"x"` // unix 纳秒
+}
+
+// FileStore 是基于目录的 Store
+type FileStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewFileStore 打开（必要时创建）一个邮箱目录
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) destDir(dest peer.PeerID) string {
+	return filepath.Join(s.dir, hex.EncodeToString(dest[:]))
+}
+
+func (s *FileStore) path(m *Message) string {
+	return filepath.Join(s.destDir(m.Dest), fmt.Sprintf("%020d-%016x.json", m.Seq, m.ID))
+}
+
+func (s *FileStore) Put(m *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := json.Marshal(wireMessage{
+		ID:      m.ID,
+		Seq:     m.Seq,
+		Env:     m.Env,
+		Stored:  m.Stored.UnixNano(),
+		Expires: m.Expires.UnixNano(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.destDir(m.Dest), 0o700); err != nil {
+		return err
+	}
+	// 先写临时文件再 rename，避免写一半崩溃留下坏文件
+	path := s.path(m)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *FileStore) List(dest peer.PeerID) ([]*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := os.ReadDir(s.destDir(dest))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var out []*Message
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(s.destDir(dest), e.Name()))
+		if err != nil {
+			continue
+		}
+		var w wireMessage
+		if err := json.Unmarshal(b, &w); err != nil {
+			continue // 坏文件跳过，不影响其它信
+		}
+		out = append(out, &Message{
+			ID:      w.ID,
+			Seq:     w.Seq,
+			Dest:    dest,
+			Env:     w.Env,
+			Stored:  time.Unix(0, w.Stored),
+			Expires: time.Unix(0, w.Expires),
+		})
+	}
+	sortMessages(out)
+	return out, nil
+}
+
+func (s *FileStore) Delete(dest peer.PeerID, id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	suffix := fmt.Sprintf("-%016x.json", id)
+	entries, err := os.ReadDir(s.destDir(dest))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), suffix) {
+			if err := os.Remove(filepath.Join(s.destDir(dest), e.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	_ = os.Remove(s.destDir(dest)) // 目录空了顺手删掉（不空会失败，忽略）
+	return nil
+}
+
+func (s *FileStore) Dests() ([]peer.PeerID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var out []peer.PeerID
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		b, err := hex.DecodeString(e.Name())
+		if err != nil || len(b) != peer.PeerIDLength {
+			continue
+		}
+		var id peer.PeerID
+		copy(id[:], b)
+		out = append(out, id)
+	}
+	return out, nil
+}
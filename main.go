@@ -132,10 +132,20 @@ func main() {
 	/****************************************************
 	 * 5. 启动所有节点
 	 ****************************************************/
-	go relayNode.ListenAndServe("0.0.0.0:9401")
-	go bobNode.ListenAndServe("0.0.0.0:9402")
-	go aliceNode.ListenAndServe("0.0.0.0:9403")
-	time.Sleep(time.Second)
+	// Listen 返回时已经在监听了，后面可以直接发，不用 sleep 等
+	for _, n := range []struct {
+		node *netquic.Node
+		addr string
+	}{
+		{relayNode, "0.0.0.0:9401"},
+		{bobNode, "0.0.0.0:9402"},
+		{aliceNode, "0.0.0.0:9403"},
+	} {
+		if err := n.node.Listen(n.addr); err != nil {
+			log.Fatalf("[%s] Listen: %v", n.node.Name, err)
+		}
+		go n.node.Serve()
+	}
 
 	/****************************************************
 	 * 6. Alice → Onion RPC → Bob
@@ -11,14 +11,14 @@ import (
 	"envelop/frame"
 	"envelop/peer"
 	"envelop/router"
+	"envelop/transport"
+	"errors"
+	"fmt"
+	"sync"
 
-	"io"
 	"log"
 	"math/big"
-	"net"
 	"time"
-
-	quic "github.com/quic-go/quic-go"
 )
 
 /*
@@ -28,21 +28,29 @@ import (
 
 职责（只做“网络 → Envelope”这一半）：
 
-1. 启动 QUIC 监听（ListenAndServe）
-2. 接受新连接（handleConn）
-3. 在连接上接受「单向流」(AcceptUniStream)
-4. 从流里读出一整块 Frame 原始字节
+1. 启动监听（Listen / Serve，或者一步到位的 ListenAndServe；Start(ctx) 后台运行）
+2. 接受新连接（handleConn）；PeerManager 拨出去的连接也由 ServeConn 接过来收帧；
+   Connect 拨一个地址，确认接通的是谁之后才交给 PeerManager
+3. 在连接上逐帧接收（Conn.RecvFrame，QUIC 下一帧就是一个单向流）；
+   连接支持 datagram 的（transport.DatagramConn），另起一个循环收 datagram，之后的处理一样
+4. 拿到一整块 Frame 原始字节
 5. Frame.Decode → 拿到 Envelope 的二进制
 6. envelop.Unmarshal → 恢复 Envelope 结构
 7. 做一些通用控制逻辑：
-    - 如果是 REGISTER（Flags=1） → 调 OnRegisterPeer
-    - 如果需要做路由学习 → 调 OnEnvelope(from, env)
-8. 最后交给上层 Router.HandleEnvelope(env)
+    - 如果是 REGISTER（Flags=1） → 验过签名（envelop.VerifyRegister）后，
+      这条连接记为该节点的连接（PeerManager.AddConn），调 OnRegisterPeer；验不过的直接丢掉。
+      对方拨进来的连接上回一个自己的 REGISTER：拨号的一方只知道地址，靠它确认接通的是谁，
+      接通的不是拨的那个节点时，这条连接移出池子、关掉；
+      设置了 ConfirmTimeout 的，拨出去的连接到时候还没等到对方的 REGISTER 也一样处理
+    - 如果需要做路由学习 → 调 OnEnvelope(from, env)，from 就是这条连接属于的节点
+8. 最后交给上层 Router.HandleEnvelopeFrom(from, env)（from 同上，中继按它判断上一跳）
+9. Close：停止接收，等正在处理的帧处理完，再关掉所有连接
 
 注意：
 - Node 不关心业务（InnerPayload 是什么不管）
 - Node 不做 RPC，不做 JSON，只做 Envelope
 - 所有「我要把包发给谁」的问题交给 PeerManager
+- 底下用什么传输由 Transport 决定（默认 QUIC，测试可以换成 transport.MemNetwork）
 */
 
 type Node struct {
@@ -53,18 +61,70 @@ type Node struct {
 	PeerMgr  *PeerManager   // 主动发包：PeerID → QUIC Connection
 	Registry *RelayRegistry // 可选：用于 addr → PeerID 的反查（路由学习）
 
-	// 当收到 REGISTER 信封（Flags=1）时调用：
-	//   - id   = 对方的 PeerID（从 env.ReturnPeerID 里来）
-	//   - addr = conn.RemoteAddr().String() 看到的远端地址
-	OnRegisterPeer func(id peer.PeerID, addr string)
+	// Transport：监听 / 拨号用的传输层，为 nil 时第一次用到时创建 QUICTransport。
+	// 一般和 PeerMgr 用同一个实例。
+	Transport transport.Transport
+
+	// DrainTimeout：Close 时等待正在处理的帧的最长时间，0 用 DefaultDrainTimeout
+	DrainTimeout time.Duration
+
+	// ConfirmTimeout：>0 时，ServeConn 接过来的（拨出去的）连接要在这段时间里收到
+	// 拨的那个节点签名的 REGISTER，否则移出池子、关掉。
+	// 地址可能是别人转述的（DHT 查找），拨通了不代表接的就是它；
+	// 要求本端拨通后先发 REGISTER（Host 的 identify 就是这样），0 表示不检查。
+	ConfirmTimeout time.Duration
+
+	// Ordered：为 true 时业务信封按到达顺序逐个处理（不再每帧一个 goroutine）：
+	// 每条连接一个队列，由一个 worker 依次取出处理，读循环只管入队、不会被慢的 handler 卡住。
+	// 配合对端 PeerManager.Streams，同一个节点发来的消息按发送顺序交给 Router。
+	// 队列满了（OrderedQueue）新来的丢掉。
+	// RPC / 控制信封仍然并发处理：RPC handler 可能要等对端的响应，排队会互相卡住。
+	Ordered bool
+
+	// OrderedQueue：Ordered 时每条连接最多排队多少个信封，<=0 用 DefaultOrderedQueue
+	OrderedQueue int
+
+	// 当收到 REGISTER 信封（Flags=1）、而且签名验证通过时调用：
+	//   - id   = 对方的 PeerID（env.ReturnPeerID，对方已经证明了持有它的私钥）
+	//   - conn = REGISTER 来的那条连接，conn.RemoteAddr() 就是看到的远端地址；
+	//     只该交给 id 本人的东西从这条连接发（PeerManager.SendOnConn）
+	OnRegisterPeer func(id peer.PeerID, conn transport.Conn)
 
 	// 当收到普通 Envelope 时，如果你想做「多跳路由学习」，
 	// 可以在这里把 from / env.ReturnPeerID 写入 RouteTable。
 	//
-	//   from = 通过 Registry.PeerByAddr(remoteAddr) 反查出来的 PeerID。
+	//   from = 这条连接属于的节点：
+	//     - 我们拨出去的连接：拨的那个 PeerID
+	//     - 对端拨进来的连接：REGISTER 过的 PeerID，
+	//       或者通过 Registry.PeerByAddr(remoteAddr) 反查出来的 PeerID
+	//   都认不出来时为零值。
 	OnEnvelope func(from peer.PeerID, env *envelop.Envelope)
+
+	// 生命周期（见 Start / Close）
+	mu       sync.Mutex
+	listener transport.Listener
+	ctx      context.Context // Close 时取消：停止 Accept / RecvFrame
+	cancel   context.CancelFunc
+	conns    map[transport.Conn]struct{} // 正在收帧的连接（接受进来的 + ServeConn 的）
+	inflight sync.WaitGroup              // 正在处理的帧
+	closed   bool
+
+	// Connect 正在等对方确认身份的连接：收到验过签名的 REGISTER 时把签名者送进去
+	pending map[transport.Conn]chan peer.PeerID
 }
 
+// DefaultDrainTimeout 是 Close 等待正在处理的帧的默认时间
+const DefaultDrainTimeout = 5 * time.Second
+
+// DefaultConfirmTimeout 是 ConfirmTimeout 的建议值（Host 用它）
+const DefaultConfirmTimeout = 10 * time.Second
+
+// DefaultOrderedQueue 是 OrderedQueue 的默认值
+const DefaultOrderedQueue = 1024
+
+// ErrNodeClosed：Node 已经 Close，Serve / ListenAndServe 因此返回
+var ErrNodeClosed = errors.New("netquic: node closed")
+
 ///////////////////////////////////////////////////////////
 // 1. TLS 配置：自签证书，满足 QUIC 要求即可
 ///////////////////////////////////////////////////////////
@@ -101,124 +161,535 @@ func generateTLSConfig() *tls.Config {
 }
 
 ///////////////////////////////////////////////////////////
-// 2. 启动 QUIC 监听
+// 2. 启动监听
 ///////////////////////////////////////////////////////////
 
-// ListenAndServe 在指定 UDP 地址上监听 QUIC 连接。
-func (n *Node) ListenAndServe(addr string) error {
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		return err
-	}
-	udpConn, err := net.ListenUDP("udp", udpAddr)
-	if err != nil {
-		return err
+// transport 返回 Node 用的传输层（没设置时用 QUIC）
+func (n *Node) transport() transport.Transport {
+	if n.Transport == nil {
+		n.Transport = NewQUICTransport()
 	}
+	return n.Transport
+}
 
-	tlsConf := generateTLSConfig()
-	quicConf := &quic.Config{
-		EnableDatagrams: true,
-		MaxIdleTimeout:  3 * time.Minute,
+// lifecycle 返回 Node 的生命周期 context（第一次调用时创建）和当前的 Listener
+func (n *Node) lifecycle() (context.Context, transport.Listener) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ctx == nil {
+		n.ctx, n.cancel = context.WithCancel(context.Background())
+		n.conns = make(map[transport.Conn]struct{})
+		n.pending = make(map[transport.Conn]chan peer.PeerID)
 	}
+	return n.ctx, n.listener
+}
 
-	// 注意：v0.57 里 Listen 返回的是 quic.Listener，
-	// Accept 返回的是 quic.Connection 接口。
-	listener, err := quic.Listen(udpConn, tlsConf, quicConf)
+// Listen 在 addr 上开始监听，但不接受连接（见 Serve）。
+// 分成两步之后，调用方可以在 Listen 返回后立刻拨号，不用 sleep 等监听起来。
+func (n *Node) Listen(addr string) error {
+	if ctx, _ := n.lifecycle(); ctx.Err() != nil {
+		return ErrNodeClosed
+	}
+	l, err := n.transport().Listen(addr)
 	if err != nil {
 		return err
 	}
+	n.mu.Lock()
+	n.listener = l
+	n.mu.Unlock()
+	log.Printf("[%s] Listening on %s", n.Name, l.Addr())
+	return nil
+}
 
-	log.Printf("[%s] QUIC Listening on %s", n.Name, addr)
+// ListenAddr 返回实际的监听地址；还没 Listen 时为空
+func (n *Node) ListenAddr() string {
+	if _, l := n.lifecycle(); l != nil {
+		return l.Addr()
+	}
+	return ""
+}
 
+// Serve 循环接受连接，直到 Close。需要先 Listen。
+// Close 之后返回 ErrNodeClosed。
+func (n *Node) Serve() error {
+	ctx, l := n.lifecycle()
+	if l == nil {
+		return fmt.Errorf("[%s] Serve: not listening", n.Name)
+	}
 	for {
 		// 阻塞等待新连接
-		conn, err := listener.Accept(context.Background())
+		conn, err := l.Accept(ctx)
 		if err != nil {
+			// 已经 Close（或 Listener 被关掉）：结束循环，不要空转刷日志
+			if ctx.Err() != nil || errors.Is(err, transport.ErrClosed) {
+				return ErrNodeClosed
+			}
 			log.Printf("[%s] Accept err: %v", n.Name, err)
 			continue
 		}
+		if !n.track(conn) {
+			_ = conn.Close()
+			return ErrNodeClosed
+		}
 		// 每个连接丢给 goroutine 处理
-		go n.handleConn(conn)
+		log.Printf("[%s] Accepted connection from %s", n.Name, conn.RemoteAddr())
+		go n.handleConn(ctx, &nodeConn{conn: conn})
+	}
+}
+
+// ListenAndServe 在指定地址上监听并接受连接（已经 Listen 过就直接 Serve）。
+func (n *Node) ListenAndServe(addr string) error {
+	if _, l := n.lifecycle(); l == nil {
+		if err := n.Listen(addr); err != nil {
+			return err
+		}
 	}
+	return n.Serve()
+}
+
+// Start 在后台 Serve，ctx 取消时自动 Close。需要先 Listen。
+func (n *Node) Start(ctx context.Context) error {
+	life, l := n.lifecycle()
+	if l == nil {
+		return fmt.Errorf("[%s] Start: not listening", n.Name)
+	}
+	if life.Err() != nil {
+		return ErrNodeClosed
+	}
+	go func() {
+		if err := n.Serve(); err != nil && !errors.Is(err, ErrNodeClosed) {
+			log.Printf("[%s] Serve err: %v", n.Name, err)
+		}
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = n.Close()
+		case <-life.Done():
+		}
+	}()
+	return nil
 }
 
 ///////////////////////////////////////////////////////////
-// 3. 处理新连接：一个 Connection 上可以有很多单向流
+// 3. 处理新连接：一个连接上会收到很多帧
 ///////////////////////////////////////////////////////////
 
-func (n *Node) handleConn(conn *quic.Conn) {
-	log.Printf("[%s] Accepted connection from %s", n.Name, conn.RemoteAddr())
+// nodeConn 是一条正在收帧的连接，以及它属于哪个节点（认出来之前为零值）
+type nodeConn struct {
+	conn   transport.Conn
+	dialed bool // 我们拨出去的：id 是拨的那个节点，对方的 REGISTER 要和它对得上
+
+	mu        sync.Mutex
+	id        peer.PeerID
+	confirmed bool // 收到过 id 签名的 REGISTER
+
+	// Ordered 的业务信封：读循环入队，worker 按顺序处理；队列空了 worker 就退出
+	qmu     sync.Mutex
+	queue   []*envelop.Envelope
+	working bool
+}
+
+func (c *nodeConn) peerID() peer.PeerID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.id
+}
+
+// ServeConn 在一条拨出去的连接上收帧（一般接 PeerManager.OnDial），
+// 这样对端可以直接从这条连接回发，不用反向拨号。id 是拨的那个节点。
+// 设置了 ConfirmTimeout 时，到时候还没等到 id 的 REGISTER 就断开。
+func (n *Node) ServeConn(id peer.PeerID, conn transport.Conn) {
+	c, ok := n.serveDialed(id, conn)
+	if !ok || n.ConfirmTimeout <= 0 {
+		return
+	}
+	time.AfterFunc(n.ConfirmTimeout, func() {
+		c.mu.Lock()
+		confirmed := c.confirmed
+		c.mu.Unlock()
+		if confirmed {
+			return
+		}
+		log.Printf("[%s] %s 上 %v 内没等到 %s 的 REGISTER，断开", n.Name,
+			conn.RemoteAddr(), n.ConfirmTimeout, peer.PeerIDToDomain(id))
+		if n.PeerMgr != nil {
+			n.PeerMgr.drop(id, conn)
+		} else {
+			_ = conn.Close()
+		}
+	})
+}
+
+func (n *Node) serveDialed(id peer.PeerID, conn transport.Conn) (*nodeConn, bool) {
+	ctx, _ := n.lifecycle()
+	if !n.track(conn) {
+		return nil, false
+	}
+	c := &nodeConn{conn: conn, dialed: true, id: id}
+	go n.handleConn(ctx, c)
+	return c, true
+}
+
+// Connect 拨 id 的 addr，确认接通的就是 id 之后才把连接放进 PeerManager 的池子（打洞用：
+// 候选地址里有对方的内网地址，换了个内网可能是个不相干的节点）。
+// 确认：我在这条连接上发签名的 REGISTER，对方验过之后回一个自己的，签名者必须就是 id。
+// ctx 结束前没确认（对方不回、或者接通的是别人）就关掉连接、返回错误。
+func (n *Node) Connect(ctx context.Context, id peer.PeerID, addr string) error {
+	if n.PeerMgr == nil || n.Key == nil {
+		return fmt.Errorf("[%s] Connect: node has no PeerMgr or Key", n.Name)
+	}
+	conn, err := n.PeerMgr.transport.Dial(ctx, addr)
+	if err != nil {
+		return err
+	}
+
+	n.lifecycle()
+	done := make(chan peer.PeerID, 1)
+	n.mu.Lock()
+	n.pending[conn] = done
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		delete(n.pending, conn)
+		n.mu.Unlock()
+	}()
+
+	if _, ok := n.serveDialed(id, conn); !ok {
+		_ = conn.Close()
+		return ErrNodeClosed
+	}
+	if err := n.sendRegister(conn, id); err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	select {
+	case got := <-done:
+		if got != id {
+			_ = conn.Close()
+			return fmt.Errorf("netquic: %s answered as %s, not %s",
+				addr, peer.PeerIDToDomain(got), peer.PeerIDToDomain(id))
+		}
+	case <-ctx.Done():
+		_ = conn.Close()
+		return ctx.Err()
+	}
+
+	if used, _, _ := n.PeerMgr.keep(id, addr, conn); used == nil {
+		return transport.ErrClosed
+	}
+	return nil
+}
+
+// sendRegister 在 conn 上发一个签名的 REGISTER 给 to
+func (n *Node) sendRegister(conn transport.Conn, to peer.PeerID) error {
+	env, err := envelop.NewRegister(n.Key, to)
+	if err != nil {
+		return err
+	}
+	raw, err := buildFrame(env)
+	if err != nil {
+		return err
+	}
+	return conn.SendFrame(raw)
+}
+
+// settle 把验过签名的 REGISTER 的签名者交给正在等这条连接的 Connect
+func (n *Node) settle(conn transport.Conn, id peer.PeerID) {
+	n.mu.Lock()
+	done := n.pending[conn]
+	n.mu.Unlock()
+	if done != nil {
+		select {
+		case done <- id:
+		default:
+		}
+	}
+}
+
+func (n *Node) handleConn(ctx context.Context, c *nodeConn) {
+	conn := c.conn
+	defer func() {
+		n.untrack(conn)
+		// 连接断了，别再让 PeerManager 从这里发
+		if id := c.peerID(); !id.IsZero() && n.PeerMgr != nil {
+			n.PeerMgr.RemoveConn(id, conn)
+		}
+	}()
+
+	// 小信封可能走 datagram（见 PeerManager.SendToPeer），和流上的帧分开收
+	if dc, ok := conn.(transport.DatagramConn); ok {
+		go n.datagramLoop(ctx, c, dc)
+	}
 
 	for {
-		// 接受「对方发来的单向流」
-		stream, err := conn.AcceptUniStream(context.Background())
+		data, err := conn.RecvFrame(ctx)
 		if err != nil {
-			log.Printf("[%s] AcceptUniStream err: %v", n.Name, err)
+			if ctx.Err() == nil {
+				log.Printf("[%s] RecvFrame err: %v", n.Name, err)
+			}
+			return
+		}
+		if !n.dispatch(data, c) {
 			return
 		}
-
-		// 每个流丢给一个 goroutine，顺便把 conn 传下去（为了拿 remoteAddr）
-		go n.handleStream(stream, conn)
 	}
 }
 
-///////////////////////////////////////////////////////////
-// 4. 从单向流中读取 Frame → Envelope
-///////////////////////////////////////////////////////////
+// datagramLoop 收连接上的 datagram，每个 datagram 是一整帧；连接关闭或 ctx 结束时退出
+func (n *Node) datagramLoop(ctx context.Context, c *nodeConn, dc transport.DatagramConn) {
+	for {
+		data, err := dc.RecvDatagram(ctx)
+		if err != nil {
+			return
+		}
+		if !n.dispatch(data, c) {
+			return
+		}
+	}
+}
 
-// handleStream：这个函数做的事是：
-//  1. 把当前 stream 的全部数据一次性读完（io.ReadAll）
-//  2. Frame.Decode → envBytes
-//  3. envelop.Unmarshal → Envelope
-//  4. 处理 REGISTER / OnEnvelope
-//  5. 把 Envelope 交给 Router.HandleEnvelope
-func (n *Node) handleStream(stream *quic.ReceiveStream, conn *quic.Conn) {
-	// =======================
-	// 1）读取整条流
-	// =======================
-	data, err := io.ReadAll(stream)
+// dispatch 解码一帧并处理；Node 已经在 Close 时返回 false
+func (n *Node) dispatch(data []byte, c *nodeConn) bool {
+	env, err := n.decodeFrame(data)
 	if err != nil {
-		log.Printf("[%s] ReadAll err: %v", n.Name, err)
+		return true
+	}
+	// REGISTER 就在读循环里处理：它决定这条连接属于谁，
+	// 紧跟在后面的帧（比如 Identify 请求）处理时要能看到
+	if isRegister(env) {
+		n.handleEnvelope(env, c)
+		return true
+	}
+	// 已经在 Close 了就不再处理新帧
+	if !n.begin() {
+		return false
+	}
+	// 要求按顺序的业务信封排进这条连接的队列
+	if n.Ordered && !isControl(env) {
+		n.enqueue(c, env)
+		return true
+	}
+	// 其它的每帧丢给一个 goroutine，顺便把连接传下去
+	go func() {
+		defer n.inflight.Done()
+		n.handleEnvelope(env, c)
+	}()
+	return true
+}
+
+// enqueue 把 env 排进 c 的队列（调用方已经 begin 过），没有 worker 在跑就起一个。
+// 读循环只在这里拿一下锁，不会等 handler；队列满了丢掉 env。
+func (n *Node) enqueue(c *nodeConn, env *envelop.Envelope) {
+	limit := n.OrderedQueue
+	if limit <= 0 {
+		limit = DefaultOrderedQueue
+	}
+
+	c.qmu.Lock()
+	if len(c.queue) >= limit {
+		c.qmu.Unlock()
+		n.inflight.Done()
+		log.Printf("[%s] ordered queue full, drop envelope from %s", n.Name, c.conn.RemoteAddr())
 		return
 	}
+	c.queue = append(c.queue, env)
+	start := !c.working
+	c.working = true
+	c.qmu.Unlock()
+
+	if start {
+		go n.drainQueue(c)
+	}
+}
+
+// drainQueue 是 c 的 worker：按入队顺序逐个处理，队列空了就退出
+func (n *Node) drainQueue(c *nodeConn) {
+	for {
+		c.qmu.Lock()
+		if len(c.queue) == 0 {
+			c.working = false
+			c.qmu.Unlock()
+			return
+		}
+		env := c.queue[0]
+		c.queue[0] = nil
+		c.queue = c.queue[1:]
+		c.qmu.Unlock()
+
+		n.handleEnvelope(env, c)
+		n.inflight.Done()
+	}
+}
+
+// track / untrack 记录接受进来的连接，Close 时统一关掉
+func (n *Node) track(conn transport.Conn) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return false
+	}
+	n.conns[conn] = struct{}{}
+	return true
+}
+
+func (n *Node) untrack(conn transport.Conn) {
+	n.mu.Lock()
+	delete(n.conns, conn)
+	n.mu.Unlock()
+}
+
+// bind 认出连接属于 id：记下来，并交给 PeerManager，之后发给 id 的信封从这条连接走。
+// 已经认出来的连接不会再改。
+func (n *Node) bind(c *nodeConn, id peer.PeerID) peer.PeerID {
+	c.mu.Lock()
+	if !c.id.IsZero() {
+		id = c.id
+		c.mu.Unlock()
+		return id
+	}
+	c.id = id
+	c.mu.Unlock()
+
+	if n.PeerMgr != nil {
+		n.PeerMgr.AddConn(id, c.conn.RemoteAddr(), c.conn)
+	}
+	return id
+}
+
+// registered 处理一个验过签名的 REGISTER：id 就在这条连接的另一端。
+//   - 还没认出来、或者认出来的就是 id：记下来（bind）
+//   - 我们拨的是别人，接通的却是 id：这条连接不能当那个节点的用，移出池子、关掉
+//   - 拨进来的连接之前按地址猜成了别人（Registry 反查）：以签名为准，改记成 id
+//
+// 对方拨进来的连接上回一个自己的 REGISTER：拨号的一方只知道地址，要靠它确认接通的是谁。
+// 返回 false 表示这条连接已经关掉，不用再往下处理。
+func (n *Node) registered(c *nodeConn, id peer.PeerID) bool {
+	defer n.settle(c.conn, id)
+
+	prev := c.peerID()
+	switch {
+	case prev.IsZero() || prev == id:
+		n.bind(c, id)
+		c.mu.Lock()
+		c.confirmed = true
+		c.mu.Unlock()
+	case c.dialed:
+		log.Printf("[%s] 拨的是 %s，%s 上接通的却是 %s，断开", n.Name,
+			peer.PeerIDToDomain(prev), c.conn.RemoteAddr(), peer.PeerIDToDomain(id))
+		if n.PeerMgr != nil {
+			n.PeerMgr.drop(prev, c.conn)
+		} else {
+			_ = c.conn.Close()
+		}
+		return false
+	default:
+		c.mu.Lock()
+		c.id = id
+		c.mu.Unlock()
+		if n.PeerMgr != nil {
+			n.PeerMgr.RemoveConn(prev, c.conn)
+			n.PeerMgr.AddConn(id, c.conn.RemoteAddr(), c.conn)
+		}
+	}
+
+	if !c.dialed {
+		if err := n.sendRegister(c.conn, id); err != nil {
+			log.Printf("[%s] 回 REGISTER 给 %s 失败：%v", n.Name, peer.PeerIDToDomain(id), err)
+		}
+	}
+	return true
+}
+
+// begin 登记一个正在处理的帧；Close 开始之后返回 false
+func (n *Node) begin() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return false
+	}
+	n.inflight.Add(1)
+	return true
+}
+
+///////////////////////////////////////////////////////////
+// 4. Frame → Envelope
+///////////////////////////////////////////////////////////
 
+// decodeFrame：
+//  1. Frame.Decode → envBytes
+//  2. envelop.Unmarshal → Envelope
+func (n *Node) decodeFrame(data []byte) (*envelop.Envelope, error) {
 	// =======================
-	// 2）Frame.Decode：解析出 Frame 和其中的 Envelope 字节
+	// 1）Frame.Decode：解析出 Frame 和其中的 Envelope 字节
 	// =======================
 	_, envBytes, err := frame.Decode(data)
 	if err != nil {
 		log.Printf("[%s] Frame decode err: %v", n.Name, err)
-		return
+		return nil, err
 	}
 
 	// =======================
-	// 3）Envelope.Unmarshal：恢复 Envelope 结构
+	// 2）Envelope.Unmarshal：恢复 Envelope 结构
 	// =======================
 	env, err := envelop.Unmarshal(envBytes)
 	if err != nil {
 		log.Printf("[%s] Envelope decode err: %v", n.Name, err)
-		return
+		return nil, err
+	}
+	return env, nil
+}
+
+// isRegister：REGISTER 信封（Flags=1，带着发送方的 ReturnPeerID）
+func isRegister(env *envelop.Envelope) bool {
+	return env.Flags == 1 && !env.ReturnPeerID.IsZero()
+}
+
+// verifyRegister 检查 REGISTER 的签名（见 envelop.VerifyRegister）。
+// 没有 Key 的 Node 不知道自己是谁，认不出 REGISTER 是不是发给自己的，一律不认。
+func (n *Node) verifyRegister(env *envelop.Envelope) error {
+	if n.Key == nil {
+		return fmt.Errorf("%w: node has no key", envelop.ErrBadRegister)
 	}
+	return envelop.VerifyRegister(env, n.Key.PeerID, time.Now())
+}
+
+// handleEnvelope：
+//  3. 处理 REGISTER / OnEnvelope（顺便认出连接属于哪个节点）
+//  4. 把 Envelope 交给 Router.HandleEnvelopeFrom
+func (n *Node) handleEnvelope(env *envelop.Envelope, c *nodeConn) {
+	remoteAddr := c.conn.RemoteAddr()
 
 	// =======================
-	// 4）REGISTER（Flags=1）优先处理
+	// 3）REGISTER（Flags=1）优先处理
 	// =======================
-	remoteAddr := conn.RemoteAddr().String()
-
-	if env.Flags == 1 && n.OnRegisterPeer != nil {
-		// REGISTER：说明“我这个 ReturnPeerID，现在出现在 remoteAddr 上”
-		n.OnRegisterPeer(env.ReturnPeerID, remoteAddr)
-		// REGISTER 是控制层协议，不需要走 Router 流程
-		return
+	if isRegister(env) {
+		// ReturnPeerID 谁都能填：签名验过了才认这条连接属于它
+		if err := n.verifyRegister(env); err != nil {
+			log.Printf("[%s] 丢弃来自 %s 的 REGISTER：%v", n.Name, remoteAddr, err)
+			return
+		}
+		// REGISTER：说明“我这个 ReturnPeerID，现在出现在 remoteAddr 上”，
+		// 以后发给它的信封就从这条连接回去（它在 NAT 后面时只能这样）
+		if !n.registered(c, env.ReturnPeerID) {
+			return
+		}
+		if n.OnRegisterPeer != nil {
+			n.OnRegisterPeer(env.ReturnPeerID, c.conn)
+			// REGISTER 是控制层协议，不需要走 Router 流程
+			return
+		}
 	}
 
 	// =======================
-	// 5）可选：多跳路由学习（通过 Registry 反查来源 PeerID）
+	// 4）可选：多跳路由学习
+	//    from = 这条连接属于的节点；还没认出来的，通过 Registry 反查来源地址
 	// =======================
-	var from peer.PeerID
-	if n.Registry != nil {
+	from := c.peerID()
+	if from.IsZero() && n.Registry != nil {
 		if id, ok := n.Registry.PeerByAddr(remoteAddr); ok {
-			from = id
+			from = n.bind(c, id)
 		}
 	}
 
@@ -227,10 +698,10 @@ func (n *Node) handleStream(stream *quic.ReceiveStream, conn *quic.Conn) {
 	}
 
 	// =======================
-	// 6）交给 Router 做正常的路由 / 多层解包
+	// 5）交给 Router 做正常的路由 / 多层解包
 	// =======================
 	if n.Router != nil {
-		n.Router.HandleEnvelope(env)
+		n.Router.HandleEnvelopeFrom(from, env)
 	}
 }
 
@@ -240,40 +711,12 @@ func (n *Node) handleStream(stream *quic.ReceiveStream, conn *quic.Conn) {
 ///////////////////////////////////////////////////////////
 
 func (n *Node) DialAndSend(addr string, env *envelop.Envelope) error {
-	remoteUDP, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		return err
-	}
-
-	udpConn, err := net.ListenUDP("udp", nil)
-	if err != nil {
-		return err
-	}
-
-	tlsConf := generateTLSConfig()
-	quicConf := &quic.Config{
-		EnableDatagrams: true,
-		MaxIdleTimeout:  3 * time.Minute,
-	}
-
-	// Dial 建立一个新的 QUIC 连接
-	conn, err := quic.Dial(
-		context.Background(),
-		udpConn,
-		remoteUDP,
-		tlsConf,
-		quicConf,
-	)
-	if err != nil {
-		return err
-	}
-	defer conn.CloseWithError(0, "bye")
-
-	// 打开一个单向流
-	stream, err := conn.OpenUniStream()
+	// 建立一个新连接，发完就关
+	conn, err := n.transport().Dial(context.Background(), addr)
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
 
 	// ========== 新版 Frame v2 打包逻辑 ==========
 	// 1. Envelope → 字节
@@ -285,10 +728,70 @@ func (n *Node) DialAndSend(addr string, env *envelop.Envelope) error {
 		return err
 	}
 
-	// 3. 写入流
-	_, err = stream.Write(f.Raw)
+	// 3. 发送一帧
+	return conn.SendFrame(f.Raw)
+}
+
+///////////////////////////////////////////////////////////
+// 6. 关闭：停止接收 → 等正在处理的帧 → 关连接
+///////////////////////////////////////////////////////////
 
-	// 不在这里关流，由 defer conn.CloseWithError 负责
+// Close 优雅地关闭 Node：
+//  1. 停止 Accept 新连接、停止从已有连接上读新帧
+//  2. 等正在处理的帧处理完（最多 DrainTimeout）
+//  3. 关闭接受进来的连接、Listener、PeerManager 的连接池和 Transport
+//
+// 可以重复调用；Close 之后 Serve 返回 ErrNodeClosed。
+func (n *Node) Close() error {
+	n.lifecycle()
+
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil
+	}
+	n.closed = true
+	n.cancel()
+	l := n.listener
+	n.mu.Unlock()
+
+	timeout := n.DrainTimeout
+	if timeout <= 0 {
+		timeout = DefaultDrainTimeout
+	}
+	drained := make(chan struct{})
+	go func() {
+		n.inflight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(timeout):
+		log.Printf("[%s] Close: in-flight frames not drained after %v", n.Name, timeout)
+	}
+
+	n.mu.Lock()
+	conns := make([]transport.Conn, 0, len(n.conns))
+	for c := range n.conns {
+		conns = append(conns, c)
+	}
+	n.conns = make(map[transport.Conn]struct{})
+	n.mu.Unlock()
+	for _, c := range conns {
+		_ = c.Close()
+	}
+
+	var err error
+	if l != nil {
+		err = l.Close()
+	}
+	if n.PeerMgr != nil {
+		_ = n.PeerMgr.Close()
+	}
+	if n.Transport != nil {
+		_ = n.Transport.Close()
+	}
+	log.Printf("[%s] Closed", n.Name)
 	return err
 }
 
@@ -321,12 +824,17 @@ func NewNode(
 	registry *RelayRegistry,
 	resolver func(peer.PeerID) []string,
 ) *Node {
-	pm := NewPeerManager(resolver)
-	return &Node{
-		Name:     name,
-		Key:      key,
-		PeerMgr:  pm,
-		Registry: registry,
+	tr := NewQUICTransport()
+	pm := NewPeerManagerWithTransport(resolver, tr)
+	n := &Node{
+		Name:      name,
+		Key:       key,
+		PeerMgr:   pm,
+		Registry:  registry,
+		Transport: tr,
 		// Router 留给上层自己 new & 注入
 	}
+	// 拨出去的连接也收帧：对端从同一条连接回发
+	pm.OnDial = n.ServeConn
+	return n
 }
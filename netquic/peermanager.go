@@ -2,17 +2,15 @@ package netquic
 
 import (
 	"context"
-	"crypto/tls"
 	"fmt"
-	"net"
 	"sync"
 	"time"
 
 	"envelop/envelop"
 	"envelop/frame"
 	"envelop/peer"
-
-	quic "github.com/quic-go/quic-go"
+	"envelop/router"
+	"envelop/transport"
 )
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -21,9 +19,27 @@ import (
 //
 // 职责：
 //   1. 通过 resolver(peerID) 拿到该节点的所有候选地址（IPv6 / IPv4 / 多端口）
-//   2. 为每个地址维护并复用 QUIC 连接（addr → quic.Conn）
-//   3. SendToPeer：自动选地址（按优先级顺序），建立或复用 QUIC 连接，
-//      打开单向流，构造 Frame（Frame v2），写入 Envelope 数据。
+//   2. 为每个节点维护并复用一条连接（PeerID → transport.Conn）
+//   3. SendToPeer：优先用已有的连接；没有（或已断）就按优先级顺序拨地址，
+//      构造 Frame（Frame v2），整帧发出去（QUIC 下就是一个单向流）。
+//      标了 FlagDatagram 的信封，连接支持 datagram 而且放得下的，作为一个 datagram 发
+//      （不开流、不重传）；放不下 / 不支持 / 发失败时照常走流。
+//   4. Streams 打开时，帧不再一帧一个单向流，而是按 StreamClass 分类写进每条连接上
+//      长期复用的流（transport.StreamConn），同一类的帧按发送顺序到达对端。
+//
+// 连接池：
+//   - 按节点而不是按地址：同一个节点换了地址也只占一条连接
+//   - 同一个地址同时只拨一次号（single-flight），并发的 SendToPeer 共用结果
+//   - 最多 MaxConns 条，超出时关掉最久没用过的（LRU）
+//   - 空闲超过 IdleTimeout 的由 Prune 关掉（Start 会定时跑）
+//   - Stats 返回池子的计数
+//
+// 对端拨进来的连接：
+//   - Node 认出连接属于哪个节点（签名的 REGISTER，或 Registry 里登记过的地址）后调 AddConn，
+//     之后 SendToPeer 直接从这条连接回发，不再反向拨号——对端在 NAT 后面时只有这条路
+//   - AddConn 只填空位：池子里已经有这个节点的存活连接时不替换它
+//   - 这种连接归 Node 管：淘汰 / 空闲清理 / Close 时只移出池子，不关它
+//   - 反过来，拨出去的连接通过 OnDial 交给 Node，对端从同一条连接发回来的帧也能收到
 //
 // 注意：
 //   - PeerManager 不关心 Envelope 解析，它只把“原始 Envelope 字节”包装进 Frame。
@@ -32,9 +48,18 @@ import (
 //     resolver 按优先级顺序返回即可。
 ///////////////////////////////////////////////////////////////////////////////
 
+const (
+	DefaultMaxConns      = 256
+	DefaultIdleTimeout   = 2 * time.Minute // 比 QUIC 的 MaxIdleTimeout 短，由我们先干净地关掉
+	DefaultPruneInterval = 30 * time.Second
+)
+
 type PeerManager struct {
-	mu    sync.Mutex
-	conns map[string]*quic.Conn
+	mu      sync.Mutex
+	conns   map[peer.PeerID]*pooledConn
+	dialing map[string]*dialCall // 正在拨号的地址
+	closed  bool
+	stats   PoolStats
 
 	// resolve: PeerID → 候选地址列表（按优先级排序）
 	//
@@ -47,148 +72,528 @@ type PeerManager struct {
 	//   }
 	resolve func(peer.PeerID) []string
 
-	tlsConf  *tls.Config
-	quicConf *quic.Config
+	// 拨号用的传输层（默认 QUICTransport）
+	transport transport.Transport
+
+	// MaxConns：池子里最多保留多少条连接（0 → DefaultMaxConns）
+	MaxConns int
+
+	// IdleTimeout：连接多久没用就由 Prune 关掉（0 → DefaultIdleTimeout）
+	IdleTimeout time.Duration
+
+	// OnDial（可选）：新拨出一条连接并放进池子后调用（Node.ServeConn），
+	// 让对端可以从这条连接把帧发回来。
+	OnDial func(id peer.PeerID, conn transport.Conn)
+
+	// Streams：为 true 时帧写进长期复用的流（连接支持 transport.StreamConn 的话），
+	// 同一个节点、同一类的帧按 SendToPeer 的调用顺序到达；为 false（默认）时一帧一个单向流。
+	// 接收端配合 Node.Ordered 才能按顺序处理。
+	Streams bool
+
+	// StreamClass（可选）：Streams 模式下信封走哪一类流，nil 时用 DefaultStreamClass
+	StreamClass func(env *envelop.Envelope) uint8
+
+	// OnSendResult（可选）：每次 SendToPeer 结束后回调一次。
+	// 一般用来把发送结果反馈给 Kademlia 表（RecordFailure）和 RouteTable（ReportSend）。
+	OnSendResult func(id peer.PeerID, res SendResult)
+}
+
+// 长期复用的流的类别（见 PeerManager.Streams）：控制信封单独一条，不会排在大量业务信封后面
+const (
+	StreamControl uint8 = 0 // REGISTER / RPC / 逐跳 ACK / 回执 / traceroute
+	StreamData    uint8 = 1 // 业务信封
+)
+
+// DefaultStreamClass 控制信封 → StreamControl，其余 → StreamData
+func DefaultStreamClass(env *envelop.Envelope) uint8 {
+	if isControl(env) {
+		return StreamControl
+	}
+	return StreamData
+}
+
+// isControl：REGISTER、RPC 和 Router 的控制信封
+func isControl(env *envelop.Envelope) bool {
+	return isRegister(env) || env.Flags&envelop.FlagRPC != 0 || router.IsControl(env)
+}
+
+// pooledConn 是池子里某个节点的连接
+type pooledConn struct {
+	conn     transport.Conn
+	addr     string
+	lastUsed time.Time
+	inbound  bool // 对端拨进来的（AddConn），不归我们关
+}
+
+// release 把移出池子的连接交还：拨出去的关掉，拨进来的留给 Node
+func (pc *pooledConn) release() {
+	if !pc.inbound {
+		_ = pc.conn.Close()
+	}
+}
+
+// dialCall 是一次正在进行的拨号，同地址的其他调用者等 done 关闭后直接拿结果
+type dialCall struct {
+	done chan struct{}
+	conn transport.Conn
+	err  error
+}
+
+// PoolStats 是连接池的计数（除 Conns 外都是累计值）
+type PoolStats struct {
+	Conns      int // 当前池子里的连接数
+	Dials      int // 真正拨出去的次数
+	DialErrors int // 其中失败的次数
+	Shared     int // 赶上同地址正在拨号、直接共用结果的次数
+	Reused     int // 直接复用池子里连接的次数
+	Inbound    int // AddConn 登记的对端拨进来的连接数
+	Evicted    int // 超出 MaxConns 被关掉的
+	IdleClosed int // 空闲超时被关掉的
+	Datagrams  int // 作为 datagram 发出去的帧
+}
+
+// SendResult 描述一次 SendToPeer 的结果
+type SendResult struct {
+	Addr string        // 成功时用的地址
+	RTT  time.Duration // 成功时该连接的平滑 RTT（还没有样本、或传输层不报告 RTT 时为 0）
+	Err  error         // nil 表示成功
 }
 
 // NewPeerManager 创建一个 PeerManager。
-// 这里的 resolver 由上层注入——通常来自 RelayRegistry。
+// 这里的 resolver 由上层注入——通常来自 RelayRegistry。拨号走 QUIC。
 func NewPeerManager(resolver func(peer.PeerID) []string) *PeerManager {
+	return NewPeerManagerWithTransport(resolver, NewQUICTransport())
+}
+
+// NewPeerManagerWithTransport 和 NewPeerManager 一样，但拨号走指定的传输层
+// （例如 transport.MemNetwork 的 Transport，测试用）。
+func NewPeerManagerWithTransport(resolver func(peer.PeerID) []string, tr transport.Transport) *PeerManager {
 	return &PeerManager{
-		conns:   make(map[string]*quic.Conn),
-		resolve: resolver,
-		tlsConf: generateTLSConfig(), // 直接复用 node.go 里的 TLS 生成函数
-		quicConf: &quic.Config{
-			EnableDatagrams: true,
-			MaxIdleTimeout:  time.Minute * 3,
-		},
+		conns:     make(map[peer.PeerID]*pooledConn),
+		dialing:   make(map[string]*dialCall),
+		resolve:   resolver,
+		transport: tr,
 	}
 }
 
+func (pm *PeerManager) maxConns() int {
+	if pm.MaxConns > 0 {
+		return pm.MaxConns
+	}
+	return DefaultMaxConns
+}
+
+func (pm *PeerManager) idleTimeout() time.Duration {
+	if pm.IdleTimeout > 0 {
+		return pm.IdleTimeout
+	}
+	return DefaultIdleTimeout
+}
+
 ///////////////////////////////////////////////////////////////////////////////
-// 1. getConn：给定一个地址，拿到一个 QUIC 连接
+// 1. 连接池
 //
-//   - 如果连接池里已经有存活的 conn，则直接复用
-//   - 如果没有，则新建一个 QUIC 连接（UDP + Dial）
-//   - 最终返回一个可用的 *quic.Conn
+//   - pooled(id)：池子里该节点存活的连接（已断的顺手清掉）
+//   - dial(addr)：拨号，同地址并发只拨一次
+//   - put(id, addr, conn)：放进池子，超出上限时踢掉最久没用的
+//   - drop(id, conn)：发送失败的连接移出池子并关掉
 ///////////////////////////////////////////////////////////////////////////////
 
-func (pm *PeerManager) getConn(addr string) (*quic.Conn, error) {
+func (pm *PeerManager) pooled(id peer.PeerID) (transport.Conn, string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pc := pm.conns[id]
+	if pc == nil {
+		return nil, ""
+	}
+	if transport.IsClosed(pc.conn) {
+		delete(pm.conns, id)
+		return nil, ""
+	}
+	pc.lastUsed = time.Now()
+	pm.stats.Reused++
+	return pc.conn, pc.addr
+}
+
+func (pm *PeerManager) dial(ctx context.Context, addr string) (transport.Conn, error) {
 	pm.mu.Lock()
-	conn := pm.conns[addr]
-	if conn != nil && conn.Context().Err() == nil {
-		// 连接存在且上下文没报错（未关闭），直接复用
+	if pm.closed {
+		pm.mu.Unlock()
+		return nil, transport.ErrClosed
+	}
+	if call, ok := pm.dialing[addr]; ok {
+		// 已经有人在拨这个地址了，等它的结果
+		pm.stats.Shared++
 		pm.mu.Unlock()
-		return conn, nil
+		<-call.done
+		return call.conn, call.err
 	}
+	call := &dialCall{done: make(chan struct{})}
+	pm.dialing[addr] = call
+	pm.stats.Dials++
 	pm.mu.Unlock()
 
-	// 需要新建连接
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		return nil, err
+	call.conn, call.err = pm.transport.Dial(ctx, addr)
+
+	pm.mu.Lock()
+	delete(pm.dialing, addr)
+	if call.err != nil {
+		pm.stats.DialErrors++
+	} else if pm.closed {
+		// 拨号期间 PeerManager 被关掉了，就别留着这条连接
+		_ = call.conn.Close()
+		call.conn, call.err = nil, transport.ErrClosed
 	}
+	pm.mu.Unlock()
+	close(call.done)
 
-	// 本地随机端口
-	udpConn, err := net.ListenUDP("udp", nil)
-	if err != nil {
-		return nil, err
+	return call.conn, call.err
+}
+
+// put 把拨出去的连接放进池子（见 keep），新放进去的交给 OnDial
+func (pm *PeerManager) put(id peer.PeerID, addr string, conn transport.Conn) (transport.Conn, string) {
+	used, usedAddr, added := pm.keep(id, addr, conn)
+	if added && pm.OnDial != nil {
+		pm.OnDial(id, conn)
 	}
+	return used, usedAddr
+}
 
-	newConn, err := quic.Dial(
-		context.Background(),
-		udpConn,
-		udpAddr,
-		pm.tlsConf,
-		pm.quicConf,
-	)
+// keep 把拨出去的连接放进池子，返回真正该用的连接，以及 conn 是不是新放进去的：
+// 并发拨了不同地址、或者对端已经拨进来了时，池子里已经有一条存活的就用那条，自己这条关掉。
+func (pm *PeerManager) keep(id peer.PeerID, addr string, conn transport.Conn) (transport.Conn, string, bool) {
+	pm.mu.Lock()
+	if pm.closed {
+		pm.mu.Unlock()
+		_ = conn.Close()
+		return nil, "", false
+	}
+	if pc := pm.conns[id]; pc != nil && !transport.IsClosed(pc.conn) {
+		pc.lastUsed = time.Now()
+		if pc.conn != conn {
+			pm.mu.Unlock()
+			_ = conn.Close()
+			return pc.conn, pc.addr, false
+		}
+		pm.mu.Unlock()
+		return conn, addr, false
+	}
+	released := pm.insertLocked(id, &pooledConn{conn: conn, addr: addr})
+	pm.mu.Unlock()
+
+	for _, pc := range released {
+		pc.release()
+	}
+	return conn, addr, true
+}
+
+// AddConn 把对端拨进来的连接登记为 id 的连接，之后 SendToPeer(id) 直接从这条连接回发。
+// 池子里已经有 id 的一条存活连接时什么都不做：登记只填空位，
+// 不会把正在用的连接换掉（别人冒充 id 拨进来也抢不走发给 id 的信封）。
+func (pm *PeerManager) AddConn(id peer.PeerID, addr string, conn transport.Conn) {
+	pm.mu.Lock()
+	if pm.closed {
+		pm.mu.Unlock()
+		return
+	}
+	if pc := pm.conns[id]; pc != nil && !transport.IsClosed(pc.conn) {
+		if pc.conn == conn {
+			pc.lastUsed = time.Now()
+		}
+		pm.mu.Unlock()
+		return
+	}
+	released := pm.insertLocked(id, &pooledConn{conn: conn, addr: addr, inbound: true})
+	pm.stats.Inbound++
+	pm.mu.Unlock()
+
+	for _, pc := range released {
+		pc.release()
+	}
+}
+
+// Connect 拨一个指定的地址，成功后记为 id 的连接（不走 resolver）。
+// 不确认接通的是不是 id；需要确认时用 Node.Connect。
+func (pm *PeerManager) Connect(ctx context.Context, id peer.PeerID, addr string) error {
+	conn, err := pm.dial(ctx, addr)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	if conn, _ := pm.put(id, addr, conn); conn == nil {
+		return transport.ErrClosed
+	}
+	return nil
+}
 
-	// 放入连接池
+// ConnAddr 返回池子里 id 那条连接的对端地址。
+// 对端拨进来的连接，这就是我们看到的它的地址（NAT 后面的节点就是 NAT 映射出来的公网地址）。
+func (pm *PeerManager) ConnAddr(id peer.PeerID) (string, bool) {
 	pm.mu.Lock()
-	pm.conns[addr] = newConn
+	defer pm.mu.Unlock()
+	pc := pm.conns[id]
+	if pc == nil || transport.IsClosed(pc.conn) {
+		return "", false
+	}
+	return pc.addr, true
+}
+
+// RemoveConn 把 id 的连接移出池子（只在池子里还是这条 conn 时），不关连接
+func (pm *PeerManager) RemoveConn(id peer.PeerID, conn transport.Conn) {
+	pm.mu.Lock()
+	if pc := pm.conns[id]; pc != nil && pc.conn == conn {
+		delete(pm.conns, id)
+	}
 	pm.mu.Unlock()
+}
+
+// insertLocked 放进池子（替换掉 id 原来的连接），超出上限时踢掉最久没用的
+// （不会是刚放进去的这条）。返回被挤出去的连接，由调用方在锁外 release。
+func (pm *PeerManager) insertLocked(id peer.PeerID, pc *pooledConn) []*pooledConn {
+	var released []*pooledConn
+	if old := pm.conns[id]; old != nil {
+		released = append(released, old)
+	}
+	pc.lastUsed = time.Now()
+	pm.conns[id] = pc
+
+	for len(pm.conns) > pm.maxConns() {
+		var oldest peer.PeerID
+		var oldestAt time.Time
+		found := false
+		for pid, c := range pm.conns {
+			if pid == id {
+				continue
+			}
+			if !found || c.lastUsed.Before(oldestAt) {
+				oldest, oldestAt, found = pid, c.lastUsed, true
+			}
+		}
+		if !found {
+			break
+		}
+		released = append(released, pm.conns[oldest])
+		delete(pm.conns, oldest)
+		pm.stats.Evicted++
+	}
+	return released
+}
 
-	return newConn, nil
+func (pm *PeerManager) drop(id peer.PeerID, conn transport.Conn) {
+	pm.mu.Lock()
+	pc := pm.conns[id]
+	if pc != nil && pc.conn == conn {
+		delete(pm.conns, id)
+	}
+	pm.mu.Unlock()
+	if pc == nil || pc.conn != conn || !pc.inbound {
+		_ = conn.Close()
+	}
+}
+
+// Prune 关掉空闲超过 IdleTimeout 的连接，顺便清掉已经断开的
+func (pm *PeerManager) Prune() {
+	cutoff := time.Now().Add(-pm.idleTimeout())
+
+	pm.mu.Lock()
+	var idle []*pooledConn
+	for id, pc := range pm.conns {
+		switch {
+		case transport.IsClosed(pc.conn):
+			delete(pm.conns, id)
+		case pc.lastUsed.Before(cutoff):
+			idle = append(idle, pc)
+			delete(pm.conns, id)
+			pm.stats.IdleClosed++
+		}
+	}
+	pm.mu.Unlock()
+
+	for _, pc := range idle {
+		pc.release()
+	}
+}
+
+// Start 在后台每 interval 跑一次 Prune（interval <= 0 → DefaultPruneInterval），ctx 结束时退出
+func (pm *PeerManager) Start(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultPruneInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				pm.Prune()
+			}
+		}
+	}()
+}
+
+// Stats 返回连接池的当前计数
+func (pm *PeerManager) Stats() PoolStats {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	st := pm.stats
+	st.Conns = len(pm.conns)
+	return st
+}
+
+// Close 关闭连接池里拨出去的连接（拨进来的由 Node 关）；之后的 SendToPeer 都会失败
+func (pm *PeerManager) Close() error {
+	pm.mu.Lock()
+	pm.closed = true
+	conns := pm.conns
+	pm.conns = make(map[peer.PeerID]*pooledConn)
+	pm.mu.Unlock()
+
+	for _, pc := range conns {
+		pc.release()
+	}
+	return nil
 }
 
 ///////////////////////////////////////////////////////////////////////////////
 // 2. SendToPeer：根据 PeerID 发送一个 Envelope
 //
 //   流程：
-//     1）通过 resolve(peerID) 拿到地址列表（可能有 IPv6 / IPv4）
-//     2）按顺序逐个尝试：
-//           - getConn(addr)
-//           - 打开单向流 conn.OpenUniStream()
-//           - Envelope.Marshal() → []byte
-//           - Frame.Build(FrameTypeNormal, envBytes, 0)
-//           - stream.Write(frame.Raw)
+//     1）Envelope.Marshal() → []byte，Frame.Build(FrameTypeNormal, envBytes, 0)
+//     2）池子里有这个节点的连接就直接 conn.SendFrame(frame.Raw)
+//     3）没有或发送失败：通过 resolve(peerID) 拿到地址列表（可能有 IPv6 / IPv4），
+//        按顺序逐个 dial(addr) → put 进池子 → conn.SendFrame(frame.Raw)，
 //        一旦某个地址发送成功，立即返回 nil
-//     3）如果所有地址都失败，返回最后一个错误
+//     4）如果所有地址都失败，返回最后一个错误
 //
 //   这样，你在上层只需要关心 “我要发给 peerID X”，至于：
 //     - 走 IPv6 还是 IPv4
 //     - 某个地址暂时连不上怎么办
 //   都交给 PeerManager 自动处理。
+//
+//   结果（成功 / 最后一个错误）会通过 OnSendResult 报告给上层。
 ///////////////////////////////////////////////////////////////////////////////
 
 func (pm *PeerManager) SendToPeer(id peer.PeerID, env *envelop.Envelope) error {
-	// 1. 通过 resolver 获取候选地址列表
-	addrs := pm.resolve(id)
-	if len(addrs) == 0 {
-		return fmt.Errorf("no address for peer %s", peer.PeerIDToDomain(id))
+	res := pm.sendToPeer(id, env)
+	if pm.OnSendResult != nil {
+		pm.OnSendResult(id, res)
+	}
+	return res.Err
+}
+
+func (pm *PeerManager) sendToPeer(id peer.PeerID, env *envelop.Envelope) SendResult {
+	// 1. Envelope → 原始字节（严格按照 EnvHeaderSize 布局），
+	//    构建 Frame（这里用 FrameTypeNormal，可变大小，不 padding）
+	raw, err := buildFrame(env)
+	if err != nil {
+		return SendResult{Err: err}
 	}
 
+	// 2. 池子里已经有这个节点的连接，先用它
 	var lastErr error
+	if conn, addr := pm.pooled(id); conn != nil {
+		err := pm.sendFrame(conn, raw, env)
+		if err == nil {
+			return sendOK(conn, addr)
+		}
+		// 连接坏了：移出池子，下面重新拨号
+		lastErr = fmt.Errorf("send frame to %s failed: %w", addr, err)
+		pm.drop(id, conn)
+	}
 
-	// 2. 按顺序逐个尝试（典型策略：IPv6 → IPv4 → 内网 → 其它）
+	// 3. 通过 resolver 获取候选地址列表
+	addrs := pm.resolve(id)
+	if len(addrs) == 0 {
+		if lastErr != nil {
+			return SendResult{Err: lastErr}
+		}
+		return SendResult{Err: fmt.Errorf("no address for peer %s", peer.PeerIDToDomain(id))}
+	}
+
+	// 4. 按顺序逐个尝试（典型策略：IPv6 → IPv4 → 内网 → 其它）
 	for _, addr := range addrs {
-		// 2.1 拿到（或新建）QUIC 连接
-		conn, err := pm.getConn(addr)
+		// 4.1 拨号（同地址并发只拨一次），放进池子
+		conn, err := pm.dial(context.Background(), addr)
 		if err != nil {
 			lastErr = fmt.Errorf("dial %s failed: %w", addr, err)
 			continue
 		}
-
-		// 2.2 打开一个单向流
-		stream, err := conn.OpenUniStream()
-		if err != nil {
-			lastErr = fmt.Errorf("open stream to %s failed: %w", addr, err)
-			continue
+		conn, used := pm.put(id, addr, conn)
+		if conn == nil {
+			return SendResult{Err: transport.ErrClosed}
 		}
 
-		// 2.3 Envelope → 原始字节（严格按照 EnvHeaderSize 布局）
-		envBytes, err := envelop.Marshal(env)
-		if err != nil {
-			lastErr = fmt.Errorf("envelop envelop failed: %w", err)
-		}
-		// 2.4 构建 Frame（这里用 FrameTypeNormal，可变大小，不 padding）
-		f := &frame.Frame{}
-		if err := f.Build(frame.FrameTypeNormal, envBytes, 0); err != nil {
-			lastErr = fmt.Errorf("build frame for %s failed: %w", addr, err)
+		// 4.2 整帧发出去（QUIC：开单向流、写完、关流，对端 ReadAll 才会拿到 EOF；或者一个 datagram）
+		if err := pm.sendFrame(conn, raw, env); err != nil {
+			lastErr = fmt.Errorf("send frame to %s failed: %w", used, err)
+			pm.drop(id, conn)
 			continue
 		}
+		// 4.3 成功了，直接返回
+		return sendOK(conn, used)
+	}
 
-		// 2.5 写入 QUIC 流
-		if _, err := stream.Write(f.Raw); err != nil {
-			lastErr = fmt.Errorf("write frame to %s failed: %w", addr, err)
-			continue
+	// 5. 所有地址都失败，返回最后一个错误
+	if lastErr == nil {
+		lastErr = fmt.Errorf("send failed: unknown error for peer %s", peer.PeerIDToDomain(id))
+	}
+	return SendResult{Err: lastErr}
+}
+
+// SendOnConn 在指定的连接上发 env，不查池子、不拨号。
+// 只该交给这条连接另一端本人的东西用它发：比如对方在这条连接上用签名的 REGISTER 证明了身份，
+// 邮箱里替它存的信封就从这里发（池子里 id 的连接可能是拨到 Registry 里某个地址的，没验证过）。
+func (pm *PeerManager) SendOnConn(conn transport.Conn, env *envelop.Envelope) error {
+	raw, err := buildFrame(env)
+	if err != nil {
+		return err
+	}
+	return pm.sendFrame(conn, raw, env)
+}
+
+// buildFrame：Envelope → Frame.Raw
+func buildFrame(env *envelop.Envelope) ([]byte, error) {
+	envBytes, err := envelop.Marshal(env)
+	if err != nil {
+		return nil, fmt.Errorf("envelop marshal failed: %w", err)
+	}
+	f := &frame.Frame{}
+	if err := f.Build(frame.FrameTypeNormal, envBytes, 0); err != nil {
+		return nil, fmt.Errorf("build frame failed: %w", err)
+	}
+	return f.Raw, nil
+}
+
+// sendFrame 在 conn 上发 env 的帧：
+//   - 要走 datagram、连接支持而且放得下的发 datagram（发失败就往下走）
+//   - Streams 模式、连接支持的写进对应类别的长期复用的流
+//   - 否则开一个单向流
+func (pm *PeerManager) sendFrame(conn transport.Conn, raw []byte, env *envelop.Envelope) error {
+	datagram := env.Flags&envelop.FlagDatagram != 0
+	if dc, ok := conn.(transport.DatagramConn); ok && datagram && len(raw) <= dc.MaxDatagramSize() {
+		if err := dc.SendDatagram(raw); err == nil {
+			pm.mu.Lock()
+			pm.stats.Datagrams++
+			pm.mu.Unlock()
+			return nil
 		}
-		// ⭐⭐ 2.6 非常关键：写完一定要告诉对端“这条消息结束了”
-		//     对端的 io.ReadAll(stream) 才会返回 EOF
-		if err := stream.Close(); err != nil {
-			lastErr = fmt.Errorf("close stream to %s failed: %w", addr, err)
-			continue
+	}
+	if sc, ok := conn.(transport.StreamConn); ok && pm.Streams {
+		class := DefaultStreamClass
+		if pm.StreamClass != nil {
+			class = pm.StreamClass
 		}
-		// 2.7 这条地址成功了，直接返回
-		return nil
+		return sc.SendOrdered(class(env), raw)
 	}
+	return conn.SendFrame(raw)
+}
 
-	// 3. 所有地址都失败，返回最后一个错误
-	if lastErr == nil {
-		lastErr = fmt.Errorf("send failed: unknown error for peer %s", peer.PeerIDToDomain(id))
+// sendOK 组装成功的 SendResult（传输层能报告 RTT 的话顺带带上）
+func sendOK(conn transport.Conn, addr string) SendResult {
+	res := SendResult{Addr: addr}
+	if rc, ok := conn.(transport.RTTConn); ok {
+		res.RTT = rc.RTT()
 	}
-	return lastErr
+	return res
 }
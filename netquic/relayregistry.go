@@ -37,6 +37,10 @@ type RelayRegistry struct {
 	// 每当一个节点发出 REGISTER(addr)，就建立映射：
 	//      addr → peerID
 	revBook map[string]peer.PeerID
+
+	// Fallback（可选）：本地 addrBook 里没有时再问一次，
+	// 典型实现是 DHT 查找（dht.DHT.ResolveAddrs）。在锁外调用。
+	Fallback func(id peer.PeerID) []string
 }
 
 // 创建注册表
@@ -74,7 +78,7 @@ func (rr *RelayRegistry) RegisterStatic(id peer.PeerID, addr string) {
 // 用于 REGISTER Envelope 的动态注册：
 //
 //	Alice → Relay 发送：Flags=1, ReturnPeerID=AliceID
-//	Relay → 在 Node.handleStream 得到 remoteAddr 和 ReturnPeerID
+//	Relay → 在 Node.handleEnvelope 得到 remoteAddr 和 ReturnPeerID
 //	RelayRegistry.RegisterPeer(AliceID, remoteAddr)
 //
 // 特点：
@@ -104,6 +108,35 @@ func (rr *RelayRegistry) RegisterPeer(id peer.PeerID, addr string) {
 	log.Printf("[Registry] 动态注册 %s → %s", peer.PeerIDToDomain(id), addr)
 }
 
+// /////////////////////////////////////////////////////////////////////////////
+// AddAddrs
+//
+// 只加正向表：别人报上来的“id 可以在这些地址拨到”（DHT 里节点自报的 Contact 等）。
+//
+// 和 RegisterPeer 的区别：
+//   - 不碰反向表：这些地址没有在一条连接上被 id 的签名确认过，
+//     不能用来认“这个地址来的信封是谁发的”
+//   - 已有的地址一个不动，只追加没见过的
+//
+// /////////////////////////////////////////////////////////////////////////////
+func (rr *RelayRegistry) AddAddrs(id peer.PeerID, addrs []string) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	for _, addr := range addrs {
+		exists := false
+		for _, a := range rr.addrBook[id] {
+			if a == addr {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			rr.addrBook[id] = append(rr.addrBook[id], addr)
+		}
+	}
+}
+
 // /////////////////////////////////////////////////////////////////////////////
 // Resolver(peerID) → []string
 //
@@ -121,16 +154,23 @@ func (rr *RelayRegistry) RegisterPeer(id peer.PeerID, addr string) {
 //	}
 //
 // 如果你想 IPv4 先尝试，只要上层把顺序调换即可。
+//
+// 本地没有这个 PeerID 的地址时，会再调用 Fallback（如果设置了，例如 DHT 查找）。
 // /////////////////////////////////////////////////////////////////////////////
 func (rr *RelayRegistry) Resolver(id peer.PeerID) []string {
 	rr.mu.RLock()
-	defer rr.mu.RUnlock()
-
 	addrs := rr.addrBook[id]
 
 	// 返回一个副本，避免外部修改内部结构
 	cp := make([]string, len(addrs))
 	copy(cp, addrs)
+	fallback := rr.Fallback
+	rr.mu.RUnlock()
+
+	// 本地没有：交给 Fallback（例如 DHT）
+	if len(cp) == 0 && fallback != nil {
+		return fallback(id)
+	}
 	return cp
 }
 
@@ -139,7 +179,7 @@ func (rr *RelayRegistry) Resolver(id peer.PeerID) []string {
 //
 // ★★★ 此函数是多跳学习的关键 ★★★
 //
-// Node.handleStream 中：
+// Node.handleEnvelope 中：
 //
 //	remoteAddr := conn.RemoteAddr().String()
 //	fromPeerID, ok := Registry.PeerByAddr(remoteAddr)
@@ -153,3 +193,16 @@ func (rr *RelayRegistry) PeerByAddr(addr string) (peer.PeerID, bool) {
 	id, ok := rr.revBook[addr]
 	return id, ok
 }
+
+// /////////////////////////////////////////////////////////////////////////////
+// Registered(id) → bool
+//
+// 本地 addrBook 里有没有这个 PeerID（静态注册或 REGISTER 过），不走 Fallback。
+// 邮箱用它判断“这是一个认识的节点，只是暂时连不上”，值得替它暂存信封。
+// /////////////////////////////////////////////////////////////////////////////
+func (rr *RelayRegistry) Registered(id peer.PeerID) bool {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+
+	return len(rr.addrBook[id]) > 0
+}
@@ -0,0 +1,407 @@
+package netquic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"envelop/frame"
+	"envelop/transport"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+/*
+==========================================================
+ QUICTransport：transport.Transport 的 UDP + QUIC 实现
+==========================================================
+
+  Listen(addr)   → net.ListenUDP + quic.Transport.Listen
+  Dial(ctx,addr) → quic.Transport.Dial，复用监听的那个 UDP socket
+  SendFrame      → 打开一个单向流，写完整帧，关流（对端 ReadAll 才能拿到 EOF）
+  RecvFrame      → 后台 AcceptUniStream，每个流 ReadAll 成一帧
+  SendDatagram   → QUIC DATAGRAM 帧（EnableDatagrams），一帧一个，不开流、不重传
+  RecvDatagram   → ReceiveDatagram
+  SendOrdered    → 每个 class 一个长期复用的单向流：先写前导 [0xFE][class]，
+                   之后帧背靠背写（帧自带长度）；对端用 frame.Reader 逐帧切开，按顺序交给 RecvFrame。
+                   一帧一个流的帧第一个字节是帧类型（0x01），不会和前导混淆
+
+这就是 Node / PeerManager 以前直接写在里面的那套逻辑，搬到这里之后
+上层只看到“帧”。
+
+UDP socket 的复用：
+  - 第一次 Listen 的 socket 同时用来拨号：对端看到的源地址就是我们的监听地址，
+    NAT 上也只有这一个映射（打洞、对端回连都靠它）
+  - 还没 Listen 就拨号时，所有拨号共用一个本地随机端口的 socket，
+    不再每次拨号开一个新的
+  - socket 在 Transport.Close 时才关；单独关 Listener 只是不再接受新连接
+==========================================================
+*/
+
+// QUICTransport 是默认的传输层
+type QUICTransport struct {
+	tlsConf  *tls.Config
+	quicConf *quic.Config
+
+	mu        sync.Mutex
+	sockets   []*udpSocket // 所有开过的 socket，Close 时一起关
+	dialer    *udpSocket   // 拨号用的 socket：第一个监听的，或者一个随机端口的
+	listening bool         // dialer 是不是监听的那个
+	listeners []*quicListener
+	conns     map[*quicConn]struct{} // 拨出去、还没关的连接；关掉后自己摘掉
+	closed    bool
+}
+
+// udpSocket 是一个 UDP socket 和跑在它上面的 quic.Transport
+type udpSocket struct {
+	udp *net.UDPConn
+	tr  *quic.Transport
+}
+
+func newUDPSocket(addr *net.UDPAddr) (*udpSocket, error) {
+	udpConn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpSocket{udp: udpConn, tr: &quic.Transport{Conn: udpConn}}, nil
+}
+
+func (s *udpSocket) close() {
+	_ = s.tr.Close()
+	_ = s.udp.Close()
+}
+
+// NewQUICTransport 创建一个 QUIC 传输层（自签证书）
+func NewQUICTransport() *QUICTransport {
+	return &QUICTransport{
+		tlsConf: generateTLSConfig(),
+		quicConf: &quic.Config{
+			EnableDatagrams: true,
+			MaxIdleTimeout:  3 * time.Minute,
+		},
+	}
+}
+
+func (t *QUICTransport) Listen(addr string) (transport.Listener, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	sock, err := newUDPSocket(udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	// 注意：v0.57 里 Listen 返回的是 *quic.Listener
+	ln, err := sock.tr.Listen(t.tlsConf, t.quicConf)
+	if err != nil {
+		sock.close()
+		return nil, err
+	}
+
+	l := &quicListener{ln: ln}
+	t.mu.Lock()
+	t.sockets = append(t.sockets, sock)
+	t.listeners = append(t.listeners, l)
+	if !t.listening {
+		// 以后的拨号都从监听的 socket 出去（之前随机端口上拨出去的连接不受影响）
+		t.dialer, t.listening = sock, true
+	}
+	t.mu.Unlock()
+	return l, nil
+}
+
+// dialSocket 返回拨号用的 socket，还没有就开一个随机端口的
+func (t *QUICTransport) dialSocket() (*udpSocket, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil, transport.ErrClosed
+	}
+	if t.dialer == nil {
+		sock, err := newUDPSocket(nil)
+		if err != nil {
+			return nil, err
+		}
+		t.sockets = append(t.sockets, sock)
+		t.dialer = sock
+	}
+	return t.dialer, nil
+}
+
+func (t *QUICTransport) Dial(ctx context.Context, addr string) (transport.Conn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	sock, err := t.dialSocket()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := sock.tr.Dial(ctx, udpAddr, t.tlsConf, t.quicConf)
+	if err != nil {
+		return nil, err
+	}
+
+	c := newQUICConn(conn)
+	t.track(c)
+	return c, nil
+}
+
+// track 记下拨出去的连接，连接关闭后从集合里删掉，集合不会越攒越多
+func (t *QUICTransport) track(c *quicConn) {
+	t.mu.Lock()
+	if t.conns == nil {
+		t.conns = make(map[*quicConn]struct{})
+	}
+	t.conns[c] = struct{}{}
+	t.mu.Unlock()
+
+	go func() {
+		<-c.Done()
+		t.mu.Lock()
+		delete(t.conns, c)
+		t.mu.Unlock()
+	}()
+}
+
+func (t *QUICTransport) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	ls, cs, socks := t.listeners, t.conns, t.sockets
+	t.listeners, t.conns, t.sockets, t.dialer = nil, nil, nil, nil
+	t.mu.Unlock()
+
+	for c := range cs {
+		_ = c.Close()
+	}
+	for _, l := range ls {
+		_ = l.Close()
+	}
+	// 连接都发过 CONNECTION_CLOSE 了，再关 socket
+	for _, s := range socks {
+		s.close()
+	}
+	return nil
+}
+
+/*
+==========================================================
+ quicListener
+==========================================================
+*/
+
+type quicListener struct {
+	ln *quic.Listener
+}
+
+func (l *quicListener) Accept(ctx context.Context) (transport.Conn, error) {
+	conn, err := l.ln.Accept(ctx)
+	if err != nil {
+		if errors.Is(err, quic.ErrServerClosed) {
+			return nil, transport.ErrClosed
+		}
+		return nil, err
+	}
+	return newQUICConn(conn), nil
+}
+
+func (l *quicListener) Addr() string { return l.ln.Addr().String() }
+
+// Close 不再接受新连接；已经接受的连接和 socket 本身不受影响（见 QUICTransport.Close）
+func (l *quicListener) Close() error {
+	return l.ln.Close()
+}
+
+/*
+==========================================================
+ quicConn：一帧一个单向流，或者一个 datagram
+==========================================================
+*/
+
+// datagram 大小的初始估计：QUIC 最小 MTU 1200 以内能装下的 DATAGRAM 负载。
+// quic-go 不直接告诉我们上限，发大了会返回 DatagramTooLargeError（里面带着上限），据此修正
+const defaultMaxDatagram = 1100
+
+// orderedPreamble：长期复用的流的第一个字节（后面跟一个字节的 class）
+const orderedPreamble = 0xFE
+
+type quicConn struct {
+	conn *quic.Conn
+
+	once   sync.Once
+	frames chan []byte
+	err    error // 接收循环退出的原因，frames 关闭后才可读
+
+	maxDatagram atomic.Int64
+
+	lanesMu sync.Mutex
+	lanes   map[uint8]*quicLane // SendOrdered 的流，按 class
+}
+
+// quicLane 是一条长期复用的发送流；mu 保证帧整帧写完才轮到下一帧
+type quicLane struct {
+	mu     sync.Mutex
+	stream *quic.SendStream
+}
+
+func newQUICConn(conn *quic.Conn) *quicConn {
+	c := &quicConn{conn: conn, frames: make(chan []byte, 64), lanes: make(map[uint8]*quicLane)}
+	c.maxDatagram.Store(defaultMaxDatagram)
+	return c
+}
+
+func (c *quicConn) SendFrame(frame []byte) error {
+	stream, err := c.conn.OpenUniStream()
+	if err != nil {
+		return err
+	}
+	if _, err := stream.Write(frame); err != nil {
+		return err
+	}
+	// 写完一定要关流，对端的 io.ReadAll(stream) 才会返回 EOF
+	return stream.Close()
+}
+
+func (c *quicConn) SendOrdered(class uint8, frame []byte) error {
+	c.lanesMu.Lock()
+	lane := c.lanes[class]
+	if lane == nil {
+		lane = &quicLane{}
+		c.lanes[class] = lane
+	}
+	c.lanesMu.Unlock()
+
+	lane.mu.Lock()
+	defer lane.mu.Unlock()
+	if lane.stream == nil {
+		stream, err := c.conn.OpenUniStream()
+		if err != nil {
+			return err
+		}
+		if _, err := stream.Write([]byte{orderedPreamble, class}); err != nil {
+			stream.CancelWrite(0)
+			return err
+		}
+		lane.stream = stream
+	}
+	if _, err := lane.stream.Write(frame); err != nil {
+		// 流坏了（可能写了半帧）：扔掉，下一帧重新开一条
+		lane.stream.CancelWrite(0)
+		lane.stream = nil
+		return err
+	}
+	return nil
+}
+
+// recvLoop 接受对端的单向流：一帧一个的流读完就是一帧，长期复用的流逐帧按顺序读
+func (c *quicConn) recvLoop() {
+	var wg sync.WaitGroup
+	for {
+		stream, err := c.conn.AcceptUniStream(context.Background())
+		if err != nil {
+			c.err = err
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.readStream(stream)
+		}()
+	}
+	wg.Wait()
+	close(c.frames)
+}
+
+// readStream 读一个对端的单向流，读出来的帧依次放进 frames
+func (c *quicConn) readStream(stream *quic.ReceiveStream) {
+	var first [1]byte
+	if _, err := io.ReadFull(stream, first[:]); err != nil {
+		return
+	}
+	if first[0] != orderedPreamble {
+		rest, err := io.ReadAll(stream)
+		if err != nil {
+			return
+		}
+		c.deliver(append(first[:], rest...))
+		return
+	}
+
+	// class 只对发送端有意义（哪些帧排在一起），接收端读掉就行
+	var class [1]byte
+	if _, err := io.ReadFull(stream, class[:]); err != nil {
+		return
+	}
+	fr := frame.NewReader(stream)
+	for {
+		data, err := fr.Next()
+		if err != nil {
+			return
+		}
+		if !c.deliver(data) {
+			return
+		}
+	}
+}
+
+// deliver 把一帧交给 RecvFrame；连接已经关闭时返回 false
+func (c *quicConn) deliver(data []byte) bool {
+	select {
+	case c.frames <- data:
+		return true
+	case <-c.conn.Context().Done():
+		return false
+	}
+}
+
+func (c *quicConn) RecvFrame(ctx context.Context) ([]byte, error) {
+	c.once.Do(func() { go c.recvLoop() })
+	select {
+	case data, ok := <-c.frames:
+		if !ok {
+			return nil, c.err
+		}
+		return data, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *quicConn) SendDatagram(frame []byte) error {
+	err := c.conn.SendDatagram(frame)
+	var tooLarge *quic.DatagramTooLargeError
+	if errors.As(err, &tooLarge) {
+		c.maxDatagram.Store(tooLarge.MaxDatagramPayloadSize)
+		return fmt.Errorf("%w: %d > %d bytes", transport.ErrDatagramTooLarge, len(frame), tooLarge.MaxDatagramPayloadSize)
+	}
+	return err
+}
+
+func (c *quicConn) RecvDatagram(ctx context.Context) ([]byte, error) {
+	return c.conn.ReceiveDatagram(ctx)
+}
+
+// MaxDatagramSize：对端没声明支持 datagram 时为 0
+func (c *quicConn) MaxDatagramSize() int {
+	if !c.conn.ConnectionState().SupportsDatagrams {
+		return 0
+	}
+	return int(c.maxDatagram.Load())
+}
+
+func (c *quicConn) LocalAddr() string     { return c.conn.LocalAddr().String() }
+func (c *quicConn) RemoteAddr() string    { return c.conn.RemoteAddr().String() }
+func (c *quicConn) Done() <-chan struct{} { return c.conn.Context().Done() }
+
+// RTT 返回连接的平滑 RTT（还没有样本时为 0）
+func (c *quicConn) RTT() time.Duration { return c.conn.ConnectionStats().SmoothedRTT }
+
+func (c *quicConn) Close() error {
+	return c.conn.CloseWithError(0, "bye")
+}
@@ -0,0 +1,108 @@
+package pubsub
+
+import "time"
+
+/*
+==========================================================
+ seenCache + msgCache
+==========================================================
+
+  seenCache：见过的消息 ID（保留 SeenTTL），重复收到直接丢弃，
+             也用来判断 IHAVE 里哪些消息还没有、要 IWANT。
+
+  msgCache： 最近几个心跳周期里的完整消息，按周期分窗：
+               windows[0] = 本周期，windows[1] = 上一个周期，...
+             - IWANT 从所有窗口里找
+             - IHAVE 只广播最近 gossip 个窗口里的 ID
+             - 每次心跳 shift 一次，最老的窗口连同消息一起丢掉
+
+两者都不带锁，由 PubSub.mu 保护。
+==========================================================
+*/
+
+type seenCache struct {
+	ttl time.Duration
+	ids map[string]time.Time
+}
+
+func newSeenCache(ttl time.Duration) *seenCache {
+	return &seenCache{ttl: ttl, ids: make(map[string]time.Time)}
+}
+
+// add 记下 id；之前已经见过就返回 false
+func (c *seenCache) add(id string, now time.Time) bool {
+	if c.has(id, now) {
+		return false
+	}
+	c.ids[id] = now
+	return true
+}
+
+func (c *seenCache) has(id string, now time.Time) bool {
+	at, ok := c.ids[id]
+	return ok && now.Sub(at) < c.ttl
+}
+
+// sweep 删掉过期的 ID
+func (c *seenCache) sweep(now time.Time) {
+	for id, at := range c.ids {
+		if now.Sub(at) >= c.ttl {
+			delete(c.ids, id)
+		}
+	}
+}
+
+type cacheEntry struct {
+	id    string
+	topic string
+}
+
+type msgCache struct {
+	msgs    map[string]*Message
+	windows [][]cacheEntry
+	gossip  int
+}
+
+func newMsgCache(history, gossip int) *msgCache {
+	return &msgCache{
+		msgs:    make(map[string]*Message),
+		windows: make([][]cacheEntry, history),
+		gossip:  gossip,
+	}
+}
+
+func (c *msgCache) put(m *Message) {
+	if _, ok := c.msgs[m.ID]; ok {
+		return
+	}
+	c.msgs[m.ID] = m
+	c.windows[0] = append(c.windows[0], cacheEntry{id: m.ID, topic: m.Topic})
+}
+
+func (c *msgCache) get(id string) (*Message, bool) {
+	m, ok := c.msgs[id]
+	return m, ok
+}
+
+// gossipIDs 返回最近 gossip 个窗口里属于 topic 的消息 ID
+func (c *msgCache) gossipIDs(topic string) []string {
+	var ids []string
+	for i := 0; i < c.gossip && i < len(c.windows); i++ {
+		for _, e := range c.windows[i] {
+			if e.topic == topic {
+				ids = append(ids, e.id)
+			}
+		}
+	}
+	return ids
+}
+
+// shift 开始一个新窗口，丢掉最老的
+func (c *msgCache) shift() {
+	last := c.windows[len(c.windows)-1]
+	for _, e := range last {
+		delete(c.msgs, e.id)
+	}
+	copy(c.windows[1:], c.windows[:len(c.windows)-1])
+	c.windows[0] = nil
+}
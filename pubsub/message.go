@@ -0,0 +1,142 @@
+package pubsub
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+
+	"envelop/peer"
+	"envelop/rpc"
+)
+
+/*
+==========================================================
+ Message：一条 pubsub 消息
+==========================================================
+
+  签名 = ed25519(sha256("envelop-pubsub-v1" | From | Seq | Topic | Data))
+  ID   = hex(sha256(签名摘要 | Key | Sig)[:16])   整条消息（连同签名）算出来，用于去重 / IHAVE / IWANT
+
+ID 不能只用 From + Seq：谁都能用别人的 From 和下一个序号先发一条不签名的，
+真正签了名的那条到的时候已经“见过”了，会被当成重复丢掉。内容不同 ID 就不同，冒充的占不了位置。
+
+签名是可选的（PubSub.Sign）：
+  - 带签名的消息：Key 推出的 PeerID 必须等于 From，且签名正确，否则丢弃
+  - 不带签名的消息：PubSub.Strict 为 true（New 时有 kp 就默认打开）时丢弃，否则照常接收（From 只能信一半）
+==========================================================
+*/
+
+const signDomain = "envelop-pubsub-v1"
+
+// Message 是一条 pubsub 消息
+type Message struct {
+	ID    string
+	From  peer.PeerID // 发布者
+	Seq   uint64
+	Topic string
+	Data  []byte
+
+	Key ed25519.PublicKey // 签名消息才有
+	Sig []byte
+
+	// ReceivedFrom：从哪个邻居收到的（不参与签名，不上线）
+	ReceivedFrom peer.PeerID
+}
+
+// msgID 由整条消息（内容和签名）算出消息 ID
+func msgID(m *Message) string {
+	var buf [8]byte
+	h := sha256.New()
+	h.Write(m.digest())
+	for _, b := range [][]byte{m.Key, m.Sig} {
+		binary.BigEndian.PutUint64(buf[:], uint64(len(b)))
+		h.Write(buf[:])
+		h.Write(b)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// Signed 判断消息是否带签名
+func (m *Message) Signed() bool {
+	return len(m.Sig) > 0
+}
+
+func (m *Message) digest() []byte {
+	var buf [8]byte
+	h := sha256.New()
+	h.Write([]byte(signDomain))
+	h.Write(m.From[:])
+	binary.BigEndian.PutUint64(buf[:], m.Seq)
+	h.Write(buf[:])
+
+	binary.BigEndian.PutUint64(buf[:], uint64(len(m.Topic)))
+	h.Write(buf[:])
+	h.Write([]byte(m.Topic))
+
+	binary.BigEndian.PutUint64(buf[:], uint64(len(m.Data)))
+	h.Write(buf[:])
+	h.Write(m.Data)
+	return h.Sum(nil)
+}
+
+// sign 用 kp 给消息签名（kp 必须就是 From）
+func (m *Message) sign(kp *peer.KeyPair) {
+	m.Key = kp.PublicKey
+	m.Sig = ed25519.Sign(kp.PrivateKey, m.digest())
+}
+
+// Verify 检查签名，以及签名者就是 From
+func (m *Message) Verify() error {
+	if len(m.Key) != ed25519.PublicKeySize || len(m.Sig) != ed25519.SignatureSize {
+		return rpc.Errorf(rpc.CodeInvalidArgument, "malformed message signature")
+	}
+	if peer.NewPeerIDFromPubKey(m.Key) != m.From {
+		return rpc.Errorf(rpc.CodeInvalidArgument, "message signed by someone other than its publisher")
+	}
+	if !ed25519.Verify(m.Key, m.digest(), m.Sig) {
+		return rpc.Errorf(rpc.CodeInvalidArgument, "invalid message signature")
+	}
+	return nil
+}
+
+// wireMessage 是 Message 的线上格式
+type wireMessage struct {
+	From  string `json:"f"` // PeerIDToDomain
+	Seq   uint64 `json:"s"`
+	Topic string `json:"t"`
+	Data  []byte `json:"d,omitempty"`
+	Key   []byte `json:"k,omitempty"`
+	Sig   []byte `json:"g,omitempty"`
+}
+
+func (m *Message) toWire() wireMessage {
+	return wireMessage{
+		From:  peer.PeerIDToDomain(m.From),
+		Seq:   m.Seq,
+		Topic: m.Topic,
+		Data:  m.Data,
+		Key:   m.Key,
+		Sig:   m.Sig,
+	}
+}
+
+func (w wireMessage) toMessage() (*Message, error) {
+	from, err := peer.DomainToPeerID(w.From)
+	if err != nil {
+		return nil, rpc.Errorf(rpc.CodeInvalidArgument, "bad publisher: %v", err)
+	}
+	if w.Topic == "" {
+		return nil, rpc.Errorf(rpc.CodeInvalidArgument, "empty topic")
+	}
+	m := &Message{
+		From:  from,
+		Seq:   w.Seq,
+		Topic: w.Topic,
+		Data:  w.Data,
+		Key:   w.Key,
+		Sig:   w.Sig,
+	}
+	m.ID = msgID(m)
+	return m, nil
+}
@@ -0,0 +1,691 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"envelop/clock"
+	"envelop/peer"
+	"envelop/rpc"
+)
+
+/*
+==========================================================
+ PubSub：基于 gossip 的发布 / 订阅（GossipSub 的简化版）
+==========================================================
+
+Socket.Send 只能一对一。PubSub 在 RPC 通知（rpc.Endpoint.Notify）之上做一对多：
+
+  订阅关系
+      每个节点把“自己订阅了哪些 topic”（完整列表）告诉邻居（pubsub.Subscribe）；
+      第一次告诉某个邻居时带上 hello，对方收到 hello 就把它的列表回给我们
+      （对方重启过、忘了我们也一样：它会重新带 hello 来）。
+      邻居 = Peers()（一般是路由表里的节点）+ 主动联系过我们的节点。
+      邻居离开 Peers()，或者连续 maxNotifyFailures 次发不过去，就把它从订阅关系和 mesh 里删掉，
+      下次心跳 mesh 度数不够时从别的订阅者里补。每个邻居最多记 maxPeerTopics 个 topic。
+
+  mesh（每个 topic 一张）
+      从订阅了同一 topic 的邻居里选 D 个，互相 GRAFT，组成一张稀疏的网。
+      完整消息只沿 mesh 转发；心跳时维护度数：
+          < Dlo → 补 GRAFT 到 D
+          > Dhi → 随机 PRUNE 到 D
+
+  gossip
+      心跳时对不在 mesh 里的 Dlazy 个订阅者发 IHAVE（最近几个周期的消息 ID），
+      对方缺哪条就回 IWANT，我们从 msgCache 里把完整消息发过去。
+      mesh 断掉的地方靠它补上。
+
+  去重
+      消息 ID = 整条消息（连同签名）的哈希；seenCache 里见过的直接丢弃，不会重复投递、不会转圈。
+
+  发布
+      自己发布的消息发给所有已知订阅者（flood publish），刚 Join、mesh 还没建好时也能送到；
+      不会投递给自己的 Messages()。
+
+线上协议（都是 RPC 单向通知，负载是 JSON）：
+      pubsub.Subscribe  {"t": [topic...], "h": true}            我现在订阅的全部 topic（h：请回你的列表）
+      pubsub.Publish    {"m": [message...]}                     完整消息
+      pubsub.Control    {"g": [...], "p": [...], "h": [...], "w": [...]}  GRAFT / PRUNE / IHAVE / IWANT
+==========================================================
+*/
+
+// RPC 方法名
+const (
+	MethodSubscribe = "pubsub.Subscribe"
+	MethodPublish   = "pubsub.Publish"
+	MethodControl   = "pubsub.Control"
+)
+
+// 默认参数（和 GossipSub 的推荐值一致）
+const (
+	DefaultD         = 6
+	DefaultDlo       = 4
+	DefaultDhi       = 12
+	DefaultDlazy     = 6
+	DefaultHeartbeat = time.Second
+	DefaultSeenTTL   = 2 * time.Minute
+
+	// MaxMessageSize：单条消息 Data 的上限（整条还要装进一个 Envelope）
+	MaxMessageSize = 32 << 10
+
+	historyLength = 5   // msgCache 保留几个心跳周期
+	historyGossip = 3   // IHAVE 广播最近几个周期
+	maxIHaveIDs   = 256 // 一条 IHAVE 最多带多少个 ID
+	topicBuffer   = 128 // Topic.Messages() 的缓冲
+
+	maxPeerTopics     = 256 // 一个邻居最多订阅多少个 topic（多了不收）
+	maxNotifyFailures = 3   // 连续发送失败几次就当这个邻居走了
+)
+
+// NotifyFunc 给 dest 发一条 RPC 单向通知（签名和 rpc.Endpoint.Notify 一致）
+type NotifyFunc func(dest peer.PeerID, method string, data []byte) error
+
+// PubSub 是一个节点上的发布 / 订阅子系统
+type PubSub struct {
+	Self   peer.PeerID
+	Key    *peer.KeyPair        // 签名用（Sign 为 true 时必须有）
+	Notify NotifyFunc           // 发给邻居
+	Peers  func() []peer.PeerID // 候选邻居（可选，一般是路由表里的节点）
+
+	Sign   bool // 自己发布的消息带签名
+	Strict bool // 只接受带签名、且验签通过的消息（有 kp 时默认打开）
+
+	D, Dlo, Dhi, Dlazy int           // mesh 度数参数，0 用默认值
+	Heartbeat          time.Duration // 心跳周期，0 用 DefaultHeartbeat
+
+	// Clock / Rand（可选）：去重 / 缓存过期、序号起点用的时钟和选邻居的随机数，
+	// nil = 系统时钟 / crypto/rand；sim 里换成虚拟的
+	Clock clock.Clock
+	Rand  io.Reader
+
+	mu         sync.Mutex
+	topics     map[string]*Topic               // 已加入的 topic
+	peerTopics map[peer.PeerID]map[string]bool // 邻居订阅了哪些 topic
+	announced  map[peer.PeerID]bool            // 已经把订阅列表告诉过谁
+	listed     map[peer.PeerID]bool            // 上一次 Peers() 给出的邻居
+	failures   map[peer.PeerID]int             // 连续发送失败次数
+	seen       *seenCache
+	mcache     *msgCache
+	seq        uint64
+}
+
+// New 创建一个 PubSub；kp 不为 nil 时默认签名，并且只收签了名的消息
+func New(kp *peer.KeyPair, notify NotifyFunc, peers func() []peer.PeerID) *PubSub {
+	ps := &PubSub{
+		Key:        kp,
+		Notify:     notify,
+		Peers:      peers,
+		Sign:       kp != nil,
+		Strict:     kp != nil,
+		topics:     make(map[string]*Topic),
+		peerTopics: make(map[peer.PeerID]map[string]bool),
+		announced:  make(map[peer.PeerID]bool),
+		listed:     make(map[peer.PeerID]bool),
+		failures:   make(map[peer.PeerID]int),
+		seen:       newSeenCache(DefaultSeenTTL),
+		mcache:     newMsgCache(historyLength, historyGossip),
+	}
+	if kp != nil {
+		ps.Self = kp.PeerID
+	}
+	return ps
+}
+
+func (ps *PubSub) now() time.Time { return clock.Or(ps.Clock).Now() }
+
+// shuffle 打乱 ids：先按 PeerID 排好（它们来自 map，顺序不定），同一个 Rand 才能打乱出同样的结果
+func (ps *PubSub) shuffle(ids []peer.PeerID) {
+	sort.Slice(ids, func(i, j int) bool { return bytes.Compare(ids[i][:], ids[j][:]) < 0 })
+	clock.Shuffle(ps.Rand, len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+}
+
+func (ps *PubSub) d() int     { return orDefault(ps.D, DefaultD) }
+func (ps *PubSub) dlo() int   { return orDefault(ps.Dlo, DefaultDlo) }
+func (ps *PubSub) dhi() int   { return orDefault(ps.Dhi, DefaultDhi) }
+func (ps *PubSub) dlazy() int { return orDefault(ps.Dlazy, DefaultDlazy) }
+
+func orDefault(v, def int) int {
+	if v > 0 {
+		return v
+	}
+	return def
+}
+
+// Mount 把 pubsub 的 RPC 方法注册到 s 上
+func (ps *PubSub) Mount(s *rpc.Server) {
+	s.RegisterWithCaller(rpc.MethodInfo{
+		Name:        MethodSubscribe,
+		Version:     "1",
+		Description: "pubsub: the full list of topics the caller subscribes to",
+	}, ps.handleSubscribe)
+
+	s.RegisterWithCaller(rpc.MethodInfo{
+		Name:        MethodPublish,
+		Version:     "1",
+		Description: "pubsub: full messages pushed along the mesh or requested by IWANT",
+	}, ps.handlePublish)
+
+	s.RegisterWithCaller(rpc.MethodInfo{
+		Name:        MethodControl,
+		Version:     "1",
+		Description: "pubsub: GRAFT / PRUNE / IHAVE / IWANT",
+	}, ps.handleControl)
+}
+
+// Start 启动心跳（维护 mesh + gossip），ctx 取消时停止；interval<=0 时用 HeartbeatInterval
+func (ps *PubSub) Start(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = ps.HeartbeatInterval()
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				ps.heartbeat()
+			}
+		}
+	}()
+}
+
+/*
+==========================================================
+ 线上格式
+==========================================================
+*/
+
+type subscribeRequest struct {
+	Topics []string `json:"t"`
+	Hello  bool     `json:"h,omitempty"` // 第一次告诉对方：请它把列表回过来
+}
+
+type publishRequest struct {
+	Msgs []wireMessage `json:"m"`
+}
+
+type ihave struct {
+	Topic string   `json:"t"`
+	IDs   []string `json:"i"`
+}
+
+type controlRequest struct {
+	Graft []string `json:"g,omitempty"`
+	Prune []string `json:"p,omitempty"`
+	IHave []ihave  `json:"h,omitempty"`
+	IWant []string `json:"w,omitempty"`
+}
+
+func (c *controlRequest) empty() bool {
+	return len(c.Graft) == 0 && len(c.Prune) == 0 && len(c.IHave) == 0 && len(c.IWant) == 0
+}
+
+// outbox 收集在锁里决定要发的东西，出锁之后再统一发
+type outbox struct {
+	subs    map[peer.PeerID]bool // 要发订阅列表的邻居 → 带不带 hello
+	control map[peer.PeerID]*controlRequest
+	publish map[peer.PeerID][]wireMessage
+}
+
+func newOutbox() *outbox {
+	return &outbox{
+		subs:    make(map[peer.PeerID]bool),
+		control: make(map[peer.PeerID]*controlRequest),
+		publish: make(map[peer.PeerID][]wireMessage),
+	}
+}
+
+func (o *outbox) ctl(p peer.PeerID) *controlRequest {
+	c := o.control[p]
+	if c == nil {
+		c = &controlRequest{}
+		o.control[p] = c
+	}
+	return c
+}
+
+// flush 把 outbox 里的东西发出去（每个邻居一个 goroutine，慢邻居不拖累别人）
+func (ps *PubSub) flush(o *outbox) {
+	if ps.Notify == nil {
+		return
+	}
+	var topics []string
+	if len(o.subs) > 0 {
+		topics = ps.topicNames()
+	}
+	send := func(p peer.PeerID, method string, v any) {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return
+		}
+		go func() {
+			err := ps.Notify(p, method, b)
+			ps.noteSend(p, err)
+			if err != nil {
+				log.Printf("[PubSub] %s to %s failed: %v", method, peer.PeerIDToDomain(p), err)
+			}
+		}()
+	}
+	for p, hello := range o.subs {
+		send(p, MethodSubscribe, subscribeRequest{Topics: topics, Hello: hello})
+	}
+	for p, c := range o.control {
+		if !c.empty() {
+			send(p, MethodControl, c)
+		}
+	}
+	for p, msgs := range o.publish {
+		send(p, MethodPublish, publishRequest{Msgs: msgs})
+	}
+}
+
+// noteSend 记下一次发给 p 的结果：连续失败 maxNotifyFailures 次就把 p 忘掉
+func (ps *PubSub) noteSend(p peer.PeerID, err error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if err == nil {
+		delete(ps.failures, p)
+		return
+	}
+	ps.failures[p]++
+	if ps.failures[p] >= maxNotifyFailures {
+		log.Printf("[PubSub] %s unreachable, dropping it", peer.PeerIDToDomain(p))
+		ps.dropPeerLocked(p)
+	}
+}
+
+// dropPeerLocked 把邻居 p 从订阅关系和所有 mesh 里删掉（调用方持有 mu）
+func (ps *PubSub) dropPeerLocked(p peer.PeerID) {
+	delete(ps.peerTopics, p)
+	delete(ps.announced, p)
+	delete(ps.failures, p)
+	for _, t := range ps.topics {
+		delete(t.mesh, p)
+	}
+}
+
+// topicNames 返回已加入的 topic
+func (ps *PubSub) topicNames() []string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	names := make([]string, 0, len(ps.topics))
+	for name := range ps.topics {
+		names = append(names, name)
+	}
+	return names
+}
+
+/*
+==========================================================
+ 订阅关系
+==========================================================
+*/
+
+// knownPeers 返回所有邻居：Peers() + 联系过我们的（Peers 在锁外调用）。
+// 上次在 Peers() 里、这次不在了的邻居顺便忘掉。
+func (ps *PubSub) knownPeers() []peer.PeerID {
+	var ids []peer.PeerID
+	if ps.Peers != nil {
+		ids = ps.Peers()
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	seen := make(map[peer.PeerID]bool, len(ids))
+	var out []peer.PeerID
+	for _, id := range ids {
+		if !id.Equals(ps.Self) && !seen[id] {
+			seen[id] = true
+			out = append(out, id)
+		}
+	}
+	if ps.Peers != nil {
+		for id := range ps.listed {
+			if !seen[id] {
+				ps.dropPeerLocked(id)
+			}
+		}
+		ps.listed = seen
+	}
+	for id := range ps.peerTopics {
+		if !seen[id] {
+			seen[id] = true
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// announceAll 把订阅列表告诉所有邻居（Join / Leave 之后调用）
+func (ps *PubSub) announceAll() {
+	peers := ps.knownPeers()
+	o := newOutbox()
+	ps.mu.Lock()
+	for _, p := range peers {
+		o.subs[p] = !ps.announced[p]
+		ps.announced[p] = true
+	}
+	ps.mu.Unlock()
+	ps.flush(o)
+}
+
+func (ps *PubSub) handleSubscribe(caller rpc.CallerInfo, data []byte) ([]byte, error) {
+	if !caller.Verified || caller.ID.Equals(ps.Self) {
+		return nil, rpc.Errorf(rpc.CodeUnauthenticated, "pubsub: unsigned caller")
+	}
+	var req subscribeRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, rpc.Errorf(rpc.CodeInvalidArgument, "bad subscribe: %v", err)
+	}
+	if len(req.Topics) > maxPeerTopics {
+		return nil, rpc.Errorf(rpc.CodeResourceExhausted, "pubsub: too many topics (%d > %d)", len(req.Topics), maxPeerTopics)
+	}
+
+	p := caller.ID
+	o := newOutbox()
+	ps.mu.Lock()
+	set := make(map[string]bool, len(req.Topics))
+	for _, t := range req.Topics {
+		set[t] = true
+	}
+	ps.peerTopics[p] = set
+	// 退订了的 topic：从 mesh 里拿掉
+	for name, t := range ps.topics {
+		if !set[name] {
+			delete(t.mesh, p)
+		}
+	}
+	// 对方第一次告诉我们（hello，可能是重启过），或者我们还没告诉过它：把我们的列表回给它
+	if req.Hello || !ps.announced[p] {
+		ps.announced[p] = true
+		o.subs[p] = false
+	}
+	delete(ps.failures, p)
+	ps.mu.Unlock()
+
+	ps.flush(o)
+	return nil, nil
+}
+
+/*
+==========================================================
+ 消息
+==========================================================
+*/
+
+// publish 发布一条本地消息（Topic.Publish 调用）
+func (ps *PubSub) publish(topic string, data []byte) error {
+	if len(data) > MaxMessageSize {
+		return rpc.Errorf(rpc.CodeInvalidArgument, "pubsub: message too large (%d > %d)", len(data), MaxMessageSize)
+	}
+	if ps.Sign && ps.Key == nil {
+		return rpc.Errorf(rpc.CodeFailedPrecondition, "pubsub: signing enabled but no key")
+	}
+
+	ps.mu.Lock()
+	if ps.seq == 0 {
+		ps.seq = uint64(ps.now().UnixNano()) // 起点用当前时间：重启后序号不会和之前的重复
+	}
+	ps.seq++
+	m := &Message{
+		From:         ps.Self,
+		Seq:          ps.seq,
+		Topic:        topic,
+		Data:         append([]byte(nil), data...),
+		ReceivedFrom: ps.Self,
+	}
+	ps.mu.Unlock()
+
+	if ps.Sign {
+		m.sign(ps.Key)
+	}
+	m.ID = msgID(m)
+
+	o := newOutbox()
+	now := ps.now()
+	ps.mu.Lock()
+	ps.seen.add(m.ID, now)
+	ps.mcache.put(m)
+	// flood publish：所有已知订阅者 + mesh
+	targets := make(map[peer.PeerID]bool)
+	for p, set := range ps.peerTopics {
+		if set[topic] {
+			targets[p] = true
+		}
+	}
+	if t := ps.topics[topic]; t != nil {
+		for p := range t.mesh {
+			targets[p] = true
+		}
+	}
+	for p := range targets {
+		o.publish[p] = append(o.publish[p], m.toWire())
+	}
+	ps.mu.Unlock()
+
+	ps.flush(o)
+	return nil
+}
+
+func (ps *PubSub) handlePublish(caller rpc.CallerInfo, data []byte) ([]byte, error) {
+	if !caller.Verified || caller.ID.Equals(ps.Self) {
+		return nil, rpc.Errorf(rpc.CodeUnauthenticated, "pubsub: unsigned caller")
+	}
+	var req publishRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, rpc.Errorf(rpc.CodeInvalidArgument, "bad publish: %v", err)
+	}
+
+	p := caller.ID
+	o := newOutbox()
+	now := ps.now()
+	for _, w := range req.Msgs {
+		m, err := w.toMessage()
+		if err != nil || m.From.Equals(ps.Self) || len(m.Data) > MaxMessageSize {
+			continue
+		}
+		if m.Signed() {
+			if err := m.Verify(); err != nil {
+				log.Printf("[PubSub] drop message from %s: %v", peer.PeerIDToDomain(p), err)
+				continue
+			}
+		} else if ps.Strict {
+			continue
+		}
+		m.ReceivedFrom = p
+
+		ps.mu.Lock()
+		if !ps.seen.add(m.ID, now) {
+			ps.mu.Unlock()
+			continue
+		}
+		ps.mcache.put(m)
+		t := ps.topics[m.Topic]
+		if t != nil {
+			t.deliver(m)
+			// 沿 mesh 继续转发（不回给来源和发布者）
+			for q := range t.mesh {
+				if q.Equals(p) || q.Equals(m.From) {
+					continue
+				}
+				o.publish[q] = append(o.publish[q], w)
+			}
+		}
+		ps.mu.Unlock()
+	}
+
+	ps.flush(o)
+	return nil, nil
+}
+
+/*
+==========================================================
+ 控制消息：GRAFT / PRUNE / IHAVE / IWANT
+==========================================================
+*/
+
+func (ps *PubSub) handleControl(caller rpc.CallerInfo, data []byte) ([]byte, error) {
+	if !caller.Verified || caller.ID.Equals(ps.Self) {
+		return nil, rpc.Errorf(rpc.CodeUnauthenticated, "pubsub: unsigned caller")
+	}
+	var req controlRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, rpc.Errorf(rpc.CodeInvalidArgument, "bad control: %v", err)
+	}
+
+	p := caller.ID
+	o := newOutbox()
+	now := ps.now()
+	ps.mu.Lock()
+
+	for _, name := range req.Graft {
+		t := ps.topics[name]
+		if t == nil {
+			// 我们没订阅这个 topic：拒绝
+			o.ctl(p).Prune = append(o.ctl(p).Prune, name)
+			continue
+		}
+		t.mesh[p] = true
+		set := ps.peerTopics[p]
+		if set == nil {
+			set = make(map[string]bool)
+			ps.peerTopics[p] = set
+		}
+		set[name] = true
+	}
+
+	for _, name := range req.Prune {
+		if t := ps.topics[name]; t != nil {
+			delete(t.mesh, p)
+		}
+	}
+
+	var want []string
+	for _, h := range req.IHave {
+		if ps.topics[h.Topic] == nil {
+			continue
+		}
+		for _, id := range h.IDs {
+			if !ps.seen.has(id, now) && len(want) < maxIHaveIDs {
+				want = append(want, id)
+			}
+		}
+	}
+	if len(want) > 0 {
+		o.ctl(p).IWant = want
+	}
+
+	for _, id := range req.IWant {
+		if m, ok := ps.mcache.get(id); ok {
+			o.publish[p] = append(o.publish[p], m.toWire())
+		}
+	}
+
+	ps.mu.Unlock()
+	ps.flush(o)
+	return nil, nil
+}
+
+/*
+==========================================================
+ 心跳：维护 mesh + gossip
+==========================================================
+*/
+
+// HeartbeatInterval 返回心跳周期（Heartbeat，为 0 时 DefaultHeartbeat）
+func (ps *PubSub) HeartbeatInterval() time.Duration {
+	if ps.Heartbeat > 0 {
+		return ps.Heartbeat
+	}
+	return DefaultHeartbeat
+}
+
+// Tick 手动做一次心跳。一般由 Start 的定时器调用；
+// 自己驱动时钟的场合（例如 sim 包的虚拟时间）可以直接调它。
+func (ps *PubSub) Tick() {
+	ps.heartbeat()
+}
+
+func (ps *PubSub) heartbeat() {
+	peers := ps.knownPeers()
+
+	o := newOutbox()
+	now := ps.now()
+	ps.mu.Lock()
+
+	// 新邻居：告诉它我们订阅了什么（带 hello，它会回它的列表）
+	for _, p := range peers {
+		if !ps.announced[p] {
+			ps.announced[p] = true
+			o.subs[p] = true
+		}
+	}
+
+	d, dlo, dhi := ps.d(), ps.dlo(), ps.dhi()
+	for name, t := range ps.topics {
+		// 订阅者里不在 mesh 的（候选）
+		var candidates []peer.PeerID
+		for p, set := range ps.peerTopics {
+			if !set[name] {
+				delete(t.mesh, p) // 已经退订
+				continue
+			}
+			if !t.mesh[p] {
+				candidates = append(candidates, p)
+			}
+		}
+		ps.shuffle(candidates)
+
+		// 度数太低：补 GRAFT
+		if len(t.mesh) < dlo {
+			for len(t.mesh) < d && len(candidates) > 0 {
+				p := candidates[0]
+				candidates = candidates[1:]
+				t.mesh[p] = true
+				o.ctl(p).Graft = append(o.ctl(p).Graft, name)
+			}
+		}
+
+		// 度数太高：随机 PRUNE 到 D
+		if len(t.mesh) > dhi {
+			members := make([]peer.PeerID, 0, len(t.mesh))
+			for p := range t.mesh {
+				members = append(members, p)
+			}
+			ps.shuffle(members)
+			for _, p := range members[d:] {
+				delete(t.mesh, p)
+				o.ctl(p).Prune = append(o.ctl(p).Prune, name)
+			}
+		}
+
+		// gossip：给不在 mesh 里的订阅者发 IHAVE
+		ids := ps.mcache.gossipIDs(name)
+		if len(ids) > maxIHaveIDs {
+			ids = ids[len(ids)-maxIHaveIDs:]
+		}
+		if len(ids) > 0 {
+			n := 0
+			for _, p := range candidates {
+				if t.mesh[p] || n >= ps.dlazy() {
+					continue
+				}
+				o.ctl(p).IHave = append(o.ctl(p).IHave, ihave{Topic: name, IDs: ids})
+				n++
+			}
+		}
+	}
+
+	ps.mcache.shift()
+	ps.seen.sweep(now)
+	ps.mu.Unlock()
+
+	ps.flush(o)
+}
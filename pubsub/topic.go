@@ -0,0 +1,139 @@
+package pubsub
+
+import (
+	"log"
+
+	"envelop/peer"
+	"envelop/rpc"
+)
+
+/*
+==========================================================
+ Topic：Join 返回的句柄
+==========================================================
+
+  t, _ := ps.Join("jobs")
+  t.Publish([]byte("job-42"))
+  for m := range t.Messages() { ... }
+  t.Close()   // 退订：告诉邻居、PRUNE 掉 mesh，Messages() 通道关闭
+
+同一个 topic 同时只能 Join 一次（Close 之后可以再 Join）。
+==========================================================
+*/
+
+// Topic 是一个已加入的 topic
+type Topic struct {
+	ps   *PubSub
+	name string
+
+	// 以下字段由 ps.mu 保护
+	mesh   map[peer.PeerID]bool
+	msgs   chan *Message
+	closed bool
+}
+
+// Join 订阅 topic：告诉邻居，开始组 mesh（下一次心跳）
+func (ps *PubSub) Join(topic string) (*Topic, error) {
+	if topic == "" {
+		return nil, rpc.Errorf(rpc.CodeInvalidArgument, "pubsub: empty topic")
+	}
+	ps.mu.Lock()
+	if ps.topics[topic] != nil {
+		ps.mu.Unlock()
+		return nil, rpc.Errorf(rpc.CodeAlreadyExists, "pubsub: already joined %q", topic)
+	}
+	t := &Topic{
+		ps:   ps,
+		name: topic,
+		mesh: make(map[peer.PeerID]bool),
+		msgs: make(chan *Message, topicBuffer),
+	}
+	ps.topics[topic] = t
+	ps.mu.Unlock()
+
+	ps.announceAll()
+	return t, nil
+}
+
+// Topics 返回已加入的 topic 名字
+func (ps *PubSub) Topics() []string {
+	return ps.topicNames()
+}
+
+// Subscribers 返回已知订阅了 topic 的邻居
+func (ps *PubSub) Subscribers(topic string) []peer.PeerID {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	var out []peer.PeerID
+	for p, set := range ps.peerTopics {
+		if set[topic] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// Name 返回 topic 名字
+func (t *Topic) Name() string { return t.name }
+
+// Publish 发布一条消息
+func (t *Topic) Publish(data []byte) error {
+	t.ps.mu.Lock()
+	closed := t.closed
+	t.ps.mu.Unlock()
+	if closed {
+		return rpc.Errorf(rpc.CodeFailedPrecondition, "pubsub: topic %q closed", t.name)
+	}
+	return t.ps.publish(t.name, data)
+}
+
+// Messages 返回收到的消息（不包括自己发布的）；Close 之后通道关闭
+func (t *Topic) Messages() <-chan *Message {
+	return t.msgs
+}
+
+// MeshPeers 返回当前 mesh 里的邻居
+func (t *Topic) MeshPeers() []peer.PeerID {
+	t.ps.mu.Lock()
+	defer t.ps.mu.Unlock()
+	out := make([]peer.PeerID, 0, len(t.mesh))
+	for p := range t.mesh {
+		out = append(out, p)
+	}
+	return out
+}
+
+// Close 退订：从 PubSub 里移除，PRUNE 掉 mesh，把新的订阅列表告诉邻居
+func (t *Topic) Close() error {
+	ps := t.ps
+	o := newOutbox()
+	ps.mu.Lock()
+	if t.closed {
+		ps.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	delete(ps.topics, t.name)
+	for p := range t.mesh {
+		o.ctl(p).Prune = append(o.ctl(p).Prune, t.name)
+	}
+	t.mesh = make(map[peer.PeerID]bool)
+	close(t.msgs)
+	ps.mu.Unlock()
+
+	ps.flush(o)
+	ps.announceAll()
+	return nil
+}
+
+// deliver 把消息放进 Messages()（调用方持有 ps.mu；满了就丢，不阻塞网络）
+func (t *Topic) deliver(m *Message) {
+	if t.closed {
+		return
+	}
+	select {
+	case t.msgs <- m:
+	default:
+		log.Printf("[PubSub] topic %q: message channel full, drop %s", t.name, m.ID)
+	}
+}
@@ -0,0 +1,444 @@
+// Package punch 实现由 relay 协调的 UDP 打洞。
+package punch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"envelop/peer"
+	"envelop/rpc"
+)
+
+/*
+==========================================================
+ 打洞（hole punching）
+==========================================================
+
+两个都在 NAT 后面的节点 A、B，谁也拨不进谁；但它们都连着同一个 relay
+（REGISTER 过，relay 从它们拨进来的连接上看得到 NAT 映射出来的公网地址）。
+
+  1. Observe   A → relay：“你看到的我是什么地址？”
+                 relay 返回它那条连接的对端地址（A 的公网映射）
+  2. Connect   A → relay：“帮我和 B 打洞，这是我的候选地址”
+  3. Sync      relay → B：“A 要和你打洞，这是 A 的候选地址（relay 看到的 + A 自己报的）”
+                 B 回复自己的候选地址，并立刻开始拨 A
+  4. relay 把 B 的候选地址（relay 看到的 + B 自己报的）返回给 A，A 开始拨 B
+
+两边几乎同时拨号，而且都从监听的那个 UDP socket 拨出去（QUICTransport 复用监听 socket），
+于是各自的 NAT 上都有了“放行对方”的映射，总有一个方向能握手成功。
+在 Timeout 内都没拨通（例如有一边是对称型 NAT）就返回 ErrPunchFailed，
+上层改走 relay 转发（见 host.Connect）。
+
+安全：
+  - 三个方法都要求调用方签名（rpc.CallerInfo.Verified）
+  - Sync 只接受 TrustRelay 过的节点发来的（否则谁都能让我们去拨任意地址）
+  - relay 只替和它有连接的节点（Observed 非空）协调 Connect，同一个调用方
+    ConnectInterval 内只协调一次；候选地址每边最多 MaxCandidates 个，
+    Sync / Connect 收到的多出来的也不拨：不能拿信任 relay 的节点当“反射器”去拨一堆第三方地址
+
+候选地址的顺序就是优先级：relay 看到的公网地址在前，自己的监听地址在后
+（两边在同一个内网时，监听地址能直接通）。所有候选并发拨，第一个拨通、而且确认了
+对方身份的胜出：内网地址换了个内网可能是个不相干的节点，握手成功不代表接通的就是对方
+（Dial 负责确认，见 netquic.Node.Connect）。
+==========================================================
+*/
+
+// 协议方法名
+const (
+	MethodObserve = "punch.Observe"
+	MethodConnect = "punch.Connect"
+	MethodSync    = "punch.Sync"
+)
+
+// 默认参数
+const (
+	DefaultTimeout         = 5 * time.Second
+	DefaultConnectInterval = time.Second
+	defaultRPCTimeout      = 5 * time.Second
+
+	// MaxCandidates：一边最多报 / 拨多少个候选地址
+	MaxCandidates = 8
+
+	maxConnectCallers = 1024 // 记多少个调用方的上次 Connect 时间，超了清掉过期的
+)
+
+// ErrPunchFailed：协调成功了，但在打洞窗口内一个候选地址都没拨通
+var ErrPunchFailed = errors.New("punch: no candidate address reachable")
+
+// observeResponse 是 Observe 的返回值（参数为空）
+type observeResponse struct {
+	Addrs []string `json:"a"`
+}
+
+// connectRequest / connectResponse 是 Connect 的参数和返回值
+type connectRequest struct {
+	Target string   `json:"target"`
+	Addrs  []string `json:"a,omitempty"`
+}
+
+type connectResponse struct {
+	Addrs []string `json:"a"`
+}
+
+// syncRequest / syncResponse 是 Sync 的参数和返回值
+type syncRequest struct {
+	Peer  string   `json:"peer"`
+	Addrs []string `json:"a"`
+}
+
+type syncResponse struct {
+	Addrs []string `json:"a,omitempty"`
+}
+
+// Service 同时是打洞的发起方 / 接收方，以及（挂在 relay 上时的）协调方
+type Service struct {
+	self peer.PeerID
+	call rpc.PeerCallFunc
+
+	// Timeout：打洞窗口，两边同时拨号的最长时间（0 → DefaultTimeout）
+	Timeout time.Duration
+	// RPCTimeout：单次 Observe / Connect / Sync 调用的超时（0 → 5s）
+	RPCTimeout time.Duration
+	// ConnectInterval（relay 侧）：同一个调用方两次 Connect 之间至少隔多久（0 → DefaultConnectInterval）
+	ConnectInterval time.Duration
+
+	// ListenAddrs：本节点的监听地址（作为候选地址报给对方）
+	ListenAddrs func() []string
+
+	// Observed（relay 侧）：我看到的 id 的地址，一般是 id 拨进来那条连接的对端地址
+	Observed func(id peer.PeerID) []string
+
+	// Dial：从监听 socket 拨 id 的 addr，确认接通的就是 id 之后把连接留在连接池里
+	// （一般接 netquic.Node.Connect）；接通的不是 id 要返回错误
+	Dial func(ctx context.Context, id peer.PeerID, addr string) error
+
+	// OnDirect（可选）：和 id 在 addr 上打通了
+	OnDirect func(id peer.PeerID, addr string)
+
+	mu       sync.Mutex
+	observed map[peer.PeerID][]string  // relay → 它最近一次告诉我的、我的公网地址
+	relays   map[peer.PeerID]bool      // 接受谁发来的 Sync
+	connects map[peer.PeerID]time.Time // relay 侧：调用方 → 上次 Connect 的时间
+}
+
+// New 创建一个打洞服务
+//   - self：本节点 PeerID
+//   - call：远程调用函数（一般是 rpc.Endpoint.Call）
+func New(self peer.PeerID, call rpc.PeerCallFunc) *Service {
+	return &Service{
+		self:            self,
+		call:            call,
+		Timeout:         DefaultTimeout,
+		RPCTimeout:      defaultRPCTimeout,
+		ConnectInterval: DefaultConnectInterval,
+		observed:        make(map[peer.PeerID][]string),
+		relays:          make(map[peer.PeerID]bool),
+		connects:        make(map[peer.PeerID]time.Time),
+	}
+}
+
+func (s *Service) timeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return DefaultTimeout
+}
+
+func (s *Service) rpcTimeout() time.Duration {
+	if s.RPCTimeout > 0 {
+		return s.RPCTimeout
+	}
+	return defaultRPCTimeout
+}
+
+func (s *Service) connectInterval() time.Duration {
+	if s.ConnectInterval > 0 {
+		return s.ConnectInterval
+	}
+	return DefaultConnectInterval
+}
+
+// allowConnect 记下 caller 这次 Connect；离上次不到 ConnectInterval 时返回 false
+func (s *Service) allowConnect(caller peer.PeerID) bool {
+	now := time.Now()
+	interval := s.connectInterval()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if last, ok := s.connects[caller]; ok && now.Sub(last) < interval {
+		return false
+	}
+	if len(s.connects) >= maxConnectCallers {
+		for id, last := range s.connects {
+			if now.Sub(last) >= interval {
+				delete(s.connects, id)
+			}
+		}
+	}
+	s.connects[caller] = now
+	return true
+}
+
+// Mount 把打洞协议方法挂到 RPC Server 上
+func (s *Service) Mount(srv *rpc.Server) {
+	srv.RegisterWithCaller(rpc.MethodInfo{
+		Name:        MethodObserve,
+		Version:     "1",
+		Description: "punch OBSERVE: return the caller's address as seen by this node",
+	}, s.handleObserve)
+
+	srv.RegisterWithCaller(rpc.MethodInfo{
+		Name:        MethodConnect,
+		Version:     "1",
+		Description: "punch CONNECT: exchange candidate addresses with target and start a simultaneous dial",
+	}, s.handleConnect)
+
+	srv.RegisterWithCaller(rpc.MethodInfo{
+		Name:        MethodSync,
+		Version:     "1",
+		Description: "punch SYNC: a relay asks us to dial a peer that is dialing us",
+	}, s.handleSync)
+}
+
+// TrustRelay 接受 relay 发来的 Sync（一般在 REGISTER 到这个 relay 时调用）
+func (s *Service) TrustRelay(relay peer.PeerID) {
+	s.mu.Lock()
+	s.relays[relay] = true
+	s.mu.Unlock()
+}
+
+func (s *Service) trusted(id peer.PeerID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.relays[id]
+}
+
+// ObservedAddrs 返回各个 relay 最近一次告诉我的、我的公网地址（按 relay 排好，去重）
+func (s *Service) ObservedAddrs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	relays := make([]peer.PeerID, 0, len(s.observed))
+	for id := range s.observed {
+		relays = append(relays, id)
+	}
+	sort.Slice(relays, func(i, j int) bool { return bytes.Compare(relays[i][:], relays[j][:]) < 0 })
+	var out []string
+	for _, id := range relays {
+		out = appendUnique(out, s.observed[id]...)
+	}
+	return out
+}
+
+// candidates 返回本节点的候选地址：看到的公网地址在前，监听地址在后，最多 MaxCandidates 个
+func (s *Service) candidates() []string {
+	out := s.ObservedAddrs()
+	if s.ListenAddrs != nil {
+		out = appendUnique(out, s.ListenAddrs()...)
+	}
+	return capCandidates(out)
+}
+
+/*
+==========================================================
+ 发起方
+==========================================================
+*/
+
+// Observe 问 relay 它看到的我的地址，记下来作为之后的候选地址（替换这个 relay 上次说的）。
+// 需要先 REGISTER 到 relay（relay 要有一条我拨进去的连接）。
+func (s *Service) Observe(relay peer.PeerID) ([]string, error) {
+	resp, err := s.call(relay, MethodObserve, nil, s.rpcTimeout())
+	if err != nil {
+		return nil, err
+	}
+	var out observeResponse
+	if err := json.Unmarshal(resp.Data, &out); err != nil {
+		return nil, rpc.Errorf(rpc.CodeInternal, "bad observe response: %v", err)
+	}
+
+	s.mu.Lock()
+	s.observed[relay] = capCandidates(appendUnique(nil, out.Addrs...))
+	s.mu.Unlock()
+	return out.Addrs, nil
+}
+
+// Connect 通过 relay 和 target 打洞，返回拨通的地址。
+// 拨通的连接已经在连接池里，之后 SendToPeer(target) 直接走它。
+// 协调成功但没拨通时返回 ErrPunchFailed，其它错误说明 relay 或 target 联系不上。
+func (s *Service) Connect(ctx context.Context, relay, target peer.PeerID) (string, error) {
+	req, _ := json.Marshal(connectRequest{
+		Target: peer.PeerIDToDomain(target),
+		Addrs:  s.candidates(),
+	})
+	resp, err := s.call(relay, MethodConnect, req, s.rpcTimeout())
+	if err != nil {
+		return "", err
+	}
+	var out connectResponse
+	if err := json.Unmarshal(resp.Data, &out); err != nil {
+		return "", rpc.Errorf(rpc.CodeInternal, "bad connect response: %v", err)
+	}
+	return s.dialAny(ctx, target, out.Addrs)
+}
+
+// dialAny 在打洞窗口内并发拨候选地址（最多前 MaxCandidates 个），
+// 第一个拨通（Dial 确认过身份）的胜出，其余的取消
+func (s *Service) dialAny(ctx context.Context, id peer.PeerID, addrs []string) (string, error) {
+	addrs = capCandidates(addrs)
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("%w: no candidates for %s", ErrPunchFailed, peer.PeerIDToDomain(id))
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.timeout())
+	defer cancel()
+
+	type result struct {
+		addr string
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	for _, addr := range addrs {
+		go func() {
+			results <- result{addr: addr, err: s.Dial(ctx, id, addr)}
+		}()
+	}
+
+	var lastErr error
+	for range addrs {
+		r := <-results
+		if r.err == nil {
+			if s.OnDirect != nil {
+				s.OnDirect(id, r.addr)
+			}
+			return r.addr, nil
+		}
+		lastErr = r.err
+	}
+	return "", fmt.Errorf("%w: %v", ErrPunchFailed, lastErr)
+}
+
+/*
+==========================================================
+ 服务端：relay 上的 Observe / Connect，接收方的 Sync
+==========================================================
+*/
+
+func (s *Service) handleObserve(caller rpc.CallerInfo, data []byte) ([]byte, error) {
+	if !caller.Verified {
+		return nil, rpc.Errorf(rpc.CodeUnauthenticated, "observe requires a signed request")
+	}
+	var addrs []string
+	if s.Observed != nil {
+		addrs = s.Observed(caller.ID)
+	}
+	if len(addrs) == 0 {
+		return nil, rpc.Errorf(rpc.CodeNotFound, "no connection from %s", peer.PeerIDToDomain(caller.ID))
+	}
+	return json.Marshal(observeResponse{Addrs: addrs})
+}
+
+func (s *Service) handleConnect(caller rpc.CallerInfo, data []byte) ([]byte, error) {
+	if !caller.Verified {
+		return nil, rpc.Errorf(rpc.CodeUnauthenticated, "connect requires a signed request")
+	}
+	var req connectRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, rpc.Errorf(rpc.CodeInvalidArgument, "bad connect: %v", err)
+	}
+	if len(req.Addrs) > MaxCandidates {
+		return nil, rpc.Errorf(rpc.CodeInvalidArgument, "too many candidates (%d > %d)", len(req.Addrs), MaxCandidates)
+	}
+	target, err := peer.DomainToPeerID(req.Target)
+	if err != nil {
+		return nil, rpc.Errorf(rpc.CodeInvalidArgument, "bad target: %v", err)
+	}
+
+	// A 的候选：我看到的在前，A 自己报的在后。和我没有连接的不协调
+	var fromAddrs []string
+	if s.Observed != nil {
+		fromAddrs = s.Observed(caller.ID)
+	}
+	if len(fromAddrs) == 0 {
+		return nil, rpc.Errorf(rpc.CodeFailedPrecondition, "no connection from %s", peer.PeerIDToDomain(caller.ID))
+	}
+	if !s.allowConnect(caller.ID) {
+		return nil, rpc.Errorf(rpc.CodeResourceExhausted, "connect from %s too frequent", peer.PeerIDToDomain(caller.ID))
+	}
+	fromAddrs = capCandidates(appendUnique(fromAddrs, req.Addrs...))
+
+	syncReq, _ := json.Marshal(syncRequest{
+		Peer:  peer.PeerIDToDomain(caller.ID),
+		Addrs: fromAddrs,
+	})
+	resp, err := s.call(target, MethodSync, syncReq, s.rpcTimeout())
+	if err != nil {
+		return nil, rpc.Errorf(rpc.CodeUnavailable, "sync with %s failed: %v", req.Target, err)
+	}
+	var syncResp syncResponse
+	if err := json.Unmarshal(resp.Data, &syncResp); err != nil {
+		return nil, rpc.Errorf(rpc.CodeInternal, "bad sync response: %v", err)
+	}
+
+	// B 的候选，同样我看到的在前
+	var targetAddrs []string
+	if s.Observed != nil {
+		targetAddrs = s.Observed(target)
+	}
+	targetAddrs = capCandidates(appendUnique(targetAddrs, syncResp.Addrs...))
+	log.Printf("[Punch] 协调 %s ↔ %s", peer.PeerIDToDomain(caller.ID), req.Target)
+	return json.Marshal(connectResponse{Addrs: targetAddrs})
+}
+
+func (s *Service) handleSync(caller rpc.CallerInfo, data []byte) ([]byte, error) {
+	if !caller.Verified || !s.trusted(caller.ID) {
+		return nil, rpc.Errorf(rpc.CodePermissionDenied, "sync only accepted from a registered relay")
+	}
+	var req syncRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, rpc.Errorf(rpc.CodeInvalidArgument, "bad sync: %v", err)
+	}
+	from, err := peer.DomainToPeerID(req.Peer)
+	if err != nil {
+		return nil, rpc.Errorf(rpc.CodeInvalidArgument, "bad peer: %v", err)
+	}
+
+	// 马上开始拨：对方收到我们的回复之后也会开始拨
+	go func() {
+		if addr, err := s.dialAny(context.Background(), from, req.Addrs); err != nil {
+			log.Printf("[Punch] 拨 %s 没有成功（对方拨进来也行）：%v", req.Peer, err)
+		} else {
+			log.Printf("[Punch] 和 %s 打通：%s", req.Peer, addr)
+		}
+	}()
+	return json.Marshal(syncResponse{Addrs: s.candidates()})
+}
+
+// capCandidates 只留前 MaxCandidates 个候选地址
+func capCandidates(addrs []string) []string {
+	if len(addrs) > MaxCandidates {
+		return addrs[:MaxCandidates]
+	}
+	return addrs
+}
+
+// appendUnique 把 addrs 里 dst 还没有的追加进去
+func appendUnique(dst []string, addrs ...string) []string {
+	for _, a := range addrs {
+		dup := false
+		for _, d := range dst {
+			if d == a {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			dst = append(dst, a)
+		}
+	}
+	return dst
+}
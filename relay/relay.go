@@ -0,0 +1,585 @@
+// Package relay 实现带预约和资源限制的中继（circuit relay）。
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"envelop/envelop"
+	"envelop/peer"
+	"envelop/rpc"
+)
+
+/*
+==========================================================
+ Circuit relay：预约 + circuit + 限额
+==========================================================
+
+默认情况下 Router 只要信封不是给自己的就“TTL 减一、转发”，
+谁都可以拿任何节点当中继，流量不受限制。开启 relay 服务的节点改成：
+
+  Reserve   A → relay：“给我留个位置”
+              relay 记下预约（ReservationTTL 内有效，A 要定期续约），
+              返回 A 的中继地址 "relay:<relay 域名>"，A 把它和自己的其它地址一起发布出去
+  Connect   B → relay：“我要经你联系 A”
+              A 必须有有效的预约；两边各自的 circuit 数不能超过 MaxCircuitsPerPeer
+              relay 开一条 A ↔ B 的 circuit，返回它的时长 / 流量限制
+
+之后 relay 只转发“上一跳 / 下一跳”正好是某条 circuit 两端的信封（两个方向都算）。
+上一跳是交给 relay 的那条连接属于的节点（签名 REGISTER 认出来的），
+不看信封头里的 ReturnPeerID / DestPeerID：那是发送方自己填的，
+按它判断的话谁都能冒用别人的 circuit。每条 circuit：
+  - CircuitDuration 之后关闭
+  - 一共最多转发 CircuitData 字节，用完之后到关闭为止不再转发（circuit 保留）
+  - 每秒最多 CircuitRate 字节（令牌桶，桶容量也是 CircuitRate），超出的信封丢弃，circuit 保留
+还开着的 circuit 再 Connect 一次拿到的还是它（剩下的时长和流量），重开不会多出额度；
+关闭后发起方要重新 Connect（重新占用配额）。预约过期时，它上面的 circuit 一起关闭。
+
+不开 relay 服务的节点保持原来的行为（什么都转发）；也可以完全不转发（Deny）。
+==========================================================
+*/
+
+// 协议方法名
+const (
+	MethodReserve = "relay.Reserve"
+	MethodConnect = "relay.Connect"
+)
+
+// 默认参数
+const (
+	DefaultMaxReservations    = 128
+	DefaultReservationTTL     = time.Hour
+	DefaultMaxCircuitsPerPeer = 16
+	DefaultCircuitDuration    = 10 * time.Minute
+	DefaultCircuitData        = 8 << 20   // 字节
+	DefaultCircuitRate        = 128 << 10 // 字节 / 秒
+	DefaultRefreshInterval    = time.Minute
+	defaultRPCTimeout         = 5 * time.Second
+)
+
+// 中继地址的前缀："relay:<relay 域名>" 表示“经这个 relay 可达”
+const addrPrefix = "relay:"
+
+// Addr 返回经 relay 中继的地址
+func Addr(relay peer.PeerID) string {
+	return addrPrefix + peer.PeerIDToDomain(relay)
+}
+
+// ParseAddr 解析中继地址，返回 relay 的 PeerID；不是中继地址时 ok=false
+func ParseAddr(addr string) (peer.PeerID, bool) {
+	domain, ok := strings.CutPrefix(addr, addrPrefix)
+	if !ok {
+		return peer.PeerID{}, false
+	}
+	id, err := peer.DomainToPeerID(domain)
+	if err != nil {
+		return peer.PeerID{}, false
+	}
+	return id, true
+}
+
+// Deny 可以直接用作 Router.Admit：什么都不转发
+func Deny(*envelop.Envelope, peer.PeerID, peer.PeerID) bool { return false }
+
+// Limits 是 relay 侧的资源限制，字段为 0 时用对应的默认值
+type Limits struct {
+	MaxReservations    int           // 同时有效的预约数
+	ReservationTTL     time.Duration // 预约有效期（客户端要在这之前续约）
+	MaxCircuitsPerPeer int           // 每个节点同时参与的 circuit 数（发起方、预约方都算）
+	CircuitDuration    time.Duration // 每条 circuit 最长存活时间
+	CircuitData        int64         // 每条 circuit 最多转发的字节数
+	CircuitRate        int           // 每条 circuit 每秒最多转发的字节数
+}
+
+func (l Limits) maxReservations() int {
+	if l.MaxReservations > 0 {
+		return l.MaxReservations
+	}
+	return DefaultMaxReservations
+}
+
+func (l Limits) reservationTTL() time.Duration {
+	if l.ReservationTTL > 0 {
+		return l.ReservationTTL
+	}
+	return DefaultReservationTTL
+}
+
+func (l Limits) maxCircuitsPerPeer() int {
+	if l.MaxCircuitsPerPeer > 0 {
+		return l.MaxCircuitsPerPeer
+	}
+	return DefaultMaxCircuitsPerPeer
+}
+
+func (l Limits) circuitDuration() time.Duration {
+	if l.CircuitDuration > 0 {
+		return l.CircuitDuration
+	}
+	return DefaultCircuitDuration
+}
+
+func (l Limits) circuitData() int64 {
+	if l.CircuitData > 0 {
+		return l.CircuitData
+	}
+	return DefaultCircuitData
+}
+
+func (l Limits) circuitRate() int {
+	if l.CircuitRate > 0 {
+		return l.CircuitRate
+	}
+	return DefaultCircuitRate
+}
+
+// reserveResponse 是 Reserve 的返回值（参数为空）
+type reserveResponse struct {
+	Addr    string `json:"addr"`
+	Expires int64  `json:"exp"` // Unix 秒
+}
+
+// connectRequest / connectResponse 是 Connect 的参数和返回值
+type connectRequest struct {
+	Target string `json:"target"`
+}
+
+type connectResponse struct {
+	Expires int64 `json:"exp"`  // Unix 秒
+	Data    int64 `json:"data"` // 字节
+	Rate    int   `json:"rate"` // 字节 / 秒
+}
+
+// Reservation 是客户端在某个 relay 上的预约
+type Reservation struct {
+	Relay   peer.PeerID
+	Addr    string // 中继地址，和自己的其它地址一起发布
+	Expires time.Time
+
+	granted time.Duration // 这次预约给了多长时间，用来决定什么时候续约
+}
+
+// Circuit 是 Connect 拿到的一条 circuit 的限制
+type Circuit struct {
+	Relay   peer.PeerID
+	Target  peer.PeerID
+	Expires time.Time
+	Data    int64 // 最多转发的字节数
+	Rate    int   // 每秒最多转发的字节数
+}
+
+// Stats 是 relay 侧的统计
+type Stats struct {
+	Reservations int    // 当前有效的预约
+	Circuits     int    // 当前打开的 circuit
+	Forwarded    uint64 // 放行的信封
+	Refused      uint64 // 拒绝的信封（没有 circuit / circuit 关闭 / 超速）
+}
+
+// circuitKey 是 circuit 两端的 PeerID（小的在前，两个方向共用一条）
+type circuitKey struct {
+	a, b peer.PeerID
+}
+
+func keyOf(x, y peer.PeerID) circuitKey {
+	if bytes.Compare(x[:], y[:]) > 0 {
+		x, y = y, x
+	}
+	return circuitKey{a: x, b: y}
+}
+
+// circuit 是 relay 侧一条打开的 circuit
+type circuit struct {
+	expires time.Time
+	data    int64 // 剩余字节数
+	tokens  float64
+	refill  time.Time
+}
+
+// Service 同时是 relay 客户端（Reserve / Connect）和（Mount 之后的）relay 服务端
+type Service struct {
+	self peer.PeerID
+	call rpc.PeerCallFunc
+
+	// Limits：作为 relay 时的资源限制（Mount 之后生效）
+	Limits Limits
+	// RPCTimeout：单次 Reserve / Connect 调用的超时（0 → 5s）
+	RPCTimeout time.Duration
+
+	// OnAddrsChanged（可选）：客户端的中继地址变了（预约成功 / 过期），参数是新的中继地址。在锁外调用。
+	OnAddrsChanged func(addrs []string)
+
+	mu sync.Mutex
+
+	// relay 侧
+	reservations map[peer.PeerID]time.Time // 预约方 → 到期时间
+	circuits     map[circuitKey]*circuit
+	perPeer      map[peer.PeerID]int // 每个节点参与的 circuit 数
+	forwarded    uint64
+	refused      uint64
+
+	// 客户端
+	held map[peer.PeerID]Reservation // relay → 我在它上面的预约
+}
+
+// New 创建一个 relay 服务
+//   - self：本节点 PeerID
+//   - call：远程调用函数（一般是 rpc.Endpoint.Call）
+func New(self peer.PeerID, call rpc.PeerCallFunc) *Service {
+	return &Service{
+		self:         self,
+		call:         call,
+		RPCTimeout:   defaultRPCTimeout,
+		reservations: make(map[peer.PeerID]time.Time),
+		circuits:     make(map[circuitKey]*circuit),
+		perPeer:      make(map[peer.PeerID]int),
+		held:         make(map[peer.PeerID]Reservation),
+	}
+}
+
+func (s *Service) rpcTimeout() time.Duration {
+	if s.RPCTimeout > 0 {
+		return s.RPCTimeout
+	}
+	return defaultRPCTimeout
+}
+
+// Mount 把 relay 服务端挂到 RPC Server 上（开始接受预约）；
+// 转发限制还要把 Admit 设为 Router.Admit 才生效
+func (s *Service) Mount(srv *rpc.Server) {
+	srv.RegisterWithCaller(rpc.MethodInfo{
+		Name:        MethodReserve,
+		Version:     "1",
+		Description: "relay RESERVE: reserve a slot so that others can reach the caller through this relay",
+	}, s.handleReserve)
+
+	srv.RegisterWithCaller(rpc.MethodInfo{
+		Name:        MethodConnect,
+		Version:     "1",
+		Description: "relay CONNECT: open a limited circuit to a peer holding a reservation",
+	}, s.handleConnect)
+}
+
+/*
+==========================================================
+ 客户端
+==========================================================
+*/
+
+// Reserve 在 relay 上预约（已经有预约时就是续约），返回中继地址和到期时间。
+// relay 要能联系到我（一般先 REGISTER 过去），才能把别人的信封转给我。
+func (s *Service) Reserve(relay peer.PeerID) (Reservation, error) {
+	resp, err := s.call(relay, MethodReserve, nil, s.rpcTimeout())
+	if err != nil {
+		return Reservation{}, err
+	}
+	var out reserveResponse
+	if err := json.Unmarshal(resp.Data, &out); err != nil {
+		return Reservation{}, rpc.Errorf(rpc.CodeInternal, "bad reserve response: %v", err)
+	}
+	expires := time.Unix(out.Expires, 0)
+	res := Reservation{
+		Relay:   relay,
+		Addr:    out.Addr,
+		Expires: expires,
+		granted: time.Until(expires),
+	}
+
+	s.mu.Lock()
+	_, renewed := s.held[relay]
+	s.held[relay] = res
+	s.mu.Unlock()
+
+	if !renewed {
+		log.Printf("[Relay] 在 %s 上预约成功：%s", peer.PeerIDToDomain(relay), res.Addr)
+		s.notify()
+	}
+	return res, nil
+}
+
+// Connect 请 relay 开一条到 target 的 circuit（target 要在 relay 上有预约）。
+// 已经有一条还开着的，relay 返回的就是它剩下的时长和流量。
+// 之后发给 target 的信封交给 relay 转发即可（路由表里记 target 经 relay 可达）。
+func (s *Service) Connect(relay, target peer.PeerID) (Circuit, error) {
+	req, _ := json.Marshal(connectRequest{Target: peer.PeerIDToDomain(target)})
+	resp, err := s.call(relay, MethodConnect, req, s.rpcTimeout())
+	if err != nil {
+		return Circuit{}, err
+	}
+	var out connectResponse
+	if err := json.Unmarshal(resp.Data, &out); err != nil {
+		return Circuit{}, rpc.Errorf(rpc.CodeInternal, "bad connect response: %v", err)
+	}
+	return Circuit{
+		Relay:   relay,
+		Target:  target,
+		Expires: time.Unix(out.Expires, 0),
+		Data:    out.Data,
+		Rate:    out.Rate,
+	}, nil
+}
+
+// Reservations 返回我持有的、还没过期的预约
+func (s *Service) Reservations() []Reservation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var out []Reservation
+	for _, res := range s.held {
+		if now.Before(res.Expires) {
+			out = append(out, res)
+		}
+	}
+	return out
+}
+
+// Addrs 返回我的中继地址（每个有效预约一个）
+func (s *Service) Addrs() []string {
+	var out []string
+	for _, res := range s.Reservations() {
+		out = append(out, res.Addr)
+	}
+	return out
+}
+
+// Refresh 续约剩余时间不到一半的预约；续不上而且已经过期的丢掉
+func (s *Service) Refresh() {
+	now := time.Now()
+	s.mu.Lock()
+	var due []peer.PeerID
+	for relay, res := range s.held {
+		if res.Expires.Sub(now) < res.granted/2 {
+			due = append(due, relay)
+		}
+	}
+	s.mu.Unlock()
+
+	dropped := false
+	for _, relay := range due {
+		_, err := s.Reserve(relay)
+		if err == nil {
+			continue
+		}
+		log.Printf("[Relay] 在 %s 上续约失败：%v", peer.PeerIDToDomain(relay), err)
+		s.mu.Lock()
+		if res, ok := s.held[relay]; ok && !time.Now().Before(res.Expires) {
+			delete(s.held, relay)
+			dropped = true
+		}
+		s.mu.Unlock()
+	}
+	if dropped {
+		s.notify()
+	}
+}
+
+func (s *Service) notify() {
+	if s.OnAddrsChanged != nil {
+		s.OnAddrsChanged(s.Addrs())
+	}
+}
+
+/*
+==========================================================
+ relay 侧：Reserve / Connect / Admit
+==========================================================
+*/
+
+func (s *Service) handleReserve(caller rpc.CallerInfo, data []byte) ([]byte, error) {
+	if !caller.Verified {
+		return nil, rpc.Errorf(rpc.CodeUnauthenticated, "reserve requires a signed request")
+	}
+	now := time.Now()
+	s.mu.Lock()
+	_, renew := s.reservations[caller.ID]
+	if !renew && s.activeReservationsLocked(now) >= s.Limits.maxReservations() {
+		s.mu.Unlock()
+		return nil, rpc.Errorf(rpc.CodeResourceExhausted, "relay has no free reservation slots")
+	}
+	expires := now.Add(s.Limits.reservationTTL())
+	s.reservations[caller.ID] = expires
+	s.mu.Unlock()
+
+	if !renew {
+		log.Printf("[Relay] %s 预约了中继", peer.PeerIDToDomain(caller.ID))
+	}
+	return json.Marshal(reserveResponse{Addr: Addr(s.self), Expires: expires.Unix()})
+}
+
+func (s *Service) handleConnect(caller rpc.CallerInfo, data []byte) ([]byte, error) {
+	if !caller.Verified {
+		return nil, rpc.Errorf(rpc.CodeUnauthenticated, "connect requires a signed request")
+	}
+	var req connectRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, rpc.Errorf(rpc.CodeInvalidArgument, "bad connect: %v", err)
+	}
+	target, err := peer.DomainToPeerID(req.Target)
+	if err != nil {
+		return nil, rpc.Errorf(rpc.CodeInvalidArgument, "bad target: %v", err)
+	}
+	if target == caller.ID || target == s.self {
+		return nil, rpc.Errorf(rpc.CodeInvalidArgument, "cannot relay to %s", req.Target)
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if exp, ok := s.reservations[target]; !ok || !now.Before(exp) {
+		return nil, rpc.Errorf(rpc.CodeFailedPrecondition, "%s has no reservation on this relay", req.Target)
+	}
+
+	// 已经有一条还没到期的 → 就用它，剩下的时长和流量不变（重开不能换来新的额度）
+	key := keyOf(caller.ID, target)
+	if c, ok := s.circuits[key]; ok {
+		if now.Before(c.expires) {
+			return json.Marshal(connectResponse{Expires: c.expires.Unix(), Data: c.data, Rate: s.Limits.circuitRate()})
+		}
+		s.closeLocked(key)
+	}
+	max := s.Limits.maxCircuitsPerPeer()
+	if s.perPeer[caller.ID] >= max || s.perPeer[target] >= max {
+		return nil, rpc.Errorf(rpc.CodeResourceExhausted, "too many circuits for %s or %s",
+			peer.PeerIDToDomain(caller.ID), req.Target)
+	}
+
+	rate := s.Limits.circuitRate()
+	c := &circuit{
+		expires: now.Add(s.Limits.circuitDuration()),
+		data:    s.Limits.circuitData(),
+		tokens:  float64(rate),
+		refill:  now,
+	}
+	s.circuits[key] = c
+	s.perPeer[caller.ID]++
+	s.perPeer[target]++
+
+	log.Printf("[Relay] 打开 circuit %s ↔ %s", peer.PeerIDToDomain(caller.ID), req.Target)
+	return json.Marshal(connectResponse{Expires: c.expires.Unix(), Data: c.data, Rate: rate})
+}
+
+// Admit 判断 env 能不能经本节点转发（接 Router.Admit）：
+// 上一跳 from ↔ 下一跳 nextHop 要有一条打开的 circuit，而且没超出它的流量限制。
+// 不知道上一跳是谁（from 为零值）的不转发。
+func (s *Service) Admit(env *envelop.Envelope, from, nextHop peer.PeerID) bool {
+	size := 0
+	if b, err := envelop.Marshal(env); err == nil {
+		size = len(b)
+	}
+
+	now := time.Now()
+	key := keyOf(from, nextHop)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.circuits[key]
+	if from.IsZero() || !ok {
+		s.refused++
+		return false
+	}
+	if !now.Before(c.expires) {
+		log.Printf("[Relay] circuit %s ↔ %s 到期，关闭",
+			peer.PeerIDToDomain(key.a), peer.PeerIDToDomain(key.b))
+		s.closeLocked(key)
+		s.refused++
+		return false
+	}
+	// 流量用完：不关，到期之前重新 Connect 也拿不到新的流量
+	if int64(size) > c.data {
+		s.refused++
+		return false
+	}
+
+	// 令牌桶：按经过的时间补充，桶容量 = 每秒的量
+	rate := float64(s.Limits.circuitRate())
+	c.tokens += now.Sub(c.refill).Seconds() * rate
+	if c.tokens > rate {
+		c.tokens = rate
+	}
+	c.refill = now
+	if c.tokens < float64(size) {
+		s.refused++
+		return false
+	}
+	c.tokens -= float64(size)
+	c.data -= int64(size)
+	s.forwarded++
+	return true
+}
+
+// Expire 丢掉过期的预约和 circuit（预约过期时，它上面的 circuit 一起关闭）
+func (s *Service) Expire() {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, exp := range s.reservations {
+		if !now.Before(exp) {
+			delete(s.reservations, id)
+		}
+	}
+	for key, c := range s.circuits {
+		_, aok := s.reservations[key.a]
+		_, bok := s.reservations[key.b]
+		if !now.Before(c.expires) || (!aok && !bok) {
+			s.closeLocked(key)
+		}
+	}
+}
+
+// Start 在后台每 interval 跑一次 Expire（relay 侧）和 Refresh（客户端），
+// interval <= 0 → DefaultRefreshInterval，ctx 结束时退出
+func (s *Service) Start(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultRefreshInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.Expire()
+				s.Refresh()
+			}
+		}
+	}()
+}
+
+// Stats 返回 relay 侧的统计
+func (s *Service) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Stats{
+		Reservations: s.activeReservationsLocked(time.Now()),
+		Circuits:     len(s.circuits),
+		Forwarded:    s.forwarded,
+		Refused:      s.refused,
+	}
+}
+
+func (s *Service) activeReservationsLocked(now time.Time) int {
+	n := 0
+	for _, exp := range s.reservations {
+		if now.Before(exp) {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *Service) closeLocked(key circuitKey) {
+	delete(s.circuits, key)
+	for _, id := range []peer.PeerID{key.a, key.b} {
+		if s.perPeer[id]--; s.perPeer[id] <= 0 {
+			delete(s.perPeer, id)
+		}
+	}
+}
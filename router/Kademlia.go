@@ -1,10 +1,14 @@
 package router
 
 import (
+	"fmt"
+	"io"
 	"math/bits"
 	"sort"
 	"sync"
+	"time"
 
+	"envelop/clock"
 	"envelop/peer"
 )
 
@@ -35,27 +39,74 @@ import (
         }
 
 真正的 Kademlia 还会有：
-  - FIND_NODE / FIND_VALUE RPC
+  - FIND_NODE / FIND_VALUE RPC        → 网络协议在 dht 包里（PING / FIND_NODE / 迭代查找）
   - bucket 按“距离区间”分层
   - bucket 满时的替换策略（k-bucket）
-这里先做一个足够讲解“XOR 距离 + k-bucket”概念的精简版。
+本文件只是“表”本身：XOR 距离 + k-bucket + 桶刷新需要的辅助函数。
+
+k-bucket 满了怎么办（Kademlia 偏爱“活得久的节点”）：
+
+  - 新节点不直接挤掉旧节点，而是先进这个桶的“候补队列”（replacement cache）
+  - 如果注入了 Pinger：异步 ping 桶里最久没见过的节点
+        活着 → 它留下（移到队尾），新节点继续候补
+        死了 → 把它踢掉，候补队列里最新的一个顶上
+  - 没有 Pinger 时：旧节点一律保留，新节点只能候补
+  - 每个节点记录 lastSeen 和连续失败次数：
+        RecordFailure 累计到 MaxFailures（比如 PeerManager 发送连续失败）→ 直接移除并用候补顶上
+        Update / RecordSuccess → 刷新 lastSeen、清零失败次数
+
+这样攻击者没法靠“不停地报新 ID”把表里稳定的老节点挤出去。
 ==========================================================
 */
 
 // 默认 K 值（每个桶最多多少节点）
 const kBucketSize = 8
 
+// K 是对外暴露的桶大小，DHT 查找时“最近 K 个节点”也用这个值
+const K = kBucketSize
+
+// DefaultMaxFailures：连续失败多少次后把节点移出路由表
+const DefaultMaxFailures = 3
+
 // KademliaTable 代表一张 Kademlia 路由表
 type KademliaTable struct {
 	selfID peer.PeerID
 
+	// Pinger：桶满时用来检查最旧节点是否还活着（一般接 DHT.Ping）。
+	// 在 goroutine 里调用，不持有表的锁；为 nil 时不做检查，旧节点一律保留。
+	Pinger func(id peer.PeerID) bool
+
+	// MaxFailures：连续失败多少次后移除（<=0 → DefaultMaxFailures）
+	MaxFailures int
+
+	// Clock / Rand（可选）：lastSeen / 桶刷新时间和刷新目标的随机数来源，
+	// nil = 系统时钟 / crypto/rand；sim 里换成虚拟的
+	Clock clock.Clock
+	Rand  io.Reader
+
 	mu      sync.RWMutex
 	buckets [256]*bucket // 256-bit ID → 256 个桶
 }
 
-// bucket：每个桶里放若干 PeerID（最多 kBucketSize）
+// entry：桶里的一个节点
+type entry struct {
+	id       peer.PeerID
+	lastSeen time.Time // 最近一次确认它活着的时间
+	failures int       // 连续失败次数
+}
+
+// bucket：每个桶里放若干节点（最多 kBucketSize），按 lastSeen 从旧到新排列
 type bucket struct {
-	peers []peer.PeerID
+	peers []*entry
+
+	// replacements：候补队列（最多 kBucketSize，队尾最新）
+	replacements []*entry
+
+	// pinging：正在 ping 队头节点，避免同一个桶并发 ping
+	pinging bool
+
+	// lastLookup：最近一次对这个桶范围做查找的时间（给刷新定时器用）
+	lastLookup time.Time
 }
 
 // NewKademliaTable 创建一张以 selfID 为中心的路由表
@@ -65,6 +116,58 @@ func NewKademliaTable(self peer.PeerID) *KademliaTable {
 	}
 }
 
+// find 返回 id 在 peers 里的下标，没有返回 -1
+func (b *bucket) find(id peer.PeerID) int {
+	for i, e := range b.peers {
+		if e.id.Equals(id) {
+			return i
+		}
+	}
+	return -1
+}
+
+// removeAt 删掉 peers[i]，并用候补队列里最新的一个顶上
+func (b *bucket) removeAt(i int) {
+	b.peers = append(b.peers[:i], b.peers[i+1:]...)
+	if n := len(b.replacements); n > 0 {
+		b.peers = append(b.peers, b.replacements[n-1])
+		b.replacements = b.replacements[:n-1]
+	}
+}
+
+// touch 把 peers[i] 标记为“刚见过”并移到队尾
+func (b *bucket) touch(i int, now time.Time) {
+	e := b.peers[i]
+	e.lastSeen = now
+	e.failures = 0
+	copy(b.peers[i:], b.peers[i+1:])
+	b.peers[len(b.peers)-1] = e
+}
+
+// addReplacement 把 id 放进候补队尾（已在队列里就挪到队尾），超出容量丢最旧的
+func (b *bucket) addReplacement(id peer.PeerID, now time.Time) {
+	for i, e := range b.replacements {
+		if e.id.Equals(id) {
+			b.replacements = append(b.replacements[:i], b.replacements[i+1:]...)
+			break
+		}
+	}
+	b.replacements = append(b.replacements, &entry{id: id, lastSeen: now})
+	if len(b.replacements) > kBucketSize {
+		b.replacements = b.replacements[1:]
+	}
+}
+
+// dropReplacement 把 id 从候补队列里删掉
+func (b *bucket) dropReplacement(id peer.PeerID) {
+	for i, e := range b.replacements {
+		if e.id.Equals(id) {
+			b.replacements = append(b.replacements[:i], b.replacements[i+1:]...)
+			return
+		}
+	}
+}
+
 /*
 ==========================================================
  距离 / 桶下标 计算
@@ -108,12 +211,13 @@ func bucketIndex(a, b peer.PeerID) int {
 ==========================================================
 */
 
-// Update 把一个 peerID 插入对应的 k-bucket 中
-// 规则（简化版）：
+// Update 表示“刚和 id 成功通信过”，把它插入 / 刷新到对应的 k-bucket：
 //   - 自己的 ID 不插入
-//   - 若 bucket 里已有这个 ID，则移动到末尾（表示最近使用）
-//   - 若 bucket 未满（<kBucketSize），append 到末尾
-//   - 若 bucket 已满，简单丢弃最旧的一个（演示版，不做复杂替换）
+//   - 已在桶里：移到队尾，刷新 lastSeen，清零失败次数
+//   - 桶未满：append 到队尾
+//   - 桶已满：先进候补队列；
+//     队头（最久没见过的）已经连续失败 MaxFailures 次 → 直接替换，
+//     否则有 Pinger 时异步 ping 队头，死了才替换
 func (t *KademliaTable) Update(id peer.PeerID) {
 	if id.Equals(t.selfID) {
 		return
@@ -127,32 +231,66 @@ func (t *KademliaTable) Update(id peer.PeerID) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
+	now := clock.Or(t.Clock).Now()
 	b := t.buckets[idx]
 	if b == nil {
 		b = &bucket{}
 		t.buckets[idx] = b
 	}
 
-	// 1. 如果已存在，移动到末尾
-	for i, p := range b.peers {
-		if p.Equals(id) {
-			// 移动到末尾（LRU 语义：最近使用）
-			copy(b.peers[i:], b.peers[i+1:])
-			b.peers[len(b.peers)-1] = id
-			return
-		}
+	// 1. 如果已存在，移动到末尾（LRU 语义：最近见过）
+	if i := b.find(id); i >= 0 {
+		b.touch(i, now)
+		return
 	}
 
 	// 2. 不存在，但桶未满
 	if len(b.peers) < kBucketSize {
-		b.peers = append(b.peers, id)
+		b.dropReplacement(id)
+		b.peers = append(b.peers, &entry{id: id, lastSeen: now})
+		return
+	}
+
+	// 3. 桶已满：先候补
+	b.addReplacement(id, now)
+
+	oldest := b.peers[0]
+	if oldest.failures >= t.maxFailures() {
+		b.removeAt(0)
+		return
+	}
+	if t.Pinger != nil && !b.pinging {
+		b.pinging = true
+		go t.checkOldest(idx, oldest.id)
+	}
+}
+
+// checkOldest 在锁外 ping 桶 idx 的队头节点，根据结果保留或替换
+func (t *KademliaTable) checkOldest(idx int, id peer.PeerID) {
+	alive := t.Pinger(id)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.buckets[idx]
+	b.pinging = false
+
+	i := b.find(id)
+	if i < 0 {
+		return // ping 期间已经被移除
+	}
+	if alive {
+		b.touch(i, clock.Or(t.Clock).Now())
 		return
 	}
+	b.removeAt(i)
+}
 
-	// 3. 桶已满：简单丢弃最旧的一个（队头），再插入队尾
-	//   真正的 Kademlia 会 ping 最旧节点判断是否可用，这里略过
-	copy(b.peers[0:], b.peers[1:])
-	b.peers[len(b.peers)-1] = id
+func (t *KademliaTable) maxFailures() int {
+	if t.MaxFailures > 0 {
+		return t.MaxFailures
+	}
+	return DefaultMaxFailures
 }
 
 /*
@@ -182,23 +320,49 @@ func (c candidate) less(other candidate) bool {
 
 // FindClosest 返回与 target 距离最近的 n 个 PeerID
 // 如果已知节点不足 n 个，就返回尽量多的。
+//
+// 不做全表扫描，而是利用 k-bucket 的结构按“距离区间”由近到远取桶：
+//
+//	设 c = bucketIndex(self, target)（target 落在哪个桶）
+//	  1. 桶 c 里的节点：和 target 在第 c 位相同 → 离 target 最近
+//	  2. 桶 c+1..255：  和 target 的第一个不同位都在第 c 位 → 次近
+//	  3. 桶 c-1, c-2 …：第一个不同位依次更高 → 一个比一个远
+//
+// 按这个顺序收集，凑够 n 个就可以停，最后只对收集到的少量候选排序。
 func (t *KademliaTable) FindClosest(target peer.PeerID, n int) []peer.PeerID {
+	if n <= 0 {
+		return nil
+	}
+
 	t.mu.RLock()
 	defer t.mu.RUnlock()
 
 	var cands []candidate
-
-	// 遍历所有 bucket
-	for _, b := range t.buckets {
+	collect := func(i int) {
+		b := t.buckets[i]
 		if b == nil {
-			continue
+			return
 		}
-		for _, id := range b.peers {
-			dist := xorDistance(id, target)
-			cands = append(cands, candidate{id: id, distance: dist})
+		for _, e := range b.peers {
+			cands = append(cands, candidate{id: e.id, distance: xorDistance(e.id, target)})
 		}
 	}
 
+	c := bucketIndex(t.selfID, target)
+	if c < 0 {
+		// target 就是自己：所有桶都是“从近到远”倒序
+		c = len(t.buckets) - 1
+	}
+
+	// 1 + 2：桶 c 以及所有更“靠近自己”的桶
+	for i := c; i < len(t.buckets); i++ {
+		collect(i)
+	}
+	// 3：往远处走，凑够就停
+	for i := c - 1; i >= 0 && len(cands) < n; i-- {
+		collect(i)
+	}
+
 	// 按 distance 递增排序
 	sort.Slice(cands, func(i, j int) bool {
 		return cands[i].less(cands[j])
@@ -215,6 +379,194 @@ func (t *KademliaTable) FindClosest(target peer.PeerID, n int) []peer.PeerID {
 	return out
 }
 
+/*
+==========================================================
+ 表维护：失败计数 / 删除 / 统计 / 桶刷新
+==========================================================
+*/
+
+// RecordFailure 记录一次和 id 通信失败（发送失败 / RPC 超时）。
+// 连续失败达到 MaxFailures 次时把它移出表，用候补顶上。
+// 候补队列里的节点失败一次就直接丢掉。
+func (t *KademliaTable) RecordFailure(id peer.PeerID) {
+	idx := bucketIndex(t.selfID, id)
+	if idx < 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.buckets[idx]
+	if b == nil {
+		return
+	}
+	b.dropReplacement(id)
+
+	i := b.find(id)
+	if i < 0 {
+		return
+	}
+	b.peers[i].failures++
+	if b.peers[i].failures >= t.maxFailures() {
+		b.removeAt(i)
+	}
+}
+
+// RecordSuccess 记录一次和 id 通信成功：只刷新 lastSeen、清零失败次数，
+// 不会把不在表里的节点加进来（加节点请用 Update）
+func (t *KademliaTable) RecordSuccess(id peer.PeerID) {
+	idx := bucketIndex(t.selfID, id)
+	if idx < 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.buckets[idx]
+	if b == nil {
+		return
+	}
+	if i := b.find(id); i >= 0 {
+		b.peers[i].lastSeen = clock.Or(t.Clock).Now()
+		b.peers[i].failures = 0
+	}
+}
+
+// LastSeen 返回 id 最近一次被确认活着的时间
+func (t *KademliaTable) LastSeen(id peer.PeerID) (time.Time, bool) {
+	idx := bucketIndex(t.selfID, id)
+	if idx < 0 {
+		return time.Time{}, false
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	b := t.buckets[idx]
+	if b == nil {
+		return time.Time{}, false
+	}
+	if i := b.find(id); i >= 0 {
+		return b.peers[i].lastSeen, true
+	}
+	return time.Time{}, false
+}
+
+// Remove 把一个 PeerID 从表里删掉，用候补顶上
+func (t *KademliaTable) Remove(id peer.PeerID) {
+	idx := bucketIndex(t.selfID, id)
+	if idx < 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.buckets[idx]
+	if b == nil {
+		return
+	}
+	b.dropReplacement(id)
+	if i := b.find(id); i >= 0 {
+		b.removeAt(i)
+	}
+}
+
+// Contains 判断表里是否有这个 PeerID
+func (t *KademliaTable) Contains(id peer.PeerID) bool {
+	idx := bucketIndex(t.selfID, id)
+	if idx < 0 {
+		return false
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	b := t.buckets[idx]
+	if b == nil {
+		return false
+	}
+	return b.find(id) >= 0
+}
+
+// Size 返回表里一共有多少个节点
+func (t *KademliaTable) Size() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	n := 0
+	for _, b := range t.buckets {
+		if b != nil {
+			n += len(b.peers)
+		}
+	}
+	return n
+}
+
+// SelfID 返回表的中心节点 ID
+func (t *KademliaTable) SelfID() peer.PeerID { return t.selfID }
+
+// BucketIndex 返回 id 落在哪个桶（-1 表示 id == self）
+func (t *KademliaTable) BucketIndex(id peer.PeerID) int {
+	return bucketIndex(t.selfID, id)
+}
+
+// MarkLookup 记录“刚对 target 所在的桶做过一次查找”，刷新定时器据此跳过最近活跃的桶
+func (t *KademliaTable) MarkLookup(target peer.PeerID) {
+	idx := bucketIndex(t.selfID, target)
+	if idx < 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.buckets[idx]
+	if b == nil {
+		b = &bucket{}
+		t.buckets[idx] = b
+	}
+	b.lastLookup = clock.Or(t.Clock).Now()
+}
+
+// StaleBuckets 返回“非空、且超过 maxAge 没被查找过”的桶下标
+func (t *KademliaTable) StaleBuckets(maxAge time.Duration) []int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	now := clock.Or(t.Clock).Now()
+	var out []int
+	for i, b := range t.buckets {
+		if b == nil || len(b.peers) == 0 {
+			continue
+		}
+		if now.Sub(b.lastLookup) > maxAge {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+// RandomIDInBucket 生成一个随机 ID，保证它落在第 idx 个桶里：
+// 前 idx 位和 self 相同，第 idx 位相反，后面随机。刷新桶时拿它做 FIND_NODE 目标。
+func (t *KademliaTable) RandomIDInBucket(idx int) peer.PeerID {
+	var id peer.PeerID
+	_ = clock.Read(t.Rand, id[:])
+
+	for bit := 0; bit <= idx && bit < 256; bit++ {
+		byteIdx, mask := bit/8, byte(0x80>>(bit%8))
+		selfBit := t.selfID[byteIdx] & mask
+		want := selfBit
+		if bit == idx {
+			want = selfBit ^ mask
+		}
+		id[byteIdx] = id[byteIdx]&^mask | want
+	}
+	return id
+}
+
 /*
 ==========================================================
  DumpBuckets：调试 / 演示辅助
@@ -222,19 +574,17 @@ func (t *KademliaTable) FindClosest(target peer.PeerID, n int) []peer.PeerID {
 */
 
 // DumpBuckets 返回一个简单的字符串切片，用于打印当前路由表状态。
-// 比如： [ "idx=3 size=2", "idx=150 size=1", ... ]
+// 比如： [ "idx=3 size=2 repl=0", "idx=150 size=8 repl=3", ... ]
 func (t *KademliaTable) DumpBuckets() []string {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
 
 	var out []string
-	for _, b := range t.buckets {
+	for i, b := range t.buckets {
 		if b == nil || len(b.peers) == 0 {
 			continue
 		}
-		out = append(out) // 这里不依赖 fmt，避免循环 import，就简化成手写的字符串；你也可以改成 fmt.Sprintf
-		// 演示用我们可以手动在 main 里用 len/idx 打印，这里就留空实现。
-
+		out = append(out, fmt.Sprintf("idx=%d size=%d repl=%d", i, len(b.peers), len(b.replacements)))
 	}
 	return out
 }
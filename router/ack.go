@@ -0,0 +1,576 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"envelop/clock"
+	"envelop/envelop"
+	"envelop/peer"
+)
+
+/*
+==========================================================
+ 投递确认：逐跳 ACK + 端到端回执
+==========================================================
+
+Router.Send 是“发出去就不管了”：下一跳收没收到、两跳之后有没有被丢掉，发送方都不知道。
+这里加一个可选的确认模式（只对带了相应扩展的信封生效，普通信封不受影响）：
+
+  逐跳（ExtHopReq / ExtHopAck）
+      发给下一跳时带 ExtHopReq(Seq, 自己)
+      下一跳收到后立即回 ExtHopAck(Seq)，并在继续转发时换成自己的 ExtHopReq
+      AckTimeout 内没收到 ACK → 重发（退避翻倍，最多 MaxRetries 次，有多条候选路由时换一条）
+      重试用完还没 ACK → 这一跳不通，给发送方回一个 ReceiptUnreachable
+      同一个 (上一跳, Seq) 重复收到 → 再回一次 ACK，但不再处理
+
+  端到端（ExtReceiptReq / ExtReceipt）
+      发送方带 ExtReceiptReq(MsgID)
+      最终收件人交给 OnPayload 之后回 ExtReceipt(MsgID, Delivered, 自己)
+      中途被丢弃（没有路由 / TTL 耗尽 / 环路 / 下一跳不通）→ 丢弃它的节点回 ExtReceipt(MsgID, 失败原因, 自己)
+      同一个 (发送方, MsgID) 重复到达 → 再回一次回执，但不再交给 OnPayload
+
+      回执谁都能伪造，所以 Delivered 回执要收件人签名（Router.Key）：
+        Sig = Ed25519(priv, "envelop-receipt-v1" | MsgID | Status | Reporter | 发送方)
+      发送方只认 Reporter 就是收件人、签名验得过的 Delivered 回执；
+      失败回执由中途的节点发，不要求签名（最坏是 Send 提前报失败）
+
+  Acker.Send(ctx, env)：
+      带上 ExtReceiptReq + 逐跳确认发出去，等回执；
+      ReceiptTimeout 内没有回执 → 整封重发（退避翻倍），直到 ctx 结束或重试用完。
+      收件人按 MsgID 去重，所以重发不会导致重复投递。
+
+回 ACK / 回执不需要 Acker（Router 自己就会回）；重发、去重和等回执需要 Router.Acker。
+==========================================================
+*/
+
+// ReceiptStatus 是端到端回执的状态
+type ReceiptStatus uint8
+
+const (
+	ReceiptDelivered   ReceiptStatus = iota // 已交给最终收件人
+	ReceiptNoRoute                          // 某个节点找不到下一跳
+	ReceiptTTLExpired                       // TTL 耗尽
+	ReceiptLoop                             // 检测到路由环路
+	ReceiptUnreachable                      // 某一跳重试用完仍没有 ACK
+	ReceiptRefused                          // 中继拒绝转发（没有预约 / 超出限额）
+)
+
+func (s ReceiptStatus) String() string {
+	switch s {
+	case ReceiptDelivered:
+		return "delivered"
+	case ReceiptNoRoute:
+		return "no route"
+	case ReceiptTTLExpired:
+		return "ttl expired"
+	case ReceiptLoop:
+		return "routing loop"
+	case ReceiptUnreachable:
+		return "next hop unreachable"
+	case ReceiptRefused:
+		return "refused by relay"
+	default:
+		return "unknown"
+	}
+}
+
+// Receipt 是一条端到端回执
+type Receipt struct {
+	MsgID    uint64
+	Status   ReceiptStatus
+	Reporter peer.PeerID   // 发回执的节点（Delivered 时就是收件人）
+	RTT      time.Duration // 发出到收到回执（由发送方测量）
+}
+
+// ErrUndelivered：信封没有送达（收到失败回执，或重试用完也没有回执）
+var ErrUndelivered = errors.New("router: envelope not delivered")
+
+const (
+	DefaultAckTimeout     = 300 * time.Millisecond // 逐跳 ACK 的首次等待
+	DefaultReceiptTimeout = 2 * time.Second        // 端到端回执的首次等待
+	DefaultMaxRetries     = 5
+	DefaultMaxBackoff     = 8 * time.Second
+
+	seenTTL   = 2 * time.Minute // 去重记录保留多久
+	seenLimit = 4096            // 超过这么多条时顺手清理一次过期的
+
+	receiptDomain = "envelop-receipt-v1" // 区分“回执签名”和其它用途的签名
+	receiptSize   = 8 + 1 + peer.PeerIDLength
+)
+
+// seenKey 是去重的键：逐跳用 (上一跳, Seq)，端到端用 (发送方, MsgID)
+type seenKey struct {
+	hop  bool
+	from peer.PeerID
+	id   uint64
+}
+
+// pendingHop 是一个发出去、还在等 ACK 的信封
+type pendingHop struct {
+	env     *envelop.Envelope
+	next    peer.PeerID
+	attempt int
+	wait    time.Duration
+	timer   clock.Timer
+}
+
+// waiter 是一个在等回执的 Send：dest 是应该报告 Delivered 的收件人
+type waiter struct {
+	ch   chan Receipt
+	dest peer.PeerID
+}
+
+// Acker 负责逐跳重发、去重和等待端到端回执
+type Acker struct {
+	R *Router
+
+	AckTimeout     time.Duration // 为 0 时用 DefaultAckTimeout
+	ReceiptTimeout time.Duration // 为 0 时用 DefaultReceiptTimeout
+	MaxRetries     int           // 为 0 时用 DefaultMaxRetries
+	MaxBackoff     time.Duration // 为 0 时用 DefaultMaxBackoff
+
+	// Clock / Rand（可选）：等 ACK / 回执的定时器和 MsgID / Seq 的随机数来源，
+	// nil = 系统时钟 / crypto/rand；sim 里换成虚拟的
+	Clock clock.Clock
+	Rand  io.Reader
+
+	mu       sync.Mutex
+	hops     map[uint64]*pendingHop
+	receipts map[uint64]waiter
+	seen     map[seenKey]time.Time
+}
+
+// NewAcker 创建一个 Acker，并挂到 r.Acker 上
+func NewAcker(r *Router) *Acker {
+	a := &Acker{
+		R:        r,
+		hops:     make(map[uint64]*pendingHop),
+		receipts: make(map[uint64]waiter),
+		seen:     make(map[seenKey]time.Time),
+	}
+	r.Acker = a
+	return a
+}
+
+func (a *Acker) ackTimeout() time.Duration {
+	if a.AckTimeout > 0 {
+		return a.AckTimeout
+	}
+	return DefaultAckTimeout
+}
+
+func (a *Acker) receiptTimeout() time.Duration {
+	if a.ReceiptTimeout > 0 {
+		return a.ReceiptTimeout
+	}
+	return DefaultReceiptTimeout
+}
+
+func (a *Acker) maxRetries() int {
+	if a.MaxRetries > 0 {
+		return a.MaxRetries
+	}
+	return DefaultMaxRetries
+}
+
+// backoff 把等待时间翻倍（不超过 MaxBackoff）
+func (a *Acker) backoff(d time.Duration) time.Duration {
+	limit := a.MaxBackoff
+	if limit <= 0 {
+		limit = DefaultMaxBackoff
+	}
+	d *= 2
+	if d > limit {
+		d = limit
+	}
+	return d
+}
+
+// Send 带端到端回执发送 env（必须已经填好 Dest / Return），
+// 阻塞到收到回执、重试用完或 ctx 结束。
+// 送达时返回 nil；收到失败回执或超时返回包装了 ErrUndelivered 的错误。
+func (a *Acker) Send(ctx context.Context, env *envelop.Envelope) (Receipt, error) {
+	return a.SendTo(ctx, env, env.DestPeerID)
+}
+
+// SendTo 和 Send 一样，recipient 是真正的收件人（Onion 信封的最外层 Dest 只是第一跳）：
+// 只有 recipient 签名的 Delivered 回执才算送达。
+func (a *Acker) SendTo(ctx context.Context, env *envelop.Envelope, recipient peer.PeerID) (Receipt, error) {
+	r := a.R
+	if r.Send == nil {
+		return Receipt{}, fmt.Errorf("acker: router has no Send")
+	}
+
+	msgID := a.newID()
+	env.SetExt(envelop.ExtReceiptReq, putID(msgID))
+
+	ch := make(chan Receipt, 1)
+	a.mu.Lock()
+	a.receipts[msgID] = waiter{ch: ch, dest: recipient}
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		delete(a.receipts, msgID)
+		a.mu.Unlock()
+	}()
+
+	clk := clock.Or(a.Clock)
+	start := clk.Now()
+	wait := a.receiptTimeout()
+	for attempt := 0; ; attempt++ {
+		// 每次重发都用一份拷贝：上一次的逐跳重发可能还在用旧的那份
+		e := cloneEnvelope(env)
+		if e.DestPeerID.Equals(r.SelfID) {
+			r.HandleEnvelope(e)
+		} else {
+			nextHop, ok := r.Resolve(e.DestPeerID)
+			if !ok {
+				rc := Receipt{MsgID: msgID, Status: ReceiptNoRoute, Reporter: r.SelfID, RTT: clk.Now().Sub(start)}
+				return rc, rc.err()
+			}
+			a.sendHop(nextHop, e)
+		}
+
+		expired, stop := clock.After(clk, wait)
+		select {
+		case rc := <-ch:
+			stop()
+			rc.RTT = clk.Now().Sub(start)
+			return rc, rc.err()
+		case <-ctx.Done():
+			stop()
+			return Receipt{MsgID: msgID}, ctx.Err()
+		case <-expired:
+			if attempt >= a.maxRetries() {
+				return Receipt{MsgID: msgID}, fmt.Errorf("%w: no receipt from %s after %d attempts",
+					ErrUndelivered, peer.PeerIDToDomain(env.DestPeerID), attempt+1)
+			}
+			wait = a.backoff(wait)
+		}
+	}
+}
+
+// err 把失败回执转成错误（Delivered 返回 nil）
+func (rc Receipt) err() error {
+	if rc.Status == ReceiptDelivered {
+		return nil
+	}
+	return fmt.Errorf("%w: %s (reported by %s)", ErrUndelivered, rc.Status, peer.PeerIDToDomain(rc.Reporter))
+}
+
+// sendHop 带逐跳确认把 env 发给 nextHop，没收到 ACK 就按退避重发
+func (a *Acker) sendHop(nextHop peer.PeerID, env *envelop.Envelope) {
+	seq := a.newID()
+	v := make([]byte, 0, 8+peer.PeerIDLength)
+	v = append(v, putID(seq)...)
+	v = append(v, a.R.SelfID[:]...)
+	env.SetExt(envelop.ExtHopReq, v)
+
+	p := &pendingHop{env: env, next: nextHop, wait: a.ackTimeout()}
+	a.mu.Lock()
+	a.hops[seq] = p
+	p.timer = clock.Or(a.Clock).AfterFunc(p.wait, func() { a.retryHop(seq) })
+	a.mu.Unlock()
+
+	a.R.Send(nextHop, env)
+}
+
+// retryHop 在 ACK 超时后重发；重试用完就放弃，并给发送方回 ReceiptUnreachable
+func (a *Acker) retryHop(seq uint64) {
+	a.mu.Lock()
+	p := a.hops[seq]
+	if p == nil {
+		a.mu.Unlock()
+		return
+	}
+	p.attempt++
+	if p.attempt > a.maxRetries() {
+		delete(a.hops, seq)
+		a.mu.Unlock()
+		fmt.Printf("[Acker %s] %s 一直没有 ACK，放弃\n",
+			peer.PeerIDToDomain(a.R.SelfID), peer.PeerIDToDomain(p.next))
+		a.R.replyReceipt(p.env, ReceiptUnreachable)
+		return
+	}
+	dest, last, attempt := p.env.DestPeerID, p.next, p.attempt
+	a.mu.Unlock()
+
+	// 选下一跳可能要查 DHT，不能拿着锁
+	next := a.retryNextHop(dest, last, attempt)
+
+	a.mu.Lock()
+	if a.hops[seq] != p {
+		a.mu.Unlock() // 等的时候 ACK 到了
+		return
+	}
+	p.next = next
+	p.wait = a.backoff(p.wait)
+	p.timer = clock.Or(a.Clock).AfterFunc(p.wait, func() { a.retryHop(seq) })
+	a.mu.Unlock()
+
+	a.R.Send(next, p.env)
+}
+
+// retryNextHop 选重发用的下一跳：有多条候选路由时轮换着试，否则重新 Resolve
+func (a *Acker) retryNextHop(dest, last peer.PeerID, attempt int) peer.PeerID {
+	if rt := a.R.RouteTable; rt != nil && a.R.NextHop == nil {
+		if routes := rt.Routes(dest); len(routes) > 1 {
+			return routes[attempt%len(routes)].Via
+		}
+	}
+	if next, ok := a.R.Resolve(dest); ok {
+		return next
+	}
+	return last
+}
+
+// onHopAck 处理发给自己的 ExtHopAck：停止重发
+func (a *Acker) onHopAck(env *envelop.Envelope) {
+	v, _ := env.Ext(envelop.ExtHopAck)
+	if len(v) != 8 {
+		return
+	}
+	seq := binary.BigEndian.Uint64(v)
+
+	a.mu.Lock()
+	p := a.hops[seq]
+	delete(a.hops, seq)
+	a.mu.Unlock()
+
+	if p != nil {
+		p.timer.Stop()
+	}
+}
+
+// Settle 停止对 env 的逐跳重发（这一跳已经在本地处理掉了，例如存进了邮箱）
+func (a *Acker) Settle(env *envelop.Envelope) {
+	v, ok := env.Ext(envelop.ExtHopReq)
+	if !ok || len(v) != 8+peer.PeerIDLength || !bytes.Equal(v[8:], a.R.SelfID[:]) {
+		return
+	}
+	seq := binary.BigEndian.Uint64(v[:8])
+
+	a.mu.Lock()
+	p := a.hops[seq]
+	delete(a.hops, seq)
+	a.mu.Unlock()
+
+	if p != nil && p.timer != nil {
+		p.timer.Stop()
+	}
+}
+
+// onReceipt 处理发给自己的 ExtReceipt：交给等待中的 Send。
+// Delivered 回执必须是收件人本人签的，否则丢掉
+func (a *Acker) onReceipt(env *envelop.Envelope) {
+	v, _ := env.Ext(envelop.ExtReceipt)
+	rc, ok := parseReceipt(v)
+	if !ok {
+		return
+	}
+
+	a.mu.Lock()
+	w, ok := a.receipts[rc.MsgID]
+	a.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	if rc.Status == ReceiptDelivered && (rc.Reporter != w.dest || !verifyReceipt(v, a.R.SelfID)) {
+		fmt.Printf("[Acker %s] 丢弃没有 %s 签名的送达回执（Reporter=%s）\n", peer.PeerIDToDomain(a.R.SelfID),
+			peer.PeerIDToDomain(w.dest), peer.PeerIDToDomain(rc.Reporter))
+		return
+	}
+
+	if w.ch != nil {
+		select {
+		case w.ch <- rc:
+		default: // 已经有一条回执在等着被取走了（重发导致的重复回执）
+		}
+	}
+}
+
+// markSeen 记下 k，之前已经见过就返回 true
+func (a *Acker) markSeen(k seenKey) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := clock.Or(a.Clock).Now()
+	if at, ok := a.seen[k]; ok && now.Sub(at) < seenTTL {
+		return true
+	}
+	if len(a.seen) >= seenLimit {
+		for key, at := range a.seen {
+			if now.Sub(at) >= seenTTL {
+				delete(a.seen, key)
+			}
+		}
+	}
+	a.seen[k] = now
+	return false
+}
+
+/*
+==========================================================
+ Router 一侧：回 ACK、回回执、按需可靠转发
+==========================================================
+*/
+
+// ackHop 处理收到的 ExtHopReq：给上一跳回 ExtHopAck，并把 ExtHopReq 去掉。
+// 返回 reliable（这封信要求逐跳确认，继续转发时也要带上）和 dup（重复收到，直接丢弃）。
+func (r *Router) ackHop(env *envelop.Envelope) (reliable, dup bool) {
+	v, ok := env.Ext(envelop.ExtHopReq)
+	if !ok {
+		return false, false
+	}
+	env.DelExt(envelop.ExtHopReq)
+	if len(v) != 8+peer.PeerIDLength {
+		return false, false
+	}
+	var prev peer.PeerID
+	copy(prev[:], v[8:])
+
+	if r.Send != nil && !prev.Equals(r.SelfID) {
+		// ACK 丢了上一跳会重发，走 datagram 就够了
+		ack, _ := envelop.NewBuilder().
+			Version(1).
+			TTL(controlTTL).
+			Dest(prev).
+			Return(r.SelfID).
+			Datagram().
+			Ext(envelop.ExtHopAck, v[:8]).
+			Build()
+		r.Send(prev, ack)
+	}
+
+	if r.Acker != nil {
+		dup = r.Acker.markSeen(seenKey{hop: true, from: prev, id: binary.BigEndian.Uint64(v[:8])})
+	}
+	return true, dup
+}
+
+// forward 把 env 交给下一跳；reliable 且有 Acker 时带逐跳确认发送
+func (r *Router) forward(nextHop peer.PeerID, env *envelop.Envelope, reliable bool) {
+	if reliable && r.Acker != nil {
+		r.Acker.sendHop(nextHop, env)
+		return
+	}
+	r.Send(nextHop, env)
+}
+
+// deliver 把最终业务信封交给 OnPayload；要求回执的，交付后回 ReceiptDelivered
+func (r *Router) deliver(env *envelop.Envelope) {
+	if v, ok := env.Ext(envelop.ExtReceiptReq); ok && len(v) == 8 && r.Acker != nil {
+		if r.Acker.markSeen(seenKey{from: env.ReturnPeerID, id: binary.BigEndian.Uint64(v)}) {
+			fmt.Println("→ 重复的信封（回执可能丢了），只重发回执")
+			r.replyReceipt(env, ReceiptDelivered)
+			return
+		}
+	}
+	if r.OnPayload != nil {
+		r.OnPayload(env)
+	}
+	r.replyReceipt(env, ReceiptDelivered)
+}
+
+// replyReceipt 如果 env 要求回执，就给发送方回一条：
+//
+//	MsgID(8) + Status(1) + 本节点 PeerID(32) [+ Pub(32) + Sig(64)]
+//
+// 设置了 Router.Key 的带上签名（Delivered 回执没有签名的话发送方不认）
+func (r *Router) replyReceipt(env *envelop.Envelope, status ReceiptStatus) {
+	mid, ok := env.Ext(envelop.ExtReceiptReq)
+	if !ok || len(mid) != 8 || env.ReturnPeerID.IsZero() {
+		return
+	}
+
+	v := make([]byte, 0, receiptSize+ed25519.PublicKeySize+ed25519.SignatureSize)
+	v = append(v, mid...)
+	v = append(v, byte(status))
+	v = append(v, r.SelfID[:]...)
+	if r.Key != nil {
+		v = append(v, r.Key.PublicKey...)
+		v = append(v, ed25519.Sign(r.Key.PrivateKey, receiptDigest(v[:receiptSize], env.ReturnPeerID))...)
+	}
+
+	reply, _ := envelop.NewBuilder().
+		Version(1).
+		TTL(controlTTL).
+		Dest(env.ReturnPeerID).
+		Return(r.SelfID).
+		Ext(envelop.ExtReceipt, v).
+		Build()
+	r.sendControl(reply, true)
+}
+
+// parseReceipt 解析 ExtReceipt（签名部分不看，见 verifyReceipt）
+func parseReceipt(v []byte) (Receipt, bool) {
+	if len(v) != receiptSize && len(v) != receiptSize+ed25519.PublicKeySize+ed25519.SignatureSize {
+		return Receipt{}, false
+	}
+	rc := Receipt{
+		MsgID:  binary.BigEndian.Uint64(v[:8]),
+		Status: ReceiptStatus(v[8]),
+	}
+	copy(rc.Reporter[:], v[9:])
+	return rc, true
+}
+
+// receiptDigest 是回执签名覆盖的内容：MsgID + Status + Reporter（body），以及回执发给谁
+func receiptDigest(body []byte, to peer.PeerID) []byte {
+	buf := make([]byte, 0, len(receiptDomain)+len(body)+peer.PeerIDLength)
+	buf = append(buf, receiptDomain...)
+	buf = append(buf, body...)
+	return append(buf, to[:]...)
+}
+
+// verifyReceipt 检查回执 v 带着 Reporter 本人、对发给 to 的这条回执的签名
+func verifyReceipt(v []byte, to peer.PeerID) bool {
+	if len(v) != receiptSize+ed25519.PublicKeySize+ed25519.SignatureSize {
+		return false
+	}
+	pub := ed25519.PublicKey(v[receiptSize : receiptSize+ed25519.PublicKeySize])
+	var reporter peer.PeerID
+	copy(reporter[:], v[9:receiptSize])
+	if peer.NewPeerIDFromPubKey(pub) != reporter {
+		return false
+	}
+	return ed25519.Verify(pub, receiptDigest(v[:receiptSize], to), v[receiptSize+ed25519.PublicKeySize:])
+}
+
+// IsControl 判断 env 是不是控制信封（逐跳 ACK / 回执 / traceroute），
+// 这类信封不值得暂存或重发
+func IsControl(env *envelop.Envelope) bool {
+	for _, typ := range []uint8{envelop.ExtHopAck, envelop.ExtReceipt, envelop.ExtProbe, envelop.ExtTraceReply} {
+		if _, ok := env.Ext(typ); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// newID 生成一个随机的 64 位 ID（MsgID / Seq）
+func (a *Acker) newID() uint64 {
+	return clock.Uint64(a.Rand)
+}
+
+func putID(id uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, id)
+	return b
+}
+
+// cloneEnvelope 浅拷贝一个信封（扩展列表单独拷贝，SetExt / DelExt 不会互相影响）
+func cloneEnvelope(env *envelop.Envelope) *envelop.Envelope {
+	c := *env
+	c.Exts = append([]envelop.Ext(nil), env.Exts...)
+	return &c
+}
@@ -0,0 +1,192 @@
+package router
+
+import (
+	"io"
+	"time"
+
+	"envelop/clock"
+	"envelop/peer"
+)
+
+/*
+==========================================================
+ 路由质量 + 多路径选路
+==========================================================
+
+一个目标可以有多条候选路由：
+    直连        dest → dest
+    经由中继    dest → via1 / via2 / ...（LearnVia 学到的，最多 MaxCandidates 个）
+
+每条路由的质量看“第一跳”这条链路（我们只能观测到自己发出去的那一跳）：
+
+    RTT          平滑 RTT（EWMA，样本来自 QUIC 连接统计）
+    Loss         发送失败率（EWMA，0..1）
+    LastSuccess  最近一次发送成功
+    LastFailure  最近一次发送失败
+    连续失败次数  ≥ downAfter 且还在 cooldown 里 → 暂时视为“断了”
+
+这些数据由 ReportSend(nextHop, rtt, err) 喂进来（Host 把 PeerManager 的发送结果接过来）。
+
+选路策略（RouteTable.Policy）：
+    PolicyFailover        按顺序（直连优先，其次先学到的 via），第一个没断的
+    PolicyLowestLatency   代价 = RTT × (1 + 4×Loss) 最小的
+    PolicyWeightedRandom  按 (1-Loss)/RTT 加权随机，把流量分散到多条路上
+
+所有候选都“断了”时，挑最早失败的那条再试一次（总比直接丢包好）。
+==========================================================
+*/
+
+// SelectPolicy 是多条候选路由之间的选择策略
+type SelectPolicy int
+
+const (
+	PolicyFailover SelectPolicy = iota
+	PolicyLowestLatency
+	PolicyWeightedRandom
+)
+
+func (p SelectPolicy) String() string {
+	switch p {
+	case PolicyFailover:
+		return "failover"
+	case PolicyLowestLatency:
+		return "lowest-latency"
+	case PolicyWeightedRandom:
+		return "weighted-random"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	// MaxCandidates：每个目标最多保留多少个中继候选
+	MaxCandidates = 4
+	// MaxViaDests：最多为多少个目标记中继路由，满了丢掉最久没学到 / 用到的那个目标
+	MaxViaDests = 4096
+
+	// 没有 RTT 样本时按这个值估算
+	defaultRTT = 100 * time.Millisecond
+
+	rttAlpha  = 0.25 // RTT EWMA 权重
+	lossAlpha = 0.2  // Loss EWMA 权重
+
+	downAfter    = 3                // 连续失败几次算“断了”
+	downCooldown = 30 * time.Second // 断了之后多久再给一次机会
+)
+
+// RouteMetrics 是一条链路（到某个下一跳）的质量统计
+type RouteMetrics struct {
+	RTT         time.Duration
+	Loss        float64
+	Sent        uint64
+	Failed      uint64
+	LastSuccess time.Time
+	LastFailure time.Time
+
+	consecutive int // 连续失败次数
+}
+
+// Route 是一条候选路由：下一跳 + 它的质量
+type Route struct {
+	Via     peer.PeerID
+	Metrics RouteMetrics
+}
+
+// observe 记录一次发送结果
+func (m *RouteMetrics) observe(rtt time.Duration, err error, now time.Time) {
+	m.Sent++
+	if err != nil {
+		m.Failed++
+		m.consecutive++
+		m.LastFailure = now
+		m.Loss = m.Loss*(1-lossAlpha) + lossAlpha
+		return
+	}
+	m.consecutive = 0
+	m.LastSuccess = now
+	m.Loss *= 1 - lossAlpha
+	if rtt > 0 {
+		if m.RTT == 0 {
+			m.RTT = rtt
+		} else {
+			m.RTT = time.Duration(float64(m.RTT)*(1-rttAlpha) + float64(rtt)*rttAlpha)
+		}
+	}
+}
+
+// down 判断这条链路现在是不是“断了”
+func (m *RouteMetrics) down(now time.Time) bool {
+	return m.consecutive >= downAfter && now.Sub(m.LastFailure) < downCooldown
+}
+
+// rtt 返回用于比较的 RTT（没有样本时用 defaultRTT）
+func (m *RouteMetrics) rtt() time.Duration {
+	if m.RTT > 0 {
+		return m.RTT
+	}
+	return defaultRTT
+}
+
+// cost 是 PolicyLowestLatency 的代价：RTT 按丢包率加罚
+func (m *RouteMetrics) cost() float64 {
+	return float64(m.rtt()) * (1 + 4*m.Loss)
+}
+
+// weight 是 PolicyWeightedRandom 的权重
+func (m *RouteMetrics) weight() float64 {
+	w := (1 - m.Loss) / float64(m.rtt())
+	if w <= 0 {
+		w = 1e-12 // 再差也留一点点机会，统计才能恢复
+	}
+	return w
+}
+
+// selectRoute 按策略从候选里挑一条（调用方保证 routes 非空）
+// （PolicyWeightedRandom 的随机数从 r 取，nil = crypto/rand）
+func selectRoute(policy SelectPolicy, routes []Route, now time.Time, r io.Reader) peer.PeerID {
+	var alive []Route
+	for _, r := range routes {
+		if !r.Metrics.down(now) {
+			alive = append(alive, r)
+		}
+	}
+
+	// 全断了：挑最早失败的那条（离 cooldown 结束最近）
+	if len(alive) == 0 {
+		best := routes[0]
+		for _, r := range routes[1:] {
+			if r.Metrics.LastFailure.Before(best.Metrics.LastFailure) {
+				best = r
+			}
+		}
+		return best.Via
+	}
+
+	switch policy {
+	case PolicyLowestLatency:
+		best := alive[0]
+		for _, r := range alive[1:] {
+			if r.Metrics.cost() < best.Metrics.cost() {
+				best = r
+			}
+		}
+		return best.Via
+
+	case PolicyWeightedRandom:
+		total := 0.0
+		for _, r := range alive {
+			total += r.Metrics.weight()
+		}
+		x := clock.Float64(r) * total
+		for _, r := range alive {
+			x -= r.Metrics.weight()
+			if x <= 0 {
+				return r.Via
+			}
+		}
+		return alive[len(alive)-1].Via
+
+	default: // PolicyFailover
+		return alive[0].Via
+	}
+}
@@ -1,8 +1,12 @@
 package router
 
 import (
+	"encoding/binary"
 	"fmt"
+	"sync"
+	"time"
 
+	"envelop/clock"
 	"envelop/envelop"
 	"envelop/peer"
 )
@@ -11,15 +15,21 @@ import (
 Router 的职责（逻辑层）：
 
 1. 识别 REGISTER 信封（Flags=1）并回调 OnRegister
-2. 打印 / 检查 TTL
+2. 打印 / 检查 TTL；要求逐跳确认的（ExtHopReq）先给上一跳回 ACK（见 ack.go）
 3. 如果信封不是发给自己：
-    - 用 NextHop(Env.DestPeerID) 算下一跳 PeerID
-    - 调用 Send(nextHop, env) 转发
+    - 环路检测：路径记录（ExtPath）里已经有自己 → 丢弃
+    - TTL 减一；减到 0 就在这里丢弃（traceroute 探测会回一个 TraceReply）
+    - 有路径记录时把自己追加进去
+    - 只用本地路由算下一跳 PeerID（注入了 NextHop 就用它，否则默认查 RouteTable）；
+      别人交来的信封不走 Fallback：目标谁都能填，不能让一封信封就触发一次 DHT 查找
+    - 注入了 Admit 的，先问它让不让转发（中继的预约 / 限额，见 relay 包）
+    - 调用 Send(nextHop, env) 转发（要求逐跳确认的交给 Acker 带重发地转发）
+    - 中途丢弃的信封如果要求回执（ExtReceiptReq），给发送方回一个失败回执
 4. 如果信封是发给自己：
     4.1 若 InnerPayload 是“下一层 Envelope”（Onion 多层信封）
         - 调用 envelop.Unmarshal 尝试解出内层 Envelope
-        - 成功就递归 HandleEnvelope(innerEnv)
-    4.2 否则当作业务数据，回调 OnPayload
+        - 成功就递归处理 innerEnv（回执请求 / 逐跳确认模式一并带进去）
+    4.2 否则当作业务数据，回调 OnPayload（要求回执的，交付后回 ReceiptDelivered）
 
 注意：Router 不关心 IP / 端口 / QUIC，它只操作 PeerID + Envelope 这两个抽象概念。
 */
@@ -28,7 +38,11 @@ type Router struct {
 	// 自己的 PeerID（用于判断 Dest 是否等于自己）
 	SelfID peer.PeerID
 
-	// 可选：路由表（R4 那一套用的）
+	// Key（可选）：本节点身份，用来给回执签名（见 ack.go）；
+	// 不设置的话回的 Delivered 回执发送方不认
+	Key *peer.KeyPair
+
+	// 可选：路由表。NextHop 为 nil 时 Resolve 默认用它选下一跳
 	RouteTable *RouteTable
 
 	// 当收到 REGISTER 信封（Flags=1）时调用
@@ -39,10 +53,24 @@ type Router struct {
 	//   输入：目标 PeerID（最终目标）
 	//   输出：下一跳 PeerID（可能等于目标，也可能是中继节点）
 	//
-	// 这里不强制你必须用 RouteTable，简单场景可以直接：
+	// 可选：为 nil 时默认使用 RouteTable（直连 → via → Kademlia 最近邻）。
+	// 简单场景也可以直接：
 	//   NextHop = func(dest PeerID) (PeerID, bool) { return dest, true }
 	NextHop func(dest peer.PeerID) (nextHop peer.PeerID, ok bool)
 
+	// Fallback（可选）:
+	//   NextHop 找不到下一跳时再试一次，典型实现是“去 DHT 里查这个 PeerID”。
+	//   它可能要走网络（会阻塞一段时间），所以只在本地路由都失败时才调用，
+	//   而且只给本节点自己发出的信封用（Resolve）；转发别人的信封不调用。
+	//   查不到的目标 fallbackMissTTL 之内不再查。
+	Fallback func(dest peer.PeerID) (nextHop peer.PeerID, ok bool)
+
+	// Clock（可选）：Fallback 负缓存用的时钟，nil = 系统时钟
+	Clock clock.Clock
+
+	mu     sync.Mutex
+	misses map[peer.PeerID]time.Time // Fallback 查不到的目标 → 到这个时间之前不再查
+
 	// Send:
 	//   输入：下一跳 PeerID + Envelope
 	//   实现通常是调用 PeerManager.SendToPeer
@@ -52,10 +80,47 @@ type Router struct {
 	//   当本节点是最终收件人，且 InnerPayload 不是“内层信封”时调用
 	//   通常是你的业务处理 / RPC / 消息回调
 	OnPayload func(env *envelop.Envelope)
+
+	// OnTraceReply（可选）:
+	//   收到发给自己的 traceroute 回应（ExtTraceReply）时调用，一般由 Tracer 设置
+	OnTraceReply func(env *envelop.Envelope)
+
+	// Admit（可选）：转发前检查，返回 false 就丢弃（要求回执的回 ReceiptRefused）。
+	// 一般由 relay.Service 设置：只替有预约的节点转发，并限制每条 circuit 的流量和时长。
+	// from 是把信封交给本节点的上一跳（见 HandleEnvelopeFrom，不知道时为零值），
+	// 不是信封头里的 ReturnPeerID——那个谁都能填。
+	// 为 nil 时什么都转发。
+	Admit func(env *envelop.Envelope, from, nextHop peer.PeerID) bool
+
+	// Acker（可选）：逐跳重发、去重、等待端到端回执（见 ack.go，一般由 NewAcker 设置）。
+	// 为 nil 时仍然会回 ACK / 回执，但不重发、不去重。
+	Acker *Acker
 }
 
-// HandleEnvelope: 路由处理入口。
+// 控制信封（traceroute 回应等）的 TTL
+const controlTTL = 16
+
+const (
+	// Fallback 查不到的目标多久之内不再查
+	fallbackMissTTL = 30 * time.Second
+	// 负缓存最多记多少个目标
+	maxFallbackMisses = 1024
+)
+
+// HandleEnvelope: 路由处理入口（不知道上一跳是谁，例如本地产生的信封）。
 func (r *Router) HandleEnvelope(env *envelop.Envelope) {
+	r.handle(env, peer.PeerID{}, false)
+}
+
+// HandleEnvelopeFrom 和 HandleEnvelope 一样，from 是把信封交给本节点的上一跳：
+// 收到它的那条连接属于的节点（Node 认出来的，签名 REGISTER 或者拨号时就确定了）。
+// 转发前交给 Admit 判断。
+func (r *Router) HandleEnvelopeFrom(from peer.PeerID, env *envelop.Envelope) {
+	r.handle(env, from, false)
+}
+
+// handle 是 HandleEnvelope 的实现；reliable 表示外层信封要求逐跳确认（拆 Onion 时带进内层）
+func (r *Router) handle(env *envelop.Envelope, from peer.PeerID, reliable bool) {
 	// ============================================
 	// 0. REGISTER 信封（Flags=1）优先处理
 	// ============================================
@@ -81,6 +146,14 @@ func (r *Router) HandleEnvelope(env *envelop.Envelope) {
 		peer.PeerIDToDomain(env.DestPeerID),
 	)
 
+	// 逐跳确认：先给上一跳回 ACK；重复收到的不再处理
+	if hopReliable, dup := r.ackHop(env); dup {
+		fmt.Println("重复的信封（ACK 可能丢了），丢弃")
+		return
+	} else if hopReliable {
+		reliable = true
+	}
+
 	// TTL 检查
 	if env.TTL == 0 {
 		fmt.Println("TTL=0，丢弃")
@@ -91,25 +164,82 @@ func (r *Router) HandleEnvelope(env *envelop.Envelope) {
 	// 2. 如果不是给自己 → 查路由并转发
 	// ============================================
 	if !env.DestPeerID.Equals(r.SelfID) {
-		if r.NextHop == nil || r.Send == nil {
-			fmt.Println("没有 NextHop/Send 实现，无法转发。丢弃")
+		if r.Send == nil {
+			fmt.Println("没有 Send 实现，无法转发。丢弃")
+			return
+		}
+
+		// 2.1 环路检测：转一圈又回到自己了
+		if env.PathContains(r.SelfID) || env.ReturnPeerID.Equals(r.SelfID) {
+			fmt.Println("检测到路由环路，丢弃")
+			r.replyReceipt(env, ReceiptLoop)
+			return
+		}
+
+		// 2.2 TTL：减到 0 就不用再发了（下一跳收到也只会丢掉）
+		env.TTL--
+		if env.TTL == 0 {
+			fmt.Println("TTL 耗尽，丢弃")
+			if _, ok := env.Ext(envelop.ExtProbe); ok {
+				r.replyTrace(env, false)
+			}
+			r.replyReceipt(env, ReceiptTTLExpired)
 			return
 		}
-		nextHop, ok := r.NextHop(env.DestPeerID)
+
+		nextHop, ok := r.resolveLocal(env.DestPeerID)
+		if !ok && from.IsZero() {
+			// 本地产生的信封（不知道上一跳）才值得去网络上查
+			nextHop, ok = r.fallback(env.DestPeerID)
+		}
 		if !ok {
 			fmt.Println("找不到下一跳 PeerID。丢弃")
+			r.replyReceipt(env, ReceiptNoRoute)
 			return
 		}
 
-		env.TTL--
+		if r.Admit != nil && !r.Admit(env, from, nextHop) {
+			fmt.Println("中继拒绝转发（没有 circuit 或超出限额），丢弃")
+			r.replyReceipt(env, ReceiptRefused)
+			return
+		}
+
+		// 2.3 路径记录：把自己追加进去
+		env.AppendPath(r.SelfID)
+
 		fmt.Printf("→ 不是给我，转发到下一跳 %s\n", peer.PeerIDToDomain(nextHop))
-		r.Send(nextHop, env)
+		r.forward(nextHop, env, reliable)
 		return
 	}
 
 	// ============================================
 	// 3. 是给自己 → 处理内层信封 / 业务数据
 	// ============================================
+
+	// 3.0 控制信封：traceroute 探测到达终点 / 收到回应，逐跳 ACK，端到端回执
+	if _, ok := env.Ext(envelop.ExtProbe); ok {
+		r.replyTrace(env, true)
+		return
+	}
+	if _, ok := env.Ext(envelop.ExtTraceReply); ok {
+		if r.OnTraceReply != nil {
+			r.OnTraceReply(env)
+		}
+		return
+	}
+	if _, ok := env.Ext(envelop.ExtHopAck); ok {
+		if r.Acker != nil {
+			r.Acker.onHopAck(env)
+		}
+		return
+	}
+	if _, ok := env.Ext(envelop.ExtReceipt); ok {
+		if r.Acker != nil {
+			r.Acker.onReceipt(env)
+		}
+		return
+	}
+
 	if env.InnerLen == 0 || len(env.InnerPayload) == 0 {
 		fmt.Println("→ 空信封（没有 InnerPayload）")
 		return
@@ -117,18 +247,181 @@ func (r *Router) HandleEnvelope(env *envelop.Envelope) {
 
 	innerBytes := env.InnerPayload
 
-	// 3.1 尝试把 InnerPayload 当作“内层 Envelope”解析
+	// 3.1 RPC 信封的负载是 RPC 报文，不可能是内层信封，直接交给上层
+	if env.Flags&envelop.FlagRPC != 0 {
+		r.deliver(env)
+		return
+	}
+
+	// 3.2 尝试把 InnerPayload 当作“内层 Envelope”解析
 	if innerEnv, err := envelop.Unmarshal(innerBytes); err == nil {
 		fmt.Println("→ 内层是信封（Onion 一层），递归处理内层 Envelope")
-		r.HandleEnvelope(innerEnv)
+		if v, ok := env.Ext(envelop.ExtReceiptReq); ok {
+			if _, has := innerEnv.Ext(envelop.ExtReceiptReq); !has {
+				innerEnv.SetExt(envelop.ExtReceiptReq, v)
+			}
+		}
+		r.handle(innerEnv, from, reliable)
 		return
 	}
 
-	// 3.2 否则，当作业务数据处理
+	// 3.3 否则，当作业务数据处理
 	fmt.Printf("→ 收到业务数据: %q\n", string(env.InnerPayload))
-	if r.OnPayload != nil {
-		r.OnPayload(env)
+	r.deliver(env)
+}
+
+// replyTrace 给 traceroute 探测的发起方回一个 TraceReply：
+//
+//	ProbeID(8) + 本节点 PeerID(32) + Reached(1)
+func (r *Router) replyTrace(probe *envelop.Envelope, reached bool) {
+	if probe.ReturnPeerID.IsZero() || r.Send == nil {
+		return
+	}
+	pid, _ := probe.Ext(envelop.ExtProbe)
+	if len(pid) != 8 {
+		return
+	}
+
+	v := make([]byte, 0, 8+peer.PeerIDLength+1)
+	v = append(v, pid...)
+	v = append(v, r.SelfID[:]...)
+	if reached {
+		v = append(v, 1)
+	} else {
+		v = append(v, 0)
+	}
+
+	reply, _ := envelop.NewBuilder().
+		Version(1).
+		TTL(controlTTL).
+		Dest(probe.ReturnPeerID).
+		Return(r.SelfID).
+		Ext(envelop.ExtTraceReply, v).
+		Build()
+
+	r.sendControl(reply, false)
+}
+
+// sendControl 发出一个本节点产生的控制信封（traceroute 回应 / 回执）：
+// 目标是自己时直接本地处理，否则查路由发出去；reliable 时带逐跳确认
+func (r *Router) sendControl(env *envelop.Envelope, reliable bool) {
+	if env.DestPeerID.Equals(r.SelfID) {
+		r.HandleEnvelope(env)
+		return
+	}
+	if r.Send == nil {
+		return
+	}
+	// 回给别人交来的信封：目标来自信封头，不走 Fallback
+	nextHop, ok := r.resolveLocal(env.DestPeerID)
+	if !ok {
+		return
+	}
+	r.forward(nextHop, env, reliable)
+}
+
+// parseTraceReply 解析 ExtTraceReply
+func parseTraceReply(v []byte) (probeID uint64, hop peer.PeerID, reached bool, ok bool) {
+	if len(v) != 8+peer.PeerIDLength+1 {
+		return 0, peer.PeerID{}, false, false
+	}
+	probeID = binary.BigEndian.Uint64(v[:8])
+	copy(hop[:], v[8:8+peer.PeerIDLength])
+	return probeID, hop, v[8+peer.PeerIDLength] == 1, true
+}
+
+// Resolve 计算本节点发出的信封的下一跳：
+//  0. dest 就是自己 → 自己（本地回环）
+//  1. 注入了 NextHop → 用 NextHop；
+//     否则用 RouteTable 里明确学到的路由（直连 → via）
+//  2. 找不到 → Fallback（例如 DHT 查找），找到的直连目标记进 RouteTable
+//  3. 还找不到 → RouteTable 的 Kademlia 最近邻（贪心转发，只在没有 NextHop 时）
+//
+// 转发别人的信封不用它（见 resolveLocal）。
+func (r *Router) Resolve(dest peer.PeerID) (peer.PeerID, bool) {
+	if nextHop, ok := r.resolveLearned(dest); ok {
+		return nextHop, true
+	}
+	if nextHop, ok := r.fallback(dest); ok {
+		return nextHop, true
+	}
+	return r.closest(dest)
+}
+
+// resolveLocal 和 Resolve 一样，只是不调用 Fallback：不走网络，不会阻塞
+func (r *Router) resolveLocal(dest peer.PeerID) (peer.PeerID, bool) {
+	if nextHop, ok := r.resolveLearned(dest); ok {
+		return nextHop, true
+	}
+	return r.closest(dest)
+}
+
+// resolveLearned：自己 → 自己；NextHop，或者 RouteTable 里明确学到的路由
+func (r *Router) resolveLearned(dest peer.PeerID) (peer.PeerID, bool) {
+	if dest.Equals(r.SelfID) {
+		return dest, true
+	}
+	if r.NextHop != nil {
+		return r.NextHop(dest)
+	}
+	if r.RouteTable != nil {
+		return r.RouteTable.LookupLearned(dest)
+	}
+	return peer.PeerID{}, false
+}
+
+// closest：没有 NextHop 时用 RouteTable 的 Kademlia 最近邻
+func (r *Router) closest(dest peer.PeerID) (peer.PeerID, bool) {
+	if r.NextHop == nil && r.RouteTable != nil {
+		return r.RouteTable.Closest(dest)
+	}
+	return peer.PeerID{}, false
+}
+
+// fallback 调用 Fallback，找到的直连目标记进 RouteTable；
+// 查不到的目标记进负缓存，fallbackMissTTL 之内直接返回 false
+func (r *Router) fallback(dest peer.PeerID) (peer.PeerID, bool) {
+	if r.Fallback == nil {
+		return peer.PeerID{}, false
+	}
+	now := clock.Or(r.Clock).Now()
+	r.mu.Lock()
+	until, missed := r.misses[dest]
+	r.mu.Unlock()
+	if missed && now.Before(until) {
+		return peer.PeerID{}, false
+	}
+
+	nextHop, ok := r.Fallback(dest)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ok {
+		delete(r.misses, dest)
+		if r.RouteTable != nil && nextHop.Equals(dest) {
+			r.RouteTable.LearnDirect(dest)
+		}
+		return nextHop, true
+	}
+	if r.misses == nil {
+		r.misses = make(map[peer.PeerID]time.Time)
+	}
+	if len(r.misses) >= maxFallbackMisses {
+		// 满了：先清过期的，还是满就随便丢一个
+		for id, t := range r.misses {
+			if !now.Before(t) {
+				delete(r.misses, id)
+			}
+		}
+		for id := range r.misses {
+			if len(r.misses) < maxFallbackMisses {
+				break
+			}
+			delete(r.misses, id)
+		}
 	}
+	r.misses[dest] = now.Add(fallbackMissTTL)
+	return peer.PeerID{}, false
 }
 
 // 给 Router 提供一个统一的构造函数。
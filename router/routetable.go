@@ -1,8 +1,11 @@
 package router
 
 import (
+	"envelop/clock"
 	"envelop/peer"
+	"io"
 	"sync"
+	"time"
 )
 
 /*
@@ -28,6 +31,14 @@ import (
 //        rt.LearnVia(dest, via)  // 同时喂给 Kademlia
 //        rt.BindSelf(selfID)     // 新增：把本节点 ID 告诉表，用于构建 Kademlia
 //
+//  4. 查找顺序：学到的路由（直连 + 多个 via 候选，按 Policy 选）→ Kademlia 最近邻
+//     直连和 via 分开存：LearnVia 不会覆盖一个已知的直连
+//     （从中继那里收到某人的信封，不代表它不能直连了）
+//     新学到的 via 排在已有候选后面，不会顶掉它们：
+//     信封里的 ReturnPeerID 谁都能填，一封伪造的信封不能把别人的路由抢走；
+//     有 via 的目标最多 MaxViaDests 个，满了丢掉最久没学到 / 用到的，伪造的目标撑不爆路由表
+//     每条候选的质量统计和选路策略见 metrics.go
+//
 //==========================================================
 //*/
 //
@@ -36,8 +47,24 @@ type RouteTable struct {
 
 	selfID peer.PeerID // 本节点 ID，用于初始化 KademliaTable
 
-	// 静态路由：dest → via
-	direct map[peer.PeerID]peer.PeerID
+	// 直连：可以直接发给它的 peer
+	direct map[peer.PeerID]bool
+
+	// 多跳路由：dest → 候选中继（先学到的在前，最多 MaxCandidates 个）
+	via map[peer.PeerID][]peer.PeerID
+	// dest → 最近一次学到 / 查到它的 via 的时间（满了 MaxViaDests 时按它淘汰）
+	viaUsed map[peer.PeerID]time.Time
+
+	// 链路质量：下一跳 → 统计
+	links map[peer.PeerID]*RouteMetrics
+
+	// Policy：多条候选路由之间怎么选（默认 PolicyFailover）
+	Policy SelectPolicy
+
+	// Clock / Rand（可选）：链路统计 / 断路冷却用的时钟和 PolicyWeightedRandom 的随机数，
+	// nil = 系统时钟 / crypto/rand；sim 里换成虚拟的
+	Clock clock.Clock
+	Rand  io.Reader
 
 	// Kademlia 路由视图
 	kad *KademliaTable
@@ -46,7 +73,10 @@ type RouteTable struct {
 // NewRouteTable 创建一张空路由表（还不知道 selfID）
 func NewRouteTable() *RouteTable {
 	return &RouteTable{
-		direct: make(map[peer.PeerID]peer.PeerID),
+		direct:  make(map[peer.PeerID]bool),
+		via:     make(map[peer.PeerID][]peer.PeerID),
+		viaUsed: make(map[peer.PeerID]time.Time),
+		links:   make(map[peer.PeerID]*RouteMetrics),
 	}
 }
 
@@ -63,6 +93,16 @@ func (rt *RouteTable) BindSelf(self peer.PeerID) {
 	}
 }
 
+// Kademlia 返回内部的 Kademlia 表（BindSelf 之前为 nil）
+// DHT 协议（dht 包）和路由表共用这一张表
+func (rt *RouteTable) Kademlia() *KademliaTable {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return rt.kad
+}
+
+func (rt *RouteTable) now() time.Time { return clock.Or(rt.Clock).Now() }
+
 // LearnDirect 表示“我知道这个 peer 可以直连”
 // 例如：
 //   - 本地有 addr 记录
@@ -75,8 +115,7 @@ func (rt *RouteTable) LearnDirect(id peer.PeerID) {
 	rt.mu.Lock()
 	defer rt.mu.Unlock()
 
-	// 静态路由：dest → via（直连时 via=dest）
-	rt.direct[id] = id
+	rt.direct[id] = true
 
 	// 顺便喂给 Kademlia
 	if rt.kad != nil {
@@ -84,11 +123,14 @@ func (rt *RouteTable) LearnDirect(id peer.PeerID) {
 	}
 }
 
-// LearnVia 表示“我知道 dest 这个目标，需要经由 via 中继”
+// LearnVia 表示“我知道 dest 这个目标，可以经由 via 中继”
 //
 // 典型场景：多跳学习
 //   - 从 from 收到了一个信封，ReturnPeerID = X
-//   - 我就可以学到：想去 X，要先经过 from
+//   - 我就可以学到：想去 X，可以先经过 from
+//
+// 同一个 dest 可以学到多个 via，都作为候选保留：新的排在已有候选后面，
+// 已经在表里的位置不变；满了之后只顶掉第一跳已经“断了”的候选，没有就不收。
 func (rt *RouteTable) LearnVia(dest, via peer.PeerID) {
 	if dest.IsZero() || via.IsZero() {
 		return
@@ -97,26 +139,205 @@ func (rt *RouteTable) LearnVia(dest, via peer.PeerID) {
 	rt.mu.Lock()
 	defer rt.mu.Unlock()
 
-	rt.direct[dest] = via
+	if dest.Equals(via) {
+		rt.direct[dest] = true
+	} else {
+		now := rt.now()
+		rt.via[dest] = rt.appendCandidateLocked(rt.via[dest], via, now)
+		rt.touchViaLocked(dest, now)
+	}
+	if rt.kad != nil {
+		rt.kad.Update(via)
+	}
+}
+
+// PreferVia 和 LearnVia 一样记下 dest 经由 via，但把 via 放到候选最前面（已存在就挪过去），
+// 超出 MaxCandidates 丢掉最后一个。只给本节点自己选定的路由用（例如刚开好的 relay circuit），
+// 不要拿对端报来的信息调用。
+func (rt *RouteTable) PreferVia(dest, via peer.PeerID) {
+	if dest.IsZero() || via.IsZero() || dest.Equals(via) {
+		rt.LearnVia(dest, via)
+		return
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	out := make([]peer.PeerID, 0, len(rt.via[dest])+1)
+	out = append(out, via)
+	for _, v := range rt.via[dest] {
+		if !v.Equals(via) {
+			out = append(out, v)
+		}
+	}
+	if len(out) > MaxCandidates {
+		out = out[:MaxCandidates]
+	}
+	rt.via[dest] = out
+	rt.touchViaLocked(dest, rt.now())
 	if rt.kad != nil {
 		rt.kad.Update(via)
 	}
 }
 
 // Lookup 查找 dest 的下一跳 PeerID：
-//  1. 先查静态 direct 映射
+//  1. 先查学到的路由（直连 → via）
 //  2. 如果没有，再用 Kademlia 找最近邻
 func (rt *RouteTable) Lookup(dest peer.PeerID) (peer.PeerID, bool) {
-	// 1. 先看有没有明确的静态路由
+	if next, ok := rt.LookupLearned(dest); ok {
+		return next, true
+	}
+	return rt.Closest(dest)
+}
+
+// LookupLearned 只查明确学到的路由：在直连和所有 via 候选里按 Policy 选一条
+func (rt *RouteTable) LookupLearned(dest peer.PeerID) (peer.PeerID, bool) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	routes := rt.routesLocked(dest)
+	if len(routes) == 0 {
+		return peer.PeerID{}, false
+	}
+	now := rt.now()
+	if _, ok := rt.via[dest]; ok {
+		rt.viaUsed[dest] = now
+	}
+	return selectRoute(rt.Policy, routes, now, rt.Rand), true
+}
+
+// Routes 返回 dest 的所有候选路由及其质量（直连在前）
+func (rt *RouteTable) Routes(dest peer.PeerID) []Route {
 	rt.mu.RLock()
-	if via, ok := rt.direct[dest]; ok {
-		rt.mu.RUnlock()
-		return via, true
+	defer rt.mu.RUnlock()
+	return rt.routesLocked(dest)
+}
+
+func (rt *RouteTable) routesLocked(dest peer.PeerID) []Route {
+	var out []Route
+	add := func(via peer.PeerID) {
+		r := Route{Via: via}
+		if m := rt.links[via]; m != nil {
+			r.Metrics = *m
+		}
+		out = append(out, r)
+	}
+	if rt.direct[dest] {
+		add(dest)
 	}
+	for _, via := range rt.via[dest] {
+		add(via)
+	}
+	return out
+}
+
+// ReportSend 记录一次“发给下一跳 nextHop”的结果：
+//   - rtt：成功时这条链路的 RTT 样本（没有就传 0）
+//   - err：nil 表示成功
+//
+// 所有经由 nextHop 的路由都会用到这份统计。
+func (rt *RouteTable) ReportSend(nextHop peer.PeerID, rtt time.Duration, err error) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	m := rt.links[nextHop]
+	if m == nil {
+		m = &RouteMetrics{}
+		rt.links[nextHop] = m
+	}
+	m.observe(rtt, err, rt.now())
+}
+
+// LinkMetrics 返回到下一跳 nextHop 的链路统计
+func (rt *RouteTable) LinkMetrics(nextHop peer.PeerID) (RouteMetrics, bool) {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	m, ok := rt.links[nextHop]
+	if !ok {
+		return RouteMetrics{}, false
+	}
+	return *m, true
+}
+
+// ForgetVia 删掉 dest 经由 via 的候选路由
+func (rt *RouteTable) ForgetVia(dest, via peer.PeerID) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if dest.Equals(via) {
+		delete(rt.direct, dest)
+		return
+	}
+	list := rt.via[dest]
+	for i, v := range list {
+		if v.Equals(via) {
+			list = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(rt.via, dest)
+		delete(rt.viaUsed, dest)
+	} else {
+		rt.via[dest] = list
+	}
+}
+
+// touchViaLocked 记下 dest 的 via 刚学到过；有 via 的目标超过 MaxViaDests 个时，
+// 丢掉最久没学到 / 用到的那个（不会是 dest 自己）
+func (rt *RouteTable) touchViaLocked(dest peer.PeerID, now time.Time) {
+	if len(rt.via[dest]) == 0 {
+		return
+	}
+	rt.viaUsed[dest] = now
+	if len(rt.via) <= MaxViaDests {
+		return
+	}
+	var oldest peer.PeerID
+	var oldestAt time.Time
+	found := false
+	for id, at := range rt.viaUsed {
+		if id.Equals(dest) {
+			continue
+		}
+		if !found || at.Before(oldestAt) {
+			oldest, oldestAt, found = id, at, true
+		}
+	}
+	if found {
+		delete(rt.via, oldest)
+		delete(rt.viaUsed, oldest)
+	}
+}
+
+// appendCandidateLocked 把 via 接到候选列表末尾（已存在就不动）；
+// 满了 MaxCandidates 时顶掉第一条第一跳已经断了的候选，都还活着就丢掉新的
+func (rt *RouteTable) appendCandidateLocked(list []peer.PeerID, via peer.PeerID, now time.Time) []peer.PeerID {
+	for _, v := range list {
+		if v.Equals(via) {
+			return list
+		}
+	}
+	if len(list) < MaxCandidates {
+		return append(list, via)
+	}
+	for i, v := range list {
+		if m := rt.links[v]; m != nil && m.down(now) {
+			out := make([]peer.PeerID, 0, len(list))
+			out = append(out, list[:i]...)
+			out = append(out, list[i+1:]...)
+			return append(out, via)
+		}
+	}
+	return list
+}
+
+// Closest 用 Kademlia 表找离 dest 最近的已知节点（贪心转发的下一跳）
+func (rt *RouteTable) Closest(dest peer.PeerID) (peer.PeerID, bool) {
+	rt.mu.RLock()
 	kad := rt.kad
 	rt.mu.RUnlock()
 
-	// 2. 没有静态路由，尝试 Kademlia
 	if kad == nil {
 		return peer.PeerID{}, false
 	}
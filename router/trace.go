@@ -0,0 +1,153 @@
+package router
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"envelop/envelop"
+	"envelop/peer"
+)
+
+/*
+==========================================================
+ Tracer：overlay 层的 traceroute
+==========================================================
+
+和 IP traceroute 一样靠 TTL：
+
+  for ttl := 1; ttl <= maxHops; ttl++ {
+      发一个探测信封：Dest = 目标，TTL = ttl，带 ExtProbe(ProbeID) + 路径记录
+      第 ttl 个中继把 TTL 减到 0 → 丢弃，并回一个 TraceReply(ProbeID, 自己, Reached=0)
+      探测到了目标本身              → 目标回一个 TraceReply(ProbeID, 自己, Reached=1)
+      记录：这一跳是谁、从发出到收到回应用了多久（RTT）
+  }
+
+  收到 Reached=1 就结束；某一跳超时记为 Timeout，继续探下一跳。
+
+RTT 是发起方自己量的（发出 → 收到回应），不依赖各节点时钟同步。
+==========================================================
+*/
+
+// Hop 是 traceroute 的一跳
+type Hop struct {
+	TTL     int
+	ID      peer.PeerID   // 回应的节点（Timeout 时为零值）
+	RTT     time.Duration // 发出探测到收到回应
+	Reached bool          // 这一跳就是目标
+	Timeout bool          // 这一跳没有回应
+}
+
+func (h Hop) String() string {
+	if h.Timeout {
+		return fmt.Sprintf("%2d  *", h.TTL)
+	}
+	mark := ""
+	if h.Reached {
+		mark = "  (dest)"
+	}
+	return fmt.Sprintf("%2d  %s  %s%s", h.TTL, peer.PeerIDToDomain(h.ID), h.RTT, mark)
+}
+
+// traceReply 是收到的一条 TraceReply
+type traceReply struct {
+	hop     peer.PeerID
+	reached bool
+	at      time.Time
+}
+
+// Tracer 在一个 Router 上发起 traceroute
+type Tracer struct {
+	R *Router
+
+	mu      sync.Mutex
+	pending map[uint64]chan traceReply
+}
+
+// NewTracer 创建一个 Tracer，并接管 r.OnTraceReply
+func NewTracer(r *Router) *Tracer {
+	t := &Tracer{
+		R:       r,
+		pending: make(map[uint64]chan traceReply),
+	}
+	r.OnTraceReply = t.onReply
+	return t
+}
+
+// onReply 把 TraceReply 交给等待中的探测
+func (t *Tracer) onReply(env *envelop.Envelope) {
+	v, _ := env.Ext(envelop.ExtTraceReply)
+	id, hop, reached, ok := parseTraceReply(v)
+	if !ok {
+		return
+	}
+
+	t.mu.Lock()
+	ch := t.pending[id]
+	delete(t.pending, id)
+	t.mu.Unlock()
+
+	if ch != nil {
+		ch <- traceReply{hop: hop, reached: reached, at: time.Now()}
+	}
+}
+
+// Trace 对 dest 做一次 traceroute，最多探 maxHops 跳，每跳最多等 timeout。
+// 返回已经探到的每一跳；本地就找不到下一跳时返回错误。
+func (t *Tracer) Trace(dest peer.PeerID, maxHops int, timeout time.Duration) ([]Hop, error) {
+	if maxHops <= 0 || maxHops > 255 {
+		maxHops = 255
+	}
+	if dest.Equals(t.R.SelfID) {
+		return []Hop{{TTL: 0, ID: dest, Reached: true}}, nil
+	}
+	if t.R.Send == nil {
+		return nil, fmt.Errorf("tracer: router has no Send")
+	}
+
+	var hops []Hop
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		nextHop, ok := t.R.Resolve(dest)
+		if !ok {
+			return hops, fmt.Errorf("tracer: no route to %s", peer.PeerIDToDomain(dest))
+		}
+
+		var b [8]byte
+		_, _ = rand.Read(b[:])
+		id := binary.BigEndian.Uint64(b[:])
+
+		probe, _ := envelop.NewBuilder().
+			Version(1).
+			TTL(uint8(ttl)).
+			Dest(dest).
+			Return(t.R.SelfID).
+			Ext(envelop.ExtProbe, b[:]).
+			RecordPath().
+			Build()
+
+		ch := make(chan traceReply, 1)
+		t.mu.Lock()
+		t.pending[id] = ch
+		t.mu.Unlock()
+
+		start := time.Now()
+		t.R.Send(nextHop, probe)
+
+		select {
+		case rep := <-ch:
+			hop := Hop{TTL: ttl, ID: rep.hop, RTT: rep.at.Sub(start), Reached: rep.reached}
+			hops = append(hops, hop)
+			if hop.Reached {
+				return hops, nil
+			}
+		case <-time.After(timeout):
+			t.mu.Lock()
+			delete(t.pending, id)
+			t.mu.Unlock()
+			hops = append(hops, Hop{TTL: ttl, Timeout: true})
+		}
+	}
+	return hops, nil
+}
@@ -0,0 +1,277 @@
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"envelop/peer"
+)
+
+/*
+==========================================================
+ ACL：按调用方 PeerID 控制“谁能调哪些方法”
+==========================================================
+
+调用方身份来自签名验证（见 auth.go），不是 Envelope.ReturnPeerID。
+
+一条规则 = 效果（allow / deny）+ 方法模式 + 主体列表：
+
+  方法模式：path.Match 语法，例如
+      "Echo"      只匹配 Echo
+      "chat.*"    匹配 chat.Send / chat.List ...
+      "*"         匹配所有方法
+
+  主体（Subject）：
+      "xxxx.env"        某个具体 PeerID（peer.PeerIDToDomain 的格式）
+      "group:admins"    某个分组里的所有 PeerID
+      "authenticated"   任何签名验证通过的调用方
+      "anonymous"       没有签名的调用方
+      "*"               任何调用方（包括匿名）
+
+判定顺序：
+  1. 任何一条匹配的 deny 规则 → 拒绝（deny 优先）
+  2. 任何一条匹配的 allow 规则 → 允许
+  3. 都不匹配 → 走 Default（默认拒绝）
+
+代码里配置：
+
+  acl := rpc.NewACL(false)
+  acl.AddGroup("admins", aliceID)
+  acl.Allow("_rpc.*", "*")
+  acl.Allow("chat.*", "authenticated")
+  acl.Allow("admin.*", "group:admins")
+  acl.Deny("*", rpc.PeerSubject(mallory))
+  server.SetACL(acl)
+
+或者从 JSON 文件加载（LoadACLFile）：
+
+  {
+    "default": "deny",
+    "groups":  { "admins": ["xxxx.env"] },
+    "rules": [
+      { "effect": "allow", "methods": ["_rpc.*"],  "subjects": ["*"] },
+      { "effect": "allow", "methods": ["admin.*"], "subjects": ["group:admins"] }
+    ]
+  }
+==========================================================
+*/
+
+// 特殊主体
+const (
+	SubjectAny           = "*"
+	SubjectAuthenticated = "authenticated"
+	SubjectAnonymous     = "anonymous"
+	groupPrefix          = "group:"
+)
+
+// PeerSubject 把 PeerID 转成 ACL 主体字符串
+func PeerSubject(id peer.PeerID) string {
+	return peer.PeerIDToDomain(id)
+}
+
+// GroupSubject 把分组名转成 ACL 主体字符串
+func GroupSubject(name string) string {
+	return groupPrefix + name
+}
+
+// aclRule 是一条编译好的规则
+type aclRule struct {
+	allow    bool
+	methods  []string
+	subjects []string
+}
+
+// ACL 是按方法 + 调用方 PeerID 的访问控制表
+type ACL struct {
+	mu           sync.RWMutex
+	defaultAllow bool
+	groups       map[string]map[peer.PeerID]bool
+	rules        []aclRule
+}
+
+// NewACL 创建一个 ACL；defaultAllow 决定“没有任何规则匹配时”的结果
+func NewACL(defaultAllow bool) *ACL {
+	return &ACL{
+		defaultAllow: defaultAllow,
+		groups:       make(map[string]map[peer.PeerID]bool),
+	}
+}
+
+// AddGroup 把若干 PeerID 加入分组
+func (a *ACL) AddGroup(name string, ids ...peer.PeerID) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	g := a.groups[name]
+	if g == nil {
+		g = make(map[peer.PeerID]bool)
+		a.groups[name] = g
+	}
+	for _, id := range ids {
+		g[id] = true
+	}
+}
+
+// Allow 添加一条 allow 规则
+func (a *ACL) Allow(method string, subjects ...string) {
+	a.addRule(true, []string{method}, subjects)
+}
+
+// Deny 添加一条 deny 规则
+func (a *ACL) Deny(method string, subjects ...string) {
+	a.addRule(false, []string{method}, subjects)
+}
+
+func (a *ACL) addRule(allow bool, methods, subjects []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rules = append(a.rules, aclRule{allow: allow, methods: methods, subjects: subjects})
+}
+
+// Check 判断 caller 能否调用 method；不允许时返回 CodePermissionDenied
+func (a *ACL) Check(caller CallerInfo, method string) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	allowed := false
+	for _, r := range a.rules {
+		if !a.ruleMatches(r, caller, method) {
+			continue
+		}
+		if !r.allow {
+			return a.denied(caller, method)
+		}
+		allowed = true
+	}
+
+	if allowed || a.defaultAllow {
+		return nil
+	}
+	return a.denied(caller, method)
+}
+
+func (a *ACL) denied(caller CallerInfo, method string) error {
+	who := SubjectAnonymous
+	if caller.Verified {
+		who = PeerSubject(caller.ID)
+	}
+	return Errorf(CodePermissionDenied, "%s is not allowed to call %s", who, method)
+}
+
+// ruleMatches 判断一条规则是否同时匹配 method 和 caller（调用方需持有读锁）
+func (a *ACL) ruleMatches(r aclRule, caller CallerInfo, method string) bool {
+	methodOK := false
+	for _, pattern := range r.methods {
+		if ok, _ := path.Match(pattern, method); ok {
+			methodOK = true
+			break
+		}
+	}
+	if !methodOK {
+		return false
+	}
+
+	for _, subj := range r.subjects {
+		if a.subjectMatches(subj, caller) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *ACL) subjectMatches(subj string, caller CallerInfo) bool {
+	switch {
+	case subj == SubjectAny:
+		return true
+	case subj == SubjectAuthenticated:
+		return caller.Verified
+	case subj == SubjectAnonymous:
+		return !caller.Verified
+	case strings.HasPrefix(subj, groupPrefix):
+		return caller.Verified && a.groups[strings.TrimPrefix(subj, groupPrefix)][caller.ID]
+	default:
+		if !caller.Verified {
+			return false
+		}
+		id, err := peer.DomainToPeerID(subj)
+		return err == nil && id == caller.ID
+	}
+}
+
+/*
+==========================================================
+ 从文件加载
+==========================================================
+*/
+
+// aclFile 是 ACL 配置文件的 JSON 格式
+type aclFile struct {
+	Default string              `json:"default"` // "allow" / "deny"（默认 deny）
+	Groups  map[string][]string `json:"groups"`
+	Rules   []struct {
+		Effect   string   `json:"effect"` // "allow" / "deny"
+		Methods  []string `json:"methods"`
+		Subjects []string `json:"subjects"`
+	} `json:"rules"`
+}
+
+// ParseACL 从 JSON 字节解析 ACL
+func ParseACL(data []byte) (*ACL, error) {
+	var f aclFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("parse acl: %w", err)
+	}
+
+	var acl *ACL
+	switch f.Default {
+	case "", "deny":
+		acl = NewACL(false)
+	case "allow":
+		acl = NewACL(true)
+	default:
+		return nil, fmt.Errorf("parse acl: bad default %q", f.Default)
+	}
+
+	for name, members := range f.Groups {
+		for _, m := range members {
+			id, err := peer.DomainToPeerID(m)
+			if err != nil {
+				return nil, fmt.Errorf("parse acl: group %s member %q: %w", name, m, err)
+			}
+			acl.AddGroup(name, id)
+		}
+	}
+
+	for i, r := range f.Rules {
+		var allow bool
+		switch r.Effect {
+		case "allow":
+			allow = true
+		case "deny":
+			allow = false
+		default:
+			return nil, fmt.Errorf("parse acl: rule %d bad effect %q", i, r.Effect)
+		}
+		for _, m := range r.Methods {
+			if _, err := path.Match(m, ""); err != nil {
+				return nil, fmt.Errorf("parse acl: rule %d bad method pattern %q", i, m)
+			}
+		}
+		acl.addRule(allow, r.Methods, r.Subjects)
+	}
+
+	return acl, nil
+}
+
+// LoadACLFile 从 JSON 文件加载 ACL
+func LoadACLFile(filename string) (*ACL, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseACL(data)
+}
@@ -0,0 +1,146 @@
+package rpc
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"time"
+
+	"envelop/peer"
+)
+
+/*
+==========================================================
+ 调用方身份：签名的 RPC 请求
+==========================================================
+
+Envelope.ReturnPeerID 谁都可以随便填，不能拿来做权限判断。
+
+所以 RPC 请求自己带“身份证明”：
+
+  Message.Pub = 调用方 Ed25519 公钥
+  Message.Sig = 用私钥对 Message 规范化摘要的签名
+
+Server 收到后：
+  1. 用 Pub 验证 Sig
+  2. PeerID = SHA256(Pub)（和 peer.NewPeerIDFromPubKey 完全一致）
+  3. 这个 PeerID 才是“可信的调用方”，交给 ACL 判断
+
+即使经过多跳 Onion 中继，签名也是端到端的：中继改了内容就验不过。
+
+摘要覆盖的字段：Type / ID / Method / Data，以及 Batch 里每一条的同样字段；
+再加上整条消息的 To（接收方 PeerID）和 Exp（过期时间）。
+响应（Response）不签名。
+
+重放：
+  - To：Server（SetSelf 过的）只收 To 是自己的签名请求，
+        发给 A 的请求拿到 B 那里重放没用
+  - Exp：过期的不收，Exp 比现在晚太多（超过 2 × SignatureTTL）的也不收
+  - 有效期之内同一个 (caller, ID) 的重复请求，用 Server 的去重缓存挡掉
+这两项在 ACL 之前检查。
+==========================================================
+*/
+
+// signDomain 用于区分“RPC 签名”和其它用途的签名
+const signDomain = "envelop-rpc-v2"
+
+// SignatureTTL 是签名请求的有效期（Endpoint 签名时 Exp = 现在 + SignatureTTL）
+const SignatureTTL = 2 * time.Minute
+
+// CallerInfo 描述一次调用的调用方
+//   - ID：      调用方 PeerID（Verified=false 时为零值）
+//   - Verified：是否通过签名验证
+type CallerInfo struct {
+	ID       peer.PeerID
+	Verified bool
+}
+
+// digest 计算 Message 的规范化摘要（不含 Pub / Sig 本身）
+func (m *Message) digest() []byte {
+	h := sha256.New()
+	h.Write([]byte(signDomain))
+	writeDigest(h, m)
+
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(len(m.To)))
+	h.Write(buf[:])
+	h.Write(m.To)
+	binary.BigEndian.PutUint64(buf[:], uint64(m.Exp))
+	h.Write(buf[:])
+	return h.Sum(nil)
+}
+
+func writeDigest(h hash.Hash, m *Message) {
+	var buf [8]byte
+
+	h.Write([]byte{byte(m.Type)})
+	binary.BigEndian.PutUint64(buf[:], m.ID)
+	h.Write(buf[:])
+
+	binary.BigEndian.PutUint64(buf[:], uint64(len(m.Method)))
+	h.Write(buf[:])
+	h.Write([]byte(m.Method))
+
+	binary.BigEndian.PutUint64(buf[:], uint64(len(m.Data)))
+	h.Write(buf[:])
+	h.Write(m.Data)
+
+	binary.BigEndian.PutUint64(buf[:], uint64(len(m.Batch)))
+	h.Write(buf[:])
+	for _, entry := range m.Batch {
+		if entry == nil {
+			h.Write([]byte{0})
+			continue
+		}
+		writeDigest(h, entry)
+	}
+}
+
+// Sign 用 KeyPair 给 Message 签名（填充 Pub / Sig）
+func (m *Message) Sign(kp *peer.KeyPair) {
+	m.Pub = append([]byte(nil), kp.PublicKey...)
+	m.Sig = ed25519.Sign(kp.PrivateKey, m.digest())
+}
+
+// SignFor 给发往 to 的 Message 签名：填上接收方和过期时间，再签名（签名覆盖这两项）
+func (m *Message) SignFor(kp *peer.KeyPair, to peer.PeerID, exp time.Time) {
+	m.To = append([]byte(nil), to[:]...)
+	m.Exp = exp.Unix()
+	m.Sign(kp)
+}
+
+// checkAudience 检查签名请求的接收方和过期时间（签名已经验过）：
+//   - self 不是零值时，To 必须就是 self
+//   - now 不能晚于 Exp，Exp 也不能比 now 晚超过 2 × SignatureTTL
+func (m *Message) checkAudience(self peer.PeerID, now time.Time) error {
+	if !self.IsZero() && !bytes.Equal(m.To, self[:]) {
+		return Errorf(CodeUnauthenticated, "signed request is addressed to another peer")
+	}
+	exp := time.Unix(m.Exp, 0)
+	if m.Exp == 0 || now.After(exp) {
+		return Errorf(CodeUnauthenticated, "signed request has expired")
+	}
+	if exp.Sub(now) > 2*SignatureTTL {
+		return Errorf(CodeUnauthenticated, "signed request expires too far in the future")
+	}
+	return nil
+}
+
+// VerifyCaller 验证签名并返回调用方身份：
+//   - 没有签名 → CallerInfo{Verified:false}，err=nil（匿名调用）
+//   - 签名不对 → CodeUnauthenticated
+//   - 签名正确 → CallerInfo{ID: SHA256(Pub), Verified:true}
+func (m *Message) VerifyCaller() (CallerInfo, error) {
+	if len(m.Sig) == 0 && len(m.Pub) == 0 {
+		return CallerInfo{}, nil
+	}
+	if len(m.Pub) != ed25519.PublicKeySize || len(m.Sig) != ed25519.SignatureSize {
+		return CallerInfo{}, Errorf(CodeUnauthenticated, "malformed caller signature")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(m.Pub), m.digest(), m.Sig) {
+		return CallerInfo{}, Errorf(CodeUnauthenticated, "invalid caller signature")
+	}
+	return CallerInfo{ID: peer.NewPeerIDFromPubKey(m.Pub), Verified: true}, nil
+}
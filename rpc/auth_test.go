@@ -0,0 +1,105 @@
+package rpc
+
+import (
+	"testing"
+	"time"
+
+	"envelop/peer"
+)
+
+// whoami 返回调用方 PeerID，匿名调用返回空
+func whoami(s *Server, notified chan<- peer.PeerID) {
+	s.RegisterWithCaller(MethodInfo{Name: "WhoAmI"}, func(caller CallerInfo, _ []byte) ([]byte, error) {
+		if !caller.Verified {
+			return nil, nil
+		}
+		if notified != nil {
+			notified <- caller.ID
+		}
+		return caller.ID[:], nil
+	})
+}
+
+// loopback 把 Client 发出的消息直接交给 Server，响应再交回 Client
+func loopback(c *Client, s *Server) SendFunc {
+	return func(req *Message) error {
+		if resp := s.HandleMessage(req); resp != nil {
+			go c.OnMessage(resp)
+		}
+		return nil
+	}
+}
+
+// SetKey 签的请求：没有 SetSelf 的 Server 和接收方对得上的 Server 都认得调用方，
+// 接收方不对的 Server 拒绝
+func TestClientSetKey(t *testing.T) {
+	kp, err := peer.NewKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	callerID := peer.NewPeerIDFromPubKey(kp.PublicKey)
+	serverID := peer.PeerID{1}
+
+	cases := []struct {
+		name   string
+		self   peer.PeerID
+		to     peer.PeerID
+		reject bool
+	}{
+		{"no SetSelf", peer.PeerID{}, peer.PeerID{}, false},
+		{"matching audience", serverID, serverID, false},
+		{"other audience", serverID, peer.PeerID{2}, true},
+		{"missing audience", serverID, peer.PeerID{}, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewServer()
+			s.SetSelf(tc.self)
+			whoami(s, nil)
+
+			c := NewClient()
+			c.SetKey(kp, tc.to)
+			resp, err := c.Call("WhoAmI", nil, loopback(c, s), time.Second)
+			if tc.reject {
+				if CodeOf(err) != CodeUnauthenticated {
+					t.Fatalf("call: %v, want unauthenticated", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("call: %v", err)
+			}
+			if peer.PeerID(resp.Data) != callerID {
+				t.Fatalf("server saw caller %x, want %x", resp.Data, callerID[:])
+			}
+		})
+	}
+}
+
+// SetKey 签的通知同样能通过验证，交给 handler
+func TestClientSetKeyNotify(t *testing.T) {
+	kp, err := peer.NewKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverID := peer.PeerID{1}
+
+	s := NewServer()
+	s.SetSelf(serverID)
+	notified := make(chan peer.PeerID, 1)
+	whoami(s, notified)
+
+	c := NewClient()
+	c.SetKey(kp, serverID)
+	if err := c.Notify("WhoAmI", nil, loopback(c, s)); err != nil {
+		t.Fatalf("notify: %v", err)
+	}
+	select {
+	case id := <-notified:
+		if id != peer.NewPeerIDFromPubKey(kp.PublicKey) {
+			t.Fatalf("notified by %x", id[:])
+		}
+	default:
+		t.Fatal("signed notification was dropped")
+	}
+}
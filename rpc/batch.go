@@ -0,0 +1,203 @@
+package rpc
+
+import (
+	"time"
+)
+
+/*
+==========================================================
+ 单向通知（Notification）+ 批量调用（Batch）
+==========================================================
+
+为什么需要？
+  走多跳 Onion 路径时，每个往返（round-trip）都很贵：
+    Alice → Relay1 → Relay2 → Bob → Relay2 → Relay1 → Alice
+
+  1. Notification：
+       - 只管发，不要回包（日志上报 / 心跳 / 事件推送）
+       - Server 执行 handler，但永远不产生 Response
+       - 没有 pending，ID 固定为 0
+
+  2. Batch：
+       - 一个 Envelope 里装多条 Request / Notification
+       - Server 逐条执行，把所有 Response 合并成一个 Response 回来：
+
+           请求： {Type:Batch, ID:7, Batch:[Req#8, Notify, Req#9]}
+           响应： {Type:Response, ID:7, Batch:[Resp#8, Resp#9]}
+
+       - 每条 Request 的成功 / 失败独立上报（BatchResult.Err）
+       - 整个 Batch 级别的错误（例如条目过多）放在外层 Response 的 Code 上
+
+==========================================================
+*/
+
+// MaxBatchSize 是单个 Batch 允许的最大条目数
+const MaxBatchSize = 128
+
+// NewNotification 创建一个单向通知消息（不期待响应，ID=0）
+func NewNotification(method string, data []byte) *Message {
+	return &Message{
+		Type:   TypeNotification,
+		Method: method,
+		Data:   data,
+	}
+}
+
+/*
+==========================================================
+ Server 侧
+==========================================================
+*/
+
+// handleNotification 执行通知对应的 handler，结果和错误都丢弃
+// 没权限 / 方法不存在时静默丢弃
+func (s *Server) handleNotification(msg *Message, caller CallerInfo) {
+	h, ok, err := s.lookup(msg.Method, caller)
+	if err != nil || !ok {
+		return
+	}
+	_, _ = callHandler(h, caller, msg.Data)
+}
+
+// handleBatch 逐条处理 Batch，合并所有 Response
+// 调用方身份以外层 Batch 的签名为准，条目本身不需要再签
+func (s *Server) handleBatch(msg *Message, caller CallerInfo) *Message {
+	if len(msg.Batch) == 0 {
+		return NewErrorResponse(msg.ID, Errorf(CodeInvalidArgument, "empty batch"))
+	}
+	if len(msg.Batch) > MaxBatchSize {
+		return NewErrorResponse(msg.ID, Errorf(CodeInvalidArgument,
+			"batch too large: %d > %d", len(msg.Batch), MaxBatchSize))
+	}
+
+	var results []*Message
+	for _, entry := range msg.Batch {
+		if entry == nil {
+			continue
+		}
+		switch entry.Type {
+		case TypeRequest:
+			results = append(results, s.handleRequest(entry, caller))
+		case TypeNotification:
+			s.handleNotification(entry, caller)
+		default:
+			// 不允许嵌套 Batch / 在 Batch 里塞 Response
+			results = append(results, NewErrorResponse(entry.ID,
+				Errorf(CodeInvalidArgument, "invalid batch entry type %d", entry.Type)))
+		}
+	}
+
+	// 全是通知：不回包
+	if len(results) == 0 {
+		return nil
+	}
+
+	return &Message{
+		Type:  TypeResponse,
+		ID:    msg.ID,
+		Batch: results,
+	}
+}
+
+/*
+==========================================================
+ Client 侧
+==========================================================
+*/
+
+// Notify 发送一条单向通知：只要 send 成功就返回 nil，不等待任何响应
+func (c *Client) Notify(method string, data []byte, send SendFunc) error {
+	n := NewNotification(method, data)
+	c.sign(n)
+	if err := send(n); err != nil {
+		return wrapError(CodeUnavailable, err)
+	}
+	return nil
+}
+
+// BatchCall 描述 Batch 里的一条调用
+type BatchCall struct {
+	Method string
+	Data   []byte
+	Notify bool // true = 单向通知，不会有对应的结果
+}
+
+// BatchResult 是 Batch 里一条调用的结果
+//   - Resp：对端的 Response（Notify 条目为 nil）
+//   - Err： 这一条的错误（*Error，可用 errors.Is 判断）
+type BatchResult struct {
+	Resp *Message
+	Err  error
+}
+
+// CallBatch 把多条调用塞进一个 Batch 发出去，只走一次往返。
+//
+// 返回值：
+//   - results：和 calls 一一对应（同样的下标）
+//   - err：    整个 Batch 级别的失败（发送失败 / 超时 / 对端拒绝整个 Batch），
+//     此时 results 为 nil
+//
+// 全部是 Notify 时不会等待响应，发送成功即返回。
+func (c *Client) CallBatch(calls []BatchCall, send SendFunc, timeout time.Duration) ([]BatchResult, error) {
+	if len(calls) == 0 {
+		return nil, Errorf(CodeInvalidArgument, "empty batch")
+	}
+	if len(calls) > MaxBatchSize {
+		return nil, Errorf(CodeInvalidArgument, "batch too large: %d > %d", len(calls), MaxBatchSize)
+	}
+
+	// 1. 组装 Batch，记录每个 Request 条目的 ID → 下标
+	batch := c.newRequest("", nil)
+	batch.Type = TypeBatch
+
+	index := make(map[uint64]int)
+	for i, call := range calls {
+		if call.Notify {
+			batch.Batch = append(batch.Batch, NewNotification(call.Method, call.Data))
+			continue
+		}
+		req := c.newRequest(call.Method, call.Data)
+		index[req.ID] = i
+		batch.Batch = append(batch.Batch, req)
+	}
+
+	results := make([]BatchResult, len(calls))
+
+	// 2. 全是通知：发完就走
+	if len(index) == 0 {
+		c.sign(batch)
+		if err := send(batch); err != nil {
+			return nil, wrapError(CodeUnavailable, err)
+		}
+		return results, nil
+	}
+
+	// 3. 一次往返
+	resp, err := c.roundTrip(batch, send, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := resp.Err(); err != nil {
+		return nil, err
+	}
+
+	// 4. 按 ID 把结果对回原来的下标
+	for _, r := range resp.Batch {
+		if r == nil {
+			continue
+		}
+		i, ok := index[r.ID]
+		if !ok {
+			continue
+		}
+		results[i] = BatchResult{Resp: r, Err: r.Err()}
+		delete(index, r.ID)
+	}
+
+	// 5. 对端漏掉的条目
+	for _, i := range index {
+		results[i] = BatchResult{Err: Errorf(CodeInternal, "no response for batch entry %d", i)}
+	}
+
+	return results, nil
+}
@@ -0,0 +1,330 @@
+package rpc
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"envelop/clock"
+	"envelop/peer"
+	"envelop/router"
+)
+
+/*
+==========================================================
+ 服务发现：基于 Kademlia 的 Provider 注册表
+==========================================================
+
+目标：客户端只知道服务名（例如 "chat" / "storage"），
+      想找到“哪些 Peer 提供了这个服务”。
+
+思路和 Kademlia / IPFS 的 Provider Record 一样：
+
+  1. 服务名 → 256-bit Key：
+        key = SHA256("envelop-service:" + name)
+     Key 和 PeerID 在同一个 XOR 空间里。
+
+  2. Provide(name)：
+        在本地 KademliaTable 里找离 key 最近的 Replicas 个节点，
+        对它们调用 _rpc.AddProvider，让它们记住“我提供这个服务”。
+
+  3. FindProviders(name)：
+        同样找离 key 最近的 Replicas 个节点，
+        对它们调用 _rpc.GetProviders，把结果合并去重。
+
+  4. 每条 Provider 记录带 TTL，过期自动失效；
+     提供方需要定期重新 Provide（一般 TTL/2 一次）。
+
+  5. AddProvider 只收提供方自己签名的请求（caller.ID == Provider），
+     谁都不能替别人登记、把服务指向别人；每个服务最多记 MaxProviders 个，
+     满了之后新的提供方要等旧记录过期（已经在表里的可以续期）。
+
+Discovery 本身不关心“怎么把 RPC 发到某个 PeerID”，
+这件事由上层注入的 PeerCallFunc 完成（Client + Envelope + Router）。
+==========================================================
+*/
+
+// 内置的 Provider 方法名
+const (
+	MethodAddProvider  = "_rpc.AddProvider"
+	MethodGetProviders = "_rpc.GetProviders"
+)
+
+const (
+	defaultProviderTTL  = 30 * time.Minute
+	defaultReplicas     = 3
+	defaultCallTimeout  = 5 * time.Second
+	defaultMaxProviders = 64
+)
+
+// PeerCallFunc：向指定 PeerID 发起一次 RPC 调用
+// 一般由上层用 Client.Call + Envelope 发送封装出来
+type PeerCallFunc func(dest peer.PeerID, method string, data []byte, timeout time.Duration) (*Message, error)
+
+// ServiceKey 把服务名映射到 Kademlia 的 Key 空间
+func ServiceKey(name string) peer.PeerID {
+	return peer.PeerID(sha256.Sum256([]byte("envelop-service:" + name)))
+}
+
+// providerRecord 是 AddProvider / GetProviders 在线上的格式
+type providerRecord struct {
+	Service  string      `json:"s"`
+	Provider peer.PeerID `json:"p"`
+	TTL      int64       `json:"ttl,omitempty"` // 秒
+}
+
+// getProvidersRequest 是 GetProviders 的参数
+type getProvidersRequest struct {
+	Service string `json:"s"`
+}
+
+// Discovery 是一个 DHT 风格的服务注册表
+type Discovery struct {
+	self  peer.PeerID
+	table *router.KademliaTable
+	call  PeerCallFunc
+
+	// TTL：Provider 记录的有效期（Provide 时告诉对端）
+	TTL time.Duration
+	// Replicas：每条记录存到离 Key 最近的几个节点上
+	Replicas int
+	// CallTimeout：单次远程调用的超时
+	CallTimeout time.Duration
+	// MaxProviders：替别人保存时，每个服务最多记多少个 Provider
+	MaxProviders int
+	// Clock（可选）：Provider 记录过期用的时钟；nil 时用 Mount 的那个 Server 的时钟
+	// （Endpoint.SetClock 设置的），都没有就是系统时钟
+	Clock clock.Clock
+
+	mu        sync.Mutex
+	providers map[string]map[peer.PeerID]time.Time // service → provider → 过期时间
+	srv       *Server                              // Mount 到的 Server
+}
+
+// NewDiscovery 创建一个服务注册表
+//   - self：  本节点 PeerID（Provide 时作为 Provider）
+//   - table： Kademlia 路由表（用来找离 Key 最近的节点）
+//   - call：  远程调用函数（可以为 nil，此时只做本地注册表）
+func NewDiscovery(self peer.PeerID, table *router.KademliaTable, call PeerCallFunc) *Discovery {
+	return &Discovery{
+		self:         self,
+		table:        table,
+		call:         call,
+		TTL:          defaultProviderTTL,
+		Replicas:     defaultReplicas,
+		CallTimeout:  defaultCallTimeout,
+		MaxProviders: defaultMaxProviders,
+		providers:    make(map[string]map[peer.PeerID]time.Time),
+	}
+}
+
+// Mount 把 _rpc.AddProvider / _rpc.GetProviders 挂到 Server 上，
+// 让本节点可以替别人保存 Provider 记录
+func (d *Discovery) Mount(s *Server) {
+	d.mu.Lock()
+	d.srv = s
+	d.mu.Unlock()
+
+	s.register(MethodInfo{
+		Name:        MethodAddProvider,
+		Version:     "1",
+		Description: "store a provider record for a service (signed by the provider)",
+	}, d.handleAddProvider)
+
+	s.register(MethodInfo{
+		Name:        MethodGetProviders,
+		Version:     "1",
+		Description: "return known providers of a service",
+	}, d.handleGetProviders)
+}
+
+func (d *Discovery) handleAddProvider(caller CallerInfo, data []byte) ([]byte, error) {
+	var rec providerRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, Errorf(CodeInvalidArgument, "bad provider record: %v", err)
+	}
+	if rec.Service == "" || rec.Provider.IsZero() {
+		return nil, Errorf(CodeInvalidArgument, "provider record missing service or provider")
+	}
+	if !caller.Verified {
+		return nil, Errorf(CodeUnauthenticated, "provider record must be signed by the provider")
+	}
+	if caller.ID != rec.Provider {
+		return nil, Errorf(CodePermissionDenied, "caller %s cannot register provider %s",
+			peer.PeerIDToDomain(caller.ID), peer.PeerIDToDomain(rec.Provider))
+	}
+
+	ttl := time.Duration(rec.TTL) * time.Second
+	if ttl <= 0 || ttl > d.TTL {
+		ttl = d.TTL
+	}
+	if !d.addRemote(rec.Service, rec.Provider, ttl) {
+		return nil, Errorf(CodeResourceExhausted, "service %q already has %d providers", rec.Service, d.maxProviders())
+	}
+	return nil, nil
+}
+
+// now 返回 Discovery 的当前时间（调用方持有 d.mu）
+func (d *Discovery) now() time.Time {
+	if d.Clock == nil && d.srv != nil {
+		return d.srv.now()
+	}
+	return clock.Or(d.Clock).Now()
+}
+
+func (d *Discovery) maxProviders() int {
+	if d.MaxProviders > 0 {
+		return d.MaxProviders
+	}
+	return defaultMaxProviders
+}
+
+// addRemote 替别人记一条 Provider：已经在表里的直接续期；
+// 新的提供方先清掉过期记录，还是满了就不收
+func (d *Discovery) addRemote(service string, provider peer.PeerID, ttl time.Duration) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	m := d.providers[service]
+	if _, ok := m[provider]; !ok && len(m) >= d.maxProviders() {
+		for id, exp := range m {
+			if now.After(exp) {
+				delete(m, id)
+			}
+		}
+		if len(m) >= d.maxProviders() {
+			return false
+		}
+	}
+	if m == nil {
+		m = make(map[peer.PeerID]time.Time)
+		d.providers[service] = m
+	}
+	m[provider] = now.Add(ttl)
+	return true
+}
+
+func (d *Discovery) handleGetProviders(_ CallerInfo, data []byte) ([]byte, error) {
+	var req getProvidersRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, Errorf(CodeInvalidArgument, "bad get providers request: %v", err)
+	}
+	return json.Marshal(d.LocalProviders(req.Service))
+}
+
+// addLocal 在本地记一条 Provider
+func (d *Discovery) addLocal(service string, provider peer.PeerID, ttl time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	m := d.providers[service]
+	if m == nil {
+		m = make(map[peer.PeerID]time.Time)
+		d.providers[service] = m
+	}
+	m[provider] = d.now().Add(ttl)
+}
+
+// LocalProviders 返回本地记住的、尚未过期的 Provider
+func (d *Discovery) LocalProviders(service string) []peer.PeerID {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	var out []peer.PeerID
+	for id, exp := range d.providers[service] {
+		if now.After(exp) {
+			delete(d.providers[service], id)
+			continue
+		}
+		out = append(out, id)
+	}
+	return out
+}
+
+// closest 返回离服务 Key 最近的若干已知节点
+func (d *Discovery) closest(service string) []peer.PeerID {
+	if d.table == nil {
+		return nil
+	}
+	return d.table.FindClosest(ServiceKey(service), d.Replicas)
+}
+
+// Provide 宣告“本节点提供 service”：
+//   - 本地记一份
+//   - 再存到离 ServiceKey(service) 最近的 Replicas 个节点上
+//
+// 只要有一个远端存成功就返回 nil；一个都没存成功时返回最后一个错误。
+func (d *Discovery) Provide(service string) error {
+	d.addLocal(service, d.self, d.TTL)
+
+	targets := d.closest(service)
+	if len(targets) == 0 || d.call == nil {
+		return nil
+	}
+
+	req, _ := json.Marshal(providerRecord{
+		Service:  service,
+		Provider: d.self,
+		TTL:      int64(d.TTL / time.Second),
+	})
+
+	var lastErr error
+	stored := 0
+	for _, target := range targets {
+		if _, err := d.call(target, MethodAddProvider, req, d.CallTimeout); err != nil {
+			lastErr = err
+			continue
+		}
+		stored++
+	}
+	if stored == 0 {
+		return lastErr
+	}
+	return nil
+}
+
+// FindProviders 查找提供 service 的节点：本地记录 + 离 Key 最近的节点上的记录，合并去重
+// 所有远端都失败、本地也没有时，返回 CodeNotFound 或最后一个远端错误。
+func (d *Discovery) FindProviders(service string) ([]peer.PeerID, error) {
+	seen := make(map[peer.PeerID]bool)
+	var out []peer.PeerID
+	add := func(ids []peer.PeerID) {
+		for _, id := range ids {
+			if !seen[id] {
+				seen[id] = true
+				out = append(out, id)
+			}
+		}
+	}
+
+	add(d.LocalProviders(service))
+
+	var lastErr error
+	if d.call != nil {
+		req, _ := json.Marshal(getProvidersRequest{Service: service})
+		for _, target := range d.closest(service) {
+			resp, err := d.call(target, MethodGetProviders, req, d.CallTimeout)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			var ids []peer.PeerID
+			if err := json.Unmarshal(resp.Data, &ids); err != nil {
+				lastErr = Errorf(CodeInternal, "bad providers response: %v", err)
+				continue
+			}
+			add(ids)
+		}
+	}
+
+	if len(out) == 0 {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		return nil, Errorf(CodeNotFound, "no provider for service %q", service)
+	}
+	return out, nil
+}
@@ -0,0 +1,187 @@
+package rpc
+
+import (
+	"io"
+	"log"
+	"time"
+
+	"envelop/clock"
+	"envelop/envelop"
+	"envelop/peer"
+)
+
+/*
+==========================================================
+ Endpoint：把 RPC 接到 Envelope 上
+==========================================================
+
+Server / Client 本身只认识 Message，不知道网络。
+Endpoint 负责把它们和 Envelope 收发拼起来：
+
+  发送：
+     Message → JSON → Envelope{Flags: FlagRPC, Dest: 对方, Return: 自己}
+     → SendEnvelope（一般是 Router：NextHop + Send）
+
+  接收（在 Router.OnPayload 里调用 HandleEnvelope）：
+     Envelope(FlagRPC) → Message
+       - Response     → Client.OnMessage（唤醒等待中的 Call）
+       - 其它         → Server.HandleMessage → 有回包就发回 env.ReturnPeerID
+
+Endpoint 设置了 Key 时，所有请求都会按目标签名（Message.SignFor：接收方 + 过期时间，见 auth.go），
+对端可以据此做 ACL / 去重 / 路由学习；Server 也只收发给自己（Self）的签名请求。
+
+Datagram 选中的方法，请求信封标 FlagDatagram（小的走 datagram，丢了就是超时）；
+收到标了 FlagDatagram 的请求，响应也这样标。
+
+用法：
+
+  ep := rpc.NewEndpoint(kp, func(env *envelop.Envelope) error { ... })
+  ep.Server.Register("Echo", ...)
+  resp, err := ep.Call(bobID, "Echo", []byte("hi"), 3*time.Second)
+==========================================================
+*/
+
+// 默认 TTL：RPC 信封经过的最大跳数
+const defaultEndpointTTL = 8
+
+// Endpoint 组合了一个 Server + 一个 Client，并负责 Envelope 的封装和分发
+type Endpoint struct {
+	Self   peer.PeerID
+	Key    *peer.KeyPair // 可选：请求签名用
+	Server *Server
+	Client *Client
+
+	// SendEnvelope：把一个已经填好 Dest 的 Envelope 送出去
+	SendEnvelope func(env *envelop.Envelope) error
+
+	// TTL：发出的 RPC 信封 TTL（0 → 默认 8）
+	TTL uint8
+
+	// Datagram（可选）：返回 true 的方法走 datagram（见上），适合丢了重试就行的小调用，例如 dht.Ping
+	Datagram func(method string) bool
+
+	// Clock（可选）：签名过期时间按它算，nil = 系统时钟；用 SetClock 连同 Server / Client 一起设置
+	Clock clock.Clock
+}
+
+// NewEndpoint 创建一个 Endpoint（kp 可以为 nil，此时请求不签名、Self 为零值）
+func NewEndpoint(kp *peer.KeyPair, send func(env *envelop.Envelope) error) *Endpoint {
+	ep := &Endpoint{
+		Key:          kp,
+		Server:       NewServer(),
+		Client:       NewClient(),
+		SendEnvelope: send,
+	}
+	if kp != nil {
+		ep.Self = kp.PeerID
+		ep.Server.SetSelf(kp.PeerID)
+	}
+	return ep
+}
+
+// SetClock 让 Endpoint、Server、Client 用同一个时钟和随机数来源（sim 里换成虚拟的）
+func (e *Endpoint) SetClock(c clock.Clock, r io.Reader) {
+	e.Clock = c
+	e.Server.SetClock(c)
+	e.Client.Clock = c
+	e.Client.Rand = r
+}
+
+// IsRPC 判断一个 Envelope 是不是 RPC 信封
+func IsRPC(env *envelop.Envelope) bool {
+	return env.Flags&envelop.FlagRPC != 0
+}
+
+// buildEnvelope 把 Message 装进一个 FlagRPC 信封（datagram 时再加 FlagDatagram）
+func (e *Endpoint) buildEnvelope(dest peer.PeerID, msg *Message, datagram bool) (*envelop.Envelope, error) {
+	b, err := msg.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	ttl := e.TTL
+	if ttl == 0 {
+		ttl = defaultEndpointTTL
+	}
+	flags := envelop.FlagRPC
+	if datagram {
+		flags |= envelop.FlagDatagram
+	}
+	return envelop.NewBuilder().
+		Version(1).
+		Flags(flags).
+		TTL(ttl).
+		Dest(dest).
+		Return(e.Self).
+		Payload(b).
+		Build()
+}
+
+// send 把 msg 发给 dest
+func (e *Endpoint) send(dest peer.PeerID, msg *Message, datagram bool) error {
+	env, err := e.buildEnvelope(dest, msg, datagram)
+	if err != nil {
+		return err
+	}
+	return e.SendEnvelope(env)
+}
+
+// sendTo 返回一个“发给 dest”的 SendFunc；方法被 Datagram 选中的走 datagram。
+// 设置了 Key 的，每次发送前按 dest 重新签名（重试时过期时间跟着往后推）
+func (e *Endpoint) sendTo(dest peer.PeerID) SendFunc {
+	return func(msg *Message) error {
+		if e.Key != nil {
+			msg.SignFor(e.Key, dest, clock.Or(e.Clock).Now().Add(SignatureTTL))
+		}
+		datagram := e.Datagram != nil && msg.Method != "" && e.Datagram(msg.Method)
+		return e.send(dest, msg, datagram)
+	}
+}
+
+// Call 对 dest 发起一次调用（签名和 PeerCallFunc 一致，可以直接注入给 Discovery / DHT）
+func (e *Endpoint) Call(dest peer.PeerID, method string, data []byte, timeout time.Duration) (*Message, error) {
+	return e.Client.Call(method, data, e.sendTo(dest), timeout)
+}
+
+// CallWithRetry 对 dest 发起一次带重试的调用
+func (e *Endpoint) CallWithRetry(dest peer.PeerID, method string, data []byte, timeout time.Duration, policy RetryPolicy) (*Message, error) {
+	return e.Client.CallWithRetry(method, data, e.sendTo(dest), timeout, policy)
+}
+
+// Notify 对 dest 发送一条单向通知
+func (e *Endpoint) Notify(dest peer.PeerID, method string, data []byte) error {
+	return e.Client.Notify(method, data, e.sendTo(dest))
+}
+
+// CallBatch 对 dest 发起一次批量调用
+func (e *Endpoint) CallBatch(dest peer.PeerID, calls []BatchCall, timeout time.Duration) ([]BatchResult, error) {
+	return e.Client.CallBatch(calls, e.sendTo(dest), timeout)
+}
+
+// HandleEnvelope 处理一个收到的 RPC 信封。
+// 返回 false 表示这不是 RPC 信封（上层应该按普通业务数据处理）。
+func (e *Endpoint) HandleEnvelope(env *envelop.Envelope) bool {
+	if !IsRPC(env) {
+		return false
+	}
+
+	msg, err := Unmarshal(env.InnerPayload)
+	if err != nil {
+		log.Printf("[RPC] bad message from %s: %v", peer.PeerIDToDomain(env.ReturnPeerID), err)
+		return true
+	}
+
+	if msg.Type == TypeResponse {
+		e.Client.OnMessage(msg)
+		return true
+	}
+
+	resp := e.Server.HandleMessage(msg)
+	if resp == nil || env.ReturnPeerID.IsZero() {
+		return true
+	}
+	// 请求走的 datagram，响应也走 datagram
+	if err := e.send(env.ReturnPeerID, resp, env.Flags&envelop.FlagDatagram != 0); err != nil {
+		log.Printf("[RPC] reply to %s failed: %v", peer.PeerIDToDomain(env.ReturnPeerID), err)
+	}
+	return true
+}
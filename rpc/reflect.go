@@ -0,0 +1,143 @@
+package rpc
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+==========================================================
+ RPC 反射服务（Introspection）
+==========================================================
+
+问题：远端的 rpc.Server 到底暴露了哪些方法？以前只能靠“口头约定”。
+
+现在每个 Server 在 NewServer() 时自动注册两个内置方法：
+
+  _rpc.List      → 返回所有已注册方法的 名字 + 版本（[]MethodInfo，不带 Schema）
+  _rpc.Describe  → 请求 {"m":"Echo"}，返回该方法完整的 MethodInfo（含 Schema）
+
+MethodInfo 由 RegisterWithInfo 提供；普通 Register 只有 Name。
+
+客户端用法：
+
+  infos, err := rpc.ListMethods(client, send, 3*time.Second)
+  info,  err := rpc.DescribeMethod(client, send, "Echo", 3*time.Second)
+
+以 "_rpc." 开头的名字保留给框架内置方法：Register 这样的名字会 panic，内置方法不会被换掉。
+==========================================================
+*/
+
+// 内置方法名
+const (
+	MethodList     = "_rpc.List"
+	MethodDescribe = "_rpc.Describe"
+
+	// ReservedPrefix 是框架内置方法的前缀
+	ReservedPrefix = "_rpc."
+)
+
+// MethodInfo 描述一个 RPC 方法
+type MethodInfo struct {
+	Name        string `json:"n"`
+	Version     string `json:"v,omitempty"`
+	Description string `json:"desc,omitempty"`
+
+	// 可选：请求 / 响应的 Schema（例如 JSON Schema），原样透传
+	RequestSchema  json.RawMessage `json:"req,omitempty"`
+	ResponseSchema json.RawMessage `json:"resp,omitempty"`
+}
+
+// describeRequest 是 _rpc.Describe 的参数
+type describeRequest struct {
+	Method string `json:"m"`
+}
+
+// Methods 返回本地已注册方法的描述信息（按名字排序）
+func (s *Server) Methods() []MethodInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := make([]MethodInfo, 0, len(s.infos))
+	for _, info := range s.infos {
+		out = append(out, info)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// registerReflection 挂上 _rpc.List / _rpc.Describe
+func (s *Server) registerReflection() {
+	s.register(MethodInfo{
+		Name:        MethodList,
+		Version:     "1",
+		Description: "list registered methods",
+	}, func(CallerInfo, []byte) ([]byte, error) {
+		infos := s.Methods()
+		// List 只给名字 + 版本 + 说明，Schema 需要时再 Describe
+		for i := range infos {
+			infos[i].RequestSchema = nil
+			infos[i].ResponseSchema = nil
+		}
+		return json.Marshal(infos)
+	})
+
+	s.register(MethodInfo{
+		Name:        MethodDescribe,
+		Version:     "1",
+		Description: `describe one method, request {"m":"<name>"}`,
+	}, func(_ CallerInfo, data []byte) ([]byte, error) {
+		var req describeRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			return nil, Errorf(CodeInvalidArgument, "bad describe request: %v", err)
+		}
+
+		s.mu.RLock()
+		info, ok := s.infos[req.Method]
+		s.mu.RUnlock()
+		if !ok {
+			return nil, Errorf(CodeNotFound, "method not found: %s", req.Method)
+		}
+		return json.Marshal(info)
+	})
+}
+
+// IsReserved 判断方法名是否属于框架内置（_rpc.*）
+func IsReserved(method string) bool {
+	return strings.HasPrefix(method, ReservedPrefix)
+}
+
+/*
+==========================================================
+ 客户端辅助函数
+==========================================================
+*/
+
+// ListMethods 调用远端 _rpc.List
+func ListMethods(c *Client, send SendFunc, timeout time.Duration) ([]MethodInfo, error) {
+	resp, err := c.Call(MethodList, nil, send, timeout)
+	if err != nil {
+		return nil, err
+	}
+	var infos []MethodInfo
+	if err := json.Unmarshal(resp.Data, &infos); err != nil {
+		return nil, Errorf(CodeInternal, "bad _rpc.List response: %v", err)
+	}
+	return infos, nil
+}
+
+// DescribeMethod 调用远端 _rpc.Describe
+func DescribeMethod(c *Client, send SendFunc, method string, timeout time.Duration) (*MethodInfo, error) {
+	req, _ := json.Marshal(describeRequest{Method: method})
+	resp, err := c.Call(MethodDescribe, req, send, timeout)
+	if err != nil {
+		return nil, err
+	}
+	var info MethodInfo
+	if err := json.Unmarshal(resp.Data, &info); err != nil {
+		return nil, Errorf(CodeInternal, "bad _rpc.Describe response: %v", err)
+	}
+	return &info, nil
+}
@@ -0,0 +1,265 @@
+package rpc
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"io"
+	"sync"
+	"time"
+
+	"envelop/clock"
+	"envelop/peer"
+)
+
+/*
+==========================================================
+ 幂等重试：客户端重试策略 + 服务端结果缓存
+==========================================================
+
+多跳路径很容易丢包，Call 要么超时要么成功一次；
+直接“超时就再发一遍”会让 handler 被执行两次（比如转账、派发任务）。
+
+解决办法分两半：
+
+  1. 客户端：CallWithRetry
+       - 同一次逻辑调用，所有重试都用“同一个 Request ID”
+       - 按 RetryPolicy 做指数退避（带抖动）
+       - 只有 RetryableCodes 里的状态码才重试（默认 Unavailable / DeadlineExceeded）
+
+  2. 服务端：Server.EnableDedup(ttl, max)
+       - 以 (调用方 PeerID, Request ID) 为 key 记住 Response
+       - 同一个 key 再来：
+           * 第一次还在执行 → 等它执行完，返回同一个结果
+           * 已经执行完     → 直接返回缓存的 Response，不再调用 handler
+       - 调用方 PeerID 来自签名验证（见 auth.go）；匿名调用不去重——
+         谁都能用同一个 ID 抢先发一个请求，让别人的请求拿到它的结果
+       - 缓存里同时记下请求内容（Method + Data）的摘要：同一个 key 内容却不一样 →
+         不是重试，是 ID 撞了（或者有人故意复用），返回 CodeAborted，不拿缓存的结果
+       - Request ID 的起点是随机的（见 rpc.go 的 globalID），不同进程之间几乎不会撞
+
+这样即使方法本身不是幂等的，在不可靠的路径上重试也是安全的。
+==========================================================
+*/
+
+// RetryPolicy 描述客户端的重试策略
+type RetryPolicy struct {
+	MaxAttempts    int           // 最多尝试几次（含第一次），<=1 表示不重试
+	InitialBackoff time.Duration // 第一次重试前等待多久
+	MaxBackoff     time.Duration // 退避上限
+	Multiplier     float64       // 每次退避乘以多少（<1 时按 1 处理）
+	Jitter         float64       // 抖动比例 [0,1]：实际等待 = backoff * (1 ± Jitter)
+	RetryableCodes []Code        // 哪些状态码可以重试
+}
+
+// DefaultRetryPolicy 是一个适合多跳路径的默认策略
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    4,
+	InitialBackoff: 200 * time.Millisecond,
+	MaxBackoff:     3 * time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+	RetryableCodes: []Code{CodeUnavailable, CodeDeadlineExceeded},
+}
+
+// retryable 判断一个错误是否值得重试
+func (p RetryPolicy) retryable(err error) bool {
+	code := CodeOf(err)
+	for _, c := range p.RetryableCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff 计算第 attempt 次重试（从 1 开始）前的等待时间，抖动的随机数从 r 取
+func (p RetryPolicy) backoff(attempt int, r io.Reader) time.Duration {
+	mult := p.Multiplier
+	if mult < 1 {
+		mult = 1
+	}
+	d := float64(p.InitialBackoff)
+	for i := 1; i < attempt; i++ {
+		d *= mult
+		if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+			d = float64(p.MaxBackoff)
+			break
+		}
+	}
+	if p.Jitter > 0 {
+		d *= 1 + p.Jitter*(2*clock.Float64(r)-1)
+	}
+	return time.Duration(d)
+}
+
+// CallWithRetry 和 Call 一样，但会按 policy 重试：
+//   - 所有尝试共用同一个 Request ID（服务端据此去重）
+//   - timeout 是“每一次尝试”的超时
+//   - 返回最后一次尝试的结果
+func (c *Client) CallWithRetry(
+	method string,
+	data []byte,
+	send SendFunc,
+	timeout time.Duration,
+	policy RetryPolicy,
+) (*Message, error) {
+	req := c.newRequest(method, data)
+
+	attempts := policy.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var lastResp *Message
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			clock.Sleep(c.Clock, policy.backoff(attempt, c.Rand))
+		}
+
+		resp, err := c.roundTrip(req, send, timeout)
+		if err == nil {
+			err = resp.Err()
+			if err == nil || !policy.retryable(err) {
+				return resp, err
+			}
+		} else {
+			resp = nil
+			if !policy.retryable(err) {
+				return nil, err
+			}
+		}
+		// 最后一次尝试的响应（服务端报的错误带着 Details）也要交给调用方
+		lastResp, lastErr = resp, err
+	}
+	return lastResp, lastErr
+}
+
+/*
+==========================================================
+ 服务端去重缓存
+==========================================================
+*/
+
+// dedupKey = (调用方, Request ID)
+type dedupKey struct {
+	caller peer.PeerID
+	id     uint64
+}
+
+// dedupEntry：done 关闭之前 resp 还没算好
+type dedupEntry struct {
+	key     dedupKey
+	sum     [sha256.Size]byte // 请求内容的摘要（见 requestSum）
+	done    chan struct{}
+	resp    *Message
+	expires time.Time
+	elem    *list.Element
+}
+
+// dedupCache 是一个带 TTL + 容量上限的 (caller, ID) → Response 缓存
+type dedupCache struct {
+	ttl time.Duration
+	max int
+
+	mu      sync.Mutex
+	clock   clock.Clock // nil = 系统时钟（Server.SetClock）
+	entries map[dedupKey]*dedupEntry
+	order   *list.List // 按插入顺序，队头最旧
+}
+
+func newDedupCache(ttl time.Duration, max int, c clock.Clock) *dedupCache {
+	return &dedupCache{
+		ttl:     ttl,
+		max:     max,
+		clock:   c,
+		entries: make(map[dedupKey]*dedupEntry),
+		order:   list.New(),
+	}
+}
+
+// do：同一个 key 只执行一次 fn，其余调用拿同一个结果；
+// key 相同但内容摘要 sum 不同的返回 CodeAborted
+func (d *dedupCache) do(key dedupKey, sum [sha256.Size]byte, fn func() *Message) *Message {
+	d.mu.Lock()
+	now := clock.Or(d.clock).Now()
+	d.evictLocked(now)
+	if e, ok := d.entries[key]; ok {
+		d.mu.Unlock()
+		if e.sum != sum {
+			return NewErrorResponse(key.id, Errorf(CodeAborted, "request id %d reused with different content", key.id))
+		}
+		<-e.done
+		return e.resp
+	}
+	e := &dedupEntry{key: key, sum: sum, done: make(chan struct{})}
+	e.elem = d.order.PushBack(e)
+	d.entries[key] = e
+	d.mu.Unlock()
+
+	resp := fn()
+
+	d.mu.Lock()
+	e.resp = resp
+	e.expires = clock.Or(d.clock).Now().Add(d.ttl)
+	close(e.done)
+	d.mu.Unlock()
+
+	return resp
+}
+
+// evictLocked 清掉过期的条目；容量满了就从最旧的开始丢，给新条目腾位置（正在执行的不丢）
+func (d *dedupCache) evictLocked(now time.Time) {
+	for el := d.order.Front(); el != nil; {
+		next := el.Next()
+		e := el.Value.(*dedupEntry)
+		finished := !e.expires.IsZero()
+		switch {
+		case finished && (now.After(e.expires) || len(d.entries) >= d.max):
+			d.order.Remove(el)
+			delete(d.entries, e.key)
+		case len(d.entries) < d.max:
+			// 队头没过期、也没超容量：后面的都更新，不用再看
+			return
+		}
+		el = next
+	}
+}
+
+// EnableDedup 打开服务端去重：
+//   - ttl：Response 缓存多久（应大于客户端整个重试周期）
+//   - max：最多缓存多少条
+//
+// ttl<=0 时关闭去重。
+func (s *Server) EnableDedup(ttl time.Duration, max int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ttl <= 0 {
+		s.dedup = nil
+		return
+	}
+	if max <= 0 {
+		max = 4096
+	}
+	s.dedup = newDedupCache(ttl, max, s.clock)
+}
+
+// withDedup 如果开启了去重，就按 (caller, ID) 只执行一次 fn（只对签名验证过的调用方）
+func (s *Server) withDedup(msg *Message, caller CallerInfo, fn func() *Message) *Message {
+	s.mu.RLock()
+	d := s.dedup
+	s.mu.RUnlock()
+	if d == nil || !caller.Verified {
+		return fn()
+	}
+	return d.do(dedupKey{caller: caller.ID, id: msg.ID}, requestSum(msg), fn)
+}
+
+// requestSum 是请求内容的摘要：Type / Method / Data，以及 Batch 里的每一条（同签名摘要的写法）
+func requestSum(msg *Message) [sha256.Size]byte {
+	h := sha256.New()
+	writeDigest(h, msg)
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
@@ -2,10 +2,14 @@ package rpc
 
 import (
 	"encoding/json"
-	"errors"
+	"fmt"
+	"io"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"envelop/clock"
+	"envelop/peer"
 )
 
 /*
@@ -16,11 +20,13 @@ import (
 我们做一个极简、好理解的 RPC 层：
 
 1. 报文结构：Message
-   - Type:   是请求还是响应（Request / Response）
+   - Type:   请求 / 响应 / 单向通知 / 批量（Request / Response / Notification / Batch，见 batch.go）
    - ID:     请求 ID，用于匹配响应
    - Method: 方法名，例如 "Echo"
    - Data:   参数或返回值（原始字节，外面自己决定用 JSON/CBOR 等）
+   - Code:   仅 Response 用，数字状态码（见 status.go，0 = OK）
    - Error:  仅 Response 用，表示错误字符串
+   - Details:仅 Response 用，可选的结构化错误详情
 
 2. 编码方式：
    - Message.Marshal()   → JSON []byte
@@ -41,17 +47,40 @@ import (
 type Type uint8
 
 const (
-	TypeRequest  Type = 1
-	TypeResponse Type = 2
+	TypeRequest      Type = 1
+	TypeResponse     Type = 2
+	TypeNotification Type = 3 // 单向通知：执行 handler，但永远不回包
+	TypeBatch        Type = 4 // 批量：Batch 里装多条 Request / Notification，合并成一个 Response
 )
 
 // Message 是一个 RPC 报文
 type Message struct {
-	Type   Type   `json:"t"`           // 1=Request, 2=Response
-	ID     uint64 `json:"id"`          // 请求 ID
-	Method string `json:"m,omitempty"` // 方法名（请求专用）
-	Data   []byte `json:"d,omitempty"` // 参数或返回值
-	Error  string `json:"e,omitempty"` // 错误信息（响应专用）
+	Type    Type       `json:"t"`            // 1=Request, 2=Response, 3=Notification, 4=Batch
+	ID      uint64     `json:"id"`           // 请求 ID
+	Method  string     `json:"m,omitempty"`  // 方法名（请求专用）
+	Data    []byte     `json:"d,omitempty"`  // 参数或返回值
+	Code    Code       `json:"c,omitempty"`  // 状态码（响应专用，0 = OK）
+	Error   string     `json:"e,omitempty"`  // 错误信息（响应专用）
+	Details []Detail   `json:"dt,omitempty"` // 结构化错误详情（响应专用）
+	Batch   []*Message `json:"b,omitempty"`  // 批量条目（Batch 请求 / 批量响应专用）
+	Pub     []byte     `json:"pk,omitempty"` // 调用方公钥（签名请求专用，见 auth.go）
+	Sig     []byte     `json:"sg,omitempty"` // 调用方签名（签名请求专用）
+	To      []byte     `json:"to,omitempty"` // 接收方 PeerID（签名请求专用，签名覆盖）
+	Exp     int64      `json:"x,omitempty"`  // 过期时间，Unix 秒（签名请求专用，签名覆盖）
+}
+
+// Err 把 Response 里的状态码 / 错误信息还原成 Go error：
+//   - Code=OK 且 Error 为空 → nil
+//   - 老版本对端只填了 Error 字符串 → 当作 CodeUnknown
+func (m *Message) Err() error {
+	if m.Code == CodeOK && m.Error == "" {
+		return nil
+	}
+	code := m.Code
+	if code == CodeOK {
+		code = CodeUnknown
+	}
+	return &Error{Code: code, Message: m.Error, Details: m.Details}
 }
 
 // Marshal 把 Message 编码成 JSON
@@ -69,7 +98,13 @@ func Unmarshal(b []byte) (*Message, error) {
 }
 
 // 全局递增的请求 ID
-var globalID uint64
+// 起点随机：服务端按 (caller, ID) 去重，重启后的进程不能和之前的 ID 撞上
+var globalID = randomIDSeed(nil)
+
+// randomIDSeed 从 r 生成一个随机起点（只用低 62 位，给自增留足空间；r 为 nil 用 crypto/rand）
+func randomIDSeed(r io.Reader) uint64 {
+	return clock.Uint64(r) >> 2
+}
 
 // NewRequest 创建一个新的 RPC 请求消息
 func NewRequest(method string, data []byte) *Message {
@@ -83,13 +118,36 @@ func NewRequest(method string, data []byte) *Message {
 }
 
 // NewResponse 创建一个 RPC 响应消息
+//
+// errStr 非空时状态码记为 CodeUnknown；需要精确状态码请用 NewErrorResponse。
 func NewResponse(reqID uint64, data []byte, errStr string) *Message {
-	return &Message{
+	m := &Message{
 		Type:  TypeResponse,
 		ID:    reqID,
 		Data:  data,
 		Error: errStr,
 	}
+	if errStr != "" {
+		m.Code = CodeUnknown
+	}
+	return m
+}
+
+// NewErrorResponse 根据 error 创建一个失败的 RPC 响应：
+//   - *Error（含被包装的）→ 保留 Code / Details
+//   - 普通 error        → CodeUnknown
+func NewErrorResponse(reqID uint64, err error) *Message {
+	e := FromError(err)
+	if e == nil {
+		return NewResponse(reqID, nil, "")
+	}
+	return &Message{
+		Type:    TypeResponse,
+		ID:      reqID,
+		Code:    e.Code,
+		Error:   e.Message,
+		Details: e.Details,
+	}
 }
 
 /*
@@ -99,48 +157,186 @@ func NewResponse(reqID uint64, data []byte, errStr string) *Message {
 */
 
 // Handler 表示一个 RPC 方法：输入一段字节，返回一段字节或错误
+//
+// 想让客户端拿到精确的状态码，handler 可以返回 *Error：
+//
+//	return nil, rpc.Errorf(rpc.CodeInvalidArgument, "bad name %q", name)
+//
+// 返回普通 error 时，客户端看到的是 CodeUnknown。
 type Handler func(reqData []byte) (respData []byte, err error)
 
+// CallerHandler 和 Handler 一样，但多一个参数：调用方身份（来自签名验证，见 auth.go）
+// 需要“知道是谁在调我”的内置服务（DHT / 中继预约等）用这个
+type CallerHandler func(caller CallerInfo, reqData []byte) (respData []byte, err error)
+
 // Server 保存 method → Handler 的映射
 type Server struct {
 	mu       sync.RWMutex
-	handlers map[string]Handler
+	handlers map[string]CallerHandler
+	infos    map[string]MethodInfo // method → 描述信息（给 _rpc.List / _rpc.Describe 用）
+	acl      *ACL                  // 可选：访问控制（nil = 不限制）
+	self     peer.PeerID           // 可选：本节点 PeerID，签名请求的 To 必须是它（见 auth.go）
+	dedup    *dedupCache           // 可选：(caller, ID) 去重缓存（见 retry.go）
+	clock    clock.Clock           // 可选：检查过期 / 去重缓存用的时钟（nil = 系统时钟）
 }
 
-// NewServer 创建一个空的 RPC Server
+// NewServer 创建一个 RPC Server
+// 会自动挂上内置的反射服务（_rpc.List / _rpc.Describe，见 reflect.go）
 func NewServer() *Server {
-	return &Server{
-		handlers: make(map[string]Handler),
+	s := &Server{
+		handlers: make(map[string]CallerHandler),
+		infos:    make(map[string]MethodInfo),
 	}
+	s.registerReflection()
+	return s
 }
 
 // Register 注册一个方法
 func (s *Server) Register(method string, h Handler) {
+	s.RegisterWithInfo(MethodInfo{Name: method}, h)
+}
+
+// RegisterWithInfo 注册一个方法，并附带版本号 / 说明 / Schema 等描述信息
+func (s *Server) RegisterWithInfo(info MethodInfo, h Handler) {
+	s.RegisterWithCaller(info, func(_ CallerInfo, data []byte) ([]byte, error) {
+		return h(data)
+	})
+}
+
+// RegisterWithCaller 注册一个能拿到调用方身份的方法
+//
+// "_rpc." 开头的名字保留给框架内置方法（见 reflect.go），注册这样的名字会 panic，
+// 免得业务代码把 _rpc.List / _rpc.AddProvider 这些换掉。
+func (s *Server) RegisterWithCaller(info MethodInfo, h CallerHandler) {
+	if IsReserved(info.Name) {
+		panic(fmt.Sprintf("rpc: method name %q is reserved", info.Name))
+	}
+	s.register(info, h)
+}
+
+// register 直接注册，不检查保留名字（内置方法用）
+func (s *Server) register(info MethodInfo, h CallerHandler) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.handlers[method] = h
+	s.handlers[info.Name] = h
+	s.infos[info.Name] = info
 }
 
-// HandleMessage 处理一个 Request Message，返回 Response Message
-func (s *Server) HandleMessage(msg *Message) *Message {
-	if msg.Type != TypeRequest {
-		return NewResponse(msg.ID, nil, "not a request")
+// SetACL 设置访问控制表；传 nil 表示不做限制
+// ACL 在 handler 执行前检查，调用方身份来自请求签名（见 auth.go）
+func (s *Server) SetACL(acl *ACL) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acl = acl
+}
+
+// SetSelf 设置本节点 PeerID：之后签名请求的接收方（To）必须就是它，
+// 发给别人的签名请求拿过来重放会被拒绝。零值表示不检查接收方（过期时间照样检查）。
+func (s *Server) SetSelf(id peer.PeerID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.self = id
+}
+
+// SetClock 设置检查签名过期、去重缓存过期用的时钟（nil = 系统时钟，sim 里换成虚拟时钟）
+func (s *Server) SetClock(c clock.Clock) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clock = c
+	if d := s.dedup; d != nil {
+		d.mu.Lock()
+		d.clock = c
+		d.mu.Unlock()
 	}
+}
 
+func (s *Server) now() time.Time {
 	s.mu.RLock()
-	h, ok := s.handlers[msg.Method]
-	s.mu.RUnlock()
+	defer s.mu.RUnlock()
+	return clock.Or(s.clock).Now()
+}
+
+// HandleMessage 处理一个收到的 Message，返回要回给对方的 Response Message：
+//   - Request      → 单条 Response
+//   - Notification → 执行 handler，返回 nil（不回包）
+//   - Batch        → 合并后的 Response（全部是 Notification 时返回 nil）
+//
+// 调用方拿到 nil 时什么都不用发。
+//
+// 带签名的请求会先验证签名，再检查接收方和过期时间（不对 → CodeUnauthenticated），
+// 验证出的 PeerID 作为调用方交给 ACL 判断。
+func (s *Server) HandleMessage(msg *Message) *Message {
+	caller, err := msg.VerifyCaller()
+	if err == nil && caller.Verified {
+		s.mu.RLock()
+		self := s.self
+		s.mu.RUnlock()
+		err = msg.checkAudience(self, s.now())
+	}
+	if err != nil {
+		if msg.Type == TypeNotification {
+			return nil
+		}
+		return NewErrorResponse(msg.ID, err)
+	}
+
+	switch msg.Type {
+	case TypeRequest:
+		return s.withDedup(msg, caller, func() *Message { return s.handleRequest(msg, caller) })
+	case TypeNotification:
+		s.handleNotification(msg, caller)
+		return nil
+	case TypeBatch:
+		return s.withDedup(msg, caller, func() *Message { return s.handleBatch(msg, caller) })
+	default:
+		return NewErrorResponse(msg.ID, Errorf(CodeInvalidArgument, "not a request"))
+	}
+}
+
+// handleRequest 处理一条普通 Request
+func (s *Server) handleRequest(msg *Message, caller CallerInfo) *Message {
+	h, ok, err := s.lookup(msg.Method, caller)
+	if err != nil {
+		return NewErrorResponse(msg.ID, err)
+	}
 	if !ok {
-		return NewResponse(msg.ID, nil, "method not found: "+msg.Method)
+		return NewErrorResponse(msg.ID, Errorf(CodeNotFound, "method not found: %s", msg.Method))
 	}
 
-	respData, err := h(msg.Data)
+	respData, err := callHandler(h, caller, msg.Data)
 	if err != nil {
-		return NewResponse(msg.ID, nil, err.Error())
+		return NewErrorResponse(msg.ID, err)
 	}
 	return NewResponse(msg.ID, respData, "")
 }
 
+// lookup 先过 ACL，再找 handler
+// ACL 放在前面：没权限的调用方连“方法存不存在”都不告诉它
+func (s *Server) lookup(method string, caller CallerInfo) (CallerHandler, bool, error) {
+	s.mu.RLock()
+	acl := s.acl
+	h, ok := s.handlers[method]
+	s.mu.RUnlock()
+
+	if acl != nil {
+		if err := acl.Check(caller, method); err != nil {
+			return nil, false, err
+		}
+	}
+	return h, ok, nil
+}
+
+// callHandler 调用 handler，并把 panic 转成 CodeInternal，避免一个坏 handler 拖垮整个节点
+func callHandler(h CallerHandler, caller CallerInfo, data []byte) (resp []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			resp = nil
+			err = Errorf(CodeInternal, "handler panic: %v", r)
+		}
+	}()
+	return h(caller, data)
+}
+
 /*
 ==========================================================
  RPC Client：发请求 + 等响应
@@ -151,8 +347,17 @@ func (s *Server) HandleMessage(msg *Message) *Message {
 //  - 把发出去的 Request 按 ID 记在 pending 里
 //  - 收到 Response 时，根据 ID 匹配等待者
 type Client struct {
+	// Clock / Rand（可选，第一次调用前设置）：等响应、重试退避用的时钟，
+	// 请求 ID 起点和退避抖动用的随机数。nil = 系统时钟 / crypto/rand，sim 里换成虚拟的。
+	// 设置了 Rand 时请求 ID 由这个 Client 自己从 Rand 取的起点开始递增，否则用全局的。
+	Clock clock.Clock
+	Rand  io.Reader
+
 	mu      sync.Mutex
 	pending map[uint64]chan *Message
+	key     *peer.KeyPair // 可选：设置后所有请求都会签名（见 auth.go）
+	to      peer.PeerID   // 签名里的接收方（SetKey 时给出）
+	nextID  uint64        // 设置了 Rand 时的请求 ID（0 = 还没取起点）
 }
 
 // NewClient 创建一个 RPC Client（注意：新版不需要任何参数）
@@ -162,6 +367,43 @@ func NewClient() *Client {
 	}
 }
 
+// SetKey 设置调用方身份：之后发出的 Request / Notification / Batch 都会用 kp 签名，
+// 签名绑定接收方 to 和过期时间（now + SignatureTTL，见 Message.SignFor）。传 nil 表示匿名调用。
+//
+// to 是对端 Server SetSelf 的那个 PeerID；对端没有 SetSelf 时可以传零值。
+// 一个 Client 要发给多个 Peer 时用 Endpoint，它按每次调用的目标签名，不用设置这里。
+func (c *Client) SetKey(kp *peer.KeyPair, to peer.PeerID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.key = kp
+	c.to = to
+}
+
+// sign 如果设置了 key，就按 SetKey 给的接收方给 msg 签名
+func (c *Client) sign(msg *Message) {
+	c.mu.Lock()
+	kp, to := c.key, c.to
+	c.mu.Unlock()
+	if kp != nil {
+		msg.SignFor(kp, to, clock.Or(c.Clock).Now().Add(SignatureTTL))
+	}
+}
+
+// newRequest 和 NewRequest 一样，只是设置了 Rand 时 ID 从 Client 自己的序列里取
+func (c *Client) newRequest(method string, data []byte) *Message {
+	req := NewRequest(method, data)
+	if c.Rand != nil {
+		c.mu.Lock()
+		if c.nextID == 0 {
+			c.nextID = randomIDSeed(c.Rand)
+		}
+		c.nextID++
+		req.ID = c.nextID
+		c.mu.Unlock()
+	}
+	return req
+}
+
 // OnMessage 用于接收“对方发来的 Response”并唤醒对应的等待协程
 func (c *Client) OnMessage(msg *Message) {
 	if msg.Type != TypeResponse {
@@ -189,6 +431,11 @@ type SendFunc func(req *Message) error
 //   - data:   参数（任意序列化）
 //   - send:   发送函数（由上层封装成 Envelope 并通过网络发出）
 //   - timeout: 超时时间
+//
+// 返回的 error 一律是 *Error（可以用 errors.Is / errors.As 判断）：
+//   - 发送失败   → CodeUnavailable（Unwrap 可拿到原始发送错误）
+//   - 等待超时   → CodeDeadlineExceeded
+//   - 对端返回错误 → 对端给的 Code / Message / Details，此时 resp 也会一并返回
 func (c *Client) Call(
 	method string,
 	data []byte,
@@ -197,36 +444,47 @@ func (c *Client) Call(
 ) (*Message, error) {
 
 	// 1. 创建 Request
-	req := NewRequest(method, data)
+	req := c.newRequest(method, data)
+
+	// 2. 发出去并等待响应
+	resp, err := c.roundTrip(req, send, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return resp, resp.Err()
+}
 
-	// 2. 为这个请求准备一个等待响应的 chan
+// roundTrip：登记 pending → 发送 → 等待同 ID 的 Response 或超时
+// （Call / CallBatch 共用）
+func (c *Client) roundTrip(req *Message, send SendFunc, timeout time.Duration) (*Message, error) {
+	c.sign(req)
 	ch := make(chan *Message, 1)
 
 	c.mu.Lock()
 	c.pending[req.ID] = ch
 	c.mu.Unlock()
 
-	// 3. 先发送请求
+	// 先发送请求
 	if err := send(req); err != nil {
 		// 发送失败要清理 pending
 		c.mu.Lock()
 		delete(c.pending, req.ID)
 		c.mu.Unlock()
-		return nil, err
+		return nil, wrapError(CodeUnavailable, err)
 	}
 
-	// 4. 等待响应或超时
-	timer := time.NewTimer(timeout)
-	defer timer.Stop()
+	// 等待响应或超时
+	expired, stop := clock.After(c.Clock, timeout)
+	defer stop()
 
 	select {
 	case resp := <-ch:
 		return resp, nil
-	case <-timer.C:
+	case <-expired:
 		c.mu.Lock()
 		delete(c.pending, req.ID)
 		c.mu.Unlock()
-		return nil, errors.New("rpc call timeout")
+		return nil, Errorf(CodeDeadlineExceeded, "rpc call timeout")
 	}
 }
 
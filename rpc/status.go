@@ -0,0 +1,204 @@
+package rpc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+/*
+==========================================================
+ RPC 状态码（Status Model）
+==========================================================
+
+以前 Response 只有一个 Error 字符串，客户端分不清：
+  - 方法不存在？
+  - 参数不对？
+  - handler 内部出错？
+  - 网络超时？
+
+现在引入一套“数字状态码 + 可选结构化详情”：
+
+  Message.Code     → 数字状态码（0 = OK）
+  Message.Error    → 人类可读的错误信息（保留，向后兼容）
+  Message.Details  → 可选的结构化详情（[]Detail，每条带 Type + JSON 数据）
+
+在 Go 这一侧，用 *Error 表示一个带状态码的错误：
+
+  err := rpc.Errorf(rpc.CodeNotFound, "user %q not found", name)
+
+客户端可以：
+
+  if errors.Is(err, rpc.ErrNotFound) { ... }   // 按状态码判断
+
+  var rerr *rpc.Error
+  if errors.As(err, &rerr) { rerr.Code / rerr.Details ... }
+
+码值参考 gRPC，方便熟悉 gRPC 的人上手。
+==========================================================
+*/
+
+// Code 是 RPC 状态码
+type Code uint32
+
+const (
+	CodeOK                 Code = 0  // 成功
+	CodeCanceled           Code = 1  // 调用方取消
+	CodeUnknown            Code = 2  // 未知错误（handler 返回了普通 error）
+	CodeInvalidArgument    Code = 3  // 参数非法 / 报文格式不对
+	CodeDeadlineExceeded   Code = 4  // 超时
+	CodeNotFound           Code = 5  // 方法 / 资源不存在
+	CodeAlreadyExists      Code = 6  // 资源已存在
+	CodePermissionDenied   Code = 7  // 没有权限
+	CodeResourceExhausted  Code = 8  // 配额 / 限流
+	CodeFailedPrecondition Code = 9  // 前置条件不满足
+	CodeAborted            Code = 10 // 被中止（冲突等）
+	CodeUnimplemented      Code = 12 // 未实现
+	CodeInternal           Code = 13 // 服务端内部错误
+	CodeUnavailable        Code = 14 // 暂时不可用（发送失败、对端不在线等）
+	CodeUnauthenticated    Code = 16 // 调用方身份无法验证
+)
+
+var codeNames = map[Code]string{
+	CodeOK:                 "OK",
+	CodeCanceled:           "Canceled",
+	CodeUnknown:            "Unknown",
+	CodeInvalidArgument:    "InvalidArgument",
+	CodeDeadlineExceeded:   "DeadlineExceeded",
+	CodeNotFound:           "NotFound",
+	CodeAlreadyExists:      "AlreadyExists",
+	CodePermissionDenied:   "PermissionDenied",
+	CodeResourceExhausted:  "ResourceExhausted",
+	CodeFailedPrecondition: "FailedPrecondition",
+	CodeAborted:            "Aborted",
+	CodeUnimplemented:      "Unimplemented",
+	CodeInternal:           "Internal",
+	CodeUnavailable:        "Unavailable",
+	CodeUnauthenticated:    "Unauthenticated",
+}
+
+// String 返回状态码的可读名字，例如 "NotFound"
+func (c Code) String() string {
+	if s, ok := codeNames[c]; ok {
+		return s
+	}
+	return fmt.Sprintf("Code(%d)", uint32(c))
+}
+
+// Detail 是一条结构化错误详情
+//   - Type：详情类型（由业务自己约定，例如 "retry_info" / "bad_field"）
+//   - Data：任意 JSON 数据
+type Detail struct {
+	Type string          `json:"t"`
+	Data json.RawMessage `json:"d,omitempty"`
+}
+
+// Error 是带状态码的 RPC 错误，实现了 error 接口
+type Error struct {
+	Code    Code
+	Message string
+	Details []Detail
+
+	// cause：本地产生的错误（例如发送失败）可以挂上原始 error，
+	// 只在本进程内有效，不会编码进 Response
+	cause error
+}
+
+// Error 实现 error 接口
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return "rpc error: code = " + e.Code.String()
+	}
+	return "rpc error: code = " + e.Code.String() + " desc = " + e.Message
+}
+
+// Is 让 errors.Is 按“状态码”比较：
+//
+//	errors.Is(err, rpc.ErrNotFound) → 只要 err 里有一个 Code=NotFound 的 *Error 即为 true
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+	return e.Code == t.Code
+}
+
+// Unwrap 返回原始错误（如果有），让 errors.Is / errors.As 能继续往里找
+func (e *Error) Unwrap() error { return e.cause }
+
+// WithDetail 追加一条结构化详情（v 会被 JSON 编码），返回 e 本身方便链式调用
+func (e *Error) WithDetail(typ string, v any) *Error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return e
+	}
+	e.Details = append(e.Details, Detail{Type: typ, Data: b})
+	return e
+}
+
+// Detail 按类型查找第一条详情，并解码到 v 中
+func (e *Error) Detail(typ string, v any) bool {
+	for _, d := range e.Details {
+		if d.Type != typ {
+			continue
+		}
+		return json.Unmarshal(d.Data, v) == nil
+	}
+	return false
+}
+
+// 方便 errors.Is 比较用的“哨兵错误”，只看 Code
+var (
+	ErrCanceled           = &Error{Code: CodeCanceled}
+	ErrUnknown            = &Error{Code: CodeUnknown}
+	ErrInvalidArgument    = &Error{Code: CodeInvalidArgument}
+	ErrDeadlineExceeded   = &Error{Code: CodeDeadlineExceeded}
+	ErrNotFound           = &Error{Code: CodeNotFound}
+	ErrAlreadyExists      = &Error{Code: CodeAlreadyExists}
+	ErrPermissionDenied   = &Error{Code: CodePermissionDenied}
+	ErrResourceExhausted  = &Error{Code: CodeResourceExhausted}
+	ErrFailedPrecondition = &Error{Code: CodeFailedPrecondition}
+	ErrAborted            = &Error{Code: CodeAborted}
+	ErrUnimplemented      = &Error{Code: CodeUnimplemented}
+	ErrInternal           = &Error{Code: CodeInternal}
+	ErrUnavailable        = &Error{Code: CodeUnavailable}
+	ErrUnauthenticated    = &Error{Code: CodeUnauthenticated}
+)
+
+// NewError 创建一个带状态码的错误
+func NewError(code Code, msg string) *Error {
+	return &Error{Code: code, Message: msg}
+}
+
+// Errorf 创建一个带状态码的错误（格式化版本）
+func Errorf(code Code, format string, args ...any) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// wrapError 用给定状态码包装一个本地错误，保留原始 error 作为 cause
+func wrapError(code Code, err error) *Error {
+	return &Error{Code: code, Message: err.Error(), cause: err}
+}
+
+// FromError 把任意 error 转成 *Error：
+//   - nil          → nil
+//   - 已经是 *Error（包括被 %w 包装过的）→ 原样取出
+//   - 普通 error   → CodeUnknown
+func FromError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return &Error{Code: CodeUnknown, Message: err.Error()}
+}
+
+// CodeOf 返回 err 对应的状态码（nil → CodeOK）
+func CodeOf(err error) Code {
+	if err == nil {
+		return CodeOK
+	}
+	return FromError(err).Code
+}
@@ -0,0 +1,627 @@
+package sim
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"time"
+
+	"envelop/clock"
+	"envelop/transport"
+)
+
+/*
+==========================================================
+ Network：虚拟时钟驱动的模拟网络
+==========================================================
+
+和 transport.MemNetwork 的区别：MemNetwork 用真实时间（time.AfterFunc）模拟延迟，
+这里的每一帧都变成事件队列里的一个事件，时间是虚拟的：
+
+  SendFrame(raw)
+      → 按链路参数算到达时间：
+          发送完成 = max(现在, 链路空闲时刻) + len(raw)/Bandwidth
+          到达     = 发送完成 + Delay ± Jitter
+      → 以 Loss 的概率直接丢掉
+      → 放进事件队列（按 到达时间, 链路, 链路内序号 排序）
+
+  Sim.Run 每次从队列里取最早的一个事件，把时钟拨到它的时间，执行它，
+  再等所有节点把手上的活干完（见 waitSettled）才取下一个。
+  同一时刻只有一件事在处理，同一个种子跑出来的结果就是一样的。
+
+  处理一个事件时节点可能并发地发出好几帧（例如 DHT 查询同时问 3 个节点），
+  它们调用 SendFrame 的先后是不确定的。所以随机数按有向链路各用一个
+  （种子 + 两端名字派生），排序也不用全局序号，而是 (时间, 链路, 链路内序号)：
+  不同链路之间谁先谁后不影响结果。
+
+节点宕机（Fail）：进出这个节点的帧全部丢弃、拨号失败，Recover 恢复。
+==========================================================
+*/
+
+// Link 描述一条（有向）链路
+type Link struct {
+	Delay     time.Duration // 单程延迟
+	Jitter    time.Duration // 延迟抖动（均匀分布在 ±Jitter）
+	Loss      float64       // 丢帧概率（0..1）
+	Bandwidth int64         // 字节/秒，0 表示不限
+}
+
+// Stats 是网络层的帧统计
+type Stats struct {
+	Sent      int // SendFrame 次数
+	Delivered int // 送到对端的帧
+	Dropped   int // 丢包 / 宕机 / 对端已关闭丢掉的帧
+	Bytes     int64
+}
+
+// event 是事件队列里的一项
+type event struct {
+	at  time.Duration
+	key string // 帧：有向链路 "from→to"；剧本事件为空（同一时刻排在帧前面）
+	seq uint64 // 帧：链路内序号；剧本事件：全局序号
+	bg  bool   // 后台定时器（心跳 / 刷新），不算“还有事没干完”
+	fn  func()
+
+	out     bool // 已经取出队列
+	stopped bool // 定时器被 Stop 了，取到时直接扔掉
+}
+
+type eventQueue []*event
+
+func (q eventQueue) Len() int { return len(q) }
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].at != q[j].at {
+		return q[i].at < q[j].at
+	}
+	if q[i].key != q[j].key {
+		return q[i].key < q[j].key
+	}
+	return q[i].seq < q[j].seq
+}
+func (q eventQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *eventQueue) Push(x any)   { *q = append(*q, x.(*event)) }
+func (q *eventQueue) Pop() any {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+// Network 是一张虚拟时间的模拟网络
+type Network struct {
+	// Link 是默认的链路参数，SetLink 可以单独覆盖某一对节点
+	Link Link
+
+	// Settle 是判断“大家都忙完了”时等待的真实时间（见 waitSettled），0 用 2ms
+	Settle time.Duration
+
+	mu        sync.Mutex
+	seed      int64
+	now       time.Duration
+	seq       uint64
+	queue     eventQueue
+	fg        int // 队列里非后台事件的个数
+	links     map[[2]string]Link
+	state     map[[2]string]*linkState
+	down      map[string]bool
+	listeners map[string]*listener
+	stats     Stats
+
+	pending  int    // 已经放进收件箱、还没被 RecvFrame 取走的帧
+	activity uint64 // 每次收发 / 拨号 / 接受都加一，用来判断是否安静下来
+}
+
+// NewNetwork 创建一张模拟网络，seed 决定丢包 / 抖动的随机序列
+func NewNetwork(seed int64) *Network {
+	return &Network{
+		seed:      seed,
+		links:     make(map[[2]string]Link),
+		state:     make(map[[2]string]*linkState),
+		down:      make(map[string]bool),
+		listeners: make(map[string]*listener),
+	}
+}
+
+// Now 返回当前虚拟时间（从模拟开始算）
+func (n *Network) Now() time.Duration {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.now
+}
+
+// SetLink 设置 a → b 和 b → a 两个方向的链路参数
+func (n *Network) SetLink(a, b string, l Link) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.links[[2]string{a, b}] = l
+	n.links[[2]string{b, a}] = l
+}
+
+// SetDown 让节点宕机 / 恢复
+func (n *Network) SetDown(name string, down bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.down[name] = down
+}
+
+// Stats 返回当前的帧统计
+func (n *Network) Stats() Stats {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.stats
+}
+
+// Transport 返回节点 name 用的 Transport；name 同时是它的监听地址和拨号时的本地地址
+func (n *Network) Transport(name string) transport.Transport {
+	return &simTransport{net: n, name: name}
+}
+
+// linkState 是一条有向链路自己的随机数、序号和带宽排队状态
+type linkState struct {
+	rng  *rand.Rand
+	seq  uint64
+	busy time.Duration // 链路发送完成的时刻
+}
+
+// stateOf 返回 from → to 的链路状态（调用方持有 n.mu）
+func (n *Network) stateOf(from, to string) *linkState {
+	key := [2]string{from, to}
+	st := n.state[key]
+	if st == nil {
+		h := fnv.New64a()
+		fmt.Fprintf(h, "%d|%s|%s", n.seed, from, to)
+		st = &linkState{rng: rand.New(rand.NewSource(int64(h.Sum64())))}
+		n.state[key] = st
+	}
+	return st
+}
+
+// schedule 在虚拟时间 at 放一个事件（调用方持有 n.mu）
+func (n *Network) schedule(e *event) {
+	if e.at < n.now {
+		e.at = n.now
+	}
+	heap.Push(&n.queue, e)
+	if !e.bg {
+		n.fg++
+	}
+	n.activity++
+}
+
+// At 在虚拟时间 at 执行 fn（at 早于现在时按现在算）
+func (n *Network) At(at time.Duration, fn func()) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.seq++
+	n.schedule(&event{at: at, seq: n.seq, fn: fn})
+}
+
+// Every 从现在起每隔 interval 执行一次 fn（后台定时器，见 RunUntilIdle）
+func (n *Network) Every(interval time.Duration, fn func()) {
+	var tick func()
+	tick = func() {
+		fn()
+		n.mu.Lock()
+		n.seq++
+		n.schedule(&event{at: n.now + interval, seq: n.seq, bg: true, fn: tick})
+		n.mu.Unlock()
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.seq++
+	n.schedule(&event{at: n.now + interval, seq: n.seq, bg: true, fn: tick})
+}
+
+// pop 取出最早的、不晚于 limit 的事件，并把时钟拨过去；
+// idle 为 true 时，队列里只剩后台定时器就不再取
+func (n *Network) pop(limit time.Duration, idle bool) (*event, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for len(n.queue) > 0 && n.queue[0].stopped {
+		heap.Pop(&n.queue) // Stop 的时候已经从 fg 里减掉了
+	}
+	if len(n.queue) == 0 || n.queue[0].at > limit || (idle && n.fg == 0) {
+		return nil, false
+	}
+	e := heap.Pop(&n.queue).(*event)
+	e.out = true
+	if !e.bg {
+		n.fg--
+	}
+	n.now = e.at
+	return e, true
+}
+
+/*
+==========================================================
+ 虚拟时钟（clock.Clock）
+==========================================================
+
+  Now       = Epoch + 虚拟时间
+  AfterFunc = 事件队列里放一个事件，到时在单独的 goroutine 里调用 f（和 time.AfterFunc 一样），
+              算“还有事没干完”：RunUntilIdle 会把时钟拨过去让它触发（比如丢包后的 RPC 超时）
+  Stop      = 还没触发的事件标记作废，不再算数
+==========================================================
+*/
+
+// Epoch 是虚拟时间 0 对应的墙上时间（固定值：同一个种子每次看到的时间都一样）
+var Epoch = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Clock 返回按这张网络的虚拟时间走的时钟
+func (n *Network) Clock() clock.Clock { return virtualClock{n} }
+
+type virtualClock struct{ n *Network }
+
+func (c virtualClock) Now() time.Time { return Epoch.Add(c.n.Now()) }
+
+func (c virtualClock) AfterFunc(d time.Duration, f func()) clock.Timer {
+	n := c.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.seq++
+	e := &event{at: n.now + d, seq: n.seq}
+	e.fn = func() {
+		go func() {
+			f()
+			n.touch()
+		}()
+	}
+	n.schedule(e)
+	return virtualTimer{n, e}
+}
+
+type virtualTimer struct {
+	n *Network
+	e *event
+}
+
+func (t virtualTimer) Stop() bool {
+	n := t.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if t.e.out || t.e.stopped {
+		return false
+	}
+	t.e.stopped = true
+	if !t.e.bg {
+		n.fg--
+	}
+	return true
+}
+
+// advance 把时钟拨到 t（不会往回拨）
+func (n *Network) advance(t time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if t > n.now {
+		n.now = t
+	}
+}
+
+func (n *Network) settle() time.Duration {
+	if n.Settle > 0 {
+		return n.Settle
+	}
+	return 2 * time.Millisecond
+}
+
+// waitSettled 等到收件箱都被取空，并且连续 Settle 这么久没有任何收发。
+// 节点的处理逻辑跑在自己的 goroutine 里，网络层只能这样“听”它们是不是忙完了。
+func (n *Network) waitSettled() {
+	for {
+		n.mu.Lock()
+		before, pending := n.activity, n.pending
+		n.mu.Unlock()
+		time.Sleep(n.settle())
+		n.mu.Lock()
+		quiet := pending == 0 && n.pending == 0 && n.activity == before
+		n.mu.Unlock()
+		if quiet {
+			return
+		}
+	}
+}
+
+func (n *Network) touch() {
+	n.mu.Lock()
+	n.activity++
+	n.mu.Unlock()
+}
+
+func (n *Network) linkOf(from, to string) Link {
+	if l, ok := n.links[[2]string{from, to}]; ok {
+		return l
+	}
+	return n.Link
+}
+
+// send 按链路参数把一帧排进事件队列
+func (n *Network) send(c *conn, frame []byte) {
+	b := append([]byte(nil), frame...)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.stats.Sent++
+	n.stats.Bytes += int64(len(b))
+	n.activity++
+
+	from, to := c.local, c.remote
+	l := n.linkOf(from, to)
+	st := n.stateOf(from, to)
+	st.seq++
+	if n.down[from] || n.down[to] || (l.Loss > 0 && st.rng.Float64() < l.Loss) {
+		n.stats.Dropped++
+		return
+	}
+
+	// 带宽：同一条链路上的帧排队发送
+	start := n.now
+	if st.busy > start {
+		start = st.busy
+	}
+	if l.Bandwidth > 0 {
+		start += time.Duration(int64(len(b)) * int64(time.Second) / l.Bandwidth)
+		st.busy = start
+	}
+
+	delay := l.Delay
+	if l.Jitter > 0 {
+		delay += time.Duration(st.rng.Int63n(int64(2*l.Jitter)+1)) - l.Jitter
+	}
+	if delay < 0 {
+		delay = 0
+	}
+
+	dst := c.peer
+	n.schedule(&event{
+		at:  start + delay,
+		key: from + "→" + to,
+		seq: st.seq,
+		fn:  func() { n.deliver(dst, b) },
+	})
+}
+
+// deliver 在事件时刻把帧放进对端的收件箱
+func (n *Network) deliver(c *conn, b []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.down[c.local] || n.down[c.remote] || c.closed() {
+		n.stats.Dropped++
+		return
+	}
+	select {
+	case c.inbox <- b:
+		n.pending++
+		n.stats.Delivered++
+	default:
+		n.stats.Dropped++ // 收件箱满了，和真实网络一样丢掉
+	}
+}
+
+/*
+==========================================================
+ Transport / Listener / Conn
+==========================================================
+*/
+
+type simTransport struct {
+	net  *Network
+	name string
+
+	mu     sync.Mutex
+	lns    []*listener
+	conns  map[*conn]struct{} // 拨出去、还没关的连接；关掉后自己摘掉
+	closed bool
+}
+
+func (t *simTransport) Listen(addr string) (transport.Listener, error) {
+	n := t.net
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.listeners[addr]; ok {
+		return nil, fmt.Errorf("sim listen %s: address already in use", addr)
+	}
+	l := &listener{net: n, addr: addr, backlog: make(chan *conn, 256), done: make(chan struct{})}
+	n.listeners[addr] = l
+
+	t.mu.Lock()
+	t.lns = append(t.lns, l)
+	t.mu.Unlock()
+	return l, nil
+}
+
+// Dial 立即建立连接（握手不占虚拟时间）
+func (t *simTransport) Dial(ctx context.Context, addr string) (transport.Conn, error) {
+	t.mu.Lock()
+	closed := t.closed
+	t.mu.Unlock()
+	if closed {
+		return nil, transport.ErrClosed
+	}
+
+	n := t.net
+	n.mu.Lock()
+	n.activity++
+	l := n.listeners[addr]
+	down := n.down[t.name] || n.down[addr]
+	n.mu.Unlock()
+	if down {
+		return nil, fmt.Errorf("sim dial %s: host is down", addr)
+	}
+	if l == nil || l.closed() {
+		return nil, fmt.Errorf("sim dial %s: connection refused", addr)
+	}
+
+	client, server := newPipe(n, t.name, addr)
+	select {
+	case l.backlog <- server:
+	case <-l.done:
+		return nil, fmt.Errorf("sim dial %s: connection refused", addr)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	t.track(client)
+	return client, nil
+}
+
+// track 记下拨出去的连接，连接关闭后从集合里删掉，集合不会越攒越多
+func (t *simTransport) track(c *conn) {
+	t.mu.Lock()
+	if t.conns == nil {
+		t.conns = make(map[*conn]struct{})
+	}
+	t.conns[c] = struct{}{}
+	t.mu.Unlock()
+
+	go func() {
+		<-c.Done()
+		t.mu.Lock()
+		delete(t.conns, c)
+		t.mu.Unlock()
+	}()
+}
+
+func (t *simTransport) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	lns, conns := t.lns, t.conns
+	t.lns, t.conns = nil, nil
+	t.mu.Unlock()
+
+	for _, l := range lns {
+		_ = l.Close()
+	}
+	for c := range conns {
+		_ = c.Close()
+	}
+	return nil
+}
+
+type listener struct {
+	net     *Network
+	addr    string
+	backlog chan *conn
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (l *listener) Accept(ctx context.Context) (transport.Conn, error) {
+	select {
+	case c := <-l.backlog:
+		l.net.touch()
+		return c, nil
+	case <-l.done:
+		return nil, transport.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *listener) Addr() string { return l.addr }
+
+func (l *listener) closed() bool {
+	select {
+	case <-l.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *listener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.net.mu.Lock()
+		if l.net.listeners[l.addr] == l {
+			delete(l.net.listeners, l.addr)
+		}
+		l.net.mu.Unlock()
+	})
+	return nil
+}
+
+// conn 是一对连接的其中一端，两端共用 done
+type conn struct {
+	net           *Network
+	local, remote string
+	peer          *conn
+
+	inbox chan []byte
+	done  chan struct{}
+	once  *sync.Once
+}
+
+func newPipe(n *Network, a, b string) (*conn, *conn) {
+	done := make(chan struct{})
+	once := &sync.Once{}
+	ca := &conn{net: n, local: a, remote: b, inbox: make(chan []byte, 4096), done: done, once: once}
+	cb := &conn{net: n, local: b, remote: a, inbox: make(chan []byte, 4096), done: done, once: once}
+	ca.peer, cb.peer = cb, ca
+	return ca, cb
+}
+
+func (c *conn) SendFrame(frame []byte) error {
+	if c.closed() {
+		return transport.ErrClosed
+	}
+	c.net.send(c, frame)
+	return nil
+}
+
+func (c *conn) RecvFrame(ctx context.Context) ([]byte, error) {
+	select {
+	case b := <-c.inbox:
+		c.net.mu.Lock()
+		c.net.pending--
+		c.net.activity++
+		c.net.mu.Unlock()
+		return b, nil
+	case <-c.done:
+		return nil, transport.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *conn) LocalAddr() string     { return c.local }
+func (c *conn) RemoteAddr() string    { return c.remote }
+func (c *conn) Done() <-chan struct{} { return c.done }
+
+func (c *conn) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close 关闭两端；还留在收件箱里的帧丢掉，不再算作待处理
+func (c *conn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		for _, in := range []chan []byte{c.inbox, c.peer.inbox} {
+			c.net.drain(in)
+		}
+	})
+	return nil
+}
+
+func (n *Network) drain(in chan []byte) {
+	for {
+		select {
+		case <-in:
+			n.mu.Lock()
+			n.pending--
+			n.stats.Delivered--
+			n.stats.Dropped++
+			n.mu.Unlock()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package sim
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"time"
+
+	"envelop/dht"
+	"envelop/host"
+	"envelop/mailbox"
+	"envelop/netquic"
+	"envelop/peer"
+)
+
+/*
+==========================================================
+ Sim：在一个进程里跑 N 个 host.Host
+==========================================================
+
+  s, _ := sim.New(sim.Config{
+      Seed:  1,
+      Nodes: 100,
+      Link:  sim.Link{Delay: 20 * time.Millisecond, Loss: 0.01},
+  })
+  s.Bootstrap(0)                                  // 所有节点通过 n0 加入 DHT
+  s.Run(time.Minute)                              // 虚拟时间跑一分钟
+
+  s.At(5*time.Second, func() { s.Fail(3) })       // 剧本：5s 时 n3 宕机
+  s.At(6*time.Second, func() { s.Send(1, 2, []byte("hi")) })
+  s.Run(10 * time.Second)
+
+  if err := s.AssertDelivered(2, []byte("hi")); err != nil { ... }
+
+节点名字是 "n0"、"n1"……，同时也是它在模拟网络里的地址。
+身份密钥由种子派生，同一个 Seed 每次得到同样的 PeerID、同样的丢包序列。
+
+Host 的后台定时任务（PubSub 心跳、DHT 桶刷新 / 记录续期、邮箱过期）不用 h.Start()
+的真实时间定时器，而是由 Sim 按虚拟时间调度（Network.Every）。
+
+每个节点 Build 时带上 Network.Clock() 和一个由 种子 + 节点名 派生的随机数（host.Builder.Clock）：
+RPC 超时 / 重试退避、逐跳重发和等回执、DHT 记录和路由表的时间、PubSub 去重和选邻居、
+邮箱过期都按虚拟时间走，请求 ID / MsgID 这些随机数也由种子决定。
+丢包之后的超时不用真的等：RunUntilIdle 直接把时钟拨到超时的那一刻。
+
+限制（写场景时要心里有数）：
+  - 其余的超时（连接确认 ConfirmTimeout、中继 circuit、打洞、REGISTER 的时间戳）仍然走真实时间，
+    场景里一般不会触发。
+  - At 的回调在驱动循环里执行，不能阻塞；要等网络往返的操作（Bootstrap、
+    SendWithReceipt ……）用 Go 放到单独的 goroutine 里。
+  - 每个 Host 的 Recv 由 Sim 接管，收到的消息记录在 Deliveries 里。
+==========================================================
+*/
+
+// Config 是模拟的参数
+type Config struct {
+	Seed  int64
+	Nodes int  // 初始节点数
+	Link  Link // 默认链路参数
+
+	// SharedRegistry：所有节点共用一个 RelayRegistry（互相直接知道地址，不需要 DHT）。
+	// 为 false 时每个节点只知道自己，要靠 Bootstrap 通过 DHT 互相发现。
+	SharedRegistry bool
+
+	// Settle 见 Network.Settle
+	Settle time.Duration
+
+	// Configure（可选）：Build 之前对每个节点的 Builder 做额外配置
+	Configure func(i int, b *host.Builder)
+}
+
+// Delivery 是一条交付到应用层的消息
+type Delivery struct {
+	At      time.Duration // 虚拟时间
+	To      int
+	From    peer.PeerID
+	Payload []byte
+}
+
+// Sim 是一次模拟
+type Sim struct {
+	Net *Network
+
+	cfg      Config
+	rng      *rand.Rand // 只用来派生密钥
+	registry *netquic.RelayRegistry
+
+	mu         sync.Mutex
+	hosts      []*host.Host
+	deliveries []Delivery
+	tasks      int
+	errs       []error
+}
+
+// New 创建模拟并启动 cfg.Nodes 个节点
+func New(cfg Config) (*Sim, error) {
+	net := NewNetwork(cfg.Seed)
+	net.Link = cfg.Link
+	net.Settle = cfg.Settle
+
+	s := &Sim{
+		Net: net,
+		cfg: cfg,
+		rng: rand.New(rand.NewSource(cfg.Seed)),
+	}
+	if cfg.SharedRegistry {
+		s.registry = netquic.NewRelayRegistry()
+	}
+	for i := 0; i < cfg.Nodes; i++ {
+		if _, err := s.AddNode(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Name 返回第 i 个节点的名字（也是它的地址）
+func Name(i int) string { return fmt.Sprintf("n%d", i) }
+
+// AddNode 新建一个节点并开始监听，返回它的下标（可以在 At 里调用，模拟节点加入）
+func (s *Sim) AddNode() (int, error) {
+	s.mu.Lock()
+	i := len(s.hosts)
+	s.mu.Unlock()
+
+	seed := make([]byte, ed25519.SeedSize)
+	s.rng.Read(seed)
+	priv := ed25519.NewKeyFromSeed(seed)
+	pub := priv.Public().(ed25519.PublicKey)
+	kp := &peer.KeyPair{PublicKey: pub, PrivateKey: priv, PeerID: peer.NewPeerIDFromPubKey(pub)}
+
+	name := Name(i)
+	b := host.NewBuilder().
+		Name(name).
+		Listen(name).
+		Key(kp).
+		Transport(s.Net.Transport(name)).
+		Clock(s.Net.Clock(), newNodeRand(s.cfg.Seed, name))
+	if s.registry != nil {
+		b.Registry(s.registry)
+	}
+	if s.cfg.Configure != nil {
+		s.cfg.Configure(i, b)
+	}
+	h, err := b.Build()
+	if err != nil {
+		return 0, err
+	}
+	if err := h.Listen(); err != nil {
+		return 0, err
+	}
+	go h.Node.Serve()
+	s.startTimers(h)
+
+	s.mu.Lock()
+	s.hosts = append(s.hosts, h)
+	s.mu.Unlock()
+
+	go s.collect(i, h)
+	return i, nil
+}
+
+// nodeRand 是一个节点用的随机数来源：由 种子 + 节点名 派生，可以并发读
+type nodeRand struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func newNodeRand(seed int64, name string) *nodeRand {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d|rand|%s", seed, name)
+	return &nodeRand{rng: rand.New(rand.NewSource(int64(h.Sum64())))}
+}
+
+func (r *nodeRand) Read(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rng.Read(b)
+}
+
+// startTimers 用虚拟时钟代替 h.Start() 里的后台定时器
+func (s *Sim) startTimers(h *host.Host) {
+	ps := h.PubSub()
+	s.Net.Every(ps.HeartbeatInterval(), ps.Tick)
+
+	// 刷新 / 续期要走网络往返，放到 Go 里
+	s.Net.Every(dht.DefaultRefreshInterval, func() {
+		s.Go(func() error { h.DHT.Refresh(dht.DefaultRefreshInterval); return nil })
+	})
+	republish := h.DHT.RepublishInterval
+	if republish <= 0 {
+		republish = dht.DefaultRepublishInterval
+	}
+	s.Net.Every(republish, func() {
+		s.Go(func() error { h.DHT.Republish(); return nil })
+	})
+
+	if h.Mailbox != nil {
+		s.Net.Every(mailbox.DefaultExpireInterval, func() { _, _ = h.Mailbox.Expire() })
+	}
+}
+
+// collect 接管 h.Recv，把收到的消息记下来
+func (s *Sim) collect(i int, h *host.Host) {
+	for m := range h.Recv() {
+		s.mu.Lock()
+		s.deliveries = append(s.deliveries, Delivery{
+			At:      s.Net.Now(),
+			To:      i,
+			From:    m.From,
+			Payload: m.Payload,
+		})
+		s.mu.Unlock()
+		s.Net.touch()
+	}
+}
+
+// Host 返回第 i 个节点
+func (s *Sim) Host(i int) *host.Host {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hosts[i]
+}
+
+// Len 返回节点数
+func (s *Sim) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.hosts)
+}
+
+// Contact 返回第 i 个节点的 DHT 联系方式
+func (s *Sim) Contact(i int) dht.Contact {
+	return dht.Contact{ID: s.Host(i).ID(), Addrs: []string{Name(i)}}
+}
+
+// Now 返回当前虚拟时间
+func (s *Sim) Now() time.Duration { return s.Net.Now() }
+
+/*
+==========================================================
+ 剧本
+==========================================================
+*/
+
+// At 在虚拟时间 t 执行 fn（不能阻塞，见包注释）
+func (s *Sim) At(t time.Duration, fn func()) { s.Net.At(t, fn) }
+
+// Go 在单独的 goroutine 里执行一个会阻塞的操作；返回的错误记在 Errors 里。
+// RunUntilIdle 会一直驱动网络，直到所有 Go 启动的任务结束。
+func (s *Sim) Go(fn func() error) {
+	s.mu.Lock()
+	s.tasks++
+	s.mu.Unlock()
+	go func() {
+		err := fn()
+		s.mu.Lock()
+		s.tasks--
+		if err != nil {
+			s.errs = append(s.errs, err)
+		}
+		s.mu.Unlock()
+		s.Net.touch()
+	}()
+}
+
+// Errors 返回 Go 任务报告的错误
+func (s *Sim) Errors() []error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]error(nil), s.errs...)
+}
+
+// Fail 让第 i 个节点宕机：进出它的帧全部丢弃
+func (s *Sim) Fail(i int) { s.Net.SetDown(Name(i), true) }
+
+// Recover 让第 i 个节点恢复
+func (s *Sim) Recover(i int) { s.Net.SetDown(Name(i), false) }
+
+// SetLink 单独设置 i、j 之间的链路参数
+func (s *Sim) SetLink(i, j int, l Link) { s.Net.SetLink(Name(i), Name(j), l) }
+
+// Send 让第 from 个节点给第 to 个节点发一条消息（发送错误记在 Errors 里）。
+// 找下一跳时可能要去 DHT 里查，所以放在 Go 里执行，At 里也可以直接调。
+func (s *Sim) Send(from, to int, payload []byte) {
+	h, dest := s.Host(from), s.Host(to).ID()
+	s.Go(func() error {
+		if err := h.Send(dest, payload); err != nil {
+			return fmt.Errorf("%s → %s: %w", Name(from), Name(to), err)
+		}
+		return nil
+	})
+}
+
+// Bootstrap 让 seed 以外的所有节点通过 seed 加入 DHT（一个接一个，顺序固定）
+func (s *Sim) Bootstrap(seed int) {
+	c := s.Contact(seed)
+	n := s.Len()
+	s.Go(func() error {
+		for i := 0; i < n; i++ {
+			if i == seed {
+				continue
+			}
+			if err := s.Host(i).Bootstrap([]dht.Contact{c}); err != nil {
+				return fmt.Errorf("%s bootstrap: %w", Name(i), err)
+			}
+		}
+		return nil
+	})
+}
+
+/*
+==========================================================
+ 驱动
+==========================================================
+*/
+
+// Run 让模拟再跑 d 这么久的虚拟时间：按时间顺序处理事件，
+// 每处理一个就等大家忙完；最后把时钟拨到 现在+d。
+func (s *Sim) Run(d time.Duration) {
+	limit := s.Net.Now() + d
+	s.run(limit, false)
+	s.Net.advance(limit)
+}
+
+// RunUntilIdle 一直跑到事件队列里只剩后台定时器、Go 任务也都结束了
+func (s *Sim) RunUntilIdle() {
+	s.run(time.Duration(1<<63-1), true)
+}
+
+func (s *Sim) run(limit time.Duration, idle bool) {
+	for {
+		s.Net.waitSettled()
+		if e, ok := s.Net.pop(limit, idle); ok {
+			e.fn()
+			continue
+		}
+		if !idle {
+			return // 剩下的事件都在 limit 之后
+		}
+		s.mu.Lock()
+		tasks := s.tasks
+		s.mu.Unlock()
+		if tasks == 0 {
+			return
+		}
+		// 还有任务在跑（可能在等真实时间的超时），等它们产生新事件或者结束
+	}
+}
+
+// Close 关闭所有节点（见 host.Host.Close）
+func (s *Sim) Close() {
+	s.mu.Lock()
+	hosts := append([]*host.Host(nil), s.hosts...)
+	s.mu.Unlock()
+	for _, h := range hosts {
+		_ = h.Close()
+	}
+}
+
+/*
+==========================================================
+ 断言
+==========================================================
+*/
+
+// Deliveries 返回到目前为止所有交付到应用层的消息
+func (s *Sim) Deliveries() []Delivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Delivery(nil), s.deliveries...)
+}
+
+// DeliveredTo 返回第 i 个节点收到的消息
+func (s *Sim) DeliveredTo(i int) []Delivery {
+	var out []Delivery
+	for _, d := range s.Deliveries() {
+		if d.To == i {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// Count 返回第 to 个节点收到 payload 的次数
+func (s *Sim) Count(to int, payload []byte) int {
+	n := 0
+	for _, d := range s.DeliveredTo(to) {
+		if bytes.Equal(d.Payload, payload) {
+			n++
+		}
+	}
+	return n
+}
+
+// AssertDelivered 检查第 to 个节点恰好收到了一次 payload
+func (s *Sim) AssertDelivered(to int, payload []byte) error {
+	switch n := s.Count(to, payload); n {
+	case 1:
+		return nil
+	case 0:
+		return fmt.Errorf("sim: %s never received %q", Name(to), payload)
+	default:
+		return fmt.Errorf("sim: %s received %q %d times", Name(to), payload, n)
+	}
+}
+
+// AssertNotDelivered 检查第 to 个节点没有收到 payload
+func (s *Sim) AssertNotDelivered(to int, payload []byte) error {
+	if n := s.Count(to, payload); n > 0 {
+		return fmt.Errorf("sim: %s unexpectedly received %q %d times", Name(to), payload, n)
+	}
+	return nil
+}
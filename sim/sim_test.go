@@ -0,0 +1,164 @@
+package sim
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"envelop/rpc"
+)
+
+func newSim(t *testing.T, cfg Config) *Sim {
+	t.Helper()
+	prev := log.Writer()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(prev) })
+
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("sim.New: %v", err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// bootstrapped 建一个 n 个节点、全部通过 n0 加入 DHT 的模拟
+func bootstrapped(t *testing.T, seed int64, n int) *Sim {
+	t.Helper()
+	s := newSim(t, Config{Seed: seed, Nodes: n, Link: Link{Delay: 5 * time.Millisecond}})
+	s.Bootstrap(0)
+	s.Run(30 * time.Second)
+	if errs := s.Errors(); len(errs) > 0 {
+		t.Fatalf("bootstrap: %v", errs)
+	}
+	return s
+}
+
+// 通过 n0 加入之后，每个节点的路由表里都有大多数其它节点，
+// 而且每个节点都能在 DHT 里找到任何一个节点
+func TestDHTConvergence(t *testing.T) {
+	const n = 12
+	s := bootstrapped(t, 1, n)
+
+	for i := 0; i < n; i++ {
+		if size := s.Host(i).DHT.Table().Size(); size < n/2 {
+			t.Errorf("%s knows only %d of %d peers", Name(i), size, n-1)
+		}
+	}
+
+	for _, p := range [][2]int{{1, 11}, {7, 2}, {11, 4}} {
+		from, to := p[0], p[1]
+		target := s.Host(to).ID()
+		s.Go(func() error {
+			c, ok := s.Host(from).DHT.Lookup(target)
+			if !ok || c.ID != target {
+				return fmt.Errorf("%s could not find %s", Name(from), Name(to))
+			}
+			return nil
+		})
+	}
+	s.RunUntilIdle()
+	for _, err := range s.Errors() {
+		t.Error(err)
+	}
+}
+
+// 只靠 DHT 互相发现的节点之间，消息恰好送达一次，不会送到别人那里
+func TestDeliveryOverDHT(t *testing.T) {
+	const n = 10
+	s := bootstrapped(t, 2, n)
+
+	pairs := [][2]int{{3, 9}, {5, 1}, {9, 0}, {0, 6}}
+	for _, p := range pairs {
+		s.Send(p[0], p[1], []byte(fmt.Sprint("hi", p)))
+	}
+	s.Run(30 * time.Second)
+
+	if errs := s.Errors(); len(errs) > 0 {
+		t.Fatalf("send: %v", errs)
+	}
+	for _, p := range pairs {
+		msg := []byte(fmt.Sprint("hi", p))
+		if err := s.AssertDelivered(p[1], msg); err != nil {
+			t.Error(err)
+		}
+		if err := s.AssertNotDelivered(p[0], msg); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// 节点宕机期间发给它的消息送不到，恢复之后再发就能送到
+func TestDeliveryAcrossFailure(t *testing.T) {
+	s := newSim(t, Config{Seed: 3, Nodes: 4, SharedRegistry: true, Link: Link{Delay: 5 * time.Millisecond}})
+
+	s.At(time.Second, func() { s.Fail(2) })
+	s.At(2*time.Second, func() { s.Send(1, 2, []byte("while down")) })
+	s.At(20*time.Second, func() { s.Recover(2) })
+	s.At(21*time.Second, func() { s.Send(1, 2, []byte("after recover")) })
+	s.Run(40 * time.Second)
+
+	if err := s.AssertNotDelivered(2, []byte("while down")); err != nil {
+		t.Error(err)
+	}
+	if err := s.AssertDelivered(2, []byte("after recover")); err != nil {
+		t.Error(err)
+	}
+}
+
+// RPC 超时按虚拟时间走：对端收不到请求时，RunUntilIdle 直接把时钟拨到超时，不用真的等
+func TestRPCTimeoutOnVirtualClock(t *testing.T) {
+	s := newSim(t, Config{Seed: 4, Nodes: 2, SharedRegistry: true, Link: Link{Delay: 5 * time.Millisecond}})
+	s.SetLink(0, 1, Link{Loss: 1})
+
+	const timeout = time.Minute
+	start := time.Now()
+	var callErr error
+	s.Go(func() error {
+		_, callErr = s.Host(0).RPC.Call(s.Host(1).ID(), "_rpc.List", nil, timeout)
+		return nil
+	})
+	s.RunUntilIdle()
+
+	if rpc.CodeOf(callErr) != rpc.CodeDeadlineExceeded {
+		t.Fatalf("call over a dead link: %v, want deadline exceeded", callErr)
+	}
+	if now := s.Now(); now < timeout {
+		t.Fatalf("virtual clock at %v after a %v timeout", now, timeout)
+	}
+	if real := time.Since(start); real > timeout/4 {
+		t.Fatalf("waited %v of real time for a virtual timeout", real)
+	}
+}
+
+// 同一个种子跑两次，消息在同样的虚拟时刻送达
+func TestReproducibleFromSeed(t *testing.T) {
+	run := func() []Delivery {
+		s := newSim(t, Config{Seed: 5, Nodes: 5, SharedRegistry: true,
+			Link: Link{Delay: 10 * time.Millisecond, Jitter: 5 * time.Millisecond}})
+		for i := 0; i < 5; i++ {
+			from, to := i, (i+2)%5
+			s.At(time.Duration(i)*100*time.Millisecond, func() {
+				s.Send(from, to, []byte(fmt.Sprint("m", from)))
+			})
+		}
+		s.Run(10 * time.Second)
+		return s.Deliveries()
+	}
+
+	a, b := run(), run()
+	if len(a) != 5 || len(b) != 5 {
+		t.Fatalf("delivered %d and %d messages, want 5", len(a), len(b))
+	}
+	at := make(map[string]time.Duration)
+	for _, d := range a {
+		at[string(d.Payload)] = d.At
+	}
+	for _, d := range b {
+		if at[string(d.Payload)] != d.At {
+			t.Errorf("%s delivered at %v, then at %v", d.Payload, at[string(d.Payload)], d.At)
+		}
+	}
+}
@@ -12,7 +12,10 @@
 package socket
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sync"
 
 	"envelop/envelop"
 	"envelop/peer"
@@ -51,12 +54,12 @@ type EnvelopeSender interface {
 }
 
 // RouterEnvelopeSender：一个基于 Router 的 EnvelopeSender 实现。
-//   - 使用 Router.NextHop 算下一跳 PeerID
+//   - 使用 Router.Resolve 算下一跳 PeerID（NextHop / RouteTable / Fallback）
 //   - 使用 Router.Send    把 Envelope 交给下一跳
 //
 // 简单理解：
 //
-//	Socket →（构造最外层 Envelope）→ RouterEnvelopeSender → Router.NextHop → Router.Send → PeerManager.SendToPeer → QUIC
+//	Socket →（构造最外层 Envelope）→ RouterEnvelopeSender → Router.Resolve → Router.Send → PeerManager.SendToPeer → QUIC
 type RouterEnvelopeSender struct {
 	R *router.Router
 }
@@ -66,12 +69,12 @@ func (s *RouterEnvelopeSender) SendEnvelope(env *envelop.Envelope) error {
 	if s.R == nil {
 		return fmt.Errorf("RouterEnvelopeSender: Router is nil")
 	}
-	if s.R.NextHop == nil || s.R.Send == nil {
-		return fmt.Errorf("RouterEnvelopeSender: NextHop or Send is not set")
+	if s.R.Send == nil {
+		return fmt.Errorf("RouterEnvelopeSender: Send is not set")
 	}
 
-	// 1）根据最终目标 DestPeerID 算下一跳
-	nextHop, ok := s.R.NextHop(env.DestPeerID)
+	// 1）根据最终目标 DestPeerID 算下一跳（NextHop / RouteTable，找不到时会走 Router.Fallback）
+	nextHop, ok := s.R.Resolve(env.DestPeerID)
 	if !ok {
 		return fmt.Errorf("RouterEnvelopeSender: no route to %s", peer.PeerIDToDomain(env.DestPeerID))
 	}
@@ -129,10 +132,16 @@ type Socket struct {
 	// Demo 简化：这里只做演示，实际项目按需处理。
 	prevOnPayload func(env *envelop.Envelope)
 
-	// 是否已关闭的标志，这里简单用一个 bool 表示（并没有做原子操作）
+	// closed：是否已关闭。mu 保护 closed 和 incoming 的关闭：
+	// Router 回调写 incoming 时持读锁，Close 持写锁，
+	// 这样 Close 之后不会再有人往已关闭的通道里写（否则会 panic）。
+	mu     sync.RWMutex
 	closed bool
 }
 
+// ErrClosed：Socket 已经 Close
+var ErrClosed = errors.New("socket already closed")
+
 // 确保 *Socket 实现 EnvelopSocket 接口
 var _ EnvelopSocket = (*Socket)(nil)
 
@@ -185,16 +194,71 @@ func NewSocket(
 //	2）交给 Strategy.BuildOutgoing 构造“最外层信封”（支持 Onion 套娃）
 //	3）交给 EnvelopeSender 把信封送出去（底下再走 Router / PeerManager / QUIC）
 func (s *Socket) Send(dest peer.PeerID, payload []byte) error {
-	if s.closed {
-		return fmt.Errorf("socket already closed")
+	if s.sender == nil {
+		return fmt.Errorf("socket sender is nil")
 	}
-	if s.strat == nil {
-		return fmt.Errorf("socket strategy is nil")
+
+	outer, err := s.build(dest, payload)
+	if err != nil {
+		return err
 	}
+
+	// 3）交给底层 EnvelopeSender 发送
+	if err := s.sender.SendEnvelope(outer); err != nil {
+		return fmt.Errorf("SendEnvelope failed: %w", err)
+	}
+
+	return nil
+}
+
+// SendDatagram 和 Send 一样，但信封标 FlagDatagram：
+// 小的每一跳走 datagram（不开流、不重传，可能丢、可能乱序），大的照常走流。
+func (s *Socket) SendDatagram(dest peer.PeerID, payload []byte) error {
 	if s.sender == nil {
 		return fmt.Errorf("socket sender is nil")
 	}
 
+	outer, err := s.build(dest, payload)
+	if err != nil {
+		return err
+	}
+	outer.Flags |= envelop.FlagDatagram
+
+	if err := s.sender.SendEnvelope(outer); err != nil {
+		return fmt.Errorf("SendEnvelope failed: %w", err)
+	}
+	return nil
+}
+
+// SendWithReceipt 和 Send 一样构造信封，但要求逐跳确认 + 端到端回执（见 router.Acker），
+// 阻塞到收件人确认收到、某个节点报告失败、重试用完或 ctx 结束：
+//   - 送达：返回回执和 nil
+//   - 失败：返回回执（谁、因为什么）和包装了 router.ErrUndelivered 的错误
+//   - ctx 结束：返回 ctx.Err()
+//
+// 需要关联的 Router 挂了 Acker（Host 默认会挂）。
+func (s *Socket) SendWithReceipt(ctx context.Context, dest peer.PeerID, payload []byte) (router.Receipt, error) {
+	if s.router == nil || s.router.Acker == nil {
+		return router.Receipt{}, fmt.Errorf("socket router has no Acker")
+	}
+
+	outer, err := s.build(dest, payload)
+	if err != nil {
+		return router.Receipt{}, err
+	}
+	// Onion 时最外层的 Dest 只是第一跳，回执要由 dest 本人签
+	return s.router.Acker.SendTo(ctx, outer, dest)
+}
+
+// build 用 Strategy 构造要发出去的最外层信封
+func (s *Socket) build(dest peer.PeerID, payload []byte) (*envelop.Envelope, error) {
+	if s.isClosed() {
+		return nil, ErrClosed
+	}
+	if s.strat == nil {
+		return nil, fmt.Errorf("socket strategy is nil")
+	}
+
 	// 1）构造策略上下文：谁发 → 发给谁 → 发什么
 	ctx := strategy.SendContext{
 		From:    s.selfID,
@@ -207,15 +271,9 @@ func (s *Socket) Send(dest peer.PeerID, payload []byte) error {
 	//    - OnionStrategy：可能多层嵌套，返回最外层 Envelope
 	outer, err := s.strat.BuildOutgoing(ctx)
 	if err != nil {
-		return fmt.Errorf("BuildOutgoing failed: %w", err)
-	}
-
-	// 3）交给底层 EnvelopeSender 发送
-	if err := s.sender.SendEnvelope(outer); err != nil {
-		return fmt.Errorf("SendEnvelope failed: %w", err)
+		return nil, fmt.Errorf("BuildOutgoing failed: %w", err)
 	}
-
-	return nil
+	return outer, nil
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -254,8 +312,8 @@ func (s *Socket) handleBusinessEnvelopeFromRouter(env *envelop.Envelope) {
 		s.prevOnPayload(env)
 	}
 
-	// 1）如果 Socket 已经关闭，就直接丢弃
-	if s.closed {
+	// 1）如果 Socket 已经关闭，就直接丢弃（真正投递前还会在锁里再查一次）
+	if s.isClosed() {
 		return
 	}
 
@@ -301,6 +359,12 @@ func (s *Socket) handleBusinessEnvelopeFromRouter(env *envelop.Envelope) {
 
 	// 4）把消息投递到 incoming 通道。
 	//    使用非阻塞写入：如果通道已满，则简单丢弃并打印日志，避免卡住 Router。
+	//    持读锁写入，和 Close 互斥。
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
 	select {
 	case s.incoming <- msg:
 	default:
@@ -308,18 +372,26 @@ func (s *Socket) handleBusinessEnvelopeFromRouter(env *envelop.Envelope) {
 	}
 }
 
+func (s *Socket) isClosed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.closed
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 // 9. Close：关闭 Socket
 ///////////////////////////////////////////////////////////////////////////////
 
 // Close 关闭 Socket：
 //   - 标记 closed = true
-//   - 关闭 incoming 通道
+//   - 关闭 incoming 通道（Recv 的 range 循环随之结束）
 //
-// 注意：
-//   - 这里没有做复杂的并发控制，只是 Demo / 教学使用。
-//   - 实际项目中你可以用 sync.Once / 原子操作 / context 等方式更精细地管理生命周期。
+// 可以重复调用，也可以和 Router 回调并发调用：
+// 投递消息时持读锁，这里持写锁，关闭之后的消息直接丢弃。
+// 之后的 Send / SendWithReceipt 返回 ErrClosed。
 func (s *Socket) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if s.closed {
 		return nil
 	}
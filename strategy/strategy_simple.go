@@ -31,6 +31,10 @@ type SimpleStrategy struct {
 
 	// DefaultTTL：默认 TTL；如果为 0，我们用 5。
 	DefaultTTL uint8
+
+	// Datagram：为 true 时构造的信封都标 FlagDatagram（小的走 datagram，可能丢；大的照常走流）。
+	// 适合掩护流量、状态广播这类丢了也无所谓的消息。
+	Datagram bool
 }
 
 // BuildOutgoing：构造一层 Envelope。
@@ -53,6 +57,9 @@ func (s *SimpleStrategy) BuildOutgoing(ctx SendContext) (*envelop.Envelope, erro
 		InnerPayload: ctx.Payload,
 	}
 	env.InnerLen = uint16(len(env.InnerPayload))
+	if s.Datagram {
+		env.Flags |= envelop.FlagDatagram
+	}
 
 	// 如果 Key 非空，则对 InnerPayload 做 AES-GCM 加密
 	if len(s.Key) > 0 {
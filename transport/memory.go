@@ -0,0 +1,585 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+/*
+==========================================================
+ MemNetwork：进程内的模拟网络
+==========================================================
+
+  net := transport.NewMemNetwork(42)     // 种子固定 → 丢包 / 抖动可复现
+  net.Latency = 5 * time.Millisecond
+  net.Loss = 0.01
+
+  ta := net.Transport()                  // 每个节点一个 Transport
+  ta.Listen("alice:1")                   // 地址就是任意字符串
+  c, _ := tb.Dial(ctx, "alice:1")
+
+模拟的东西：
+  - Latency + Jitter：每帧延迟 Latency ± Jitter 后才到达对端（Jitter 可能导致乱序）
+  - Loss：每帧以 Loss 的概率被丢掉（SendFrame 仍然返回 nil，和 UDP 一样发送方不知道）
+  - Partition(a, b)：a 组和 b 组之间的帧全部丢弃、拨号失败，Heal() 恢复
+  - NAT：NewNAT 造一台路由器，nat.Transport() 接在它后面（见下面 NAT 一节）
+  - Datagram：连接实现 DatagramConn，超过 MaxDatagram 的帧发不出去；
+    延迟 / 丢包和普通帧一样（模拟网络里的帧本来就不保证送达）
+  - 长期复用的流：连接实现 StreamConn，SendOrdered 的帧不丢、按顺序到达
+    （有 Jitter 时后一帧等前一帧，就像 TCP / QUIC 流的队头阻塞）；分区时照样丢
+
+连接的本地地址：这个 Transport 已经在监听时用监听地址（相当于复用监听 socket），
+否则分配一个 "mem-N" 的临时地址。
+==========================================================
+*/
+
+// MemNetwork 是一张模拟网络，里面的 Transport 可以互相拨号
+type MemNetwork struct {
+	Latency time.Duration // 单程延迟
+	Jitter  time.Duration // 延迟抖动（均匀分布在 ±Jitter）
+	Loss    float64       // 丢帧概率（0..1）
+
+	// MaxDatagram：一个 datagram 最多多少字节（0 → DefaultMaxDatagram）
+	MaxDatagram int
+
+	mu        sync.Mutex
+	rng       *rand.Rand
+	listeners map[string]*memListener
+	blocked   map[[2]string]bool     // 分区：(a, b) 之间不通
+	mapped    map[string]*natMapping // NAT 对外地址 → 映射
+	ephemeral int
+}
+
+// DefaultMaxDatagram 接近 QUIC 在常见 MTU 下一个 DATAGRAM 帧能装下的大小
+const DefaultMaxDatagram = 1200
+
+// NewMemNetwork 创建一张模拟网络，seed 决定丢包 / 抖动的随机序列
+func NewMemNetwork(seed int64) *MemNetwork {
+	return &MemNetwork{
+		rng:       rand.New(rand.NewSource(seed)),
+		listeners: make(map[string]*memListener),
+		blocked:   make(map[[2]string]bool),
+		mapped:    make(map[string]*natMapping),
+	}
+}
+
+// Transport 返回一个接在这张网络上的 Transport
+func (n *MemNetwork) Transport() Transport {
+	return &memTransport{net: n}
+}
+
+// Partition 让 a 组和 b 组之间互相不通（双向）
+func (n *MemNetwork) Partition(a, b []string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, x := range a {
+		for _, y := range b {
+			n.blocked[[2]string{x, y}] = true
+			n.blocked[[2]string{y, x}] = true
+		}
+	}
+}
+
+// Heal 取消所有分区
+func (n *MemNetwork) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.blocked = make(map[[2]string]bool)
+}
+
+// reachable 判断 from → to 现在通不通
+func (n *MemNetwork) reachable(from, to string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return !n.blocked[[2]string{from, to}]
+}
+
+// sample 决定一帧是否丢弃，以及它的延迟
+func (n *MemNetwork) sample() (drop bool, delay time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.Loss > 0 && n.rng.Float64() < n.Loss {
+		return true, 0
+	}
+	delay = n.Latency
+	if n.Jitter > 0 {
+		delay += time.Duration(n.rng.Int63n(int64(2*n.Jitter)+1)) - n.Jitter
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return false, delay
+}
+
+/*
+==========================================================
+ memTransport
+==========================================================
+*/
+
+type memTransport struct {
+	net *MemNetwork
+	nat *NAT // 不为 nil：在这台 NAT 后面
+
+	mu        sync.Mutex
+	listeners []*memListener
+	conns     map[*memConn]struct{} // 拨出去、还没关的连接；关掉后自己摘掉
+	closed    bool
+}
+
+func (t *memTransport) Listen(addr string) (Listener, error) {
+	n := t.net
+	n.mu.Lock()
+	if _, ok := n.listeners[addr]; ok {
+		n.mu.Unlock()
+		return nil, fmt.Errorf("mem listen %s: address already in use", addr)
+	}
+	l := &memListener{
+		net:     n,
+		nat:     t.nat,
+		addr:    addr,
+		backlog: make(chan *memConn, 64),
+		done:    make(chan struct{}),
+	}
+	n.listeners[addr] = l
+	n.mu.Unlock()
+
+	t.mu.Lock()
+	t.listeners = append(t.listeners, l)
+	t.mu.Unlock()
+	return l, nil
+}
+
+// localAddr 返回拨号用的本地地址：有监听就用监听地址，否则分配临时地址
+func (t *memTransport) localAddr() string {
+	t.mu.Lock()
+	for _, l := range t.listeners {
+		if !l.isClosed() {
+			t.mu.Unlock()
+			return l.addr
+		}
+	}
+	t.mu.Unlock()
+
+	t.net.mu.Lock()
+	defer t.net.mu.Unlock()
+	t.net.ephemeral++
+	return fmt.Sprintf("mem-%d", t.net.ephemeral)
+}
+
+func (t *memTransport) Dial(ctx context.Context, addr string) (Conn, error) {
+	t.mu.Lock()
+	closed := t.closed
+	t.mu.Unlock()
+	if closed {
+		return nil, ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	local := t.localAddr()
+	n := t.net
+	if !n.reachable(local, addr) {
+		return nil, fmt.Errorf("mem dial %s: network unreachable", addr)
+	}
+
+	// 对端看到的源地址：在 NAT 后面就是映射出来的公网地址
+	src := local
+	if t.nat != nil {
+		src = t.nat.outbound(local, addr)
+	}
+	l, err := n.connectTo(ctx, src, addr, t.nat)
+	if err != nil {
+		return nil, err
+	}
+
+	client, server := newMemPipe(n, local, addr)
+	server.remote = src
+	select {
+	case l.backlog <- server:
+	case <-l.done:
+		return nil, fmt.Errorf("mem dial %s: connection refused", addr)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	t.track(client)
+	return client, nil
+}
+
+// track 记下拨出去的连接，连接关闭后从集合里删掉，集合不会越攒越多
+func (t *memTransport) track(c *memConn) {
+	t.mu.Lock()
+	if t.conns == nil {
+		t.conns = make(map[*memConn]struct{})
+	}
+	t.conns[c] = struct{}{}
+	t.mu.Unlock()
+
+	go func() {
+		<-c.Done()
+		t.mu.Lock()
+		delete(t.conns, c)
+		t.mu.Unlock()
+	}()
+}
+
+func (t *memTransport) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	ls, cs := t.listeners, t.conns
+	t.listeners, t.conns = nil, nil
+	t.mu.Unlock()
+
+	for _, l := range ls {
+		_ = l.Close()
+	}
+	for c := range cs {
+		_ = c.Close()
+	}
+	return nil
+}
+
+/*
+==========================================================
+ NAT：模拟家用路由器
+==========================================================
+
+  nat := net.NewNAT("203.0.113.7", false)
+  ta := nat.Transport()                  // ta 在 NAT 后面
+  ta.Listen("10.0.0.2:1")                // 内网地址，外面直接拨不进来
+
+出去的连接：
+  - 映射：内网地址 → "203.0.113.7:N"，对端看到的 RemoteAddr 就是它
+      - 端点无关（symmetric=false）：同一个内网地址对所有目标都用同一个映射，
+        所以 relay 看到的地址也就是别人该拨的地址（打洞能成功）
+      - 对称（symmetric=true）：每个目标一个新映射，relay 看到的地址对别人没用
+  - 过滤（端口受限锥形）：映射只放行它发过包的那些地址连进来
+    （拨号本身就算“发过包”，不管拨没拨通）
+
+进来的连接：拨映射地址，源地址没被放行时像 UDP 一样没有回应——
+拨号方一直重试（相当于握手重传），直到放行（对端也开始拨我了）或者超时。
+两边同时拨，就是打洞。
+
+映射不会过期。
+==========================================================
+*/
+
+// natHandshakeTimeout：拨号被 NAT 过滤时最多重试多久（和 quic-go 默认的握手超时一样）
+const natHandshakeTimeout = 5 * time.Second
+
+// NAT 是一台模拟的 NAT 路由器，后面的 Transport 对外只露出映射出来的地址
+type NAT struct {
+	net       *MemNetwork
+	ip        string
+	symmetric bool
+
+	// 下面的字段由 net.mu 保护
+	ports    int
+	mappings map[string]*natMapping // 内网地址（对称型：内网地址|目标）→ 映射
+}
+
+type natMapping struct {
+	private string          // 内网地址
+	public  string          // 对外地址
+	allowed map[string]bool // 发过包的目标，只有它们能连进来
+}
+
+// NewNAT 在这张网络上加一台 NAT，对外地址是 "ip:N"；symmetric 见上面的说明
+func (n *MemNetwork) NewNAT(ip string, symmetric bool) *NAT {
+	return &NAT{
+		net:       n,
+		ip:        ip,
+		symmetric: symmetric,
+		mappings:  make(map[string]*natMapping),
+	}
+}
+
+// Transport 返回一个接在这台 NAT 后面的 Transport
+func (nat *NAT) Transport() Transport {
+	return &memTransport{net: nat.net, nat: nat}
+}
+
+// outbound 从内网地址 local 往 dst 发包：拿到（或新建）映射，并放行 dst。返回对外地址。
+func (nat *NAT) outbound(local, dst string) string {
+	n := nat.net
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	key := local
+	if nat.symmetric {
+		key = local + "|" + dst
+	}
+	m := nat.mappings[key]
+	if m == nil {
+		nat.ports++
+		m = &natMapping{
+			private: local,
+			public:  fmt.Sprintf("%s:%d", nat.ip, nat.ports),
+			allowed: make(map[string]bool),
+		}
+		nat.mappings[key] = m
+		n.mapped[m.public] = m
+	}
+	m.allowed[dst] = true
+	return m.public
+}
+
+// connectTo 找到 src 拨 addr 时真正接电话的 Listener。
+// 被 NAT 过滤的拨号一直重试，直到放行、ctx 结束或者 natHandshakeTimeout。
+func (n *MemNetwork) connectTo(ctx context.Context, src, addr string, from *NAT) (*memListener, error) {
+	deadline := time.Now().Add(natHandshakeTimeout)
+	for {
+		l, filtered, err := n.lookup(src, addr, from)
+		if !filtered {
+			return l, err
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("mem dial %s: handshake timeout (filtered by NAT)", addr)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+func (n *MemNetwork) lookup(src, addr string, from *NAT) (l *memListener, filtered bool, err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if m := n.mapped[addr]; m != nil {
+		// 拨的是 NAT 的对外地址：没放行的源地址进不来
+		if !m.allowed[src] {
+			return nil, true, nil
+		}
+		l = n.listeners[m.private]
+	} else {
+		l = n.listeners[addr]
+		// NAT 后面的内网地址，只有同一台 NAT 后面的才能直接拨
+		if l != nil && l.nat != nil && l.nat != from {
+			return nil, false, fmt.Errorf("mem dial %s: network unreachable", addr)
+		}
+	}
+	if l == nil || l.isClosed() {
+		return nil, false, fmt.Errorf("mem dial %s: connection refused", addr)
+	}
+	return l, false, nil
+}
+
+/*
+==========================================================
+ memListener
+==========================================================
+*/
+
+type memListener struct {
+	net     *MemNetwork
+	nat     *NAT // 在 NAT 后面：外面只能通过映射地址连进来
+	addr    string
+	backlog chan *memConn
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (l *memListener) Accept(ctx context.Context) (Conn, error) {
+	select {
+	case c := <-l.backlog:
+		return c, nil
+	case <-l.done:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *memListener) Addr() string { return l.addr }
+
+func (l *memListener) isClosed() bool {
+	select {
+	case <-l.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.net.mu.Lock()
+		if l.net.listeners[l.addr] == l {
+			delete(l.net.listeners, l.addr)
+		}
+		l.net.mu.Unlock()
+	})
+	return nil
+}
+
+/*
+==========================================================
+ memConn：一对连接的其中一端
+==========================================================
+*/
+
+type memConn struct {
+	net    *MemNetwork
+	local  string
+	remote string
+	peer   *memConn
+
+	inbox  chan []byte
+	dgrams chan []byte
+	done   chan struct{} // 两端共用：任意一端 Close 都会关
+	once   *sync.Once
+
+	lanesMu sync.Mutex
+	lanes   map[uint8]*memLane // SendOrdered 的流，按 class
+}
+
+// memLane 是一条模拟的有序流：每帧等前一帧投递完才投递
+type memLane struct {
+	mu   sync.Mutex
+	last chan struct{} // 前一帧投递完（或连接关闭）时关闭
+}
+
+func newMemPipe(n *MemNetwork, a, b string) (*memConn, *memConn) {
+	done := make(chan struct{})
+	once := &sync.Once{}
+	ca := &memConn{net: n, local: a, remote: b, inbox: make(chan []byte, 1024), dgrams: make(chan []byte, 1024), done: done, once: once}
+	cb := &memConn{net: n, local: b, remote: a, inbox: make(chan []byte, 1024), dgrams: make(chan []byte, 1024), done: done, once: once}
+	ca.peer, cb.peer = cb, ca
+	return ca, cb
+}
+
+func (c *memConn) SendFrame(frame []byte) error {
+	return c.send(frame, c.peer.inbox)
+}
+
+// send 按网络的分区 / 丢包 / 延迟把一帧投进对端的 to
+func (c *memConn) send(frame []byte, to chan []byte) error {
+	if IsClosed(c) {
+		return ErrClosed
+	}
+	if !c.net.reachable(c.local, c.remote) {
+		return nil // 分区：悄悄丢掉
+	}
+	drop, delay := c.net.sample()
+	if drop {
+		return nil
+	}
+
+	b := append([]byte(nil), frame...)
+	deliver := func() {
+		select {
+		case to <- b:
+		case <-c.done:
+		}
+	}
+	if delay == 0 {
+		deliver()
+	} else {
+		time.AfterFunc(delay, deliver)
+	}
+	return nil
+}
+
+func (c *memConn) SendDatagram(frame []byte) error {
+	if max := c.MaxDatagramSize(); len(frame) > max {
+		return fmt.Errorf("%w: %d > %d bytes", ErrDatagramTooLarge, len(frame), max)
+	}
+	return c.send(frame, c.peer.dgrams)
+}
+
+func (c *memConn) SendOrdered(class uint8, frame []byte) error {
+	if IsClosed(c) {
+		return ErrClosed
+	}
+	if !c.net.reachable(c.local, c.remote) {
+		return nil // 分区：悄悄丢掉
+	}
+	_, delay := c.net.sample() // 流是可靠的：只要延迟，不丢
+
+	c.lanesMu.Lock()
+	if c.lanes == nil {
+		c.lanes = make(map[uint8]*memLane)
+	}
+	lane := c.lanes[class]
+	if lane == nil {
+		lane = &memLane{}
+		c.lanes[class] = lane
+	}
+	c.lanesMu.Unlock()
+
+	b := append([]byte(nil), frame...)
+	lane.mu.Lock()
+	prev := lane.last
+	done := make(chan struct{})
+	lane.last = done
+	lane.mu.Unlock()
+
+	deliver := func() {
+		defer close(done)
+		if prev != nil {
+			select {
+			case <-prev:
+			case <-c.done:
+				return
+			}
+		}
+		select {
+		case c.peer.inbox <- b:
+		case <-c.done:
+		}
+	}
+	if delay == 0 {
+		deliver()
+	} else {
+		time.AfterFunc(delay, deliver)
+	}
+	return nil
+}
+
+func (c *memConn) RecvDatagram(ctx context.Context) ([]byte, error) {
+	select {
+	case b := <-c.dgrams:
+		return b, nil
+	case <-c.done:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *memConn) MaxDatagramSize() int {
+	if c.net.MaxDatagram > 0 {
+		return c.net.MaxDatagram
+	}
+	return DefaultMaxDatagram
+}
+
+func (c *memConn) RecvFrame(ctx context.Context) ([]byte, error) {
+	select {
+	case b := <-c.inbox:
+		return b, nil
+	case <-c.done:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *memConn) LocalAddr() string     { return c.local }
+func (c *memConn) RemoteAddr() string    { return c.remote }
+func (c *memConn) Done() <-chan struct{} { return c.done }
+func (c *memConn) RTT() time.Duration    { return 2 * c.net.Latency }
+
+func (c *memConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
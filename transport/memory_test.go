@@ -0,0 +1,129 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// pair 在 n 上开一个监听 "b:1" 的 Transport，另一个 Transport 拨过去，返回两端的连接
+func pair(t *testing.T, n *MemNetwork) (client, server Conn, ta *memTransport) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	tb := n.Transport()
+	ln, err := tb.Listen("b:1")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = tb.Close() })
+
+	ta = n.Transport().(*memTransport)
+	if _, err := ta.Listen("a:1"); err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ta.Close() })
+
+	client, err = ta.Dial(ctx, "b:1")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	server, err = ln.Accept(ctx)
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	return client, server, ta
+}
+
+func recv(t *testing.T, c Conn, wait time.Duration) ([]byte, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	return c.RecvFrame(ctx)
+}
+
+// 有延迟的链路上，帧都送到，而且不早于 Latency
+func TestMemNetworkDelivery(t *testing.T) {
+	n := NewMemNetwork(1)
+	n.Latency = 10 * time.Millisecond
+	client, server, _ := pair(t, n)
+
+	if client.LocalAddr() != "a:1" || server.RemoteAddr() != "a:1" {
+		t.Fatalf("addrs: local %q, remote seen by server %q", client.LocalAddr(), server.RemoteAddr())
+	}
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if err := client.SendFrame([]byte(fmt.Sprint("frame", i))); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+	got := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		b, err := recv(t, server, time.Second)
+		if err != nil {
+			t.Fatalf("recv %d: %v", i, err)
+		}
+		got[string(b)] = true
+	}
+	if d := time.Since(start); d < n.Latency {
+		t.Fatalf("frames arrived after %v, latency is %v", d, n.Latency)
+	}
+	for i := 0; i < 10; i++ {
+		if !got[fmt.Sprint("frame", i)] {
+			t.Fatalf("frame%d missing", i)
+		}
+	}
+}
+
+// 分区时帧被悄悄丢掉、拨号失败，Heal 之后恢复
+func TestMemNetworkPartition(t *testing.T) {
+	n := NewMemNetwork(1)
+	client, server, ta := pair(t, n)
+
+	n.Partition([]string{"a:1"}, []string{"b:1"})
+	if err := client.SendFrame([]byte("lost")); err != nil {
+		t.Fatalf("send during partition: %v", err)
+	}
+	if _, err := recv(t, server, 50*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("frame crossed the partition: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := ta.Dial(ctx, "b:1"); err == nil {
+		t.Fatal("dial crossed the partition")
+	}
+
+	n.Heal()
+	if err := client.SendFrame([]byte("after heal")); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	b, err := recv(t, server, time.Second)
+	if err != nil || string(b) != "after heal" {
+		t.Fatalf("recv after heal: %q, %v", b, err)
+	}
+}
+
+// 关掉的连接从 Transport 的连接集合里摘掉
+func TestMemTransportForgetsClosedConns(t *testing.T) {
+	n := NewMemNetwork(1)
+	client, _, ta := pair(t, n)
+
+	_ = client.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		ta.mu.Lock()
+		left := len(ta.conns)
+		ta.mu.Unlock()
+		if left == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d closed connections still tracked", left)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,109 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+/*
+==========================================================
+ Transport：Node / PeerManager 底下的“传输层”抽象
+==========================================================
+
+Node 和 PeerManager 以前直接写死了 UDP + QUIC。现在它们只依赖这三个接口：
+
+  Transport   Listen(addr) / Dial(ctx, addr) / Close()
+  Listener    Accept(ctx) → Conn
+  Conn        SendFrame(raw) / RecvFrame(ctx) / Close()
+
+一次 SendFrame 对应对端的一次 RecvFrame，帧边界由传输层保证
+（QUIC：一帧一个单向流；内存：一帧一条消息），上层不用再自己切分。
+帧的内容（Frame v2 原始字节）传输层不关心。
+
+可选的 DatagramConn：一帧一个不可靠的 datagram（QUIC DATAGRAM 帧），
+不开流、不重传，适合小而丢了也无所谓的帧（掩护流量、ACK、ping）。
+
+可选的 StreamConn：同一类（class）的帧背靠背写进一条长期复用的流，
+省掉每帧开流的开销，而且对端按写入顺序收到（RecvFrame 出来的顺序也一样）。
+
+实现：
+  - netquic.QUICTransport：真实的 UDP + QUIC（默认）
+  - MemNetwork.Transport()：进程内的模拟网络，可以设置延迟 / 丢包 / 分区，
+    随机数由种子决定，测试不需要端口、也不需要 sleep 等监听起来
+==========================================================
+*/
+
+// ErrClosed：Listener / Conn / Transport 已经关闭
+var ErrClosed = errors.New("transport: closed")
+
+// Transport 负责监听和拨号
+type Transport interface {
+	// Listen 在 addr 上开始监听
+	Listen(addr string) (Listener, error)
+	// Dial 建立一条到 addr 的连接
+	Dial(ctx context.Context, addr string) (Conn, error)
+	// Close 关闭这个 Transport 创建的所有 Listener 和连接
+	Close() error
+}
+
+// Listener 接受对端发起的连接
+type Listener interface {
+	// Accept 等待下一条连接；Listener 关闭后返回 ErrClosed
+	Accept(ctx context.Context) (Conn, error)
+	// Addr 返回监听地址
+	Addr() string
+	Close() error
+}
+
+// Conn 是到一个对端的连接，按帧收发
+type Conn interface {
+	// SendFrame 发送一帧
+	SendFrame(frame []byte) error
+	// RecvFrame 收下一帧；连接关闭后返回 ErrClosed（或底层错误）
+	RecvFrame(ctx context.Context) ([]byte, error)
+
+	LocalAddr() string
+	RemoteAddr() string
+
+	// Done 在连接关闭（任意一端）后关闭
+	Done() <-chan struct{}
+	Close() error
+}
+
+// ErrDatagramTooLarge：帧比连接当前能发的 datagram 大，应该改走 SendFrame
+var ErrDatagramTooLarge = errors.New("transport: datagram too large")
+
+// DatagramConn 是能收发 datagram 的连接（可选接口）：
+// 可能丢、可能乱序，一个 datagram 对应对端的一次 RecvDatagram
+type DatagramConn interface {
+	// SendDatagram 把一帧作为 datagram 发出去。
+	// 超过 MaxDatagramSize 时返回 ErrDatagramTooLarge；对端不支持时也返回错误
+	SendDatagram(frame []byte) error
+	// RecvDatagram 收下一个 datagram；连接关闭后返回错误
+	RecvDatagram(ctx context.Context) ([]byte, error)
+	// MaxDatagramSize 返回当前能发的最大帧长度，0 表示这条连接不能发 datagram
+	MaxDatagramSize() int
+}
+
+// StreamConn 是能把帧写进长期复用的流的连接（可选接口）
+type StreamConn interface {
+	// SendOrdered 把一帧写进 class 对应的流（没有就开一条）：
+	// 同一个 class 的帧可靠、按调用顺序到达对端；不同 class 之间互不阻塞、也不保证顺序
+	SendOrdered(class uint8, frame []byte) error
+}
+
+// RTTConn 是能报告 RTT 的连接（可选接口，PeerManager 用它喂路由质量统计）
+type RTTConn interface {
+	RTT() time.Duration
+}
+
+// IsClosed 判断连接是否已经关闭
+func IsClosed(c Conn) bool {
+	select {
+	case <-c.Done():
+		return true
+	default:
+		return false
+	}
+}